@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rmrfslashbin/mastostart/pkg/app"
+	"github.com/rs/zerolog/log"
+)
+
+// Credentials is the mastostart session cached by `mastostart login` for the other commands
+type Credentials struct {
+	// Server is the mastostart API URL the token is for
+	Server string `json:"server"`
+
+	// Token is the mastostart JWT
+	Token string `json:"token"`
+
+	// TokenType is always "Bearer"
+	TokenType string `json:"token_type"`
+
+	// Scope is the space separated list of scopes granted to the session
+	Scope string `json:"scope,omitempty"`
+
+	// ExpiresAt is the unix time the JWT expires
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// credentialsPath returns the path of the cached credentials (eg ~/.config/mastostart/config.json)
+func credentialsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, APP_NAME, CONFIG_FILE), nil
+}
+
+// loadCredentials reads the cached credentials
+func loadCredentials() (*Credentials, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("not logged in; run `%s login` first", APP_NAME)
+	}
+	if err != nil {
+		return nil, err
+	}
+	creds := &Credentials{}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	if creds.ExpiresAt != 0 && time.Now().Unix() > creds.ExpiresAt {
+		return nil, fmt.Errorf("the session expired; run `%s login` again", APP_NAME)
+	}
+	return creds, nil
+}
+
+// saveCredentials caches the credentials. The file is only readable by the user.
+func saveCredentials(creds *Credentials) (string, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// postForm posts a form to the mastostart API and decodes the JSON response into res (2xx) or errRes (anything else).
+// Returns true if the response was a 2xx.
+func postForm(client *http.Client, req *http.Request, res interface{}, errRes interface{}) (bool, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	target := errRes
+	if ok {
+		target = res
+	}
+	if err := json.Unmarshal(body, target); err != nil {
+		return ok, fmt.Errorf("unexpected response from %s (%s): %s", req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return ok, nil
+}
+
+// newFormRequest builds a form POST to the mastostart API
+func newFormRequest(server string, path string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(server, "/")+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// LoginCmd logs in with the device flow and caches the session
+type LoginCmd struct {
+	Server   string `name:"server" env:"MASTOSTART_SERVER" required:"" help:"The mastostart API URL (the ApiGateway output)."`
+	Instance string `name:"instance" xor:"instance" help:"The Mastodon instance to login to (eg mastodon.social)."`
+	Username string `name:"username" xor:"instance" help:"Your full handle (eg @alice@example.social); the instance is looked up with WebFinger."`
+	Scope    string `name:"scope" help:"Space separated scopes to ask for. Defaults to all the scopes the app is registered with."`
+}
+
+// Run is the entry point for the login command
+func (r *LoginCmd) Run(ctx *Context) error {
+	if r.Instance == "" && r.Username == "" {
+		return fmt.Errorf("one of --instance or --username is required")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	// Start the device flow
+	form := url.Values{}
+	if r.Instance != "" {
+		form.Set("instance_url", r.Instance)
+	}
+	if r.Username != "" {
+		form.Set("username", r.Username)
+	}
+	if r.Scope != "" {
+		form.Set("scope", r.Scope)
+	}
+	req, err := newFormRequest(r.Server, "/auth/device", form)
+	if err != nil {
+		return err
+	}
+	device := &app.DeviceAuthorizationResponse{}
+	restErr := &app.GeneralRestError{}
+	ok, err := postForm(client, req, device, restErr)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("unable to start the login: %s (error_instance_id: %s)", restErr.ErrorMessage, restErr.ErrorInstanceID)
+	}
+
+	fmt.Printf("To sign in, open %s and enter the code %s\n", device.VerificationURI, device.UserCode)
+	fmt.Printf("Or open %s\n", device.VerificationURIComplete)
+	fmt.Println("Waiting for you to sign in...")
+
+	// Poll until the user approved or denied the login, or the code expired
+	interval := time.Duration(device.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		req, err := newFormRequest(r.Server, "/auth/device/token", url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {device.DeviceCode},
+		})
+		if err != nil {
+			return err
+		}
+		token := &app.DeviceTokenResponse{}
+		oauthErr := &app.OAuthError{}
+		ok, err := postForm(client, req, token, oauthErr)
+		if err != nil {
+			return err
+		}
+		if ok {
+			creds := &Credentials{
+				Server:    strings.TrimSuffix(r.Server, "/"),
+				Token:     token.AccessToken,
+				TokenType: token.TokenType,
+				Scope:     token.Scope,
+				ExpiresAt: time.Now().Add(time.Duration(token.ExpiresIn) * time.Second).Unix(),
+			}
+			path, err := saveCredentials(creds)
+			if err != nil {
+				return err
+			}
+			log.Info().
+				Str("server", creds.Server).
+				Str("credentials", path).
+				Time("expiresAt", time.Unix(creds.ExpiresAt, 0)).
+				Msg("logged in")
+			return nil
+		}
+
+		switch oauthErr.Error {
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		case "access_denied":
+			return fmt.Errorf("the login was denied")
+		case "expired_token":
+			return fmt.Errorf("the code expired; run `%s login` again", APP_NAME)
+		default:
+			return fmt.Errorf("login failed: %s: %s", oauthErr.Error, oauthErr.ErrorDescription)
+		}
+	}
+	return fmt.Errorf("the code expired; run `%s login` again", APP_NAME)
+}
+
+// LogoutCmd ends the cached session
+type LogoutCmd struct{}
+
+// Run is the entry point for the logout command
+func (r *LogoutCmd) Run(ctx *Context) error {
+	creds, err := loadCredentials()
+	if err != nil {
+		return err
+	}
+
+	req, err := newFormRequest(creds.Server, "/auth/logout", url.Values{})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", creds.TokenType+" "+creds.Token)
+	res := map[string]interface{}{}
+	restErr := &app.GeneralRestError{}
+	ok, err := postForm(&http.Client{Timeout: 30 * time.Second}, req, &res, restErr)
+	if err != nil {
+		// The session may already be gone (eg revoked by an admin); forget it anyway
+		log.Warn().
+			Err(err).
+			Msg("unable to end the session on the server")
+	} else if !ok {
+		log.Warn().
+			Str("error", restErr.ErrorMessage).
+			Str("errorInstanceID", restErr.ErrorInstanceID).
+			Msg("unable to end the session on the server")
+	}
+
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	log.Info().
+		Str("server", creds.Server).
+		Interface("result", res).
+		Msg("logged out")
+	return nil
+}
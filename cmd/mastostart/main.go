@@ -3,13 +3,22 @@ package main
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/rmrfslashbin/mastostart/pkg/app"
 	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -30,20 +39,17 @@ type Context struct {
 
 // ConfigSetCmd sets a config value
 type ConfigSetCmd struct {
-	Key     string `name:"key" required:"" enum:"app_name,permit_instances,redirect_uri,scopes,website," help:"The key to set."`
-	Value   string `name:"value" required:"" help:"The value to set."`
-	Profile string `name:"profile" default:"default" help:"The profile to set the value for."`
-	Region  string `name:"region" default:"us-east-1" help:"The region to set the value for."`
-	Prefix  string `name:"prefix" default:"mastostart-" help:"The prefix for dynamodb table names."`
+	Key   string `name:"key" required:"" enum:"admin_accounts,app_name,cookie_domain,cors_headers,cors_methods,cors_origins,deny_instances,oidc_issuer,permit_instances,redirect_uri,return_to_allowlist,scopes,website," help:"The key to set."`
+	Value string `name:"value" required:"" help:"The value to set."`
+	StoreFlags
 }
 
 // Run is the entry point for the config set command
 func (r *ConfigSetCmd) Run(ctx *Context) error {
-	db, err := database.New(
-		database.WithDDBProfile(r.Profile),
-		database.WithDDBRegion(r.Region),
-		database.WithDDBTablePrefix(r.Prefix),
-	)
+	if err := app.ValidateSetting(r.Key, r.Value); err != nil {
+		return err
+	}
+	db, err := r.open()
 	if err != nil {
 		return err
 	}
@@ -56,6 +62,7 @@ func (r *ConfigSetCmd) Run(ctx *Context) error {
 	log.Info().
 		Str("key", r.Key).
 		Str("value", r.Value).
+		Str("backend", r.Backend).
 		Str("aws profile", r.Profile).
 		Str("aws region", r.Region).
 		Str("ddb table prefix", r.Prefix).
@@ -65,20 +72,14 @@ func (r *ConfigSetCmd) Run(ctx *Context) error {
 
 // ConfigGetCmd gets a config value
 type ConfigGetCmd struct {
-	Key     string `name:"key" required:"" group:"selectors" xor:"selectors" help:"The key to get."`
-	All     bool   `name:"all" required:"" group:"selectors" xor:"selectors" help:"Get all keys."`
-	Profile string `name:"profile" default:"default" help:"The profile to set the value for."`
-	Region  string `name:"region" default:"us-east-1" help:"The region to set the value for."`
-	Prefix  string `name:"prefix" default:"mastostart-" help:"The prefix for dynamodb table names."`
+	Key string `name:"key" required:"" group:"selectors" xor:"selectors" help:"The key to get."`
+	All bool   `name:"all" required:"" group:"selectors" xor:"selectors" help:"Get all keys."`
+	StoreFlags
 }
 
 // Run is the entry point for the config get command
 func (r *ConfigGetCmd) Run(ctx *Context) error {
-	db, err := database.New(
-		database.WithDDBProfile(r.Profile),
-		database.WithDDBRegion(r.Region),
-		database.WithDDBTablePrefix(r.Prefix),
-	)
+	db, err := r.open()
 	if err != nil {
 		return err
 	}
@@ -108,34 +109,25 @@ func (r *ConfigGetCmd) Run(ctx *Context) error {
 	return nil
 }
 
-// ConfigMakeJWTKeyCmd makes a JWT key
-type ConfigMakeJWTKey struct {
-	Profile string `name:"profile" default:"default" help:"The profile to set the value for."`
-	Region  string `name:"region" default:"us-east-1" help:"The region to set the value for."`
-	Prefix  string `name:"prefix" default:"mastostart-" help:"The prefix for dynamodb table names."`
-	Len     int    `name:"len" default:"256" help:"The length of the key to generate."`
-	Confirm bool   `name:"confirm" required:"" help:"Confirm the action. This will overwrite an existing key."`
+// ConfigJWTKeyNewCmd makes a new JWT signing key
+type ConfigJWTKeyNewCmd struct {
+	StoreFlags
+	Len      int  `name:"len" default:"2048" help:"The length of the RSA key to generate."`
+	Activate bool `name:"activate" help:"Activate the key immediately. Without this, the key is published in the JWKS but doesn't sign until activated."`
 }
 
-// Run is the entry point for the config make-jwt-key command
-func (r *ConfigMakeJWTKey) Run(ctx *Context) error {
-	if !r.Confirm {
-		return fmt.Errorf("you must confirm the action by passing --confirm")
-	}
-
-	db, err := database.New(
-		database.WithDDBProfile(r.Profile),
-		database.WithDDBRegion(r.Region),
-		database.WithDDBTablePrefix(r.Prefix),
-	)
+// Run is the entry point for the config jwt-key new command
+func (r *ConfigJWTKeyNewCmd) Run(ctx *Context) error {
+	db, err := r.open()
 	if err != nil {
 		return err
 	}
 
 	rng := rand.Reader
-	privateKey, err := rsa.GenerateKey(rng, 2048)
+	privateKey, err := rsa.GenerateKey(rng, r.Len)
 	if err != nil {
 		ctx.log.Error().Err(err).Msg("failed to generate private key")
+		return err
 	}
 
 	pemdata := pem.EncodeToMemory(
@@ -145,28 +137,423 @@ func (r *ConfigMakeJWTKey) Run(ctx *Context) error {
 		},
 	)
 
+	now := time.Now().Unix()
+	key := &database.SigningKey{
+		KeyID:      xid.New().String(),
+		PrivateKey: string(pemdata),
+		Status:     database.SigningKeyPending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := db.PutSigningKey(key); err != nil {
+		return err
+	}
+	log.Info().
+		Str("kid", key.KeyID).
+		Str("status", key.Status).
+		Str("backend", r.Backend).
+		Str("aws profile", r.Profile).
+		Str("aws region", r.Region).
+		Str("ddb table prefix", r.Prefix).
+		Msg("jwt signing key created")
+
+	if r.Activate {
+		return activateSigningKey(db, key.KeyID)
+	}
+	return nil
+}
+
+// ConfigJWTKeyListCmd lists the JWT signing keys
+type ConfigJWTKeyListCmd struct {
+	StoreFlags
+}
+
+// Run is the entry point for the config jwt-key list command
+func (r *ConfigJWTKeyListCmd) Run(ctx *Context) error {
+	db, err := r.open()
+	if err != nil {
+		return err
+	}
+
+	keys, err := db.ListSigningKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		log.Info().
+			Str("kid", key.KeyID).
+			Str("status", key.Status).
+			Time("created", time.Unix(key.CreatedAt, 0)).
+			Time("updated", time.Unix(key.UpdatedAt, 0)).
+			Msg("jwt signing key")
+	}
+	return nil
+}
+
+// ConfigJWTKeyActivateCmd activates a JWT signing key
+type ConfigJWTKeyActivateCmd struct {
+	KeyID string `name:"kid" required:"" help:"The key ID to activate."`
+	StoreFlags
+}
+
+// Run is the entry point for the config jwt-key activate command
+func (r *ConfigJWTKeyActivateCmd) Run(ctx *Context) error {
+	db, err := r.open()
+	if err != nil {
+		return err
+	}
+	return activateSigningKey(db, r.KeyID)
+}
+
+// ConfigJWTKeyRetireCmd retires a JWT signing key
+type ConfigJWTKeyRetireCmd struct {
+	KeyID string `name:"kid" required:"" help:"The key ID to retire."`
+	StoreFlags
+	Confirm bool `name:"confirm" required:"" help:"Confirm the action. JWTs signed with this key will no longer verify."`
+}
+
+// Run is the entry point for the config jwt-key retire command
+func (r *ConfigJWTKeyRetireCmd) Run(ctx *Context) error {
+	if !r.Confirm {
+		return fmt.Errorf("you must confirm the action by passing --confirm")
+	}
+
+	db, err := r.open()
+	if err != nil {
+		return err
+	}
+
+	key, err := db.GetSigningKey(r.KeyID)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("no jwt signing key with kid %s", r.KeyID)
+	}
+	if key.Status == database.SigningKeyActive {
+		return fmt.Errorf("key %s is active; activate another key first", r.KeyID)
+	}
+
+	key.Status = database.SigningKeyRetired
+	key.UpdatedAt = time.Now().Unix()
+	if err := db.PutSigningKey(key); err != nil {
+		return err
+	}
+	log.Info().
+		Str("kid", key.KeyID).
+		Str("status", key.Status).
+		Msg("jwt signing key retired")
+	return nil
+}
+
+// activateSigningKey makes a key the active signing key.
+// The previously active key keeps verifying existing JWTs until it is retired.
+func activateSigningKey(db database.Store, keyID string) error {
+	keys, err := db.ListSigningKeys()
+	if err != nil {
+		return err
+	}
+
+	var target *database.SigningKey
+	for _, key := range keys {
+		if key.KeyID == keyID {
+			target = key
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("no jwt signing key with kid %s", keyID)
+	}
+	if target.Status == database.SigningKeyRetired {
+		return fmt.Errorf("key %s is retired", keyID)
+	}
+
+	now := time.Now().Unix()
+
+	// Activate the new key before demoting the old one so there is always an active key
+	target.Status = database.SigningKeyActive
+	target.UpdatedAt = now
+	if err := db.PutSigningKey(target); err != nil {
+		return err
+	}
+	log.Info().
+		Str("kid", target.KeyID).
+		Str("status", target.Status).
+		Msg("jwt signing key activated")
+
+	for _, key := range keys {
+		if key.KeyID == keyID || key.Status != database.SigningKeyActive {
+			continue
+		}
+		key.Status = database.SigningKeyRetiring
+		key.UpdatedAt = now
+		if err := db.PutSigningKey(key); err != nil {
+			return err
+		}
+		log.Info().
+			Str("kid", key.KeyID).
+			Str("status", key.Status).
+			Msg("jwt signing key retiring")
+	}
+	return nil
+}
+
+// ConfigJWTKeyCmd manages the JWT signing keys
+type ConfigJWTKeyCmd struct {
+	New      ConfigJWTKeyNewCmd      `cmd:"" help:"Make a new JWT signing key."`
+	List     ConfigJWTKeyListCmd     `cmd:"" help:"List the JWT signing keys."`
+	Activate ConfigJWTKeyActivateCmd `cmd:"" help:"Sign new JWTs with a key. The previously active key keeps verifying until retired."`
+	Retire   ConfigJWTKeyRetireCmd   `cmd:"" help:"Stop verifying JWTs signed with a key."`
+}
+
+// ConfigMakeTokenKey makes a token encryption key
+type ConfigMakeTokenKey struct {
+	StoreFlags
+	Confirm bool `name:"confirm" required:"" help:"Confirm the action. This will overwrite an existing key."`
+}
+
+// Run is the entry point for the config token-key command
+func (r *ConfigMakeTokenKey) Run(ctx *Context) error {
+	if !r.Confirm {
+		return fmt.Errorf("you must confirm the action by passing --confirm")
+	}
+
+	db, err := r.open()
+	if err != nil {
+		return err
+	}
+
+	// AES-256 key for encrypting stored Mastodon access tokens
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
 	if err := db.PutConfig(&database.ConfigItem{
-		ConfigKey:   "jwt_signing_key",
-		ConfigValue: string(pemdata),
+		ConfigKey:   "token_encryption_key",
+		ConfigValue: base64.StdEncoding.EncodeToString(key),
 	}); err != nil {
 		return err
 	}
 	log.Info().
-		Str("key", "jwt_signing_key").
+		Str("key", "token_encryption_key").
 		Str("value", "key_not_shown").
+		Str("backend", r.Backend).
 		Str("aws profile", r.Profile).
 		Str("aws region", r.Region).
 		Str("ddb table prefix", r.Prefix).
 		Msg("config set")
 	return nil
+}
 
+// ConfigDenyImportCmd imports a domain blocklist CSV into deny_instances
+type ConfigDenyImportCmd struct {
+	File       string   `name:"file" required:"" type:"existingfile" help:"The blocklist CSV (Mastodon domain_blocks.csv format: domain,severity,...)."`
+	Severities []string `name:"severity" default:"suspend" help:"The severities to deny. Repeat to import several."`
+	Replace    bool     `name:"replace" help:"Replace deny_instances instead of adding to it."`
+	StoreFlags
+}
+
+// Run is the entry point for the config deny-import command
+func (r *ConfigDenyImportCmd) Run(ctx *Context) error {
+	f, err := os.Open(r.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.Comment = 0
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	// Find the domain and severity columns; exports name them "#domain" and "#severity"
+	domainCol, severityCol := 0, -1
+	if len(records) > 0 {
+		header := records[0]
+		isHeader := false
+		for i, name := range header {
+			switch strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#")) {
+			case "domain":
+				domainCol = i
+				isHeader = true
+			case "severity":
+				severityCol = i
+			}
+		}
+		if isHeader {
+			records = records[1:]
+		} else {
+			severityCol = -1
+		}
+	}
+
+	severities := make(map[string]struct{})
+	for _, severity := range r.Severities {
+		severities[strings.ToLower(strings.TrimSpace(severity))] = struct{}{}
+	}
+
+	db, err := r.open()
+	if err != nil {
+		return err
+	}
+
+	deny := make(map[string]struct{})
+	if !r.Replace {
+		existing, err := db.GetConfig("deny_instances")
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			for _, pattern := range strings.Split(existing.ConfigValue, ",") {
+				if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+					deny[pattern] = struct{}{}
+				}
+			}
+		}
+	}
+
+	imported, skipped := 0, 0
+	for _, record := range records {
+		if domainCol >= len(record) {
+			continue
+		}
+		domain := strings.ToLower(strings.TrimSpace(record[domainCol]))
+		if domain == "" {
+			continue
+		}
+
+		// Rows without a severity are suspensions
+		severity := "suspend"
+		if severityCol >= 0 && severityCol < len(record) && strings.TrimSpace(record[severityCol]) != "" {
+			severity = strings.ToLower(strings.TrimSpace(record[severityCol]))
+		}
+		if _, ok := severities[severity]; !ok {
+			continue
+		}
+
+		// Obfuscated domains (eg ex*mple.com) can't be matched, and invalid ones would break the list
+		if strings.Contains(domain, "*") || app.ValidateSetting("deny_instances", "."+domain) != nil {
+			skipped++
+			continue
+		}
+
+		// Blocks apply to subdomains too
+		pattern := "." + domain
+		if _, ok := deny[pattern]; !ok {
+			deny[pattern] = struct{}{}
+			imported++
+		}
+	}
+
+	patterns := make([]string, 0, len(deny))
+	for pattern := range deny {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	if err := db.PutConfig(&database.ConfigItem{
+		ConfigKey:   "deny_instances",
+		ConfigValue: strings.Join(patterns, ","),
+	}); err != nil {
+		return err
+	}
+	log.Info().
+		Str("key", "deny_instances").
+		Int("imported", imported).
+		Int("skipped", skipped).
+		Int("total", len(patterns)).
+		Str("backend", r.Backend).
+		Str("aws profile", r.Profile).
+		Str("aws region", r.Region).
+		Str("ddb table prefix", r.Prefix).
+		Msg("config set")
+	return nil
 }
 
 // ConfigCmd is the main config command
 type ConfigCmd struct {
-	Set    ConfigSetCmd     `cmd:"" help:"Set a config value."`
-	Get    ConfigGetCmd     `cmd:"" help:"Get a config value."`
-	JWTKey ConfigMakeJWTKey `cmd:"" help:"Make a JWT. This is a destructive action and will overwrite an existing key."`
+	Set        ConfigSetCmd        `cmd:"" help:"Set a config value."`
+	Get        ConfigGetCmd        `cmd:"" help:"Get a config value."`
+	DenyImport ConfigDenyImportCmd `cmd:"" help:"Import a domain blocklist CSV into deny_instances."`
+	JWTKey     ConfigJWTKeyCmd     `cmd:"" help:"Manage the JWT signing keys."`
+	TokenKey   ConfigMakeTokenKey  `cmd:"" help:"Make a key for encrypting stored Mastodon access tokens. This is a destructive action and will invalidate all sessions."`
+}
+
+// OIDCClientAddCmd registers an OpenID Connect client
+type OIDCClientAddCmd struct {
+	Name         string   `name:"name" required:"" help:"A human friendly name for the client."`
+	RedirectURIs []string `name:"redirect-uri" required:"" help:"A redirect URI the client may use. Repeat for more than one."`
+	Public       bool     `name:"public" help:"Register a public client (no secret; PKCE required)."`
+	StoreFlags
+}
+
+// Run is the entry point for the oidc-client add command
+func (r *OIDCClientAddCmd) Run(ctx *Context) error {
+	db, err := r.open()
+	if err != nil {
+		return err
+	}
+
+	client := &database.OIDCClient{
+		ClientID:     xid.New().String(),
+		Name:         r.Name,
+		RedirectURIs: r.RedirectURIs,
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	// Only the hash of the secret is stored; show it once
+	secret := ""
+	if !r.Public {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+		sum := sha256.Sum256([]byte(secret))
+		client.ClientSecretHash = hex.EncodeToString(sum[:])
+	}
+
+	if err := db.PutOIDCClient(client); err != nil {
+		return err
+	}
+	log.Info().
+		Str("client_id", client.ClientID).
+		Str("client_secret", secret).
+		Str("name", client.Name).
+		Strs("redirect_uris", client.RedirectURIs).
+		Bool("public", r.Public).
+		Msg("oidc client registered. the client secret will not be shown again")
+	return nil
+}
+
+// OIDCClientDeleteCmd deletes an OpenID Connect client
+type OIDCClientDeleteCmd struct {
+	ClientID string `name:"client-id" required:"" help:"The client ID to delete."`
+	StoreFlags
+}
+
+// Run is the entry point for the oidc-client delete command
+func (r *OIDCClientDeleteCmd) Run(ctx *Context) error {
+	db, err := r.open()
+	if err != nil {
+		return err
+	}
+	if err := db.DeleteOIDCClient(r.ClientID); err != nil {
+		return err
+	}
+	log.Info().
+		Str("client_id", r.ClientID).
+		Msg("oidc client deleted")
+	return nil
+}
+
+// OIDCClientCmd manages the OpenID Connect clients
+type OIDCClientCmd struct {
+	Add    OIDCClientAddCmd    `cmd:"" help:"Register an OpenID Connect client."`
+	Delete OIDCClientDeleteCmd `cmd:"" help:"Delete an OpenID Connect client."`
 }
 
 // CLI is the main CLI struct
@@ -175,7 +562,11 @@ type CLI struct {
 	LogLevel string `name:"loglevel" env:"LOGLEVEL" default:"info" enum:"panic,fatal,error,warn,info,debug,trace" help:"Set the log level."`
 
 	//Cfg CfgCmd `cmd:"" help:"Show Mastgraph config details."`
-	Config ConfigCmd `cmd:"" help:"Manage the config."`
+	Config     ConfigCmd     `cmd:"" help:"Manage the config."`
+	OIDCClient OIDCClientCmd `cmd:"" name:"oidc-client" help:"Manage the OpenID Connect clients."`
+	Login      LoginCmd      `cmd:"" help:"Login to a mastostart server with your Mastodon account (device flow) and cache the session."`
+	Logout     LogoutCmd     `cmd:"" help:"End the cached session."`
+	Serve      ServeCmd      `cmd:"" help:"Run the server outside Lambda (eg with a bolt database on a single VM)."`
 }
 
 func main() {
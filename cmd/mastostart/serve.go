@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rmrfslashbin/mastostart/pkg/app"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
+)
+
+// ServeCmd runs the mastostart server outside Lambda, eg on a single VM with a bolt file
+type ServeCmd struct {
+	Listen string        `name:"listen" env:"MASTOSTART_LISTEN" default:":8080" help:"The address to listen on."`
+	Sweep  time.Duration `name:"sweep" default:"5m" help:"How often expired items are deleted from a bolt database."`
+
+	RequestTimeout   time.Duration `name:"request-timeout" env:"MASTOSTART_REQUEST_TIMEOUT" default:"28s" help:"How long a request may take."`
+	APITimeout       time.Duration `name:"api-timeout" env:"MASTOSTART_API_TIMEOUT" default:"10s" help:"How long a Mastodon API call may take."`
+	OAuthTimeout     time.Duration `name:"oauth-timeout" env:"MASTOSTART_OAUTH_TIMEOUT" default:"10s" help:"How long a Mastodon OAuth call (token exchange, revocation, app verification) may take."`
+	DiscoveryTimeout time.Duration `name:"discovery-timeout" env:"MASTOSTART_DISCOVERY_TIMEOUT" default:"5s" help:"How long discovering an instance (WebFinger, NodeInfo, OAuth metadata) may take."`
+	RegisterTimeout  time.Duration `name:"register-timeout" env:"MASTOSTART_REGISTER_TIMEOUT" default:"15s" help:"How long registering the app with an instance may take."`
+	RegistrationCap  int           `name:"registration-cap" env:"MASTOSTART_REGISTRATION_CAP" default:"100" help:"How many apps may be registered on new instances an hour, across all clients (0 for no cap)."`
+	StoreFlags
+}
+
+// Run is the entry point for the serve command
+func (r *ServeCmd) Run(ctx *Context) error {
+	db, err := r.open()
+	if err != nil {
+		return err
+	}
+
+	// DynamoDB expires items with its TTL. The key/value stores need sweeping.
+	if kv, ok := db.(*database.KVStore); ok {
+		defer kv.Close()
+		go func() {
+			for range time.Tick(r.Sweep) {
+				deleted, err := kv.Sweep()
+				if err != nil {
+					ctx.log.Error().Err(err).Msg("unable to sweep expired items")
+					continue
+				}
+				ctx.log.Debug().Int("deleted", deleted).Msg("swept expired items")
+			}
+		}()
+	}
+
+	a, err := app.New(
+		app.WithDB(db),
+		app.WithLogger(ctx.log),
+		app.WithRegistrationCap(r.RegistrationCap),
+		app.WithTimeouts(app.Timeouts{
+			Request: r.RequestTimeout,
+			Mastodon: mastoclient.Timeouts{
+				API:       r.APITimeout,
+				OAuth:     r.OAuthTimeout,
+				Discovery: r.DiscoveryTimeout,
+				Register:  r.RegisterTimeout,
+			},
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Shut down gracefully on SIGINT/SIGTERM
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx.log.Info().Msg("shutting down")
+		if err := a.Shutdown(); err != nil {
+			ctx.log.Error().Err(err).Msg("unable to shut down")
+		}
+	}()
+
+	ctx.log.Info().
+		Str("listen", r.Listen).
+		Str("backend", r.Backend).
+		Msg("serving")
+	return a.Listen(r.Listen)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+)
+
+// StoreFlags selects the database the commands work on
+type StoreFlags struct {
+	Backend    string        `name:"backend" env:"MASTOSTART_BACKEND" default:"dynamodb" enum:"dynamodb,bolt" help:"The database backend: dynamodb or a bolt file."`
+	BoltPath   string        `name:"bolt-path" env:"MASTOSTART_BOLT_PATH" default:"mastostart.db" type:"path" help:"The bolt database file (with --backend=bolt)."`
+	Profile    string        `name:"profile" default:"default" help:"The profile to set the value for."`
+	Region     string        `name:"region" default:"us-east-1" help:"The region to set the value for."`
+	Prefix     string        `name:"prefix" default:"mastostart-" help:"The prefix for dynamodb table names."`
+	DDBTimeout time.Duration `name:"ddb-timeout" env:"MASTOSTART_DDB_TIMEOUT" default:"5s" help:"How long a dynamodb call may take."`
+	DDBBatch   int           `name:"ddb-batch-concurrency" env:"MASTOSTART_DDB_BATCH_CONCURRENCY" default:"4" help:"How many dynamodb batch writes may run at once."`
+}
+
+// open opens the selected database
+func (r *StoreFlags) open() (database.Store, error) {
+	if r.Backend == "bolt" {
+		return database.NewBolt(r.BoltPath)
+	}
+	return database.New(
+		database.WithDDBProfile(r.Profile),
+		database.WithDDBRegion(r.Region),
+		database.WithDDBTablePrefix(r.Prefix),
+		database.WithDDBTimeout(r.DDBTimeout),
+		database.WithDDBBatchConcurrency(r.DDBBatch),
+	)
+}
@@ -11,6 +11,8 @@ require (
 	github.com/mattn/go-mastodon v0.0.6
 	github.com/rs/xid v1.5.0
 	github.com/rs/zerolog v1.32.0
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/net v0.23.0
 )
 
 require (
@@ -37,7 +39,7 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.52.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
-	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
 
 require (
@@ -2,14 +2,45 @@ package main
 
 import (
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/rmrfslashbin/mastostart/pkg/app"
 	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
 	"github.com/rs/zerolog"
 )
 
+// envDuration reads a duration (eg "5s") from the environment, falling back to def if unset or invalid
+func envDuration(log *zerolog.Logger, name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warn().Err(err).Str("name", name).Str("value", value).Msg("invalid duration; using the default")
+		return def
+	}
+	return d
+}
+
+// envInt reads a positive integer from the environment, falling back to def if unset or invalid
+func envInt(log *zerolog.Logger, name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Warn().Err(err).Str("name", name).Str("value", value).Msg("invalid number; using the default")
+		return def
+	}
+	return n
+}
+
 func main() {
 	// Set up the logger
 	log := zerolog.New(os.Stderr).With().Timestamp().Logger()
@@ -39,7 +70,10 @@ func main() {
 
 	log.Debug().Msg("startup!")
 
-	db, err := database.New()
+	db, err := database.New(
+		database.WithDDBTimeout(envDuration(&log, "MASTOSTART_DDB_TIMEOUT", database.DefaultDDBTimeout)),
+		database.WithDDBBatchConcurrency(envInt(&log, "MASTOSTART_DDB_BATCH_CONCURRENCY", database.DefaultBatchConcurrency)),
+	)
 	if err != nil {
 		log.Fatal().Err(err).Msg("main(): non-starter: failed to create database")
 	}
@@ -47,6 +81,16 @@ func main() {
 	if a, err := app.New(
 		app.WithDB(db),
 		app.WithLogger(&log),
+		app.WithRegistrationCap(envInt(&log, "MASTOSTART_REGISTRATION_CAP", app.DefaultRegistrationCap)),
+		app.WithTimeouts(app.Timeouts{
+			Request: envDuration(&log, "MASTOSTART_REQUEST_TIMEOUT", app.DefaultTimeouts.Request),
+			Mastodon: mastoclient.Timeouts{
+				API:       envDuration(&log, "MASTOSTART_API_TIMEOUT", mastoclient.DefaultTimeouts.API),
+				OAuth:     envDuration(&log, "MASTOSTART_OAUTH_TIMEOUT", mastoclient.DefaultTimeouts.OAuth),
+				Discovery: envDuration(&log, "MASTOSTART_DISCOVERY_TIMEOUT", mastoclient.DefaultTimeouts.Discovery),
+				Register:  envDuration(&log, "MASTOSTART_REGISTER_TIMEOUT", mastoclient.DefaultTimeouts.Register),
+			},
+		}),
 	); err != nil {
 		log.Fatal().Err(err).Msg("main(): non-starter: failed to create app")
 	} else {
@@ -0,0 +1,614 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattn/go-mastodon"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// targetAccountHeader selects which linked account an API request acts as
+const targetAccountHeader = "X-Mastostart-Account"
+
+// linkLogin links the account a user logged in with to its identity (starting a new identity
+// for accounts that aren't linked yet) and stores the login's access token with the link.
+// Returns the identity ID.
+func (cfg *Config) linkLogin(ctx context.Context, me *mastodon.Account, instanceHost string, encryptedToken string, scopes []string) (string, error) {
+	link, err := cfg.db.GetLinkedAccountByURLWithContext(ctx, me.URL)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "linkLogin::cfg.db.GetLinkedAccountByURL(me.URL)").
+			Str("errRef", guid.String()).
+			Msg("Unable to get linked account from database")
+		return "", errors.New(guid.String() + ": Unable to get linked account from database")
+	}
+
+	now := time.Now().Unix()
+	if link == nil {
+		link = &database.LinkedAccount{
+			IdentityID: xid.New().String(),
+			AccountURL: me.URL,
+			LinkedAt:   now,
+		}
+	}
+	link.InstanceURL = instanceHost
+	link.UserID = string(me.ID)
+	link.AccessToken = encryptedToken
+	link.Scopes = scopes
+	link.UpdatedAt = now
+
+	if err := cfg.db.PutLinkedAccountWithContext(ctx, link); err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "linkLogin::cfg.db.PutLinkedAccount()").
+			Str("errRef", guid.String()).
+			Msg("Unable to save linked account to database")
+		return "", errors.New(guid.String() + ": Unable to save linked account to database")
+	}
+
+	return link.IdentityID, nil
+}
+
+// syncLinkedToken replaces the session's access token in its linked account, if the link holds the
+// same token (the link stores the token of the latest login). Set encryptedToken to "" when the
+// token was revoked; the account must then be linked again to act as it from other sessions.
+func (cfg *Config) syncLinkedToken(ctx context.Context, session *database.UserCredentials, encryptedToken string, scopes []string) error {
+	if session.IdentityID == "" {
+		return nil
+	}
+
+	link, err := cfg.db.GetLinkedAccountWithContext(ctx, session.IdentityID, session.AccountURL)
+	if err != nil {
+		return err
+	}
+	if link == nil || link.AccessToken != session.AccessToken {
+		return nil
+	}
+
+	link.AccessToken = encryptedToken
+	if encryptedToken != "" {
+		link.Scopes = scopes
+	}
+	link.UpdatedAt = time.Now().Unix()
+	return cfg.db.PutLinkedAccountWithContext(ctx, link)
+}
+
+// finishLink links the account a POST /api/accounts login authorized to the identity that started it
+func (cfg *Config) finishLink(c *fiber.Ctx, attempt *database.LoginAttempt, me *mastodon.Account, accessToken string, scopes []string) error {
+	existing, err := cfg.db.GetLinkedAccountByURLWithContext(c.UserContext(), me.URL)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishLink::cfg.db.GetLinkedAccountByURL(me.URL)").
+			Msg("unable to get linked account from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// An account belongs to one identity
+	if existing != nil && existing.IdentityID != attempt.LinkIdentityID {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishLink::existing.IdentityID != attempt.LinkIdentityID").
+			Str("accountURL", me.URL).
+			Msg("account is linked to another identity")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "account is linked to another identity. unlink it there first",
+		})
+		return c.Status(fiber.StatusConflict).SendString(string(e))
+	}
+
+	encryptedToken, err := cfg.encryptToken(c.UserContext(), accessToken)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishLink::cfg.encryptToken(accessToken)").
+			Msg("unable to encrypt access token")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	now := time.Now().Unix()
+	link := existing
+	if link == nil {
+		link = &database.LinkedAccount{
+			IdentityID: attempt.LinkIdentityID,
+			AccountURL: me.URL,
+			LinkedAt:   now,
+		}
+	}
+	link.InstanceURL = attempt.InstanceURL
+	link.UserID = string(me.ID)
+	link.AccessToken = encryptedToken
+	link.Scopes = scopes
+	link.UpdatedAt = now
+	if err := cfg.db.PutLinkedAccountWithContext(c.UserContext(), link); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishLink::cfg.db.PutLinkedAccount()").
+			Msg("unable to save linked account to database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// Browser links go back to the frontend; the JWT didn't change
+	if attempt.ReturnTo != "" {
+		return c.Redirect(attempt.ReturnTo, fiber.StatusFound)
+	}
+
+	return c.JSON(
+		fiber.Map{
+			"linked":  true,
+			"account": newLinkedAccountView(link, ""),
+		},
+	)
+}
+
+// loadTargetAccount loads the linked account a request acts as (the X-Mastostart-Account header or
+// ?account= query param) and stores it in c.Locals("linkedAccount"). Requests without one act as
+// the account the session logged in with.
+func (cfg *Config) loadTargetAccount(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+
+	target := c.Get(targetAccountHeader, c.Query("account"))
+	if target == "" || target == session.AccountURL {
+		return c.Next()
+	}
+
+	// API keys only act as the account they were minted for
+	if apiKey(c) != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadTargetAccount::apiKey(c) != nil").
+			Msg("api keys can't act as linked accounts")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "api keys can only act as the account they were minted for",
+		})
+		return c.Status(fiber.ErrForbidden.Code).SendString(string(e))
+	}
+
+	if session.IdentityID == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadTargetAccount::session.IdentityID == ''").
+			Msg("session has no identity")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "session predates linked accounts. please login again",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	link, err := cfg.db.GetLinkedAccountWithContext(c.UserContext(), session.IdentityID, target)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadTargetAccount::cfg.db.GetLinkedAccount()").
+			Msg("unable to get linked account from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if link == nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadTargetAccount::link == nil").
+			Str("accountURL", target).
+			Msg("account not linked")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "account not linked",
+		})
+		return c.Status(fiber.ErrNotFound.Code).SendString(string(e))
+	}
+	if link.AccessToken == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadTargetAccount::link.AccessToken == ''").
+			Str("accountURL", target).
+			Msg("linked account has no access token")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "the account's access token was revoked. please link the account again",
+		})
+		return c.Status(fiber.StatusConflict).SendString(string(e))
+	}
+
+	c.Locals("linkedAccount", link)
+	return c.Next()
+}
+
+// linkedAccount returns the linked account loaded by loadTargetAccount, or nil if the request acts as the session's account
+func linkedAccount(c *fiber.Ctx) *database.LinkedAccount {
+	link, _ := c.Locals("linkedAccount").(*database.LinkedAccount)
+	return link
+}
+
+// apiAccounts is the handler for GET /api/accounts. It lists the accounts linked to the session's identity.
+func (cfg *Config) apiAccounts(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+	if session.IdentityID == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiAccounts::session.IdentityID == ''").
+			Msg("session has no identity")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "session predates linked accounts. please login again",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	links, err := cfg.db.ListLinkedAccountsWithContext(c.UserContext(), session.IdentityID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiAccounts::cfg.db.ListLinkedAccounts()").
+			Msg("unable to get linked accounts from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	accounts := make([]*LinkedAccountView, 0, len(links))
+	for _, link := range links {
+		accounts = append(accounts, newLinkedAccountView(link, session.AccountURL))
+	}
+	return c.JSON(fiber.Map{"identity_id": session.IdentityID, "accounts": accounts})
+}
+
+// apiLinkAccount is the handler for POST /api/accounts. It starts a login linking another account to the session's identity.
+func (cfg *Config) apiLinkAccount(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+	if session.IdentityID == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiLinkAccount::session.IdentityID == ''").
+			Msg("session has no identity")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "session predates linked accounts. please login again",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// The instance to link an account from: instance_url, or the instance serving a handle
+	var instanceURL *url.URL
+	if rawInstanceURL := c.FormValue("instance_url"); rawInstanceURL != "" {
+		if !strings.Contains(rawInstanceURL, "://") {
+			rawInstanceURL = "https://" + rawInstanceURL
+		}
+		parsed, err := url.Parse(rawInstanceURL)
+		if err != nil || parsed.Host == "" {
+			guid := xid.New()
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "apiLinkAccount::url.Parse(rawInstanceURL)").
+				Msg("error parsing instance_url")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "unable to parse instance_url",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		instanceURL = parsed
+	} else if handle := c.FormValue("username"); strings.Contains(strings.TrimPrefix(handle, "@"), "@") {
+		resolved, err := cfg.resolveHandle(c.UserContext(), handle)
+		if err != nil {
+			guid := xid.New()
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "apiLinkAccount::cfg.resolveHandle(handle)").
+				Str("username", handle).
+				Msg("unable to resolve handle")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "unable to resolve handle to an instance",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		instanceURL = resolved
+	} else {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiLinkAccount::c.FormValue('instance_url')").
+			Msg("missing 'instance_url' or 'username' form value")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing 'instance_url' or 'username' (a full handle) form value",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	attempt := &database.LoginAttempt{
+		Scope:          strings.Join(parseScopes(c.FormValue("scope")), " "),
+		LinkIdentityID: session.IdentityID,
+	}
+
+	// Optionally send the browser back to the frontend after the callback
+	if rawReturnTo := c.FormValue("return_to"); rawReturnTo != "" {
+		returnTo, err := cfg.checkReturnTo(c.UserContext(), rawReturnTo)
+		if err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "apiLinkAccount::cfg.checkReturnTo(rawReturnTo)").
+				Msg("unable to check return_to")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+			})
+			return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		}
+		if returnTo == nil {
+			guid := xid.New()
+			cfg.log.Error().
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "apiLinkAccount::cfg.checkReturnTo(rawReturnTo)").
+				Str("returnTo", rawReturnTo).
+				Msg("return_to not in allowlist")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "return_to not in allowlist",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		attempt.ReturnTo = returnTo.String()
+	}
+
+	authURI, err := cfg.beginLogin(c.UserContext(), instanceURL, attempt)
+	if err != nil {
+		var limited *RateLimited
+		if errors.As(err, &limited) {
+			return tooManyRequests(c, limited)
+		}
+		guid := xid.New()
+		var notRegistered *ScopeNotRegistered
+		var notPermitted *InstanceNotPermitted
+		var unsupported *UnsupportedSoftware
+		if errors.As(err, &notRegistered) || errors.As(err, &notPermitted) || errors.As(err, &unsupported) {
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "apiLinkAccount::cfg.beginLogin()").
+				Str("instanceURL", instanceURL.Host).
+				Msg("unable to link account")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    err.Error(),
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiLinkAccount::cfg.beginLogin()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to start login")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// Bind the state to this browser; the callback rejects a mismatched cookie
+	setStateCookie(c, attempt.State)
+
+	// Return the authorize URL
+	return c.JSON(fiber.Map{"authuri": authURI.String()})
+}
+
+// apiUnlinkAccount is the handler for DELETE /api/accounts. It unlinks an account from the session's identity and revokes its access token.
+func (cfg *Config) apiUnlinkAccount(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+
+	accountURL := c.Query("account_url")
+	if accountURL == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiUnlinkAccount::c.Query('account_url')").
+			Msg("missing 'account_url' query param")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing 'account_url' query param",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// The session's own account goes away with /auth/logout
+	if accountURL == session.AccountURL {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiUnlinkAccount::accountURL == session.AccountURL").
+			Msg("unable to unlink the session's account")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "unable to unlink the account this session is logged in with. use /auth/logout",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	link, err := cfg.db.GetLinkedAccountWithContext(c.UserContext(), session.IdentityID, accountURL)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiUnlinkAccount::cfg.db.GetLinkedAccount()").
+			Msg("unable to get linked account from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if link == nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiUnlinkAccount::link == nil").
+			Str("accountURL", accountURL).
+			Msg("account not linked")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "account not linked",
+		})
+		return c.Status(fiber.ErrNotFound.Code).SendString(string(e))
+	}
+
+	// Revoke the account's access token. A failure here shouldn't keep the account linked.
+	mastodonRevoked := false
+	if link.AccessToken != "" {
+		if flight, err := cfg.preflight(&PreflightInput{ctx: c.UserContext(), session: session, linked: link}); err != nil {
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("function", "apiUnlinkAccount::cfg.preflight()").
+				Msg("prefilight failed")
+		} else if err := flight.Client.RevokeTokenWithContext(c.UserContext()); err != nil {
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("function", "apiUnlinkAccount::flight.Client.RevokeToken()").
+				Str("instanceURL", link.InstanceURL).
+				Msg("unable to revoke mastodon access token")
+		} else {
+			mastodonRevoked = true
+		}
+	}
+
+	if err := cfg.db.DeleteLinkedAccountWithContext(c.UserContext(), session.IdentityID, accountURL); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiUnlinkAccount::cfg.db.DeleteLinkedAccount()").
+			Msg("unable to delete linked account from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	return c.JSON(
+		fiber.Map{
+			"unlinked":         true,
+			"mastodon_revoked": mastodonRevoked,
+		},
+	)
+}
+
+// newLinkedAccountView returns the public view of a linked account.
+// current is the account URL the session logged in with.
+func newLinkedAccountView(link *database.LinkedAccount, current string) *LinkedAccountView {
+	return &LinkedAccountView{
+		AccountURL:  link.AccountURL,
+		InstanceURL: link.InstanceURL,
+		UserID:      link.UserID,
+		Scopes:      link.Scopes,
+		LinkedAt:    link.LinkedAt,
+		Current:     link.AccountURL == current,
+		NeedsRelink: link.AccessToken == "",
+	}
+}
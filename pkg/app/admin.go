@@ -0,0 +1,552 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// adminConfigKeys are the config items admins may edit with the admin API.
+// Secrets (jwt_signing_key, token_encryption_key) are managed with the CLI only.
+var adminConfigKeys = []string{
+	"admin_accounts",
+	"app_name",
+	"cookie_domain",
+	"cors_headers",
+	"cors_methods",
+	"cors_origins",
+	"deny_instances",
+	"oidc_issuer",
+	"permit_instances",
+	"redirect_uri",
+	"return_to_allowlist",
+	"scopes",
+	"website",
+}
+
+// secretConfigKeys are the config items whose values are never returned by the admin API
+var secretConfigKeys = []string{
+	"jwt_signing_key",
+	"token_encryption_key",
+}
+
+// isAdminAccount reports whether an account is listed in the admin_accounts config
+func (cfg *Config) isAdminAccount(ctx context.Context, accountURL string) (bool, error) {
+	settings, err := cfg.getSettings(ctx)
+	if err != nil {
+		return false, err
+	}
+	return containsString(settings.AdminAccounts, accountURL), nil
+}
+
+// requireAdmin is the middleware for the /admin routes.
+// The JWT must carry the admin claim and the account must (still) be in admin_accounts.
+func (cfg *Config) requireAdmin(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+
+	admin, _ := claims["adm"].(bool)
+	if admin {
+		var err error
+		if admin, err = cfg.isAdminAccount(c.UserContext(), session.AccountURL); err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "requireAdmin::cfg.isAdminAccount()").
+				Msg("unable to get admin_accounts from database")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+			})
+			return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		}
+	}
+
+	if !admin {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "requireAdmin::!admin").
+			Str("accountURL", session.AccountURL).
+			Msg("admin route requested by a non-admin")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "admin only",
+		})
+		return c.Status(fiber.ErrForbidden.Code).SendString(string(e))
+	}
+
+	// Audit admin requests
+	cfg.log.Info().
+		Str("method", c.Method()).
+		Str("originalURL", c.OriginalURL()).
+		Str("admin", session.AccountURL).
+		Msg("admin request")
+	return c.Next()
+}
+
+// adminListConfig is the handler for GET /admin/config
+func (cfg *Config) adminListConfig(c *fiber.Ctx) error {
+	items, err := cfg.db.ListConfigWithContext(c.UserContext())
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminListConfig::cfg.db.ListConfig()").
+			Msg("unable to get config from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	for _, item := range items {
+		if containsString(secretConfigKeys, item.ConfigKey) {
+			item.ConfigValue = "(redacted)"
+		}
+	}
+	return c.JSON(fiber.Map{"config": items})
+}
+
+// adminPutConfig is the handler for PUT /admin/config/:key
+func (cfg *Config) adminPutConfig(c *fiber.Ctx) error {
+	key := c.Params("key")
+	if !containsString(adminConfigKeys, key) {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminPutConfig::containsString(adminConfigKeys, key)").
+			Str("key", key).
+			Msg("config key not editable")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "config key not editable with the admin API: " + key,
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	value := c.FormValue("value")
+	if err := ValidateSetting(key, value); err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminPutConfig::ValidateSetting(key, value)").
+			Str("key", key).
+			Msg("invalid config value")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    err.Error(),
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+	if err := cfg.db.PutConfigWithContext(c.UserContext(), &database.ConfigItem{
+		ConfigKey:   key,
+		ConfigValue: value,
+	}); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminPutConfig::cfg.db.PutConfig()").
+			Msg("unable to save config to database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	cfg.invalidateSettings()
+	return c.JSON(&database.ConfigItem{ConfigKey: key, ConfigValue: value})
+}
+
+// adminDeleteConfig is the handler for DELETE /admin/config/:key
+func (cfg *Config) adminDeleteConfig(c *fiber.Ctx) error {
+	key := c.Params("key")
+	if !containsString(adminConfigKeys, key) {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminDeleteConfig::containsString(adminConfigKeys, key)").
+			Str("key", key).
+			Msg("config key not editable")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "config key not editable with the admin API: " + key,
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	if err := cfg.db.DeleteConfigWithContext(c.UserContext(), key); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminDeleteConfig::cfg.db.DeleteConfig()").
+			Msg("unable to delete config from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	cfg.invalidateSettings()
+	return c.JSON(fiber.Map{"deleted": key})
+}
+
+// adminListApps is the handler for GET /admin/apps
+func (cfg *Config) adminListApps(c *fiber.Ctx) error {
+	apps, err := cfg.db.ListAppCredentialsWithContext(c.UserContext())
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminListApps::cfg.db.ListAppCredentials()").
+			Msg("unable to get app credentials from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	views := make([]*AppCredentialsView, 0, len(apps))
+	for _, app := range apps {
+		views = append(views, &AppCredentialsView{
+			InstanceURL:     app.InstanceURL,
+			ID:              app.ID,
+			Name:            app.Name,
+			Website:         app.Website,
+			RedirectURI:     app.RedirectURI,
+			ClientID:        app.ClientID,
+			Software:        app.Software,
+			SoftwareVersion: app.SoftwareVersion,
+			Scopes:          app.Scopes,
+			CreatedAt:       app.CreatedAt,
+			VerifiedAt:      app.VerifiedAt,
+		})
+	}
+	return c.JSON(fiber.Map{"apps": views})
+}
+
+// adminDeleteApp is the handler for DELETE /admin/apps/:instance.
+// The registration is archived; the next login on the instance registers the app again.
+func (cfg *Config) adminDeleteApp(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+	instance := normalizeInstanceURL(&url.URL{Host: strings.TrimSpace(c.Params("instance"))}).Host
+
+	app, err := cfg.db.GetAppCredentialsWithContext(c.UserContext(), instance)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminDeleteApp::cfg.db.GetAppCredentials()").
+			Msg("unable to get app credentials from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if app == nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminDeleteApp::app == nil").
+			Str("instance", instance).
+			Msg("no app credentials for instance")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "no app credentials for instance",
+		})
+		return c.Status(fiber.ErrNotFound.Code).SendString(string(e))
+	}
+
+	if err := cfg.db.PutArchivedAppCredentialsWithContext(c.UserContext(), &database.ArchivedAppCredentials{
+		AppCredentials: *app,
+		ArchivedAt:     time.Now().UnixNano(),
+		Reason:         "purged by " + session.AccountURL,
+	}); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminDeleteApp::cfg.db.PutArchivedAppCredentials()").
+			Msg("unable to archive app credentials")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	if err := cfg.db.DeleteAppCredentialsWithContext(c.UserContext(), instance); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminDeleteApp::cfg.db.DeleteAppCredentials()").
+			Msg("unable to delete app credentials")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	return c.JSON(fiber.Map{"deleted": instance})
+}
+
+// adminListLists is the handler for GET /admin/lists
+func (cfg *Config) adminListLists(c *fiber.Ctx) error {
+	lists, err := cfg.db.ListListsWithContext(c.UserContext(), c.Query("instance"), c.Query("owner"))
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminListLists::cfg.db.ListLists()").
+			Msg("unable to get lists from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	return c.JSON(fiber.Map{"lists": lists})
+}
+
+// adminListSessions is the handler for GET /admin/sessions
+func (cfg *Config) adminListSessions(c *fiber.Ctx) error {
+	accountURL := c.Query("account_url")
+	if accountURL == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminListSessions::c.Query('account_url')").
+			Msg("missing 'account_url' query param")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing 'account_url' query param",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	sessions, err := cfg.db.ListUserCredentialsWithContext(c.UserContext(), accountURL)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminListSessions::cfg.db.ListUserCredentials()").
+			Msg("unable to get sessions from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	views := make([]*SessionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, newSessionView(session))
+	}
+	return c.JSON(fiber.Map{"sessions": views})
+}
+
+// adminRevokeSession is the handler for DELETE /admin/sessions/:sessionID
+func (cfg *Config) adminRevokeSession(c *fiber.Ctx) error {
+	session, err := cfg.db.GetUserCredentialsWithContext(c.UserContext(), c.Params("sessionID"))
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminRevokeSession::cfg.db.GetUserCredentials()").
+			Msg("unable to get session from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if session == nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminRevokeSession::session == nil").
+			Msg("session not found")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "session not found",
+		})
+		return c.Status(fiber.ErrNotFound.Code).SendString(string(e))
+	}
+
+	if err := cfg.revokeSession(c.UserContext(), session); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminRevokeSession::cfg.revokeSession()").
+			Msg("unable to revoke session")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	return c.JSON(fiber.Map{"revoked": []string{session.SessionID}})
+}
+
+// adminRevokeSessions is the handler for DELETE /admin/sessions. It revokes all the sessions of an account.
+func (cfg *Config) adminRevokeSessions(c *fiber.Ctx) error {
+	accountURL := c.Query("account_url")
+	if accountURL == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminRevokeSessions::c.Query('account_url')").
+			Msg("missing 'account_url' query param")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing 'account_url' query param",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	sessions, err := cfg.db.ListUserCredentialsWithContext(c.UserContext(), accountURL)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "adminRevokeSessions::cfg.db.ListUserCredentials()").
+			Msg("unable to get sessions from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	revoked := []string{}
+	for _, session := range sessions {
+		if err := cfg.revokeSession(c.UserContext(), session); err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "adminRevokeSessions::cfg.revokeSession()").
+				Strs("revoked", revoked).
+				Msg("unable to revoke session")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+			})
+			return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		}
+		revoked = append(revoked, session.SessionID)
+	}
+
+	return c.JSON(fiber.Map{"revoked": revoked})
+}
+
+// revokeSession ends a session: its Mastodon access token is revoked (best effort) and the session
+// is deleted, so JWTs referencing it are no longer accepted.
+func (cfg *Config) revokeSession(ctx context.Context, session *database.UserCredentials) error {
+	if flight, err := cfg.preflight(&PreflightInput{ctx: ctx, session: session}); err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "revokeSession::cfg.preflight()").
+			Msg("prefilight failed; the mastodon access token won't be revoked")
+	} else if err := flight.Client.RevokeTokenWithContext(ctx); err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "revokeSession::flight.Client.RevokeToken()").
+			Str("instanceURL", session.InstanceURL).
+			Msg("unable to revoke mastodon access token")
+	}
+
+	if err := cfg.syncLinkedToken(ctx, session, "", nil); err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "revokeSession::cfg.syncLinkedToken()").
+			Msg("unable to clear the linked account's access token")
+	}
+
+	return cfg.db.DeleteUserCredentialsWithContext(ctx, session.SessionID)
+}
+
+// newSessionView returns the admin view of a session
+func newSessionView(session *database.UserCredentials) *SessionView {
+	return &SessionView{
+		SessionID:   session.SessionID,
+		IdentityID:  session.IdentityID,
+		AccountURL:  session.AccountURL,
+		InstanceURL: session.InstanceURL,
+		Scopes:      session.Scopes,
+		CreatedAt:   session.CreatedAt,
+		ExpiresAt:   session.ExpiresAt,
+	}
+}
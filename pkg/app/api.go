@@ -7,8 +7,8 @@ import (
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/mattn/go-mastodon"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
 	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
 	"github.com/rs/xid"
 	"github.com/rs/zerolog/log"
@@ -18,7 +18,9 @@ import (
 func (cfg *Config) apiInstanceInfo(c *fiber.Ctx) error {
 	flight, err := cfg.preflight(
 		&PreflightInput{
-			jwtToken: c.Locals("user").(*jwt.Token),
+			ctx:     c.UserContext(),
+			session: c.Locals("session").(*database.UserCredentials),
+			linked:  linkedAccount(c),
 		},
 	)
 	if err != nil {
@@ -34,10 +36,10 @@ func (cfg *Config) apiInstanceInfo(c *fiber.Ctx) error {
 			ErrorInstanceID: guid.String(),
 			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
 		})
-		c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
-	instance, err := flight.Client.GetInstanceInfo()
+	instance, err := flight.Client.GetInstanceInfoWithContext(c.UserContext())
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -52,10 +54,10 @@ func (cfg *Config) apiInstanceInfo(c *fiber.Ctx) error {
 			ErrorInstanceID: guid.String(),
 			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
 		})
-		c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
-	stats, err := flight.Client.GetInstanceStats()
+	stats, err := flight.Client.GetInstanceStatsWithContext(c.UserContext())
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -70,7 +72,7 @@ func (cfg *Config) apiInstanceInfo(c *fiber.Ctx) error {
 			ErrorInstanceID: guid.String(),
 			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
 		})
-		c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
 	type output struct {
@@ -87,30 +89,35 @@ func (cfg *Config) apiInstanceInfo(c *fiber.Ctx) error {
 func (cfg *Config) preflight(in *PreflightInput) (*PreflightOutput, error) {
 	output := &PreflightOutput{}
 
-	// Get the JWT claims
-	claims := in.jwtToken.Claims.(jwt.MapClaims)
-
-	// Get user's Mastodon access token from the JWT claims
-	accessToken := claims["access_token"].(string)
+	// Act as the session's account, or as the linked account the request targets
+	accountURL := in.session.AccountURL
+	userID := in.session.UserID
+	instanceHost := in.session.InstanceURL
+	encryptedToken := in.session.AccessToken
+	if in.linked != nil {
+		accountURL = in.linked.AccountURL
+		userID = in.linked.UserID
+		instanceHost = in.linked.InstanceURL
+		encryptedToken = in.linked.AccessToken
+	}
 
-	// Subject is the fully qualified URL to the user's account
-	subject := claims["sub"].(string)
-	output.FQUsername = &subject
+	// AccountURL is the fully qualified URL to the user's account
+	output.FQUsername = &accountURL
 
 	// userid is the user's numeric ID in the Mastodon instance
-	userid := mastodon.ID(claims["jti"].(string))
+	userid := mastodon.ID(userID)
 	output.Userid = &userid
 
 	// subjectURL is a fully qualified URL to the user's account
-	subjectURL, err := url.Parse(subject)
+	subjectURL, err := url.Parse(accountURL)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
 			Err(err).
 			Str("errRef", guid.String()).
-			Str("function", "preflight::url.Parse(subject)").
-			Str("subject", subject).
-			Msg("unable to parse subject as URL from JWT claims")
+			Str("function", "preflight::url.Parse(accountURL)").
+			Str("accountURL", accountURL).
+			Msg("unable to parse account URL from session")
 		e, _ := json.Marshal(&GeneralRestError{
 			ErrorInstanceID: guid.String(),
 			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
@@ -125,18 +132,34 @@ func (cfg *Config) preflight(in *PreflightInput) (*PreflightOutput, error) {
 	output.Username = &username
 
 	// Construct the instance URL
-	instanceURL := "https://" + subjectURL.Host
+	instanceURL := "https://" + instanceHost
 	output.InstanceURL = &instanceURL
 
+	// Decrypt the user's Mastodon access token from the session
+	accessToken, err := cfg.decryptToken(in.ctx, encryptedToken)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("errRef", guid.String()).
+			Str("function", "preflight::cfg.decryptToken(encryptedToken)").
+			Msg("unable to decrypt access token from session")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return nil, errors.New(string(e))
+	}
+
 	// Get the app credentials from the database
-	appCreds, err := cfg.db.GetAppCredentials(subjectURL.Host)
+	appCreds, err := cfg.db.GetAppCredentialsWithContext(in.ctx, instanceHost)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
 			Err(err).
 			Str("errRef", guid.String()).
-			Str("function", "preflight::cfg.db.GetAppCredentials(subjectURL.Host)").
-			Str("instanceURL", subjectURL.Host).
+			Str("function", "preflight::cfg.db.GetAppCredentials(instanceHost)").
+			Str("instanceURL", instanceHost).
 			Msg("unable to get app credentials from database")
 		e, _ := json.Marshal(&GeneralRestError{
 			ErrorInstanceID: guid.String(),
@@ -149,8 +172,8 @@ func (cfg *Config) preflight(in *PreflightInput) (*PreflightOutput, error) {
 		guid := xid.New()
 		log.Error().
 			Str("errRef", guid.String()).
-			Str("function", "preflight::cfg.db.GetAppCredentials(subjectURL.Host)").
-			Str("instanceURL", subjectURL.Host).
+			Str("function", "preflight::cfg.db.GetAppCredentials(instanceHost)").
+			Str("instanceURL", instanceHost).
 			Msg("unable to get app credentials from database: appCreds is nil")
 		e, _ := json.Marshal(&GeneralRestError{
 			ErrorInstanceID: guid.String(),
@@ -161,11 +184,12 @@ func (cfg *Config) preflight(in *PreflightInput) (*PreflightOutput, error) {
 
 	// Create a new mastoclient instance
 	mc, err := mastoclient.New(
-		mastoclient.WithInstance(&instanceURL),               // Mastodon instance URL from the JWT subject claim
+		mastoclient.WithInstance(&instanceURL),               // Mastodon instance URL of the account
 		mastoclient.WithClientkey(&appCreds.ClientID),        // Mastodon app client ID from the database
 		mastoclient.WithClientSecret(&appCreds.ClientSecret), // Mastodon app client secret from the database
-		mastoclient.WithAccessToken(&accessToken),            // Mastodon user access token from the JWT claims
+		mastoclient.WithAccessToken(&accessToken),            // Mastodon user access token of the account
 		mastoclient.WithLogger(cfg.log),                      // You know, for logging
+		mastoclient.WithTimeouts(cfg.timeouts.Mastodon),      // Deadlines of the calls to the instance
 	)
 	if err != nil {
 		guid := xid.New()
@@ -0,0 +1,506 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// apiKeyPrefix starts every API key so they're easy to tell apart from JWTs (and to spot in leaks)
+	apiKeyPrefix = "msk_"
+
+	// apiKeyDefaultTTL is how long an API key is valid for unless asked otherwise
+	apiKeyDefaultTTL = 90 * 24 * time.Hour
+
+	// apiKeyMaxTTL is the longest an API key can be valid for
+	apiKeyMaxTTL = 365 * 24 * time.Hour
+
+	// apiKeyTouchInterval is how often an API key's last used time is updated
+	apiKeyTouchInterval = time.Minute
+)
+
+// isAPIKeyRequest returns true if the request is authenticated with an API key rather than a JWT.
+// The JWT middleware skips these requests.
+func isAPIKeyRequest(c *fiber.Ctx) bool {
+	return strings.HasPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "+apiKeyPrefix)
+}
+
+// apiKey returns the API key the request is authenticated with, or nil for JWTs
+func apiKey(c *fiber.Ctx) *database.APIKey {
+	key, _ := c.Locals("apiKey").(*database.APIKey)
+	return key
+}
+
+// loadAPIKey resolves an API key and the session it acts as, and stores them in c.Locals("apiKey") and c.Locals("session").
+// It is installed right after the JWT middleware.
+func (cfg *Config) loadAPIKey(c *fiber.Ctx) error {
+	if !isAPIKeyRequest(c) {
+		return c.Next()
+	}
+
+	// msk_<keyID>_<secret>
+	rawKey := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	keyID, _, _ := strings.Cut(strings.TrimPrefix(rawKey, apiKeyPrefix), "_")
+
+	var key *database.APIKey
+	var err error
+	if keyID != "" {
+		key, err = cfg.db.GetAPIKeyWithContext(c.UserContext(), keyID)
+	}
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadAPIKey::cfg.db.GetAPIKey(keyID)").
+			Msg("unable to get api key from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	now := time.Now()
+	if key == nil || subtle.ConstantTimeCompare([]byte(hashSecret(rawKey)), []byte(key.SecretHash)) != 1 || now.Unix() > key.ExpiresAt {
+		guid := xid.New()
+		log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadAPIKey::key == nil").
+			Str("keyID", keyID).
+			Msg("unknown, revoked or expired api key")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "invalid api key",
+		})
+		return c.Status(fiber.ErrUnauthorized.Code).SendString(string(e))
+	}
+
+	// The key acts as its credentials; it ends with them (eg an admin revoking the account's sessions)
+	session, err := cfg.db.GetUserCredentialsWithContext(c.UserContext(), key.SessionID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadAPIKey::cfg.db.GetUserCredentials(key.SessionID)").
+			Msg("unable to get session from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if session == nil || now.Unix() > session.ExpiresAt {
+		guid := xid.New()
+		log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadAPIKey::session == nil").
+			Str("keyID", keyID).
+			Msg("api key's session revoked or expired")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "the api key's credentials have been revoked. please login again and mint a new key",
+		})
+		return c.Status(fiber.ErrUnauthorized.Code).SendString(string(e))
+	}
+
+	// Record the last use, but not on every request
+	if now.Sub(time.Unix(key.LastUsedAt, 0)) >= apiKeyTouchInterval {
+		key.LastUsedAt = now.Unix()
+		if err := cfg.db.TouchAPIKeyWithContext(c.UserContext(), key.KeyID, key.LastUsedAt); err != nil {
+			cfg.log.Warn().
+				Err(err).
+				Str("function", "loadAPIKey::cfg.db.TouchAPIKey()").
+				Str("keyID", keyID).
+				Msg("unable to record api key use")
+		}
+	}
+
+	c.Locals("apiKey", key)
+	c.Locals("session", session)
+	return c.Next()
+}
+
+// requireJWT is the middleware for routes API keys can't use (eg logging out or minting keys)
+func (cfg *Config) requireJWT(c *fiber.Ctx) error {
+	if apiKey(c) == nil {
+		return c.Next()
+	}
+	guid := xid.New()
+	cfg.log.Error().
+		Str("method", c.Method()).
+		Str("originalURL", c.OriginalURL()).
+		Str("errRef", guid.String()).
+		Str("function", "requireJWT").
+		Msg("route not available with an api key")
+	e, _ := json.Marshal(&GeneralRestError{
+		ErrorInstanceID: guid.String(),
+		ErrorMessage:    "not available with an api key. use a login session",
+	})
+	return c.Status(fiber.ErrForbidden.Code).SendString(string(e))
+}
+
+// apiListKeys is the handler for GET /api/keys. It lists the identity's API keys.
+func (cfg *Config) apiListKeys(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+	if session.IdentityID == "" {
+		return c.JSON(fiber.Map{"keys": []*APIKeyView{}})
+	}
+
+	keys, err := cfg.db.ListAPIKeysWithContext(c.UserContext(), session.IdentityID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiListKeys::cfg.db.ListAPIKeys()").
+			Msg("unable to get api keys from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	now := time.Now().Unix()
+	views := make([]*APIKeyView, 0, len(keys))
+	for _, key := range keys {
+		// DynamoDB TTL deletion is lazy
+		if now > key.ExpiresAt {
+			continue
+		}
+		views = append(views, newAPIKeyView(key))
+	}
+	return c.JSON(fiber.Map{"keys": views})
+}
+
+// apiCreateKey is the handler for POST /api/keys. It mints an API key acting as the current session's account.
+func (cfg *Config) apiCreateKey(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+	if session.IdentityID == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiCreateKey::session.IdentityID == ''").
+			Msg("session has no identity")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "session predates linked accounts. please login again",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiCreateKey::c.FormValue('name')").
+			Msg("missing 'name' form value")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing 'name' form value",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// Keys get the session's scopes, or fewer
+	scopes := session.Scopes
+	if requested := parseScopes(c.FormValue("scope")); len(requested) > 0 {
+		if len(session.Scopes) > 0 {
+			if missing := missingScopes(session.Scopes, requested); len(missing) > 0 {
+				guid := xid.New()
+				cfg.log.Error().
+					Str("method", c.Method()).
+					Str("originalURL", c.OriginalURL()).
+					Str("errRef", guid.String()).
+					Str("function", "apiCreateKey::missingScopes()").
+					Strs("missingScopes", missing).
+					Msg("api key scopes not granted to the session")
+				e, _ := json.Marshal(&GeneralRestError{
+					ErrorInstanceID: guid.String(),
+					ErrorMessage:    "scopes not granted to the session: " + strings.Join(missing, " "),
+				})
+				return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+			}
+		}
+		scopes = requested
+	}
+
+	ttl := apiKeyDefaultTTL
+	if rawDays := c.FormValue("expires_in_days"); rawDays != "" {
+		days, err := strconv.Atoi(rawDays)
+		if err != nil || days < 1 || time.Duration(days)*24*time.Hour > apiKeyMaxTTL {
+			guid := xid.New()
+			cfg.log.Error().
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "apiCreateKey::c.FormValue('expires_in_days')").
+				Str("expiresInDays", rawDays).
+				Msg("invalid expires_in_days")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "'expires_in_days' must be between 1 and " + strconv.Itoa(int(apiKeyMaxTTL.Hours()/24)),
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		ttl = time.Duration(days) * 24 * time.Hour
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiCreateKey::randomString(32)").
+			Msg("failed getting random bytes for api key")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	credentialsID, err := randomString(32)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiCreateKey::randomString(32)").
+			Msg("failed getting random bytes for api key credentials")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	now := time.Now()
+	keyID := xid.New().String()
+	rawKey := apiKeyPrefix + keyID + "_" + secret
+	key := &database.APIKey{
+		KeyID:      keyID,
+		SecretHash: hashSecret(rawKey),
+		Name:       name,
+		IdentityID: session.IdentityID,
+		SessionID:  credentialsID,
+		AccountURL: session.AccountURL,
+		Scopes:     scopes,
+		CreatedAt:  now.Unix(),
+		ExpiresAt:  now.Add(ttl).Unix(),
+	}
+
+	// The key gets its own copy of the session's credentials, lasting as long as the key.
+	// Logging out of the session (or it expiring) leaves the key working.
+	credentials := *session
+	credentials.SessionID = credentialsID
+	credentials.KeyID = keyID
+	credentials.CreatedAt = key.CreatedAt
+	credentials.ExpiresAt = key.ExpiresAt
+	if err := cfg.db.PutUserCredentialsWithContext(c.UserContext(), &credentials); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiCreateKey::cfg.db.PutUserCredentials()").
+			Msg("unable to save api key credentials")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	if err := cfg.db.PutAPIKeyWithContext(c.UserContext(), key); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiCreateKey::cfg.db.PutAPIKey()").
+			Msg("unable to save api key")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	cfg.log.Info().
+		Str("keyID", keyID).
+		Str("accountURL", session.AccountURL).
+		Strs("scopes", scopes).
+		Time("expiresAt", time.Unix(key.ExpiresAt, 0)).
+		Msg("minted api key")
+
+	// The key is only shown now
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	view := newAPIKeyView(key)
+	view.Key = rawKey
+	return c.Status(fiber.StatusCreated).JSON(view)
+}
+
+// apiRevokeKey is the handler for DELETE /api/keys/:keyID
+func (cfg *Config) apiRevokeKey(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+	keyID := c.Params("keyID")
+
+	key, err := cfg.db.GetAPIKeyWithContext(c.UserContext(), keyID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiRevokeKey::cfg.db.GetAPIKey(keyID)").
+			Msg("unable to get api key from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if key == nil || session.IdentityID == "" || key.IdentityID != session.IdentityID {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiRevokeKey::key == nil").
+			Str("keyID", keyID).
+			Msg("api key not found")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "api key not found",
+		})
+		return c.Status(fiber.ErrNotFound.Code).SendString(string(e))
+	}
+
+	// Remove the key's credentials too. Older keys act as a login session, which is left alone.
+	credentials, err := cfg.db.GetUserCredentialsWithContext(c.UserContext(), key.SessionID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiRevokeKey::cfg.db.GetUserCredentials(key.SessionID)").
+			Msg("unable to get api key credentials from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if credentials != nil && credentials.KeyID == key.KeyID {
+		if err := cfg.db.DeleteUserCredentialsWithContext(c.UserContext(), credentials.SessionID); err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "apiRevokeKey::cfg.db.DeleteUserCredentials()").
+				Msg("unable to delete api key credentials")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+			})
+			return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		}
+	}
+
+	if err := cfg.db.DeleteAPIKeyWithContext(c.UserContext(), keyID); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiRevokeKey::cfg.db.DeleteAPIKey()").
+			Msg("unable to delete api key")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	return c.JSON(fiber.Map{"revoked": true, "key_id": keyID})
+}
+
+// apiKeyCredentials returns the credentials of the identity's API keys that hold the session's Mastodon access token
+func (cfg *Config) apiKeyCredentials(ctx context.Context, session *database.UserCredentials) ([]*database.UserCredentials, error) {
+	if session.IdentityID == "" {
+		return nil, nil
+	}
+
+	keys, err := cfg.db.ListAPIKeysWithContext(ctx, session.IdentityID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	holders := []*database.UserCredentials{}
+	for _, key := range keys {
+		if now > key.ExpiresAt || key.SessionID == session.SessionID {
+			continue
+		}
+		credentials, err := cfg.db.GetUserCredentialsWithContext(ctx, key.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if credentials != nil && credentials.KeyID == key.KeyID && credentials.AccessToken == session.AccessToken {
+			holders = append(holders, credentials)
+		}
+	}
+	return holders, nil
+}
+
+// newAPIKeyView returns the API view of an API key
+func newAPIKeyView(key *database.APIKey) *APIKeyView {
+	return &APIKeyView{
+		KeyID:      key.KeyID,
+		Name:       key.Name,
+		AccountURL: key.AccountURL,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		LastUsedAt: key.LastUsedAt,
+		ExpiresAt:  key.ExpiresAt,
+	}
+}
@@ -0,0 +1,33 @@
+package app
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+)
+
+func TestNewAPIKeyView(t *testing.T) {
+	key := &database.APIKey{
+		KeyID:      "abc",
+		SecretHash: "hash-of-the-key",
+		Name:       "batch",
+		IdentityID: "identity",
+		SessionID:  "credentials-of-the-key",
+		AccountURL: "https://a.example/@alice",
+		Scopes:     []string{"read:lists"},
+	}
+	b, err := json.Marshal(newAPIKeyView(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret_hash", "hash-of-the-key", "session_id", "credentials-of-the-key", "identity"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("view %s exposes %q", b, secret)
+		}
+	}
+	if !strings.Contains(string(b), `"key_id":"abc"`) {
+		t.Errorf("view %s lacks the key ID", b)
+	}
+}
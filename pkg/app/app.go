@@ -6,20 +6,19 @@ package app
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
-	"errors"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	fiberadapter "github.com/awslabs/aws-lambda-go-api-proxy/fiber"
 	"github.com/gofiber/fiber/v2"
 	jwtware "github.com/gofiber/jwt/v3"
 	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rmrfslashbin/mastostart/pkg/ratelimit"
 	"github.com/rs/xid"
 	"github.com/rs/zerolog"
-	"github.com/rs/zerolog/log"
 )
 
 // Options for the app instance
@@ -30,7 +29,20 @@ type Config struct {
 	log         *zerolog.Logger
 	fiberLambda *fiberadapter.FiberLambda
 	app         *fiber.App
-	db          *database.DDB
+	db          database.Store
+	limiter     ratelimit.Limiter
+	timeouts    Timeouts
+	invocations sync.Map
+	keyring     *keyring
+	keyringMu   sync.Mutex
+	settings    *Settings
+	settingsMu  sync.Mutex
+
+	// registrationCap caps the app registrations on new instances across all clients; zero Requests for none
+	registrationCap *ratelimit.Limit
+
+	shareAccounts   map[string]*shareAccount
+	shareAccountsMu sync.Mutex
 }
 
 // New creates a new mastoclinet instance
@@ -54,6 +66,19 @@ func New(opts ...Option) (*Config, error) {
 		return nil, &NoDB{}
 	}
 
+	// Bound the requests unless told otherwise
+	if cfg.timeouts == (Timeouts{}) {
+		cfg.timeouts = DefaultTimeouts
+	}
+
+	// Count requests in the database unless another limiter is provided
+	if cfg.limiter == nil {
+		cfg.limiter = ratelimit.NewStore(cfg.db)
+	}
+	if cfg.registrationCap == nil {
+		cfg.registrationCap = &ratelimit.Limit{Requests: DefaultRegistrationCap, Window: time.Hour}
+	}
+
 	// Set up Fiber
 	cfg.app = fiber.New()
 	cfg.appSetup()
@@ -62,13 +87,36 @@ func New(opts ...Option) (*Config, error) {
 	return cfg, nil
 }
 
-// WithDB sets the database for the app instance
-func WithDB(db *database.DDB) Option {
+// WithDB sets the database for the app instance: DynamoDB (database.New),
+// a bbolt file (database.NewBolt) or memory (database.NewMemory)
+func WithDB(db database.Store) Option {
 	return func(cfg *Config) {
 		cfg.db = db
 	}
 }
 
+// WithLimiter sets the rate limiter for the app instance
+func WithLimiter(limiter ratelimit.Limiter) Option {
+	return func(cfg *Config) {
+		cfg.limiter = limiter
+	}
+}
+
+// WithRegistrationCap sets how many apps may be registered on new instances an hour, across all clients.
+// Each client IP is limited on its own too; 0 turns the overall cap off.
+func WithRegistrationCap(requests int) Option {
+	return func(cfg *Config) {
+		cfg.registrationCap = &ratelimit.Limit{Requests: requests, Window: time.Hour}
+	}
+}
+
+// WithTimeouts sets the timeouts of the requests and of the calls to the instances
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(cfg *Config) {
+		cfg.timeouts = timeouts
+	}
+}
+
 // WithLogger sets the logger for the app instance
 func WithLogger(log *zerolog.Logger) Option {
 	return func(cfg *Config) {
@@ -78,89 +126,134 @@ func WithLogger(log *zerolog.Logger) Option {
 
 // appSetup sets up the Fiber app
 func (cfg *Config) appSetup() error {
+	// Every request gets a context the database and Mastodon calls are bound by
+	cfg.app.Use(cfg.requestContext)
+
+	// Security headers and CORS apply to every response, including preflights and errors
+	cfg.app.Use(securityHeaders)
+	cfg.app.Use(cfg.cors)
+
 	// Set up the "/" route
 	cfg.app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Hello, World!")
 	})
 
-	// Add non-auth routes
-	cfg.app.Get("/auth/callback", cfg.authCallback)
-	cfg.app.Get("/auth/login", cfg.authLogin)
+	// Add non-auth routes. They're rate limited per client IP.
+	cfg.app.Get("/auth/callback", cfg.limitByIP, cfg.authCallback)
+	cfg.app.Get("/auth/login", cfg.limitByIP, cfg.authLogin)
+	cfg.app.Post("/auth/exchange", cfg.limitByIP, cfg.authExchange)
+
+	// Device flow (RFC 8628) routes
+	cfg.app.Post("/auth/device", cfg.limitByIP, cfg.authDevice)
+	cfg.app.Get("/auth/device/verify", cfg.limitByIP, cfg.authDeviceVerifyForm)
+	cfg.app.Post("/auth/device/verify", cfg.limitByIP, cfg.authDeviceVerify)
+	cfg.app.Post("/auth/device/token", cfg.limitByIP, cfg.authDeviceToken)
+
+	// Publish the JWT verification keys
+	cfg.app.Get("/.well-known/jwks.json", cfg.wellKnownJWKS)
+
+	// OpenID Connect provider routes
+	cfg.app.Get("/.well-known/openid-configuration", cfg.oidcDiscovery)
+	cfg.app.Get("/oidc/authorize", cfg.limitByIP, cfg.oidcAuthorize)
+	cfg.app.Post("/oidc/token", cfg.limitByIP, cfg.oidcToken)
+
+	// Userinfo takes the access tokens /oidc/token issues, not session JWTs
+	cfg.app.Get(userinfoPath, cfg.limitByIP, cfg.loadOIDCAccessToken, cfg.oidcUserinfo)
+	cfg.app.Post(userinfoPath, cfg.limitByIP, cfg.loadOIDCAccessToken, cfg.oidcUserinfo)
+
+	// Shared saved lists are for people without an account here yet
+	cfg.app.Get("/share/lists/:instance/:owner/:listID", cfg.limitByIP, cfg.shareList)
 
 	// Install JWT Middleware
-	// All following routes require a valid JWT
-	if privateKey, err := cfg.getRSAPrivateKey(); err != nil {
-		return err
-	} else {
-		cfg.app.Use(jwtware.New(jwtware.Config{
-			SigningMethod: "RS256",
-			SigningKey:    privateKey.Public(),
-		}))
-	}
+	// All following routes require a valid JWT, from the Authorization header or the session cookie, or an API key.
+	// It's set up per request so loading the signing keys uses the request's context.
+	cfg.app.Use(func(c *fiber.Ctx) error {
+		return jwtware.New(jwtware.Config{
+			Filter:         isAPIKeyRequest,
+			TokenLookup:    "header:" + fiber.HeaderAuthorization + ",cookie:" + sessionCookieName,
+			AuthScheme:     "Bearer",
+			KeyFunc:        cfg.jwtKeyFunc(c.UserContext()),
+			SuccessHandler: cfg.loadSession,
+		})(c)
+	})
+	cfg.app.Use(cfg.loadAPIKey)
+
+	// Cookie sessions need a CSRF token to change anything
+	cfg.app.Use(cfg.checkCSRF)
+
+	// Requests can act as any account linked to the session's identity
+	cfg.app.Use(cfg.loadTargetAccount)
 
 	// Add auth routes
-	cfg.app.Get("/auth/verify", cfg.authVerify)
+	cfg.app.Get("/auth/verify", cfg.requireScopes("read:accounts", "read:statuses"), cfg.authVerify)
+	cfg.app.Post("/auth/logout", cfg.requireJWT, cfg.authLogout)
+	cfg.app.Get("/auth/upgrade", cfg.requireJWT, cfg.authUpgrade)
+
+	// Linked account routes
+	cfg.app.Get("/api/accounts", cfg.requireScopes("read:accounts"), cfg.apiAccounts)
+	cfg.app.Post("/api/accounts", cfg.requireJWT, cfg.apiLinkAccount)
+	cfg.app.Delete("/api/accounts", cfg.requireJWT, cfg.apiUnlinkAccount)
+
+	// API key routes
+	cfg.app.Get("/api/keys", cfg.requireJWT, cfg.apiListKeys)
+	cfg.app.Post("/api/keys", cfg.requireJWT, cfg.apiCreateKey)
+	cfg.app.Delete("/api/keys/:keyID", cfg.requireJWT, cfg.apiRevokeKey)
 
 	// List routes
-	cfg.app.Get("/api/lists", cfg.apiMyLists)
-	cfg.app.Get("/api/lists/:listID", cfg.apiAccountsInList)
+	cfg.app.Get("/api/lists", cfg.requireScopes("read:lists"), cfg.apiMyLists)
+	cfg.app.Get("/api/lists/:listID", cfg.requireScopes("read:lists"), cfg.apiAccountsInList)
+	cfg.app.Post("/api/lists/:listID", cfg.requireScopes("read:lists"), cfg.apiAccountsInList)
+
+	// Saved list routes. Changing or deleting a saved copy takes write:lists.
+	cfg.app.Get("/api/saved-lists", cfg.requireScopes("read:lists"), cfg.apiSavedLists)
+	cfg.app.Get("/api/saved-lists/:listID", cfg.requireScopes("read:lists"), cfg.loadSavedList, cfg.apiGetSavedList)
+	cfg.app.Put("/api/saved-lists/:listID", cfg.requireScopes("write:lists"), cfg.loadSavedList, cfg.apiUpdateSavedList)
+	cfg.app.Delete("/api/saved-lists/:listID", cfg.requireScopes("write:lists"), cfg.loadSavedList, cfg.apiDeleteSavedList)
 
 	// Instance routes
 	cfg.app.Get("/api/instance", cfg.apiInstanceInfo)
 
+	// Admin routes
+	admin := cfg.app.Group("/admin", cfg.requireJWT, cfg.requireAdmin)
+	admin.Get("/config", cfg.adminListConfig)
+	admin.Put("/config/:key", cfg.adminPutConfig)
+	admin.Delete("/config/:key", cfg.adminDeleteConfig)
+	admin.Get("/apps", cfg.adminListApps)
+	admin.Delete("/apps/:instance", cfg.adminDeleteApp)
+	admin.Get("/lists", cfg.adminListLists)
+	admin.Get("/sessions", cfg.adminListSessions)
+	admin.Delete("/sessions", cfg.adminRevokeSessions)
+	admin.Delete("/sessions/:sessionID", cfg.adminRevokeSession)
+
 	return nil
 }
 
-// getRSAPrivateKey gets the RSA private key from the database
-func (cfg *Config) getRSAPrivateKey() (*rsa.PrivateKey, error) {
-	// Get the RSA private key from the database
-	jwtSingingKeyEncoded, err := cfg.db.GetConfig("jwt_signing_key")
-	if err != nil {
-		guid := xid.New()
-		log.Error().
-			Err(err).
-			Str("function", "app::getRSAPrivateKey()::cfg.db.GetConfig('jwt_signing_key')").
-			Str("errRef", guid.String()).
-			Msg("Error getting jwt_signing_key from database")
-		return nil, errors.New(guid.String() + ": Error to getting jwt_signing_key from database")
-	}
-
-	if jwtSingingKeyEncoded == nil {
-		guid := xid.New()
-		log.Error().
-			Str("function", "app::getRSAPrivateKey()::cfg.db.GetConfig('jwt_signing_key')").
-			Str("errRef", guid.String()).
-			Msg("Error get jwt_signing_key from database")
-		return nil, errors.New(guid.String() + ": Error to get jwt_signing_key from database")
-	}
-
-	// Decode the PEM formatted RSA private signing key
-	block, _ := pem.Decode([]byte(jwtSingingKeyEncoded.ConfigValue))
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		guid := xid.New()
-		log.Error().
-			Str("function", "app::getRSAPrivateKey()::pem.Decode([]byte(jwtSingingKeyEncoded.ConfigValue))").
-			Str("errRef", guid.String()).
-			Msg("Unable to decode jwt_signing_key PEM from database")
-		return nil, errors.New(guid.String() + ": Unable to decode jwt_signing_key PEM from database")
+// LambdaHandler is the entry point for the Lambda function
+func (cfg *Config) LambdaHandler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// The adapter doesn't hand the invocation's context to Fiber. Pass it by reference
+	// so requestContext can make the request's context end with the invocation.
+	id := xid.New().String()
+	cfg.invocations.Store(id, ctx)
+	defer cfg.invocations.Delete(id)
+	headers := make(map[string]string, len(req.Headers)+1)
+	for name, value := range req.Headers {
+		if !strings.EqualFold(name, invocationHeader) {
+			headers[name] = value
+		}
 	}
+	headers[invocationHeader] = id
+	req.Headers = headers
 
-	// Parse the PEM encoded RSA private signing key
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		guid := xid.New()
-		log.Error().
-			Err(err).
-			Str("function", "app::getRSAPrivateKey()::x509.ParsePKCS1PrivateKey(block.Bytes)").
-			Str("errRef", guid.String()).
-			Msg("Unable to parse PEM to RSA private key")
-		return nil, errors.New(guid.String() + ": Unable to parse PEM to RSA private key")
-	}
+	return cfg.fiberLambda.ProxyWithContextV2(ctx, req)
+}
 
-	return privateKey, nil
+// Listen serves the app over HTTP on addr (eg ":8080"), for running outside Lambda.
+// It blocks until the server stops.
+func (cfg *Config) Listen(addr string) error {
+	return cfg.app.Listen(addr)
 }
 
-// LambdaHandler is the entry point for the Lambda function
-func (cfg *Config) LambdaHandler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-	return cfg.fiberLambda.ProxyWithContextV2(ctx, req)
+// Shutdown gracefully stops a server started with Listen
+func (cfg *Config) Shutdown() error {
+	return cfg.app.Shutdown()
 }
@@ -0,0 +1,167 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
+	"github.com/rs/xid"
+)
+
+// appCredsVerifyInterval is how often stored app credentials are verified with the instance
+const appCredsVerifyInterval = 24 * time.Hour
+
+// getAppCreds returns app credentials for the instance that are good to login with.
+// The app is registered if it hasn't been yet. It's registered again if the config (app_name,
+// website, redirect_uri or scopes) no longer matches the registration, or if the instance no
+// longer knows the app (eg an admin deleted it). Replaced registrations are archived.
+func (cfg *Config) getAppCreds(ctx context.Context, instanceURL *url.URL) (*database.AppCredentials, error) {
+	appCreds, err := cfg.db.GetAppCredentialsWithContext(ctx, instanceURL.Host)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("errRef", guid.String()).
+			Str("function", "getAppCreds::cfg.db.GetAppCredentials(instanceURL.Host)").
+			Msg("error fetching app creds from ddb")
+		return nil, errors.New(guid.String() + ": error fetching app creds from ddb")
+	}
+
+	// If app creds don't exist, create them. New instances are capped (per client IP, and overall)
+	// so we can't be used to spam app registrations across the fediverse.
+	if appCreds == nil {
+		if err := cfg.checkRegistrationRate(ctx, instanceURL); err != nil {
+			return nil, err
+		}
+		return cfg.createAppCreds(ctx, instanceURL)
+	}
+
+	// Re-register if the config changed since the app was registered
+	reg, err := cfg.getAppRegistration(ctx, instanceURL)
+	if err != nil {
+		return nil, err
+	}
+	if reason := appCredsDrift(appCreds, reg); reason != "" {
+		return cfg.replaceAppCreds(ctx, instanceURL, appCreds, reason)
+	}
+
+	// Verify the registration with the instance now and then
+	if time.Since(time.Unix(appCreds.VerifiedAt, 0)) < appCredsVerifyInterval {
+		return appCreds, nil
+	}
+
+	instanceUrlStr := instanceURL.String()
+	mc, err := mastoclient.New(
+		mastoclient.WithInstance(&instanceUrlStr),
+		mastoclient.WithClientkey(&appCreds.ClientID),
+		mastoclient.WithClientSecret(&appCreds.ClientSecret),
+		mastoclient.WithLogger(cfg.log),
+		mastoclient.WithTimeouts(cfg.timeouts.Mastodon),
+	)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("errRef", guid.String()).
+			Str("function", "getAppCreds::mastoclient.New()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to create mastoclient")
+		return nil, errors.New(guid.String() + ": unable to create mastoclient")
+	}
+	if _, err := mc.VerifyAppCredentialsWithContext(ctx); err != nil {
+		var invalid *mastoclient.InvalidClientError
+		if errors.As(err, &invalid) {
+			return cfg.replaceAppCreds(ctx, instanceURL, appCreds, "client credentials rejected by the instance")
+		}
+
+		// Can't tell if the app is still registered; keep using it and check again on the next login
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "getAppCreds::mc.VerifyAppCredentials()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to verify app credentials; using the stored credentials")
+		return appCreds, nil
+	}
+
+	appCreds.VerifiedAt = time.Now().Unix()
+	if err := cfg.db.PutAppCredentialsWithContext(ctx, appCreds); err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "getAppCreds::cfg.db.PutAppCredentials(appCreds)").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to save app credentials verification time")
+	}
+	return appCreds, nil
+}
+
+// appCredsDrift compares stored app credentials with the registration the config asks for.
+// Returns why the app must be registered again, or an empty string if it doesn't.
+func appCredsDrift(appCreds *database.AppCredentials, reg *appRegistration) string {
+	if appCreds.Name != reg.name {
+		return "app_name changed"
+	}
+	if appCreds.Website != reg.website {
+		return "website changed"
+	}
+	if appCreds.RedirectURI != reg.redirectURI {
+		return "redirect_uri changed"
+	}
+
+	// Apps registered before scopes were stored can't be compared
+	if len(appCreds.Scopes) == 0 {
+		return ""
+	}
+	scopes := reg.scopes
+	if quirks, ok := supportedSoftware[appCreds.Software]; ok {
+		scopes = quirks.adaptScopes(scopes)
+	}
+	registered := append([]string{}, appCreds.Scopes...)
+	wanted := append([]string{}, scopes...)
+	sort.Strings(registered)
+	sort.Strings(wanted)
+	if strings.Join(registered, " ") != strings.Join(wanted, " ") {
+		return "scopes changed"
+	}
+	return ""
+}
+
+// replaceAppCreds registers the app with the instance again, archiving the old registration.
+// Registering again counts against the same caps as a new instance, plus a cap per instance,
+// so logins can't make us churn app registrations on an instance.
+func (cfg *Config) replaceAppCreds(ctx context.Context, instanceURL *url.URL, old *database.AppCredentials, reason string) (*database.AppCredentials, error) {
+	if err := cfg.checkReregistrationRate(ctx, instanceURL); err != nil {
+		return nil, err
+	}
+	if err := cfg.checkRegistrationRate(ctx, instanceURL); err != nil {
+		return nil, err
+	}
+
+	cfg.log.Info().
+		Str("function", "replaceAppCreds").
+		Str("instanceURL", instanceURL.Host).
+		Str("clientID", old.ClientID).
+		Str("reason", reason).
+		Msg("registering app again")
+
+	// Archive first; the new registration overwrites the stored credentials
+	if err := cfg.db.PutArchivedAppCredentialsWithContext(ctx, &database.ArchivedAppCredentials{
+		AppCredentials: *old,
+		ArchivedAt:     time.Now().UnixNano(),
+		Reason:         reason,
+	}); err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("errRef", guid.String()).
+			Str("function", "replaceAppCreds::cfg.db.PutArchivedAppCredentials()").
+			Msg("error archiving app creds in ddb")
+		return nil, errors.New(guid.String() + ": error archiving app creds in ddb")
+	}
+
+	return cfg.createAppCreds(ctx, instanceURL)
+}
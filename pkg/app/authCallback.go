@@ -1,13 +1,13 @@
 package app
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
 	"github.com/rs/xid"
 	"github.com/rs/zerolog/log"
@@ -15,6 +15,39 @@ import (
 
 // authCallback is the handler for the /auth/callback endpoint
 func (cfg *Config) authCallback(c *fiber.Ctx) error {
+	// The user declined (or the instance refused) the authorization.
+	// OpenID Connect clients are told; anyone else gets an error.
+	if c.Query("error") != "" {
+		if attempt, err := cfg.db.ConsumeLoginAttemptWithContext(c.UserContext(), c.Query("state")); err == nil && attempt != nil {
+			if attempt.OIDC != nil {
+				return oidcRedirectError(c, attempt.OIDC.RedirectURI, attempt.OIDC.State, "access_denied", c.Query("error_description", "the user denied the request"))
+			}
+			if attempt.DeviceCode != "" {
+				if err := cfg.denyDevice(c.UserContext(), attempt.DeviceCode); err != nil {
+					log.Error().
+						Err(err).
+						Str("function", "authCallback::cfg.denyDevice()").
+						Msg("unable to deny device authorization")
+				}
+				c.Type("html", "utf-8")
+				return deviceResultPage.Execute(c.Response().BodyWriter(), "The device was not signed in.")
+			}
+		}
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authCallback::c.Query('error')").
+			Str("error", c.Query("error")).
+			Msg("authorization was not granted")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "authorization was not granted: " + c.Query("error"),
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
 	// Fetch the code query param
 	code := c.Query("code")
 	if code == "" {
@@ -66,18 +99,47 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 		})
 		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
 	}
+	instanceURL = normalizeInstanceURL(instanceURL)
 
-	// Get the app name
-	appNameConfig, err := cfg.db.GetConfig("app_name")
+	// Fetch the state query param
+	state := c.Query("state")
+	if state == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authCallback::c.Query('state')").
+			Msg("missing 'state' query param")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing 'state' query param",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// The state cookie is single use as well
+	stateCookie := c.Cookies(stateCookieName(state))
+	c.Cookie(&fiber.Cookie{
+		Name:     stateCookieName(state),
+		Path:     "/auth/callback",
+		Expires:  time.Unix(0, 0),
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	// Consume the login attempt; a state can only be used once
+	attempt, err := cfg.db.ConsumeLoginAttemptWithContext(c.UserContext(), state)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
 			Err(err).
 			Str("method", c.Method()).
 			Str("originalURL", c.OriginalURL()).
-			Str("function", "authCallback::cfg.db.GetConfig('app_name')").
 			Str("errRef", guid.String()).
-			Msg("Unable get app_name from database")
+			Str("function", "authCallback::cfg.db.ConsumeLoginAttempt(state)").
+			Msg("unable to get login attempt from database")
 		e, _ := json.Marshal(&GeneralRestError{
 			ErrorInstanceID: guid.String(),
 			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
@@ -85,13 +147,60 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
-	// Set a defailt app name if it's not set
-	appName := strings.TrimSpace(appNameConfig.ConfigValue)
-	if appName == "" {
-		appName = "mastostart"
+	// Unknown or replayed state
+	if attempt == nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authCallback::attempt == nil").
+			Msg("unknown or already used state")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "invalid 'state'. please start the login again",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// DynamoDB TTL deletion is lazy, so check the expiry here too
+	if time.Now().Unix() > attempt.ExpiresAt {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authCallback::attempt.ExpiresAt").
+			Int64("expiresAt", attempt.ExpiresAt).
+			Msg("expired state")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "expired 'state'. please start the login again",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
 	}
 
-	permitted, err := cfg.checkPermitInstanceList(instanceURL)
+	// The state must belong to this instance and to this browser. Without the cookie check, anyone could
+	// finish their own login in a victim's browser (login CSRF), or hand a victim their session.
+	if !strings.EqualFold(attempt.InstanceURL, instanceURL.Host) || stateCookie == "" ||
+		subtle.ConstantTimeCompare([]byte(stateCookie), []byte(state)) != 1 {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authCallback::attempt.InstanceURL").
+			Str("instanceURL", instanceURL.Host).
+			Str("attemptInstanceURL", attempt.InstanceURL).
+			Msg("state does not match this login")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "mismatched 'state'. please start the login again",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	permitted, err := cfg.checkPermitInstanceList(c.UserContext(), instanceURL)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -116,16 +225,16 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 			Str("errRef", guid.String()).
 			Str("function", "authCallback::CheckPermitInstanceList").
 			Str("instanceURL", instanceURL.Host).
-			Msg("instance not in permit list")
+			Msg("instance not permitted")
 		e, _ := json.Marshal(&GeneralRestError{
 			ErrorInstanceID: guid.String(),
-			ErrorMessage:    "instance not in permit list",
+			ErrorMessage:    "instance not permitted",
 		})
 		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
 	}
 
 	// Get the app credentials from the database
-	appCreds, err := cfg.db.GetAppCredentials(instanceURL.Host)
+	appCreds, err := cfg.db.GetAppCredentialsWithContext(c.UserContext(), instanceURL.Host)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -168,6 +277,7 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 		mastoclient.WithClientSecret(&appCreds.ClientSecret),
 		mastoclient.WithInstance(&instanceUrlStr),
 		mastoclient.WithLogger(cfg.log),
+		mastoclient.WithTimeouts(cfg.timeouts.Mastodon),
 	)
 
 	if err != nil {
@@ -190,8 +300,14 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
+	// Send the PKCE code verifier if the login attempt used one
+	var codeVerifier *string
+	if attempt.CodeVerifier != "" {
+		codeVerifier = &attempt.CodeVerifier
+	}
+
 	// Using the OAuth2 code, get the access token
-	accessToken, err := mastodon.GetAuthTokenFromCode(&code, &appCreds.RedirectURI)
+	oauthToken, err := mastodon.GetAuthTokenFromCodeWithContext(c.UserContext(), &code, &appCreds.RedirectURI, codeVerifier)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -211,7 +327,7 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
-	if accessToken == nil {
+	if oauthToken == nil || oauthToken.AccessToken == "" {
 		guid := xid.New()
 		log.Error().
 			Str("method", c.Method()).
@@ -229,9 +345,11 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
+	accessToken := &oauthToken.AccessToken
+
 	// Get the user's profile from Mastodon using their access token
 	mastodon.SetAccessToken(accessToken)
-	me, err := mastodon.Me()
+	me, err := mastodon.MeWithContext(c.UserContext())
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -248,18 +366,69 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
-	// Get RSA private key for signing JWT
-	privateKey, err := cfg.getRSAPrivateKey()
+	// The scopes the user granted; instances that don't report them granted what was asked for
+	scopes := parseScopes(oauthToken.Scope)
+	if len(scopes) == 0 {
+		scopes = parseScopes(attempt.Scope)
+	}
+	if len(scopes) == 0 {
+		scopes = appCreds.Scopes
+	}
+
+	// Upgrades replace the access token of an existing session
+	if attempt.UpgradeSessionID != "" {
+		return cfg.finishUpgrade(c, attempt, appCreds, me, *accessToken, scopes)
+	}
+
+	// Links add the account to an existing identity
+	if attempt.LinkIdentityID != "" {
+		return cfg.finishLink(c, attempt, me, *accessToken, scopes)
+	}
+
+	// Store the session and sign a JWT for it. An OpenID Connect login's session only backs the
+	// tokens issued for it, so it ends with them.
+	ttl := sessionTTL
+	if attempt.OIDC != nil {
+		ttl = oidcSessionTTL
+	}
+	signedJWT, session, err := cfg.issueSession(c.UserContext(), me, instanceURL.Host, *accessToken, scopes, ttl)
 	if err != nil {
-		if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "authCallback::cfg.issueSession()").
+			Str("errRef", guid.String()).
+			Msg("Unable to issue session")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// Device logins hand the JWT to the polling device
+	if attempt.DeviceCode != "" {
+		return cfg.finishDevice(c, attempt, session, signedJWT)
+	}
+
+	// OpenID Connect logins go back to the client with an authorization code
+	if attempt.OIDC != nil {
+		return cfg.oidcFinishAuthorize(c, attempt.OIDC, session, me)
+	}
+
+	// Cookie sessions keep the JWT out of reach of JavaScript
+	if attempt.ResponseMode == "cookie" {
+		if err := cfg.setSessionCookies(c, session, signedJWT); err != nil {
 			guid := xid.New()
 			log.Error().
 				Err(err).
 				Str("method", c.Method()).
 				Str("originalURL", c.OriginalURL()).
-				Str("function", "authCallback::cfg.getRSAPrivateKey()").
+				Str("function", "authCallback::cfg.setSessionCookies()").
 				Str("errRef", guid.String()).
-				Msg("Unable fetch RSA private key")
+				Msg("Unable to set session cookies")
 			e, _ := json.Marshal(&GeneralRestError{
 				ErrorInstanceID: guid.String(),
 				ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
@@ -268,37 +437,19 @@ func (cfg *Config) authCallback(c *fiber.Ctx) error {
 		}
 	}
 
-	// Create the JWT claims
-	claims := JWTClaims{
-		*accessToken, // Encode the user's Mastodon access token
-		jwt.RegisteredClaims{
-			// A usual scenario is to set the expiration time relative to the current time
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)), // 1 week
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    appName,
-			Subject:   me.URL,        // Fully qualified URL representing the user
-			ID:        string(me.ID), // Mastodon (numeric) user ID
-		},
+	// Browser logins go back to the frontend
+	if attempt.ReturnTo != "" {
+		return cfg.returnToFrontend(c, attempt, session, signedJWT)
 	}
 
-	// Create the JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	signedJWT, err := token.SignedString(privateKey)
-	if err != nil {
-		guid := xid.New()
-		log.Error().
-			Err(err).
-			Str("method", c.Method()).
-			Str("originalURL", c.OriginalURL()).
-			Str("function", "authCallback::token.SignedString(privateKey)").
-			Str("errRef", guid.String()).
-			Msg("Unable to sign JWT with RSA private key")
-		e, _ := json.Marshal(&GeneralRestError{
-			ErrorInstanceID: guid.String(),
-			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
-		})
-		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	if attempt.ResponseMode == "cookie" {
+		return c.JSON(
+			fiber.Map{
+				"type":        "Cookie",
+				"csrf_cookie": csrfCookieName,
+				"csrf_header": csrfHeaderName,
+			},
+		)
 	}
 
 	// Return the signed JWT
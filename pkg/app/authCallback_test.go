@@ -0,0 +1,74 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestAuthCallbackStateCookie(t *testing.T) {
+	tests := []struct {
+		name    string
+		cookies map[string]string
+		want    string
+	}{
+		{"its own cookie", map[string]string{stateCookieName("state-a"): "state-a"}, "instance not permitted"},
+		{"two logins in one browser", map[string]string{
+			stateCookieName("state-a"): "state-a",
+			stateCookieName("state-b"): "state-b",
+		}, "instance not permitted"},
+		{"no cookie", nil, "mismatched 'state'. please start the login again"},
+		{"another login's cookie", map[string]string{stateCookieName("state-b"): "state-b"}, "mismatched 'state'. please start the login again"},
+		{"wrong value", map[string]string{stateCookieName("state-a"): "state-b"}, "mismatched 'state'. please start the login again"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := database.NewMemory()
+			// Past the state check the instance is denied, so the callback stops before talking to it
+			db.PutConfig(&database.ConfigItem{ConfigKey: "deny_instances", ConfigValue: "a.example"})
+			for _, state := range []string{"state-a", "state-b"} {
+				db.PutLoginAttempt(&database.LoginAttempt{
+					State:       state,
+					InstanceURL: "a.example",
+					ExpiresAt:   time.Now().Add(loginAttemptTTL).Unix(),
+				})
+			}
+			log := zerolog.Nop()
+			cfg, err := New(WithDB(db), WithLogger(&log))
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			app := fiber.New()
+			app.Get("/auth/callback", cfg.authCallback)
+
+			req := httptest.NewRequest(fiber.MethodGet, "/auth/callback?code=code&instance_url=https://a.example&state=state-a", nil)
+			for name, value := range tt.cookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test: %v", err)
+			}
+			body := &GeneralRestError{}
+			json.NewDecoder(resp.Body).Decode(body)
+			if body.ErrorMessage != tt.want {
+				t.Errorf("error = %q, want %q", body.ErrorMessage, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateCookieName(t *testing.T) {
+	if stateCookieName("state-a") == stateCookieName("state-b") {
+		t.Error("two states share a cookie")
+	}
+	if stateCookieName("state-a") != stateCookieName("state-a") {
+		t.Error("a state's cookie name isn't stable")
+	}
+}
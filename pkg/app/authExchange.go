@@ -0,0 +1,193 @@
+package app
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// exchangeCodeTTL is how long a return_to exchange code can be exchanged for a JWT
+const exchangeCodeTTL = time.Minute
+
+// returnToFrontend redirects the browser to the login attempt's return_to URL.
+// The JWT goes in the fragment (never sent to servers), is swapped for a one-time
+// code the frontend exchanges with POST /auth/exchange, or was set as a cookie.
+func (cfg *Config) returnToFrontend(c *fiber.Ctx, attempt *database.LoginAttempt, session *database.UserCredentials, signedJWT string) error {
+	returnTo, err := url.Parse(attempt.ReturnTo)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "returnToFrontend::url.Parse(attempt.ReturnTo)").
+			Msg("unable to parse return_to")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// The session cookie is already set
+	if attempt.ResponseMode == "cookie" {
+		return c.Redirect(returnTo.String(), fiber.StatusFound)
+	}
+
+	if attempt.ResponseMode != "code" {
+		returnTo.Fragment = url.Values{
+			"token": {signedJWT},
+			"type":  {"Bearer"},
+		}.Encode()
+		return c.Redirect(returnTo.String(), fiber.StatusFound)
+	}
+
+	code, err := randomString(32)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "returnToFrontend::randomString(32)").
+			Msg("failed getting random bytes for exchange code")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// The JWT waits in the database until the frontend exchanges the code, so it is stored encrypted
+	encryptedJWT, err := cfg.encryptToken(c.UserContext(), signedJWT)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "returnToFrontend::cfg.encryptToken()").
+			Msg("unable to encrypt exchange code token")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	now := time.Now()
+	if err := cfg.db.PutAuthCodeWithContext(c.UserContext(), &database.AuthCode{
+		Code:        hashSecret(code),
+		RedirectURI: attempt.ReturnTo,
+		SessionID:   session.SessionID,
+		Token:       encryptedJWT,
+		Subject:     session.AccountURL,
+		AuthTime:    now.Unix(),
+		ExpiresAt:   now.Add(exchangeCodeTTL).Unix(),
+	}); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "returnToFrontend::cfg.db.PutAuthCode()").
+			Msg("unable to save exchange code")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	query := returnTo.Query()
+	query.Set("code", code)
+	returnTo.RawQuery = query.Encode()
+	return c.Redirect(returnTo.String(), fiber.StatusFound)
+}
+
+// authExchange is the handler for the /auth/exchange endpoint
+func (cfg *Config) authExchange(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	code := c.FormValue("code")
+	if code == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authExchange::c.FormValue('code')").
+			Msg("missing 'code' form value")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing 'code' form value",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// Codes are single use. OpenID Connect codes belong to /oidc/token and are left for it.
+	authCode, err := cfg.db.ConsumeAuthCodeWithContext(c.UserContext(), hashSecret(code), "")
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authExchange::cfg.db.ConsumeAuthCode()").
+			Msg("unable to get exchange code from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	if authCode == nil || time.Now().Unix() > authCode.ExpiresAt {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authExchange::authCode == nil").
+			Msg("unknown, used or expired exchange code")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "unknown, used or expired 'code'",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	signedJWT, err := cfg.decryptToken(c.UserContext(), authCode.Token)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authExchange::cfg.decryptToken()").
+			Msg("unable to decrypt exchange code token")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	return c.JSON(
+		fiber.Map{
+			"token": signedJWT,
+			"type":  "Bearer",
+		},
+	)
+}
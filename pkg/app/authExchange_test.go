@@ -0,0 +1,80 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestAuthExchange(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	db := database.NewMemory()
+	db.PutConfig(&database.ConfigItem{ConfigKey: "token_encryption_key", ConfigValue: base64.StdEncoding.EncodeToString(key)})
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(db), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	app := fiber.New()
+	app.Get("/callback", func(c *fiber.Ctx) error {
+		return cfg.returnToFrontend(c,
+			&database.LoginAttempt{ReturnTo: "https://app.example.com/done", ResponseMode: "code"},
+			&database.UserCredentials{SessionID: "session", AccountURL: "https://example.social/@user"},
+			"signed.jwt.value",
+		)
+	})
+	app.Post("/auth/exchange", cfg.authExchange)
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/callback", nil))
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	location, err := url.Parse(resp.Header.Get(fiber.HeaderLocation))
+	if err != nil || location.Query().Get("code") == "" {
+		t.Fatalf("callback redirected to %q, want a code", resp.Header.Get(fiber.HeaderLocation))
+	}
+	code := location.Query().Get("code")
+
+	// The auth-codes table never holds the usable JWT
+	stored, err := db.ConsumeAuthCode(hashSecret(code), "")
+	if err != nil || stored == nil {
+		t.Fatalf("ConsumeAuthCode = %+v, %v", stored, err)
+	}
+	if stored.Token == "signed.jwt.value" || strings.Contains(stored.Token, "jwt") {
+		t.Errorf("exchange code token stored in plaintext: %q", stored.Token)
+	}
+	if err := db.PutAuthCode(stored); err != nil {
+		t.Fatalf("PutAuthCode: %v", err)
+	}
+
+	exchange := func() (int, string) {
+		req := httptest.NewRequest(fiber.MethodPost, "/auth/exchange", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		var body struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Token
+	}
+
+	if status, token := exchange(); status != fiber.StatusOK || token != "signed.jwt.value" {
+		t.Errorf("exchange = %d %q, want 200 and the JWT", status, token)
+	}
+	if status, _ := exchange(); status != fiber.StatusBadRequest {
+		t.Errorf("second exchange = %d, want 400", status)
+	}
+}
@@ -2,7 +2,9 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
 	"net/url"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/rmrfslashbin/mastostart/pkg/database"
@@ -12,7 +14,7 @@ import (
 
 // authLogin is the handler for the /auth/login endpoint
 func (cfg *Config) authLogin(c *fiber.Ctx) error {
-	// get the username from the query params
+	// get the username from the query params; either a local username or a full handle (@user@domain)
 	username := c.Query("username")
 	if username == "" {
 		guid := xid.New()
@@ -29,86 +31,188 @@ func (cfg *Config) authLogin(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
 	}
 
-	// get the instance_url from the query params
-	rawInstanceURL := c.Query("instance_url")
-	if rawInstanceURL == "" {
-		guid := xid.New()
-		cfg.log.Error().
-			Str("method", c.Method()).
-			Str("originalURL", c.OriginalURL()).
-			Str("errRef", guid.String()).
-			Str("function", "authLogin::c.Query('instance_url')").
-			Msg("missing 'instance_url' query param")
-		e, _ := json.Marshal(&GeneralRestError{
-			ErrorInstanceID: guid.String(),
-			ErrorMessage:    "missing 'instance_url' query param",
-		})
-		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
-	}
+	// get the instance_url from the query params, or resolve it from the handle
+	var instanceURL *url.URL
+	if rawInstanceURL := c.Query("instance_url"); rawInstanceURL != "" {
+		// Parse the instance_url
+		var err error
+		instanceURL, err = url.Parse(rawInstanceURL)
+		if err != nil {
+			guid := xid.New()
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authLogin::url.Parse(rawInstanceURL)").
+				Msg("error parsing instance_url")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "unable to parse instance_url",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+	} else {
+		if !strings.Contains(strings.TrimPrefix(username, "@"), "@") {
+			guid := xid.New()
+			cfg.log.Error().
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authLogin::c.Query('instance_url')").
+				Msg("missing 'instance_url' query param")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "missing 'instance_url' query param. use a full handle (@user@domain) as the username or set instance_url",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
 
-	// Parse the instance_url
-	instanceURL, err := url.Parse(rawInstanceURL)
-	if err != nil {
-		guid := xid.New()
-		cfg.log.Error().
-			Err(err).
-			Str("method", c.Method()).
-			Str("originalURL", c.OriginalURL()).
-			Str("errRef", guid.String()).
-			Str("function", "authLogin::url.Parse(rawInstanceURL)").
-			Msg("error parsing instance_url")
-		e, _ := json.Marshal(&GeneralRestError{
-			ErrorInstanceID: guid.String(),
-			ErrorMessage:    "unable to parse instance_url",
-		})
-		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		var err error
+		instanceURL, err = cfg.resolveHandle(c.UserContext(), username)
+		if err != nil {
+			guid := xid.New()
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authLogin::cfg.resolveHandle(username)").
+				Str("username", username).
+				Msg("unable to resolve handle")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "unable to resolve handle to an instance",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
 	}
 
-	permitted, err := cfg.checkPermitInstanceList(instanceURL)
-	if err != nil {
-		guid := xid.New()
-		log.Error().
-			Err(err).
-			Str("method", c.Method()).
-			Str("originalURL", c.OriginalURL()).
-			Str("function", "authLogin::cfg.checkPermitInstanceList(instanceURL)").
-			Str("errRef", guid.String()).
-			Msg("Unable get do permit instance list check")
-		e, _ := json.Marshal(&GeneralRestError{
-			ErrorInstanceID: guid.String(),
-			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
-		})
-		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	// Optionally send the browser back to the frontend after the callback
+	attempt := &database.LoginAttempt{}
+	if rawReturnTo := c.Query("return_to"); rawReturnTo != "" {
+		returnTo, err := cfg.checkReturnTo(c.UserContext(), rawReturnTo)
+		if err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authLogin::cfg.checkReturnTo(rawReturnTo)").
+				Msg("unable to check return_to")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+			})
+			return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		}
+		if returnTo == nil {
+			guid := xid.New()
+			cfg.log.Error().
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authLogin::cfg.checkReturnTo(rawReturnTo)").
+				Str("returnTo", rawReturnTo).
+				Msg("return_to not in allowlist")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "return_to not in allowlist",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+
+		attempt.ReturnTo = returnTo.String()
 	}
 
-	if !*permitted {
+	// How the JWT is handed over: in the return_to fragment, for a one-time code or as an HttpOnly cookie
+	responseMode := c.Query("response_mode", "fragment")
+	if responseMode != "fragment" && responseMode != "code" && responseMode != "cookie" {
 		guid := xid.New()
 		cfg.log.Error().
 			Str("method", c.Method()).
 			Str("originalURL", c.OriginalURL()).
 			Str("errRef", guid.String()).
-			Str("function", "authLogin::CheckPermitInstanceList").
-			Str("instanceURL", instanceURL.Host).
-			Msg("instance not in permit list")
+			Str("function", "authLogin::c.Query('response_mode')").
+			Str("responseMode", responseMode).
+			Msg("invalid response_mode")
 		e, _ := json.Marshal(&GeneralRestError{
 			ErrorInstanceID: guid.String(),
-			ErrorMessage:    "instance not in permit list",
+			ErrorMessage:    "'response_mode' must be 'fragment', 'code' or 'cookie'",
 		})
 		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
 	}
+	if attempt.ReturnTo != "" || responseMode == "cookie" {
+		attempt.ResponseMode = responseMode
+	}
 
-	// Get/Setup App credentials
-	var appCreds *database.AppCredentials
-	appCreds, err = cfg.db.GetAppCredentials(instanceURL.Host)
+	// Optionally request a subset of the app's scopes; more can be granted later with /auth/upgrade
+	attempt.Scope = strings.Join(parseScopes(c.Query("scope")), " ")
+
+	// Start the login against the instance
+	authURI, err := cfg.beginLogin(c.UserContext(), instanceURL, attempt)
 	if err != nil {
+		var limited *RateLimited
+		if errors.As(err, &limited) {
+			return tooManyRequests(c, limited)
+		}
 		guid := xid.New()
-		cfg.log.Error().
+		var notPermitted *InstanceNotPermitted
+		if errors.As(err, &notPermitted) {
+			cfg.log.Error().
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authLogin::cfg.beginLogin()").
+				Str("instanceURL", instanceURL.Host).
+				Msg("instance not permitted")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "instance not permitted",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		var notRegistered *ScopeNotRegistered
+		if errors.As(err, &notRegistered) {
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authLogin::cfg.beginLogin()").
+				Str("instanceURL", instanceURL.Host).
+				Msg("scope not registered")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    notRegistered.Msg,
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		var unsupported *UnsupportedSoftware
+		if errors.As(err, &unsupported) {
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authLogin::cfg.beginLogin()").
+				Str("instanceURL", instanceURL.Host).
+				Msg("unsupported server software")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    unsupported.Msg,
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		log.Error().
 			Err(err).
 			Str("method", c.Method()).
 			Str("originalURL", c.OriginalURL()).
 			Str("errRef", guid.String()).
-			Str("function", "authLogin::cfg.db.GetAppCredentials(instanceURL.Host)").
-			Msg("error fetching app creds from ddb")
+			Str("function", "authLogin::cfg.beginLogin()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to start login")
 		e, _ := json.Marshal(&GeneralRestError{
 			ErrorInstanceID: guid.String(),
 			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
@@ -116,27 +220,14 @@ func (cfg *Config) authLogin(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
-	// If app creds don't exist, create them
-	if appCreds == nil {
-		createdAppCreds, appCredsErr := cfg.createAppCreds(instanceURL)
-		if appCredsErr != nil {
-			guid := xid.New()
-			cfg.log.Error().
-				Err(err).
-				Str("method", c.Method()).
-				Str("originalURL", c.OriginalURL()).
-				Str("errRef", guid.String()).
-				Str("function", "authLogin::cfg.createAppCreds(instanceURL.Host)").
-				Msg("error creating app creds")
-			e, _ := json.Marshal(&GeneralRestError{
-				ErrorInstanceID: guid.String(),
-				ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
-			})
-			return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
-		}
-		appCreds = createdAppCreds
+	// Bind the state to this browser; the callback rejects a mismatched cookie
+	setStateCookie(c, attempt.State)
+
+	// A top level navigation gets the state cookie as a first party cookie, whatever site the frontend is on
+	if c.QueryBool("redirect") {
+		return c.Redirect(authURI.String(), fiber.StatusFound)
 	}
 
-	// Return the signed JWT
-	return c.JSON(fiber.Map{"authuri": appCreds.AuthURI})
+	// Return the authorize URL
+	return c.JSON(fiber.Map{"authuri": authURI.String()})
 }
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// authLogout is the handler for the /auth/logout endpoint.
+// Revoking the Mastodon access token is best effort: if it can't be done (eg the instance is down), the
+// session is still denylisted and deleted here, and the response says mastodon_revoked: false.
+func (cfg *Config) authLogout(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+
+	// API keys minted from the session hold the same Mastodon access token; it's kept while they do.
+	// If that can't be told, the token is kept too.
+	keyCredentials, err := cfg.apiKeyCredentials(c.UserContext(), session)
+	keepToken := err != nil || len(keyCredentials) > 0
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "authLogout::cfg.apiKeyCredentials()").
+			Msg("unable to get api key credentials from database; keeping the mastodon access token")
+	}
+
+	// Revoke the Mastodon access token. A failure here shouldn't keep the
+	// user from logging out of mastostart, so log it and carry on.
+	mastodonRevoked := false
+	if len(keyCredentials) > 0 {
+		cfg.log.Info().
+			Str("function", "authLogout::len(keyCredentials) > 0").
+			Str("instanceURL", session.InstanceURL).
+			Int("apiKeys", len(keyCredentials)).
+			Msg("mastodon access token kept for api keys")
+	} else if !keepToken {
+		mastodonRevoked = cfg.revokeMastodonToken(c, session)
+	}
+
+	// Denylist the JWT until it would have expired anyway
+	tokenID, _ := claims["jti"].(string)
+	expiresAt := session.ExpiresAt
+	if exp, ok := claims["exp"].(float64); ok {
+		expiresAt = int64(exp)
+	}
+	if err := cfg.db.PutRevokedTokenWithContext(c.UserContext(), &database.RevokedToken{
+		TokenID:   tokenID,
+		RevokedAt: time.Now().Unix(),
+		ExpiresAt: expiresAt,
+	}); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authLogout::cfg.db.PutRevokedToken()").
+			Str("tokenID", tokenID).
+			Msg("unable to denylist JWT")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// The revoked token can't be used from the linked account either
+	if !keepToken {
+		if err := cfg.syncLinkedToken(c.UserContext(), session, "", nil); err != nil {
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("function", "authLogout::cfg.syncLinkedToken()").
+				Msg("unable to clear the linked account's access token")
+		}
+	}
+
+	// Remove the session and its stored access token
+	if err := cfg.db.DeleteUserCredentialsWithContext(c.UserContext(), session.SessionID); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authLogout::cfg.db.DeleteUserCredentials()").
+			Msg("unable to delete session")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// Cookie sessions end in the browser too
+	if err := cfg.clearSessionCookies(c); err != nil {
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "authLogout::cfg.clearSessionCookies()").
+			Msg("unable to clear session cookies")
+	}
+
+	return c.JSON(fiber.Map{
+		"logged_out":       true,
+		"mastodon_revoked": mastodonRevoked,
+	})
+}
+
+// revokeMastodonToken revokes the session's Mastodon access token; false if it couldn't be
+func (cfg *Config) revokeMastodonToken(c *fiber.Ctx, session *database.UserCredentials) bool {
+	flight, err := cfg.preflight(
+		&PreflightInput{
+			ctx:     c.UserContext(),
+			session: session,
+		},
+	)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "revokeMastodonToken::cfg.preflight()").
+			Str("instanceURL", session.InstanceURL).
+			Msg("prefilight failed; logging out without revoking the mastodon access token")
+		return false
+	}
+	if err := flight.Client.RevokeTokenWithContext(c.UserContext()); err != nil {
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "revokeMastodonToken::flight.Client.RevokeToken()").
+			Str("instanceURL", session.InstanceURL).
+			Msg("unable to revoke mastodon access token")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattn/go-mastodon"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// authUpgrade is the handler for the /auth/upgrade endpoint.
+// It starts a login granting the session more scopes; the JWT keeps working throughout.
+func (cfg *Config) authUpgrade(c *fiber.Ctx) error {
+	session := c.Locals("session").(*database.UserCredentials)
+
+	// get the additional scopes from the query params
+	requested := parseScopes(c.Query("scope"))
+	if len(requested) == 0 {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authUpgrade::c.Query('scope')").
+			Msg("missing 'scope' query param")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing 'scope' query param",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// Ask for the scopes already granted too; the new access token replaces the old one
+	scopes := append([]string{}, session.Scopes...)
+	for _, scope := range requested {
+		if !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	attempt := &database.LoginAttempt{
+		Scope:            strings.Join(scopes, " "),
+		UpgradeSessionID: session.SessionID,
+	}
+
+	// Optionally send the browser back to the frontend after the callback
+	if rawReturnTo := c.Query("return_to"); rawReturnTo != "" {
+		returnTo, err := cfg.checkReturnTo(c.UserContext(), rawReturnTo)
+		if err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authUpgrade::cfg.checkReturnTo(rawReturnTo)").
+				Msg("unable to check return_to")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+			})
+			return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+		}
+		if returnTo == nil {
+			guid := xid.New()
+			cfg.log.Error().
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authUpgrade::cfg.checkReturnTo(rawReturnTo)").
+				Str("returnTo", rawReturnTo).
+				Msg("return_to not in allowlist")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "return_to not in allowlist",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		attempt.ReturnTo = returnTo.String()
+	}
+
+	// Start the login against the session's instance
+	instanceURL := &url.URL{Scheme: "https", Host: session.InstanceURL}
+	authURI, err := cfg.beginLogin(c.UserContext(), instanceURL, attempt)
+	if err != nil {
+		var limited *RateLimited
+		if errors.As(err, &limited) {
+			return tooManyRequests(c, limited)
+		}
+		guid := xid.New()
+		var notRegistered *ScopeNotRegistered
+		var notPermitted *InstanceNotPermitted
+		if errors.As(err, &notRegistered) || errors.As(err, &notPermitted) {
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authUpgrade::cfg.beginLogin()").
+				Str("instanceURL", instanceURL.Host).
+				Msg("unable to upgrade scopes")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    err.Error(),
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authUpgrade::cfg.beginLogin()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to start login")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// Bind the state to this browser; the callback rejects a mismatched cookie
+	setStateCookie(c, attempt.State)
+
+	// Return the authorize URL
+	return c.JSON(fiber.Map{"authuri": authURI.String()})
+}
+
+// finishUpgrade swaps the access token (and scopes) of the session an upgrade login was started for.
+// The old access token is revoked.
+func (cfg *Config) finishUpgrade(c *fiber.Ctx, attempt *database.LoginAttempt, appCreds *database.AppCredentials, me *mastodon.Account, accessToken string, scopes []string) error {
+	session, err := cfg.db.GetUserCredentialsWithContext(c.UserContext(), attempt.UpgradeSessionID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishUpgrade::cfg.db.GetUserCredentials()").
+			Msg("unable to get session from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if session == nil || time.Now().Unix() > session.ExpiresAt {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishUpgrade::session == nil").
+			Msg("session revoked or expired during upgrade")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "invalid session. please login again",
+		})
+		return c.Status(fiber.ErrUnauthorized.Code).SendString(string(e))
+	}
+
+	// The user must authorize the account the session belongs to
+	if me.URL != session.AccountURL {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishUpgrade::me.URL != session.AccountURL").
+			Str("accountURL", me.URL).
+			Msg("upgrade authorized by a different account")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "authorized with a different account than the session's",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// Keep a client for the old access token so it can be revoked once replaced
+	oldFlight, err := cfg.preflight(&PreflightInput{ctx: c.UserContext(), session: session})
+	if err != nil {
+		oldFlight = nil
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "finishUpgrade::cfg.preflight()").
+			Msg("unable to load the old access token; it won't be revoked")
+	}
+
+	encryptedToken, err := cfg.encryptToken(c.UserContext(), accessToken)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishUpgrade::cfg.encryptToken(accessToken)").
+			Msg("unable to encrypt access token")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// Keep the linked account's copy of the token current
+	if err := cfg.syncLinkedToken(c.UserContext(), session, encryptedToken, scopes); err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "finishUpgrade::cfg.syncLinkedToken()").
+			Msg("unable to update the linked account's access token")
+	}
+
+	// API keys minted from the session hold the old token, which is about to be revoked
+	keyCredentials, err := cfg.apiKeyCredentials(c.UserContext(), session)
+	if err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "finishUpgrade::cfg.apiKeyCredentials()").
+			Msg("unable to get api key credentials; their access token won't be updated")
+	}
+	for _, credentials := range keyCredentials {
+		credentials.AccessToken = encryptedToken
+		if err := cfg.db.PutUserCredentialsWithContext(c.UserContext(), credentials); err != nil {
+			cfg.log.Warn().
+				Err(err).
+				Str("function", "finishUpgrade::cfg.db.PutUserCredentials(credentials)").
+				Str("keyID", credentials.KeyID).
+				Msg("unable to update the api key's access token")
+		}
+	}
+
+	session.AccessToken = encryptedToken
+	session.Scopes = scopes
+	if err := cfg.db.PutUserCredentialsWithContext(c.UserContext(), session); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishUpgrade::cfg.db.PutUserCredentials()").
+			Msg("unable to save session to database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	if oldFlight != nil {
+		if err := oldFlight.Client.RevokeTokenWithContext(c.UserContext()); err != nil {
+			cfg.log.Warn().
+				Err(err).
+				Str("function", "finishUpgrade::oldFlight.Client.RevokeToken()").
+				Str("instanceURL", appCreds.InstanceURL).
+				Msg("unable to revoke the replaced access token")
+		}
+	}
+
+	// Browser upgrades go back to the frontend; the JWT didn't change
+	if attempt.ReturnTo != "" {
+		return c.Redirect(attempt.ReturnTo, fiber.StatusFound)
+	}
+
+	return c.JSON(
+		fiber.Map{
+			"upgraded": true,
+			"scopes":   scopes,
+		},
+	)
+}
@@ -1,54 +1,200 @@
 package app
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"net"
 	"net/url"
+	"path"
 	"strings"
 
 	"github.com/rs/xid"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/idna"
 )
 
-// checkPermitInstanceList checks if the instance is in the permit list
-func (cfg *Config) checkPermitInstanceList(instanceURL *url.URL) (*bool, error) {
+// checkPermitInstanceList checks if the instance may be used to login.
+// The instance must not match the deny_instances list, and must match the permit_instances list if one exists.
+// Both lists are comma-separated patterns; see matchInstancePattern.
+// The host is compared in its normal form (see normalizeHost), and its port is ignored: patterns
+// can't have one, so an instance matches on any port. A host that isn't a valid hostname isn't permitted.
+func (cfg *Config) checkPermitInstanceList(ctx context.Context, instanceURL *url.URL) (*bool, error) {
 	var permitted bool
+	host, ok := normalizeHost(instanceURL.Hostname())
+	if !ok {
+		return &permitted, nil
+	}
 
-	// Get the instance permit list
-	permitInstances, err := cfg.db.GetConfig("permit_instances")
+	// Get the instance lists
+	settings, err := cfg.getSettings(ctx)
 	// Fail if there's an error- this doesn't mean the instance isn't permitted, it means we can't check
 	if err != nil {
 		guid := xid.New()
 		log.Error().
 			Err(err).
-			Str("function", "checkPermitInstanceList::cfg.db.GetConfig('permit_instances')").
+			Str("function", "checkPermitInstanceList::cfg.getSettings()").
 			Str("errRef", guid.String()).
-			Msg("unable get permit_instances from database")
-		return nil, errors.New(guid.String() + ": unable get permit_instances from database")
+			Msg("unable to load settings")
+		return nil, errors.New(guid.String() + ": unable to load settings")
+	}
+
+	// Deny takes precedence over permit
+	if matchInstanceList(settings.DenyInstances, host) {
+		permitted = false
+		return &permitted, nil
 	}
 
 	// Default to permitted
 	permitted = true
 
-	// Check if the instance is in the permit list
-	if permitInstances != nil {
-		// Create a map of the instances in the permit list
-		permitList := make(map[string]struct{})
+	// If there is a permit list, check if the instance is in the list
+	if len(settings.PermitInstances) > 0 {
+		permitted = matchInstanceList(settings.PermitInstances, host)
+	}
+
+	// Instance is on the permit list --or-- no permit list exists, allow all instances
+	return &permitted, nil
+}
 
-		// Normalize the instance name to lowercase and trimp the spaces
-		for _, instance := range strings.Split(permitInstances.ConfigValue, ",") {
-			permitList[strings.ToLower(strings.TrimSpace(instance))] = struct{}{}
+// matchInstanceList reports whether the host matches any pattern of a list
+func matchInstanceList(list []string, host string) bool {
+	for _, pattern := range list {
+		if matchInstancePattern(pattern, host) {
+			return true
 		}
+	}
+	return false
+}
+
+// matchInstancePattern reports whether the host matches an instance pattern:
+//
+//	example.com    exactly example.com
+//	*.example.com  any subdomain of example.com, but not example.com
+//	.example.com   example.com and any of its subdomains
+func matchInstancePattern(pattern string, host string) bool {
+	switch {
+	case pattern == "":
+		return false
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	default:
+		return host == pattern
+	}
+}
+
+// normalizeHost returns a host as it is compared with the instance lists: lower case, without a
+// trailing dot, and with internationalized labels in their ASCII (punycode) form, so
+// "Exämple.social." and "xn--exmple-cua.social" are the same instance.
+// ok is false if the host isn't a valid hostname.
+func normalizeHost(host string) (string, bool) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil || !validHost(ascii) {
+		return "", false
+	}
+	return ascii, true
+}
+
+// normalizeInstanceURL returns the https origin of an instance URL, with its host in the form normalizeHost
+// gives it and without the default :443 port. Instances are only ever talked to over https, so however the
+// instance was typed (http://, a path, upper case, a trailing dot, unicode) it maps to the same app
+// registration, sessions and lists, and to the host the instance lists are checked against.
+// A host that isn't a valid hostname is only lowercased; checkPermitInstanceList rejects it.
+func normalizeInstanceURL(instanceURL *url.URL) *url.URL {
+	host, ok := normalizeHost(instanceURL.Hostname())
+	if !ok {
+		return &url.URL{Scheme: "https", Host: strings.ToLower(instanceURL.Host)}
+	}
+	if port := instanceURL.Port(); port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	return &url.URL{Scheme: "https", Host: host}
+}
+
+// randomString returns a URL-safe random string built from n random bytes
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
 
-		// If there is a permit list, check if the instance is in the list
-		if len(permitList) > 0 {
-			if _, ok := permitList[strings.ToLower(instanceURL.Host)]; !ok {
-				// Permit list exists, but the instance isn't in the list
-				permitted = false
-				return &permitted, nil
-			}
+// pkceChallenge returns the S256 PKCE code challenge for a code verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// hashSecret returns the SHA-256 hash (hex) of a secret for storage and lookups
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// containsString reports whether s is in list
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
 		}
 	}
+	return false
+}
 
-	// Instance is on the permit list --or-- no permit list exists, allow all instances
-	return &permitted, nil
+// checkReturnTo parses a return_to URL and checks it against the return_to_allowlist.
+// Allowlist entries are absolute URLs; return_to must have the same scheme and host
+// and a path under the entry's path. The path is cleaned first, so dot segments can't climb
+// out of an allowed path, and the cleaned URL is returned. Returns nil if return_to is not allowed.
+func (cfg *Config) checkReturnTo(ctx context.Context, rawReturnTo string) (*url.URL, error) {
+	returnTo, err := url.Parse(rawReturnTo)
+	if err != nil || !returnTo.IsAbs() || returnTo.Host == "" || returnTo.User != nil {
+		return nil, nil
+	}
+
+	// Browsers read a backslash as a slash, which path.Clean doesn't
+	if strings.Contains(returnTo.Path, "\\") {
+		return nil, nil
+	}
+	if returnTo.Path != "" {
+		cleaned := path.Clean(returnTo.Path)
+		if containsString(strings.Split(cleaned, "/"), "..") {
+			return nil, nil
+		}
+		if strings.HasSuffix(returnTo.Path, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		returnTo.Path = cleaned
+		returnTo.RawPath = ""
+	}
+
+	// Get the allowlist
+	settings, err := cfg.getSettings(ctx)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("function", "checkReturnTo::cfg.getSettings()").
+			Str("errRef", guid.String()).
+			Msg("unable to load settings")
+		return nil, errors.New(guid.String() + ": unable to load settings")
+	}
+
+	// No allowlist, no redirects
+	for _, allowed := range settings.ReturnToAllowlist {
+		if !strings.EqualFold(allowed.Scheme, returnTo.Scheme) || !strings.EqualFold(allowed.Host, returnTo.Host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(allowed.Path, "/")
+		if returnTo.Path == prefix || strings.HasPrefix(returnTo.Path, prefix+"/") {
+			return returnTo, nil
+		}
+	}
+	return nil, nil
 }
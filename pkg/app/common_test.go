@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestMatchInstancePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"example.com", "notexample.com", false},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "wwwexample.com", false},
+		{".example.com", "example.com", true},
+		{".example.com", "www.example.com", true},
+		{".example.com", "notexample.com", false},
+		{"", "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			if got := matchInstancePattern(tt.pattern, tt.host); got != tt.want {
+				t.Errorf("matchInstancePattern(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host   string
+		want   string
+		wantOK bool
+	}{
+		{"example.social", "example.social", true},
+		{"Example.Social", "example.social", true},
+		{"example.social.", "example.social", true},
+		{"exämple.social", "xn--exmple-cua.social", true},
+		{"xn--exmple-cua.social", "xn--exmple-cua.social", true},
+		{"", "", false},
+		{"exa mple.social", "", false},
+		{"-example.social", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, ok := normalizeHost(tt.host)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("normalizeHost(%q) = %q, %v; want %q, %v", tt.host, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCheckReturnTo(t *testing.T) {
+	db := database.NewMemory()
+	db.PutConfig(&database.ConfigItem{ConfigKey: "return_to_allowlist", ConfigValue: "https://app.example.com/app/,https://other.example.com"})
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(db), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		returnTo string
+		want     string
+	}{
+		{"https://app.example.com/app", "https://app.example.com/app"},
+		{"https://app.example.com/app/done?x=1", "https://app.example.com/app/done?x=1"},
+		{"https://app.example.com/app/./done/", "https://app.example.com/app/done/"},
+		{"https://app.example.com/app/a/../done", "https://app.example.com/app/done"},
+		{"https://app.example.com/app/../admin", ""},
+		{"https://app.example.com/app/%2e%2e/admin", ""},
+		{"https://app.example.com/app/..%5cadmin", ""},
+		{"https://app.example.com/app/..\\admin", ""},
+		{"https://app.example.com/application", ""},
+		{"https://app.example.com/", ""},
+		{"http://app.example.com/app/", ""},
+		{"https://user@app.example.com/app/", ""},
+		{"https://other.example.com/anything", "https://other.example.com/anything"},
+		{"https://other.example.com", "https://other.example.com"},
+		{"/app/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.returnTo, func(t *testing.T) {
+			returnTo, err := cfg.checkReturnTo(context.Background(), tt.returnTo)
+			if err != nil {
+				t.Fatalf("checkReturnTo: %v", err)
+			}
+			got := ""
+			if returnTo != nil {
+				got = returnTo.String()
+			}
+			if got != tt.want {
+				t.Errorf("checkReturnTo(%q) = %q, want %q", tt.returnTo, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeInstanceURL(t *testing.T) {
+	tests := []struct {
+		instanceURL string
+		want        string
+	}{
+		{"https://example.social", "https://example.social"},
+		{"http://Example.Social/path?q=1", "https://example.social"},
+		{"https://example.social.", "https://example.social"},
+		{"https://example.social:443", "https://example.social"},
+		{"https://Example.Social.:443/", "https://example.social"},
+		{"https://example.social:8443", "https://example.social:8443"},
+		{"https://exämple.social", "https://xn--exmple-cua.social"},
+		{"https://xn--exmple-cua.social", "https://xn--exmple-cua.social"},
+		{"https://Bad_Host.example", "https://bad_host.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.instanceURL, func(t *testing.T) {
+			instanceURL, err := url.Parse(tt.instanceURL)
+			if err != nil {
+				t.Fatalf("url.Parse: %v", err)
+			}
+			if got := normalizeInstanceURL(instanceURL).String(); got != tt.want {
+				t.Errorf("normalizeInstanceURL(%q) = %q, want %q", tt.instanceURL, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
+)
+
+// invocationHeader carries the ID of the Lambda invocation a request belongs to,
+// from LambdaHandler to requestContext. It never reaches the handlers.
+const invocationHeader = "X-Mastostart-Invocation"
+
+// Timeouts bound the work done for a request. The database's timeout is set with database.WithDDBTimeout.
+type Timeouts struct {
+	// Request bounds the whole request. Keep it under API Gateway's 30 second integration timeout:
+	// past it the client has been sent a 504 and the work is wasted.
+	Request time.Duration
+
+	// Mastodon bounds the calls to the instances, by class of call
+	Mastodon mastoclient.Timeouts
+}
+
+// DefaultTimeouts are the timeouts used unless WithTimeouts says otherwise
+var DefaultTimeouts = Timeouts{
+	Request:  28 * time.Second,
+	Mastodon: mastoclient.DefaultTimeouts,
+}
+
+// requestContext is middleware that sets the request's context (c.UserContext()).
+// It ends with the Lambda invocation (or the server's shutdown), when the request times out or,
+// outside Lambda, when the client disconnects, which cancels the database and Mastodon calls
+// in flight for the request, including the fan-outs to the instances.
+func (cfg *Config) requestContext(c *fiber.Ctx) error {
+	var ctx context.Context = c.Context()
+	if id := c.Get(invocationHeader); id != "" {
+		if invocation, ok := cfg.invocations.Load(id); ok {
+			ctx = invocation.(context.Context)
+		}
+	}
+	c.Request().Header.Del(invocationHeader)
+
+	ctx, cancel := mastoclient.WithTimeout(ctx, cfg.timeouts.Request)
+	defer cancel()
+	stop := watchDisconnect(c.Context().Conn(), cancel)
+	defer stop()
+	c.SetUserContext(context.WithValue(ctx, clientIPKey{}, c.IP()))
+	return c.Next()
+}
+
+// clientIPKey is the context key of the client IP set by requestContext
+type clientIPKey struct{}
+
+// clientIP returns the IP of the client a request's context belongs to; empty outside a request
+func clientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// sessionCookieName is the HttpOnly cookie carrying the JWT for response_mode=cookie logins
+	sessionCookieName = "mastostart_session"
+
+	// csrfCookieName is the cookie carrying the CSRF token. JavaScript reads it and echoes it in csrfHeaderName.
+	csrfCookieName = "mastostart_csrf"
+
+	// csrfHeaderName is the header state changing requests authenticated with the session cookie must send
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// setSessionCookies sets the session cookie (the JWT, out of reach of JavaScript) and a CSRF cookie for double-submit
+func (cfg *Config) setSessionCookies(c *fiber.Ctx, session *database.UserCredentials, signedJWT string) error {
+	settings, err := cfg.getSettings(c.UserContext())
+	if err != nil {
+		return err
+	}
+	csrfToken, err := randomString(32)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Unix(session.ExpiresAt, 0)
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Value:    signedJWT,
+		Path:     "/",
+		Domain:   settings.CookieDomain,
+		Expires:  expires,
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	c.Cookie(&fiber.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		Domain:   settings.CookieDomain,
+		Expires:  expires,
+		Secure:   true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return nil
+}
+
+// clearSessionCookies removes the session and CSRF cookies, if the request came with them
+func (cfg *Config) clearSessionCookies(c *fiber.Ctx) error {
+	if c.Cookies(sessionCookieName) == "" && c.Cookies(csrfCookieName) == "" {
+		return nil
+	}
+	settings, err := cfg.getSettings(c.UserContext())
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		c.Cookie(&fiber.Cookie{
+			Name:     name,
+			Path:     "/",
+			Domain:   settings.CookieDomain,
+			Expires:  time.Unix(0, 0),
+			Secure:   true,
+			HTTPOnly: name == sessionCookieName,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+	return nil
+}
+
+// checkCSRF is middleware that protects requests authenticated with the session cookie.
+// Browsers attach the cookie to cross-site requests too, so state changing requests must also
+// send the CSRF cookie's value in the X-CSRF-Token header; other sites can't read the cookie.
+// Bearer token requests aren't affected.
+func (cfg *Config) checkCSRF(c *fiber.Ctx) error {
+	// A bearer token takes precedence over the cookie (see the JWT middleware's TokenLookup)
+	if strings.HasPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ") || c.Cookies(sessionCookieName) == "" {
+		return c.Next()
+	}
+	// GET /api/lists/:listID?save=true writes the list to the database (and makes a new PSK), so it's checked too
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		if strings.ToLower(c.Query("save", "false")) != "true" {
+			return c.Next()
+		}
+	}
+
+	cookie := c.Cookies(csrfCookieName)
+	header := c.Get(csrfHeaderName)
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) != 1 {
+		guid := xid.New()
+		log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "checkCSRF").
+			Msg("missing or mismatched csrf token")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "missing or mismatched " + csrfHeaderName + " header",
+		})
+		return c.Status(fiber.ErrForbidden.Code).SendString(string(e))
+	}
+	return c.Next()
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		session bool
+		csrf    string
+		header  string
+		bearer  bool
+		want    int
+	}{
+		{"cookie post with token", fiber.MethodPost, "/api/lists/1", true, "token", "token", false, fiber.StatusOK},
+		{"cookie post without header", fiber.MethodPost, "/api/lists/1", true, "token", "", false, fiber.StatusForbidden},
+		{"cookie post with wrong header", fiber.MethodPost, "/api/lists/1", true, "token", "other", false, fiber.StatusForbidden},
+		{"cookie post without csrf cookie", fiber.MethodPost, "/api/lists/1", true, "", "", false, fiber.StatusForbidden},
+		{"cookie delete without header", fiber.MethodDelete, "/api/saved-lists/1", true, "token", "", false, fiber.StatusForbidden},
+		{"cookie get", fiber.MethodGet, "/api/lists/1", true, "token", "", false, fiber.StatusOK},
+		{"cookie get that saves", fiber.MethodGet, "/api/lists/1?save=true", true, "token", "", false, fiber.StatusForbidden},
+		{"cookie get that saves with token", fiber.MethodGet, "/api/lists/1?save=TRUE", true, "token", "token", false, fiber.StatusOK},
+		{"bearer post", fiber.MethodPost, "/api/lists/1", true, "token", "", true, fiber.StatusOK},
+		{"no session cookie", fiber.MethodPost, "/api/lists/1", false, "", "", false, fiber.StatusOK},
+	}
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(database.NewMemory()), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	app := fiber.New()
+	app.Use(cfg.checkCSRF)
+	app.All("/*", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.session {
+				req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "jwt"})
+			}
+			if tt.csrf != "" {
+				req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.csrf})
+			}
+			if tt.header != "" {
+				req.Header.Set(csrfHeaderName, tt.header)
+			}
+			if tt.bearer {
+				req.Header.Set(fiber.HeaderAuthorization, "Bearer jwt")
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatalf("app.Test: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// defaultCORSMethods are the methods cross-origin requests may use unless cors_methods is set
+	defaultCORSMethods = "GET,HEAD,POST,PUT,DELETE"
+
+	// defaultCORSHeaders are the request headers cross-origin requests may send unless cors_headers is set
+	defaultCORSHeaders = "Authorization,Content-Type," + csrfHeaderName + "," + targetAccountHeader
+
+	// corsExposeHeaders are the response headers cross-origin JavaScript may read
+	corsExposeHeaders = "Retry-After,WWW-Authenticate,X-RateLimit-Limit,X-RateLimit-Remaining,X-RateLimit-Reset"
+
+	// corsMaxAge is how long (seconds) browsers may cache a preflight response
+	corsMaxAge = "600"
+)
+
+// cors is middleware that lets the origins in the cors_origins config item call the API from a browser.
+// It answers preflight (OPTIONS) requests itself, so they never reach the JWT middleware.
+// Listed origins get credentialed access (the session cookie); "*" allows any origin without credentials.
+func (cfg *Config) cors(c *fiber.Ctx) error {
+	origin := c.Get(fiber.HeaderOrigin)
+	preflight := c.Method() == fiber.MethodOptions && c.Get(fiber.HeaderAccessControlRequestMethod) != ""
+	if origin == "" {
+		return c.Next()
+	}
+	c.Vary(fiber.HeaderOrigin)
+
+	settings, err := cfg.getSettings(c.UserContext())
+	if err != nil {
+		cfg.log.Error().
+			Err(err).
+			Str("function", "cors::cfg.getSettings()").
+			Msg("unable to load settings; not allowing cross-origin request")
+		if preflight {
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+		return c.Next()
+	}
+
+	allowed, wildcard := false, false
+	for _, o := range settings.CORSOrigins {
+		if o == "*" {
+			wildcard = true
+		}
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			allowed = true
+		}
+	}
+
+	switch {
+	case allowed:
+		c.Set(fiber.HeaderAccessControlAllowOrigin, origin)
+		c.Set(fiber.HeaderAccessControlAllowCredentials, "true")
+	case wildcard:
+		c.Set(fiber.HeaderAccessControlAllowOrigin, "*")
+	default:
+		// Without CORS headers the browser blocks the response
+		if preflight {
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+		return c.Next()
+	}
+
+	if !preflight {
+		c.Set(fiber.HeaderAccessControlExposeHeaders, corsExposeHeaders)
+		return c.Next()
+	}
+
+	c.Set(fiber.HeaderAccessControlAllowMethods, strings.Join(settings.CORSMethods, ","))
+	c.Set(fiber.HeaderAccessControlAllowHeaders, strings.Join(settings.CORSHeaders, ","))
+	c.Set(fiber.HeaderAccessControlMaxAge, corsMaxAge)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// securityHeaders is middleware that sets the standard security headers on every response
+func securityHeaders(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderStrictTransportSecurity, "max-age=63072000; includeSubDomains")
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderContentSecurityPolicy, "frame-ancestors 'none'")
+	c.Set(fiber.HeaderXFrameOptions, "DENY")
+	c.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+	return c.Next()
+}
@@ -1,114 +1,88 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/rmrfslashbin/mastostart/pkg/database"
 	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
 	"github.com/rs/xid"
 )
 
-// createAppCreds creates an app on the instance and returns the credentials
-func (cfg *Config) createAppCreds(instanceURL *url.URL) (*database.AppCredentials, error) {
-	// Get redirect_uri from database
-	redirectURI, err := cfg.db.GetConfig("redirect_uri")
+// appRegistration is how the app should be registered with an instance, per the config
+type appRegistration struct {
+	name        string
+	website     string
+	redirectURI string
+	scopes      []string
+}
+
+// getAppRegistration builds the app registration for an instance from the settings
+func (cfg *Config) getAppRegistration(ctx context.Context, instanceURL *url.URL) (*appRegistration, error) {
+	settings, err := cfg.getSettings(ctx)
 	if err != nil {
 		guid := xid.New()
 		cfg.log.Error().
 			Err(err).
 			Str("errRef", guid.String()).
-			Str("function", "createAppCreds::cfg.db.GetConfig('redirect_uri')").
-			Msg("error fetching 'redirect_uri' key/value pair from ddb")
-		return nil, errors.New(guid.String() + ": error fetching 'redirect_uri' key/value pair from ddb")
+			Str("function", "getAppRegistration::cfg.getSettings()").
+			Msg("error loading settings")
+		return nil, errors.New(guid.String() + ": error loading settings")
 	}
 
-	if redirectURI == nil {
+	if settings.RedirectURI == "" {
 		guid := xid.New()
 		cfg.log.Error().
 			Str("errRef", guid.String()).
-			Str("function", "createAppCreds::redirectURI == nil").
-			Msg("'redirect_uri' key/value pair is nil (not found in database). Maybe run setup?")
-		return nil, errors.New(guid.String() + ": 'redirect_uri' key/value pair is nil (not found in database). Maybe run setup?")
+			Str("function", "getAppRegistration::settings.RedirectURI == \"\"").
+			Msg("'redirect_uri' key/value pair is not set. Maybe run setup?")
+		return nil, errors.New(guid.String() + ": 'redirect_uri' key/value pair is not set. Maybe run setup?")
 	}
 
-	// Get app_name from database
-	appName, err := cfg.db.GetConfig("app_name")
-	if err != nil {
-		guid := xid.New()
-		cfg.log.Error().
-			Err(err).
-			Str("errRef", guid.String()).
-			Str("function", "createAppCreds::cfg.db.GetConfig('app_name')").
-			Msg("error fetching 'app_name' key/value pair from ddb")
-		return nil, errors.New(guid.String() + ": error fetching 'app_name' key/value pair from ddb")
-	}
-	if appName == nil {
-		guid := xid.New()
-		cfg.log.Error().
-			Str("errRef", guid.String()).
-			Str("function", "createAppCreds::appName == nil").
-			Msg("'appName' key/value pair is nil (not found in database). Maybe run setup?")
-		return nil, errors.New(guid.String() + ": 'appName' key/value pair is nil (not found in database). Maybe run setup?")
-	}
+	// Construct the redirect URI. Only the (https) origin of the instance URL is used so the
+	// redirect URI doesn't change with how the instance was typed.
+	instanceOrigin := normalizeInstanceURL(instanceURL)
+	redirectURIStr := settings.RedirectURI + "?instance_url=" + instanceOrigin.String()
 
-	// Get website from database
-	website, err := cfg.db.GetConfig("website")
+	return &appRegistration{
+		name:        settings.AppName,
+		website:     settings.Website,
+		redirectURI: redirectURIStr,
+		scopes:      append([]string(nil), settings.Scopes...),
+	}, nil
+}
+
+// createAppCreds creates an app on the instance and returns the credentials
+func (cfg *Config) createAppCreds(ctx context.Context, instanceURL *url.URL) (*database.AppCredentials, error) {
+	reg, err := cfg.getAppRegistration(ctx, instanceURL)
 	if err != nil {
-		guid := xid.New()
-		cfg.log.Error().
-			Err(err).
-			Str("errRef", guid.String()).
-			Str("function", "createAppCreds::cfg.db.GetConfig('website')").
-			Msg("error fetching 'website' key/value pair from ddb")
-		return nil, errors.New(guid.String() + ": error fetching 'website' key/value pair from ddb")
-	}
-	if website == nil {
-		guid := xid.New()
-		cfg.log.Error().
-			Str("errRef", guid.String()).
-			Str("function", "createAppCreds::website == nil").
-			Msg("'website' key/value pair is nil (not found in database). Maybe run setup?")
-		return nil, errors.New(guid.String() + ": 'website' key/value pair is nil (not found in database). Maybe run setup?")
+		return nil, err
 	}
 
-	// Get website from database
-	scopeConfig, err := cfg.db.GetConfig("scopes")
+	// Make sure the instance runs software we can login with, and adapt to its quirks
+	nodeInfo, quirks, err := cfg.detectSoftware(ctx, instanceURL)
 	if err != nil {
-		guid := xid.New()
 		cfg.log.Error().
 			Err(err).
-			Str("errRef", guid.String()).
-			Str("function", "createAppCreds::cfg.db.GetConfig('scopes')").
-			Msg("error fetching 'scopes' key/value pair from ddb")
-		return nil, errors.New(guid.String() + ": error fetching 'scopes' key/value pair from ddb")
-	}
-	if scopeConfig == nil {
-		guid := xid.New()
-		cfg.log.Error().
-			Str("errRef", guid.String()).
-			Str("function", "createAppCreds::scopeConfig == nil").
-			Msg("'scopeConfig' key/value pair is nil (not found in database). Maybe run setup?")
-		return nil, errors.New(guid.String() + ": 'scopeConfig' key/value pair is nil (not found in database). Maybe run setup?")
-	}
-
-	// Split and clean up the scopes
-	scopes := strings.Split(scopeConfig.ConfigValue, ",")
-	for i, scope := range scopes {
-		scopes[i] = strings.ToLower(strings.TrimSpace(scope))
+			Str("function", "createAppCreds::cfg.detectSoftware(instanceURL)").
+			Str("instanceURL", instanceURL.String()).
+			Msg("unable to use instance's server software")
+		return nil, err
 	}
-
-	// Construct the redirect URI
-	redirectURIStr := redirectURI.ConfigValue + "?instance_url=" + instanceURL.String()
+	scopes := quirks.adaptScopes(reg.scopes)
 
 	// Register the app with the instance
-	app, err := mastoclient.RegisterApp(&mastoclient.RegisterAppInput{
-		ClientName:  appName.ConfigValue,
+	registerCtx, cancel := mastoclient.WithTimeout(ctx, cfg.timeouts.Mastodon.Register)
+	defer cancel()
+	app, err := mastoclient.RegisterAppWithContext(registerCtx, &mastoclient.RegisterAppInput{
+		ClientName:  reg.name,
 		InstanceURL: instanceURL.String(),
-		RedirectURI: redirectURIStr,
+		RedirectURI: reg.redirectURI,
 		Scopes:      scopes,
-		Website:     website.ConfigValue,
+		Website:     reg.website,
 	})
 	if err != nil {
 		guid := xid.New()
@@ -116,27 +90,35 @@ func (cfg *Config) createAppCreds(instanceURL *url.URL) (*database.AppCredential
 			Err(err).
 			Str("errRef", guid.String()).
 			Str("function", "createAppCreds::mastoclient.RegisterApp()").
-			Str("clientName", appName.ConfigValue).
+			Str("clientName", reg.name).
 			Str("instanceURL", instanceURL.String()).
-			Str("redirectURI", redirectURIStr).
-			Str("website", website.ConfigValue).
+			Str("redirectURI", reg.redirectURI).
+			Str("website", reg.website).
 			Msg("error registering app")
 		return nil, errors.New(guid.String() + ": error registering app")
 	}
+	cfg.chargeRegistration(ctx)
 
+	now := time.Now()
 	newApp := &database.AppCredentials{
 		InstanceURL:  instanceURL.Host,
 		ID:           string(app.ID),
-		Name:         appName.ConfigValue,
-		Website:      website.ConfigValue,
-		RedirectURI:  redirectURIStr,
+		Name:         reg.name,
+		Website:      reg.website,
+		RedirectURI:  reg.redirectURI,
 		ClientID:     app.ClientID,
 		ClientSecret: app.ClientSecret,
 		AuthURI:      app.AuthURI,
+
+		Software:        nodeInfo.Software.Name,
+		SoftwareVersion: nodeInfo.Software.Version,
+		Scopes:          scopes,
+		CreatedAt:       now.Unix(),
+		VerifiedAt:      now.Unix(),
 	}
 
 	// Save the app credentials in the database
-	if err := cfg.db.PutAppCredentials(newApp); err != nil {
+	if err := cfg.db.PutAppCredentialsWithContext(ctx, newApp); err != nil {
 		guid := xid.New()
 		cfg.log.Error().
 			Err(err).
@@ -149,13 +131,15 @@ func (cfg *Config) createAppCreds(instanceURL *url.URL) (*database.AppCredential
 	// Log success
 	cfg.log.Info().
 		Str("appID", string(app.ID)).
-		Str("appName", appName.ConfigValue).
+		Str("appName", reg.name).
 		Str("authURI", app.AuthURI).
 		Str("clientID", app.ClientID).
 		Str("instanceURL", instanceURL.String()).
-		Str("redirectURI", redirectURIStr).
-		Str("website", website.ConfigValue).
+		Str("redirectURI", reg.redirectURI).
+		Str("website", reg.website).
 		Str("scopes", strings.Join(scopes, ",")).
+		Str("software", nodeInfo.Software.Name).
+		Str("softwareVersion", nodeInfo.Software.Version).
 		Msg("created mastodon app credentials")
 
 	// Return the app credentials
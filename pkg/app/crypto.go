@@ -0,0 +1,75 @@
+package app
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"github.com/rs/xid"
+)
+
+// getTokenCipher gets the AES-GCM cipher used to encrypt stored Mastodon access tokens
+func (cfg *Config) getTokenCipher(ctx context.Context) (cipher.AEAD, error) {
+	settings, err := cfg.getSettings(ctx)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "app::getTokenCipher()::cfg.getSettings()").
+			Str("errRef", guid.String()).
+			Msg("Error loading settings")
+		return nil, errors.New(guid.String() + ": Error loading settings")
+	}
+
+	if settings.tokenCipher == nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("function", "app::getTokenCipher()::settings.tokenCipher").
+			Str("errRef", guid.String()).
+			Msg("token_encryption_key not found in database. Maybe run setup?")
+		return nil, errors.New(guid.String() + ": token_encryption_key not found in database")
+	}
+	return settings.tokenCipher, nil
+}
+
+// encryptToken encrypts a Mastodon access token for storage
+func (cfg *Config) encryptToken(ctx context.Context, token string) (string, error) {
+	aead, err := cfg.getTokenCipher(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	// Store the nonce in front of the ciphertext
+	sealed := aead.Seal(nonce, nonce, []byte(token), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptToken decrypts a stored Mastodon access token
+func (cfg *Config) decryptToken(ctx context.Context, encrypted string) (string, error) {
+	aead, err := cfg.getTokenCipher(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted token is too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	token, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
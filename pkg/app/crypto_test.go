@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestTokenEncryption(t *testing.T) {
+	ctx := context.Background()
+	key := make([]byte, 32)
+	rand.Read(key)
+	db := database.NewMemory()
+	db.PutConfig(&database.ConfigItem{ConfigKey: "token_encryption_key", ConfigValue: base64.StdEncoding.EncodeToString(key)})
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(db), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []string{"", "token", "a much longer Mastodon access token with spaces and ünïcode"}
+	for _, token := range tests {
+		t.Run(token, func(t *testing.T) {
+			encrypted, err := cfg.encryptToken(ctx, token)
+			if err != nil {
+				t.Fatalf("encryptToken: %v", err)
+			}
+			if token != "" && encrypted == token {
+				t.Fatal("token stored in plaintext")
+			}
+
+			// A random nonce makes every encryption different
+			again, err := cfg.encryptToken(ctx, token)
+			if err != nil {
+				t.Fatalf("encryptToken: %v", err)
+			}
+			if again == encrypted {
+				t.Error("encrypting twice gave the same ciphertext")
+			}
+
+			decrypted, err := cfg.decryptToken(ctx, encrypted)
+			if err != nil {
+				t.Fatalf("decryptToken: %v", err)
+			}
+			if decrypted != token {
+				t.Errorf("decryptToken = %q, want %q", decrypted, token)
+			}
+		})
+	}
+}
+
+func TestTokenDecryptionErrors(t *testing.T) {
+	ctx := context.Background()
+	log := zerolog.Nop()
+
+	// cfg and other have different keys; none has no key at all
+	configs := make([]*Config, 3)
+	for i := range configs {
+		db := database.NewMemory()
+		if i < 2 {
+			key := make([]byte, 32)
+			rand.Read(key)
+			db.PutConfig(&database.ConfigItem{ConfigKey: "token_encryption_key", ConfigValue: base64.StdEncoding.EncodeToString(key)})
+		}
+		var err error
+		if configs[i], err = New(WithDB(db), WithLogger(&log)); err != nil {
+			t.Fatalf("New: %v", err)
+		}
+	}
+	cfg, other, none := configs[0], configs[1], configs[2]
+
+	encrypted, err := cfg.encryptToken(ctx, "token")
+	if err != nil {
+		t.Fatalf("encryptToken: %v", err)
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(encrypted)
+	sealed[len(sealed)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(sealed)
+
+	tests := []struct {
+		name      string
+		cfg       *Config
+		encrypted string
+	}{
+		{"not base64", cfg, "not base64!"},
+		{"too short", cfg, base64.StdEncoding.EncodeToString([]byte("short"))},
+		{"tampered", cfg, tampered},
+		{"other key", other, encrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cfg.decryptToken(ctx, tt.encrypted); err == nil {
+				t.Error("decryptToken succeeded, want an error")
+			}
+		})
+	}
+
+	t.Run("no key", func(t *testing.T) {
+		if _, err := none.encryptToken(ctx, "token"); err == nil {
+			t.Error("encryptToken succeeded without a token_encryption_key")
+		}
+	})
+}
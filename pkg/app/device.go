@@ -0,0 +1,551 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// deviceCodeTTL is how long the user has to enter the user code and login
+	deviceCodeTTL = 10 * time.Minute
+
+	// devicePollInterval is the minimum number of seconds between polls of /auth/device/token.
+	// Devices polling faster are told to slow_down and the interval grows by this much.
+	devicePollInterval = 5
+
+	// deviceGrantType is the RFC 8628 grant type for /auth/device/token
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// userCodeAlphabet leaves out vowels (no words) and look-alikes
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// deviceVerifyForm asks the user for the code shown on their device
+var deviceVerifyForm = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorize a device</title></head>
+<body>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>
+{{end}}<p>Enter the code shown on your device. You'll be asked to sign in to your Mastodon instance; only continue if you started the login yourself.</p>
+<form method="post" action="/auth/device/verify">
+<label>Code <input type="text" name="user_code" value="{{.UserCode}}" autocomplete="off" autocapitalize="characters" required></label>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// deviceResultPage tells the user how the device authorization went
+var deviceResultPage = template.Must(template.New("deviceResult").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Authorize a device</title></head>
+<body>
+<p>{{.}}</p>
+</body>
+</html>
+`))
+
+// deviceVerifyPage is the data for deviceVerifyForm
+type deviceVerifyPage struct {
+	UserCode string
+	Error    string
+}
+
+// newUserCode returns a random user code (eg BCDF-GHJK)
+func newUserCode() (string, error) {
+	code := make([]byte, 0, 9)
+	b := make([]byte, 1)
+	for len(code) < 9 {
+		if len(code) == 4 {
+			code = append(code, '-')
+			continue
+		}
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		// Drop bytes past the last multiple of the alphabet size so every letter is as likely
+		if int(b[0]) >= 256-256%len(userCodeAlphabet) {
+			continue
+		}
+		code = append(code, userCodeAlphabet[int(b[0])%len(userCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode formats a user code as typed (any case, with or without the dash) like newUserCode does
+func normalizeUserCode(userCode string) string {
+	letters := make([]rune, 0, 8)
+	for _, r := range strings.ToUpper(userCode) {
+		if r >= 'A' && r <= 'Z' {
+			letters = append(letters, r)
+		}
+	}
+	if len(letters) != 8 {
+		return ""
+	}
+	return string(letters[:4]) + "-" + string(letters[4:])
+}
+
+// authDevice is the handler for the /auth/device endpoint.
+// It starts an RFC 8628 device flow for clients without a browser (eg the mastostart CLI).
+func (cfg *Config) authDevice(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	// The instance to login to: instance_url, or the instance serving a full handle
+	rawInstanceURL := c.FormValue("instance_url")
+	if rawInstanceURL == "" {
+		username := c.FormValue("username")
+		if !strings.Contains(strings.TrimPrefix(username, "@"), "@") {
+			guid := xid.New()
+			cfg.log.Error().
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authDevice::c.FormValue('instance_url')").
+				Msg("missing 'instance_url' form value")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "missing 'instance_url' form value. use a full handle (@user@domain) as the username or set instance_url",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+
+		resolved, err := cfg.resolveHandle(c.UserContext(), username)
+		if err != nil {
+			guid := xid.New()
+			cfg.log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authDevice::cfg.resolveHandle(username)").
+				Str("username", username).
+				Msg("unable to resolve handle")
+			e, _ := json.Marshal(&GeneralRestError{
+				ErrorInstanceID: guid.String(),
+				ErrorMessage:    "unable to resolve handle to an instance",
+			})
+			return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+		}
+		rawInstanceURL = resolved.String()
+	}
+	if !strings.Contains(rawInstanceURL, "://") {
+		rawInstanceURL = "https://" + rawInstanceURL
+	}
+	instanceURL, err := url.Parse(rawInstanceURL)
+	if err != nil || instanceURL.Host == "" {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDevice::url.Parse(rawInstanceURL)").
+			Msg("error parsing instance_url")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "unable to parse instance_url",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	// Fail now rather than after the user entered the code
+	permitted, err := cfg.checkPermitInstanceList(c.UserContext(), instanceURL)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDevice::cfg.checkPermitInstanceList()").
+			Msg("unable to check the instance lists")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if !*permitted {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDevice::cfg.checkPermitInstanceList()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("instance not permitted")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "instance not permitted",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	issuer, err := cfg.getIssuer(c.UserContext())
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDevice::cfg.getIssuer()").
+			Msg("unable to get issuer")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	deviceCode, err := randomString(32)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDevice::randomString(32)").
+			Msg("failed getting random bytes for device code")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDevice::newUserCode()").
+			Msg("failed getting random bytes for user code")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	now := time.Now()
+	if err := cfg.db.PutDeviceAuthorizationWithContext(c.UserContext(), &database.DeviceAuthorization{
+		DeviceCode:  hashSecret(deviceCode),
+		UserCode:    userCode,
+		InstanceURL: instanceURL.Host,
+		Scope:       strings.Join(parseScopes(c.FormValue("scope")), " "),
+		Status:      database.DevicePending,
+		Interval:    devicePollInterval,
+		CreatedAt:   now.Unix(),
+		ExpiresAt:   now.Add(deviceCodeTTL).Unix(),
+	}); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDevice::cfg.db.PutDeviceAuthorization()").
+			Msg("unable to save device authorization")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	verificationURI := issuer + "/auth/device/verify"
+	return c.JSON(&DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {userCode}}.Encode(),
+		ExpiresIn:               int64(deviceCodeTTL.Seconds()),
+		Interval:                devicePollInterval,
+	})
+}
+
+// authDeviceVerifyForm is the GET handler for the /auth/device/verify endpoint.
+// The code is pre-filled from verification_uri_complete but never submitted for the user.
+func (cfg *Config) authDeviceVerifyForm(c *fiber.Ctx) error {
+	c.Type("html", "utf-8")
+	return deviceVerifyForm.Execute(c.Response().BodyWriter(), &deviceVerifyPage{
+		UserCode: c.Query("user_code"),
+	})
+}
+
+// authDeviceVerify is the POST handler for the /auth/device/verify endpoint.
+// It sends the user to their instance to login; the callback approves the device.
+func (cfg *Config) authDeviceVerify(c *fiber.Ctx) error {
+	c.Type("html", "utf-8")
+	rawUserCode := c.FormValue("user_code")
+	page := &deviceVerifyPage{UserCode: rawUserCode}
+
+	userCode := normalizeUserCode(rawUserCode)
+	if userCode == "" {
+		page.Error = "That isn't a valid code. Codes look like BCDF-GHJK."
+		c.Status(fiber.StatusBadRequest)
+		return deviceVerifyForm.Execute(c.Response().BodyWriter(), page)
+	}
+
+	device, err := cfg.db.GetDeviceAuthorizationByUserCodeWithContext(c.UserContext(), userCode)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDeviceVerify::cfg.db.GetDeviceAuthorizationByUserCode()").
+			Msg("unable to get device authorization from database")
+		page.Error = "Something went wrong. Please report " + guid.String() + " to the admin."
+		c.Status(fiber.StatusInternalServerError)
+		return deviceVerifyForm.Execute(c.Response().BodyWriter(), page)
+	}
+	if device == nil || device.Status != database.DevicePending || time.Now().Unix() > device.ExpiresAt {
+		page.Error = "Unknown, used or expired code. Start the login on your device again."
+		c.Status(fiber.StatusBadRequest)
+		return deviceVerifyForm.Execute(c.Response().BodyWriter(), page)
+	}
+
+	instanceURL := &url.URL{Scheme: "https", Host: device.InstanceURL}
+	attempt := &database.LoginAttempt{
+		Scope:      device.Scope,
+		DeviceCode: device.DeviceCode,
+	}
+	authURI, err := cfg.beginLogin(c.UserContext(), instanceURL, attempt)
+	if err != nil {
+		var limited *RateLimited
+		if errors.As(err, &limited) {
+			return tooManyRequests(c, limited)
+		}
+		var notRegistered *ScopeNotRegistered
+		var notPermitted *InstanceNotPermitted
+		var unsupported *UnsupportedSoftware
+		if errors.As(err, &notRegistered) || errors.As(err, &notPermitted) || errors.As(err, &unsupported) {
+			page.Error = "Unable to login to " + device.InstanceURL + ": " + err.Error()
+			c.Status(fiber.StatusBadRequest)
+			return deviceVerifyForm.Execute(c.Response().BodyWriter(), page)
+		}
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDeviceVerify::cfg.beginLogin()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to start login")
+		page.Error = "Something went wrong. Please report " + guid.String() + " to the admin."
+		c.Status(fiber.StatusInternalServerError)
+		return deviceVerifyForm.Execute(c.Response().BodyWriter(), page)
+	}
+
+	// Bind the state to this browser; the callback rejects a mismatched cookie
+	setStateCookie(c, attempt.State)
+
+	return c.Redirect(authURI.String(), fiber.StatusFound)
+}
+
+// finishDevice approves a device authorization once the user logged in.
+// The device picks up the JWT on its next poll of /auth/device/token.
+func (cfg *Config) finishDevice(c *fiber.Ctx, attempt *database.LoginAttempt, session *database.UserCredentials, signedJWT string) error {
+	c.Type("html", "utf-8")
+
+	device, err := cfg.db.GetDeviceAuthorizationWithContext(c.UserContext(), attempt.DeviceCode)
+	if err != nil || device == nil || device.Status != database.DevicePending || time.Now().Unix() > device.ExpiresAt {
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "finishDevice::cfg.db.GetDeviceAuthorization()").
+			Msg("device authorization missing, used or expired")
+
+		// Nobody will pick up the session
+		if err := cfg.revokeSession(c.UserContext(), session); err != nil {
+			log.Error().
+				Err(err).
+				Str("function", "finishDevice::cfg.revokeSession()").
+				Msg("unable to revoke unused session")
+		}
+		c.Status(fiber.StatusBadRequest)
+		return deviceResultPage.Execute(c.Response().BodyWriter(), "The code expired before the login finished. Start the login on your device again.")
+	}
+
+	// The JWT waits in the database until the device polls, so it is stored encrypted
+	encryptedJWT, err := cfg.encryptToken(c.UserContext(), signedJWT)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishDevice::cfg.encryptToken()").
+			Msg("unable to encrypt device token")
+		c.Status(fiber.StatusInternalServerError)
+		return deviceResultPage.Execute(c.Response().BodyWriter(), "Something went wrong. Please report "+guid.String()+" to the admin.")
+	}
+
+	// Only a still pending authorization is approved, so a denial or a concurrent poll isn't overwritten
+	approved, err := cfg.db.ResolveDeviceAuthorizationWithContext(c.UserContext(), device.DeviceCode, database.DeviceApproved, session.SessionID, encryptedJWT)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "finishDevice::cfg.db.ResolveDeviceAuthorization()").
+			Msg("unable to approve device authorization")
+		c.Status(fiber.StatusInternalServerError)
+		return deviceResultPage.Execute(c.Response().BodyWriter(), "Something went wrong. Please report "+guid.String()+" to the admin.")
+	}
+	if !approved {
+		log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "finishDevice::!approved").
+			Msg("device authorization no longer pending")
+		if err := cfg.revokeSession(c.UserContext(), session); err != nil {
+			log.Error().
+				Err(err).
+				Str("function", "finishDevice::cfg.revokeSession()").
+				Msg("unable to revoke unused session")
+		}
+		c.Status(fiber.StatusBadRequest)
+		return deviceResultPage.Execute(c.Response().BodyWriter(), "The code expired before the login finished. Start the login on your device again.")
+	}
+
+	return deviceResultPage.Execute(c.Response().BodyWriter(), "Your device is signed in. You can close this window.")
+}
+
+// denyDevice marks a pending device authorization as denied so the device stops polling
+func (cfg *Config) denyDevice(ctx context.Context, deviceCode string) error {
+	// An authorization approved or denied in the meantime is left alone
+	_, err := cfg.db.ResolveDeviceAuthorizationWithContext(ctx, deviceCode, database.DeviceDenied, "", "")
+	return err
+}
+
+// authDeviceToken is the handler for the /auth/device/token endpoint.
+// Devices poll it (RFC 8628 section 3.4) until the user approved or denied the login.
+func (cfg *Config) authDeviceToken(c *fiber.Ctx) error {
+	// Tokens must never be cached
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if c.FormValue("grant_type") != deviceGrantType {
+		return oidcTokenError(c, fiber.StatusBadRequest, "unsupported_grant_type", "only the '"+deviceGrantType+"' grant type is supported")
+	}
+	deviceCode := c.FormValue("device_code")
+	if deviceCode == "" {
+		return oidcTokenError(c, fiber.StatusBadRequest, "invalid_request", "missing 'device_code'")
+	}
+	deviceCode = hashSecret(deviceCode)
+
+	device, err := cfg.db.GetDeviceAuthorizationWithContext(c.UserContext(), deviceCode)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDeviceToken::cfg.db.GetDeviceAuthorization()").
+			Msg("unable to get device authorization from database")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+	if device == nil {
+		return oidcTokenError(c, fiber.StatusBadRequest, "invalid_grant", "unknown or used device_code")
+	}
+
+	now := time.Now()
+	if now.Unix() > device.ExpiresAt {
+		return oidcTokenError(c, fiber.StatusBadRequest, "expired_token", "the device_code expired; start again")
+	}
+
+	switch device.Status {
+	case database.DeviceDenied:
+		if err := cfg.db.DeleteDeviceAuthorizationWithContext(c.UserContext(), deviceCode); err != nil {
+			log.Error().
+				Err(err).
+				Str("function", "authDeviceToken::cfg.db.DeleteDeviceAuthorization()").
+				Msg("unable to delete denied device authorization")
+		}
+		return oidcTokenError(c, fiber.StatusBadRequest, "access_denied", "the user denied the request")
+
+	case database.DeviceApproved:
+		// The JWT is handed out once
+		device, err = cfg.db.ConsumeDeviceAuthorizationWithContext(c.UserContext(), deviceCode)
+		if err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authDeviceToken::cfg.db.ConsumeDeviceAuthorization()").
+				Msg("unable to consume device authorization")
+			return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+		}
+		if device == nil {
+			return oidcTokenError(c, fiber.StatusBadRequest, "invalid_grant", "unknown or used device_code")
+		}
+		signedJWT, err := cfg.decryptToken(c.UserContext(), device.Token)
+		if err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("method", c.Method()).
+				Str("originalURL", c.OriginalURL()).
+				Str("errRef", guid.String()).
+				Str("function", "authDeviceToken::cfg.decryptToken()").
+				Msg("unable to decrypt device token")
+			return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+		}
+		return c.JSON(&DeviceTokenResponse{
+			AccessToken: signedJWT,
+			TokenType:   "Bearer",
+			ExpiresIn:   int64(sessionTTL.Seconds()),
+			Scope:       device.Scope,
+		})
+	}
+
+	// Still pending. Devices polling too fast have to wait longer from now on.
+	// Only the poll fields are updated, and only while pending, so an approval made meanwhile isn't lost.
+	interval := device.Interval
+	tooFast := now.Unix()-device.LastPolledAt < interval
+	if tooFast {
+		interval += devicePollInterval
+	}
+	if _, err := cfg.db.PollDeviceAuthorizationWithContext(c.UserContext(), deviceCode, now.Unix(), interval); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "authDeviceToken::cfg.db.PollDeviceAuthorization()").
+			Msg("unable to update device authorization")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+	// If the user just approved or denied, the next poll picks it up
+	if tooFast {
+		return oidcTokenError(c, fiber.StatusBadRequest, "slow_down", "poll less often")
+	}
+	return oidcTokenError(c, fiber.StatusBadRequest, "authorization_pending", "the user hasn't finished the login yet")
+}
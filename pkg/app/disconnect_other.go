@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package app
+
+import (
+	"context"
+	"net"
+)
+
+// watchDisconnect doesn't watch for disconnects on this platform: requests run until they finish or time out
+func watchDisconnect(conn net.Conn, cancel context.CancelFunc) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,59 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package app
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestRequestContextDisconnect(t *testing.T) {
+	db := database.NewMemory()
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(db), WithLogger(&log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	ended := make(chan error, 1)
+	app := fiber.New()
+	app.Use(cfg.requestContext)
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		close(started)
+		select {
+		case <-c.UserContext().Done():
+			ended <- c.UserContext().Err()
+		case <-time.After(5 * time.Second):
+			ended <- nil
+		}
+		return nil
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: a.example\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	conn.Close()
+
+	if err := <-ended; err != context.Canceled {
+		t.Errorf("request context ended with %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package app
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// disconnectPollInterval is how often watchDisconnect checks whether the client is still connected
+const disconnectPollInterval = 250 * time.Millisecond
+
+// watchDisconnect calls cancel if the client at the other end of conn disconnects (or half-closes the connection)
+// before stop is called. The server (fasthttp) doesn't read from the connection while a handler runs, so
+// the connection is peeked at: a read of zero bytes or a reset means the client is gone, while a pipelined
+// request is left for the server to read. Connections that aren't sockets, like Lambda's, aren't watched.
+func watchDisconnect(conn net.Conn, cancel context.CancelFunc) (stop func()) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return func() {}
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(disconnectPollInterval)
+		defer ticker.Stop()
+		buf := make([]byte, 1)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			var n int
+			var peekErr error
+			if err := raw.Control(func(fd uintptr) {
+				n, _, peekErr = syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+			}); err != nil {
+				// The connection was closed by the server
+				return
+			}
+			switch {
+			case peekErr == syscall.EAGAIN || peekErr == syscall.EWOULDBLOCK || peekErr == syscall.EINTR:
+				// Connected, nothing sent
+			case peekErr != nil || n == 0:
+				cancel()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
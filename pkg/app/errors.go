@@ -1,5 +1,7 @@
 package app
 
+import "time"
+
 // GeneralRestError is the error returned by the Mastodon API
 type GeneralRestError struct {
 	// ErrorInstanceID is a unique identifier for this error instance; useful for error log cross-referencing
@@ -9,6 +11,28 @@ type GeneralRestError struct {
 	ErrorMessage string `json:"error_message"`
 }
 
+// InsufficientScopeError is returned when the session's access token lacks the scopes a route needs
+type InsufficientScopeError struct {
+	// ErrorInstanceID is a unique identifier for this error instance; useful for error log cross-referencing
+	ErrorInstanceID string `json:"error_instance_id"`
+
+	// ErrorCode is always "insufficient_scope"
+	ErrorCode string `json:"error"`
+
+	// ErrorMessage is the error message returned to the user
+	ErrorMessage string `json:"error_message"`
+
+	// RequiredScopes are the scopes the route needs
+	RequiredScopes []string `json:"required_scopes"`
+
+	// GrantedScopes are the scopes the user granted
+	GrantedScopes []string `json:"granted_scopes"`
+
+	// UpgradeURI is the endpoint that starts a login granting the missing scopes.
+	// Empty for API keys, which can't be upgraded.
+	UpgradeURI string `json:"upgrade_uri,omitempty"`
+}
+
 // NoDB is returned when the no database is provided
 type NoDB struct {
 	Err error
@@ -25,3 +49,90 @@ func (e *NoDB) Error() string {
 	}
 	return e.Msg
 }
+
+// InstanceNotPermitted is returned when an instance may not be used to login
+type InstanceNotPermitted struct {
+	Err error
+	Msg string
+}
+
+// Error returns the error message
+func (e *InstanceNotPermitted) Error() string {
+	if e.Msg == "" {
+		e.Msg = "instance not permitted"
+	}
+	if e.Err != nil {
+		e.Msg += ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+// UnsupportedSoftware is returned when an instance runs server software mastostart can't login with
+type UnsupportedSoftware struct {
+	Err error
+	Msg string
+}
+
+// Error returns the error message
+func (e *UnsupportedSoftware) Error() string {
+	if e.Msg == "" {
+		e.Msg = "unsupported server software"
+	}
+	if e.Err != nil {
+		e.Msg += ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+// ScopeNotRegistered is returned when a login requests scopes the app isn't registered with
+type ScopeNotRegistered struct {
+	Err error
+	Msg string
+}
+
+// Error returns the error message
+func (e *ScopeNotRegistered) Error() string {
+	if e.Msg == "" {
+		e.Msg = "scope not registered"
+	}
+	if e.Err != nil {
+		e.Msg += ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+// RateLimited is returned when a rate limit is exceeded
+type RateLimited struct {
+	Err        error
+	Msg        string
+	RetryAfter time.Duration
+}
+
+// Error returns the error message
+func (e *RateLimited) Error() string {
+	if e.Msg == "" {
+		e.Msg = "too many requests"
+	}
+	if e.Err != nil {
+		e.Msg += ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+// InvalidSetting is returned when a config item's value is invalid. Msg is the config key.
+type InvalidSetting struct {
+	Err error
+	Msg string
+}
+
+// Error returns the error message
+func (e *InvalidSetting) Error() string {
+	msg := "invalid setting"
+	if e.Msg != "" {
+		msg += " " + e.Msg
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
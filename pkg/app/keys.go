@@ -0,0 +1,245 @@
+package app
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// keyringTTL is how long loaded signing keys are used before being reloaded from the database
+	keyringTTL = 5 * time.Minute
+
+	// keyringMinRefresh limits how often an unknown "kid" can force a reload
+	keyringMinRefresh = 30 * time.Second
+
+	// legacyKeyID is the key ID of the single, pre-rotation jwt_signing_key config item
+	legacyKeyID = "legacy"
+)
+
+// keyring holds the JWT signing keys that are not retired
+type keyring struct {
+	// activeKeyID is the key ID used to sign new JWTs
+	activeKeyID string
+
+	// keys maps key IDs to keys; all of them verify JWTs
+	keys map[string]*rsa.PrivateKey
+
+	// loadedAt is when the keyring was loaded from the database
+	loadedAt time.Time
+}
+
+// getKeyring returns the cached keyring, reloading it from the database when it is stale.
+// Set refresh to reload it early (eg: when a JWT references an unknown key ID).
+func (cfg *Config) getKeyring(ctx context.Context, refresh bool) (*keyring, error) {
+	cfg.keyringMu.Lock()
+	defer cfg.keyringMu.Unlock()
+
+	if cfg.keyring != nil {
+		age := time.Since(cfg.keyring.loadedAt)
+		if age < keyringTTL && (!refresh || age < keyringMinRefresh) {
+			return cfg.keyring, nil
+		}
+	}
+
+	ring, err := cfg.loadKeyring(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg.keyring = ring
+	return ring, nil
+}
+
+// loadKeyring loads the JWT signing keys from the database
+func (cfg *Config) loadKeyring(ctx context.Context) (*keyring, error) {
+	ring := &keyring{
+		keys:     make(map[string]*rsa.PrivateKey),
+		loadedAt: time.Now(),
+	}
+	var activatedAt time.Time
+
+	// Get the signing keys from the database
+	signingKeys, err := cfg.db.ListSigningKeysWithContext(ctx)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("function", "app::loadKeyring()::cfg.db.ListSigningKeys()").
+			Str("errRef", guid.String()).
+			Msg("Error getting JWT signing keys from database")
+		return nil, errors.New(guid.String() + ": Error getting JWT signing keys from database")
+	}
+
+	for _, signingKey := range signingKeys {
+		if signingKey.Status == database.SigningKeyRetired {
+			continue
+		}
+		privateKey, err := parseRSAPrivateKeyPEM(signingKey.PrivateKey)
+		if err != nil {
+			guid := xid.New()
+			log.Error().
+				Err(err).
+				Str("function", "app::loadKeyring()::parseRSAPrivateKeyPEM()").
+				Str("kid", signingKey.KeyID).
+				Str("errRef", guid.String()).
+				Msg("Unable to parse JWT signing key; skipping it")
+			continue
+		}
+		ring.keys[signingKey.KeyID] = privateKey
+		if signingKey.Status == database.SigningKeyActive {
+			ring.activeKeyID = signingKey.KeyID
+			activatedAt = time.Unix(signingKey.UpdatedAt, 0)
+		}
+	}
+
+	// The pre-rotation jwt_signing_key signs new JWTs until a key in the keys table is activated.
+	// It verifies the JWTs it signed until they have all expired: sessionTTL after the activation.
+	settings, err := cfg.getSettings(ctx)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("function", "app::loadKeyring()::cfg.getSettings()").
+			Str("errRef", guid.String()).
+			Msg("Error loading settings")
+		return nil, errors.New(guid.String() + ": Error loading settings")
+	}
+	if settings.legacySigningKey != nil {
+		if ring.activeKeyID == "" {
+			ring.keys[legacyKeyID] = settings.legacySigningKey
+			ring.activeKeyID = legacyKeyID
+		} else if time.Since(activatedAt) < sessionTTL {
+			ring.keys[legacyKeyID] = settings.legacySigningKey
+		} else {
+			log.Warn().
+				Str("function", "app::loadKeyring()").
+				Str("activeKeyID", ring.activeKeyID).
+				Msg("the legacy jwt_signing_key no longer verifies JWTs; delete the config item")
+		}
+	}
+
+	if ring.activeKeyID == "" {
+		guid := xid.New()
+		log.Error().
+			Str("function", "app::loadKeyring()").
+			Str("errRef", guid.String()).
+			Msg("No active JWT signing key. Maybe run setup?")
+		return nil, errors.New(guid.String() + ": No active JWT signing key")
+	}
+
+	return ring, nil
+}
+
+// signJWT signs claims with the active signing key
+func (cfg *Config) signJWT(ctx context.Context, claims jwt.Claims) (string, error) {
+	ring, err := cfg.getKeyring(ctx, false)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = ring.activeKeyID
+	return token.SignedString(ring.keys[ring.activeKeyID])
+}
+
+// jwtKeyFunc returns the jwt.Keyfunc for a request; keys are loaded with the request's context
+func (cfg *Config) jwtKeyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		return cfg.verifyingKey(ctx, token)
+	}
+}
+
+// verifyingKey supplies the public key to verify a JWT with, based on its "kid" header
+func (cfg *Config) verifyingKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+		return nil, errors.New("unexpected JWT signing method: " + token.Method.Alg())
+	}
+
+	// JWTs signed before key rotation have no kid
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyKeyID
+	}
+
+	ring, err := cfg.getKeyring(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := ring.keys[kid]; ok {
+		return key.Public(), nil
+	}
+
+	// The key may have been added since the keyring was loaded
+	if ring, err = cfg.getKeyring(ctx, true); err != nil {
+		return nil, err
+	}
+	if key, ok := ring.keys[kid]; ok {
+		return key.Public(), nil
+	}
+	return nil, errors.New("unknown JWT signing key: " + kid)
+}
+
+// wellKnownJWKS is the handler for the /.well-known/jwks.json endpoint
+func (cfg *Config) wellKnownJWKS(c *fiber.Ctx) error {
+	ring, err := cfg.getKeyring(c.UserContext(), false)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "wellKnownJWKS::cfg.getKeyring()").
+			Msg("unable to load JWT signing keys")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// Publish every non-retired public key, sorted for a stable document
+	kids := make([]string, 0, len(ring.keys))
+	for kid := range ring.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	jwks := &JWKS{Keys: make([]JWK, 0, len(kids))}
+	for _, kid := range kids {
+		publicKey := ring.keys[kid].PublicKey
+		jwks.Keys = append(jwks.Keys, JWK{
+			KeyType:   "RSA",
+			Use:       "sig",
+			Algorithm: jwt.SigningMethodRS256.Alg(),
+			KeyID:     kid,
+			Modulus:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(jwks)
+}
+
+// parseRSAPrivateKeyPEM parses a PEM encoded RSA private key
+func parseRSAPrivateKeyPEM(encoded string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("unable to decode RSA private key PEM")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
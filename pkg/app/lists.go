@@ -8,7 +8,6 @@ import (
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/mattn/go-mastodon"
 	"github.com/rmrfslashbin/mastostart/pkg/database"
 	"github.com/rs/xid"
@@ -20,7 +19,9 @@ func (cfg *Config) apiAccountsInList(c *fiber.Ctx) error {
 
 	flight, err := cfg.preflight(
 		&PreflightInput{
-			jwtToken: c.Locals("user").(*jwt.Token),
+			ctx:     c.UserContext(),
+			session: c.Locals("session").(*database.UserCredentials),
+			linked:  linkedAccount(c),
 		},
 	)
 	if err != nil {
@@ -39,7 +40,7 @@ func (cfg *Config) apiAccountsInList(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
-	listSlice, err := flight.Client.MyLists(&listID)
+	listSlice, err := flight.Client.MyListsWithContext(c.UserContext(), &listID)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -75,7 +76,7 @@ func (cfg *Config) apiAccountsInList(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
 	}
 
-	accounts, err := flight.Client.GetAccountsInList(&listID)
+	accounts, err := flight.Client.GetAccountsInListWithContext(c.UserContext(), &listID)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -98,9 +99,10 @@ func (cfg *Config) apiAccountsInList(c *fiber.Ctx) error {
 	saved := false
 	public := false
 	psk := ""
-	if strings.ToLower(c.Query("save", "false")) == "true" {
+	// POST saves the list. GET saves it with ?save=true, the older form; checkCSRF treats that as a state change.
+	if c.Method() == fiber.MethodPost || strings.ToLower(c.Query("save", "false")) == "true" {
 		saved = true
-		if strings.ToLower(c.Query("public", "false")) == "true" {
+		if strings.ToLower(c.Query("public", c.FormValue("public", "false"))) == "true" {
 			public = true
 		}
 
@@ -126,7 +128,7 @@ func (cfg *Config) apiAccountsInList(c *fiber.Ctx) error {
 		psk = base64.StdEncoding.EncodeToString(b)[0:32]
 		instanceURL, _ := url.Parse(*flight.InstanceURL)
 
-		if err = cfg.db.PutList(&database.List{
+		if err = cfg.db.PutListWithContext(c.UserContext(), &database.List{
 			Instance:    instanceURL.Host,
 			ListID:      string(listID),
 			ListTitle:   list.Title,
@@ -157,9 +159,11 @@ func (cfg *Config) apiAccountsInList(c *fiber.Ctx) error {
 			userIDs[i] = string(account.ID)
 		}
 
-		if err = cfg.db.PutAccountsInList(&database.ListMember{
-			ListID:  string(listID),
-			UserIDs: userIDs,
+		if err = cfg.db.PutAccountsInListWithContext(c.UserContext(), &database.ListMember{
+			Instance:    instanceURL.Host,
+			OwnerUserID: string(*flight.Userid),
+			ListID:      string(listID),
+			UserIDs:     userIDs,
 		}); err != nil {
 			guid := xid.New()
 			log.Error().
@@ -195,7 +199,9 @@ func (cfg *Config) apiAccountsInList(c *fiber.Ctx) error {
 func (cfg *Config) apiMyLists(c *fiber.Ctx) error {
 	flight, err := cfg.preflight(
 		&PreflightInput{
-			jwtToken: c.Locals("user").(*jwt.Token),
+			ctx:     c.UserContext(),
+			session: c.Locals("session").(*database.UserCredentials),
+			linked:  linkedAccount(c),
 		},
 	)
 	if err != nil {
@@ -214,7 +220,7 @@ func (cfg *Config) apiMyLists(c *fiber.Ctx) error {
 		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
 	}
 
-	lists, err := flight.Client.MyLists(nil)
+	lists, err := flight.Client.MyListsWithContext(c.UserContext(), nil)
 	if err != nil {
 		guid := xid.New()
 		log.Error().
@@ -0,0 +1,295 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mattn/go-mastodon"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
+	"github.com/rs/xid"
+)
+
+const (
+	// loginAttemptTTL is how long a login attempt (and its state) is valid for
+	loginAttemptTTL = 10 * time.Minute
+
+	// stateCookiePrefix starts the names of the cookies binding login attempts to the browser that started them
+	stateCookiePrefix = "mastostart_state_"
+)
+
+// beginLogin starts a login against an instance and returns the instance's authorize URL.
+// attempt carries anything the callback needs to finish the login; its State, InstanceURL,
+// CodeVerifier and timestamps are set here. Returns *InstanceNotPermitted if the instance
+// is not allowed to login.
+func (cfg *Config) beginLogin(ctx context.Context, instanceURL *url.URL, attempt *database.LoginAttempt) (*url.URL, error) {
+	instanceURL = normalizeInstanceURL(instanceURL)
+
+	permitted, err := cfg.checkPermitInstanceList(ctx, instanceURL)
+	if err != nil {
+		return nil, err
+	}
+	if !*permitted {
+		return nil, &InstanceNotPermitted{Msg: "instance not permitted: " + instanceURL.Host}
+	}
+
+	// Don't let anyone hammer an instance through us
+	if err := cfg.checkInstanceRate(ctx, instanceURL); err != nil {
+		return nil, err
+	}
+
+	// Get/Setup App credentials
+	appCreds, err := cfg.getAppCreds(ctx, instanceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only scopes the app is registered with can be requested
+	if attempt.Scope != "" && len(appCreds.Scopes) > 0 {
+		if missing := missingScopes(appCreds.Scopes, parseScopes(attempt.Scope)); len(missing) > 0 {
+			return nil, &ScopeNotRegistered{Msg: "app not registered with scopes: " + strings.Join(missing, " ")}
+		}
+	}
+
+	// Mint a per-attempt state to tie the callback to this login
+	state, err := randomString(32)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("errRef", guid.String()).
+			Str("function", "beginLogin::randomString(32)").
+			Msg("failed getting random bytes for state")
+		return nil, errors.New(guid.String() + ": failed getting random bytes for state")
+	}
+
+	// Use PKCE if the instance advertises it. Older instances don't, so fall back to the plain code flow.
+	codeVerifier := ""
+	instanceUrlStr := instanceURL.String()
+	mc, err := mastoclient.New(
+		mastoclient.WithInstance(&instanceUrlStr),
+		mastoclient.WithLogger(cfg.log),
+		mastoclient.WithTimeouts(cfg.timeouts.Mastodon),
+	)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("errRef", guid.String()).
+			Str("function", "beginLogin::mastoclient.New()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to create mastoclient")
+		return nil, errors.New(guid.String() + ": unable to create mastoclient")
+	}
+	if pkce, err := mc.SupportsPKCEWithContext(ctx); err != nil {
+		cfg.log.Debug().
+			Err(err).
+			Str("function", "beginLogin::mc.SupportsPKCE()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to detect PKCE support; continuing without PKCE")
+	} else if pkce {
+		if codeVerifier, err = randomString(48); err != nil {
+			guid := xid.New()
+			cfg.log.Error().
+				Err(err).
+				Str("errRef", guid.String()).
+				Str("function", "beginLogin::randomString(48)").
+				Msg("failed getting random bytes for PKCE code verifier")
+			return nil, errors.New(guid.String() + ": failed getting random bytes for PKCE code verifier")
+		}
+	}
+
+	// Persist the login attempt so the callback can verify the state (and send the PKCE verifier)
+	now := time.Now()
+	attempt.State = state
+	attempt.InstanceURL = instanceURL.Host
+	attempt.CodeVerifier = codeVerifier
+	attempt.CreatedAt = now.Unix()
+	attempt.ExpiresAt = now.Add(loginAttemptTTL).Unix()
+	if err := cfg.db.PutLoginAttemptWithContext(ctx, attempt); err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("errRef", guid.String()).
+			Str("function", "beginLogin::cfg.db.PutLoginAttempt()").
+			Msg("error saving login attempt to ddb")
+		return nil, errors.New(guid.String() + ": error saving login attempt to ddb")
+	}
+
+	// Add the state (and PKCE challenge) to the authorize URL
+	authURI, err := url.Parse(appCreds.AuthURI)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("errRef", guid.String()).
+			Str("function", "beginLogin::url.Parse(appCreds.AuthURI)").
+			Str("authURI", appCreds.AuthURI).
+			Msg("error parsing stored auth uri")
+		return nil, errors.New(guid.String() + ": error parsing stored auth uri")
+	}
+	query := authURI.Query()
+	query.Set("state", state)
+	if attempt.Scope != "" {
+		query.Set("scope", attempt.Scope)
+	}
+	if codeVerifier != "" {
+		query.Set("code_challenge", pkceChallenge(codeVerifier))
+		query.Set("code_challenge_method", "S256")
+	}
+	authURI.RawQuery = query.Encode()
+
+	return authURI, nil
+}
+
+// stateCookieName returns the name of the cookie holding a login attempt's state.
+// Each state gets its own cookie, so logins started in two tabs of a browser don't overwrite each other's.
+func stateCookieName(state string) string {
+	return stateCookiePrefix + hashSecret(state)[:8]
+}
+
+// setStateCookie binds a login attempt's state to the browser; the callback rejects a mismatched cookie
+func setStateCookie(c *fiber.Ctx, state string) {
+	c.Cookie(&fiber.Cookie{
+		Name:     stateCookieName(state),
+		Value:    state,
+		Path:     "/auth/callback",
+		Expires:  time.Now().Add(loginAttemptTTL),
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// resolveHandle resolves a fediverse handle (@user@domain) to the instance serving the account
+func (cfg *Config) resolveHandle(ctx context.Context, handle string) (*url.URL, error) {
+	ctx, cancel := mastoclient.WithTimeout(ctx, cfg.timeouts.Mastodon.Discovery)
+	defer cancel()
+	instanceURL, err := mastoclient.ResolveHandleWithContext(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+	cfg.log.Debug().
+		Str("function", "resolveHandle::mastoclient.ResolveHandle()").
+		Str("handle", handle).
+		Str("instanceURL", instanceURL.Host).
+		Msg("resolved handle")
+	return instanceURL, nil
+}
+
+// issueSession stores a new session for a Mastodon account and returns it with a signed JWT referencing it.
+// scopes are the scopes the user granted the access token; the session and the JWT expire after ttl.
+func (cfg *Config) issueSession(ctx context.Context, me *mastodon.Account, instanceHost string, accessToken string, scopes []string, ttl time.Duration) (string, *database.UserCredentials, error) {
+	// Get the app name
+	settings, err := cfg.getSettings(ctx)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "issueSession::cfg.getSettings()").
+			Str("errRef", guid.String()).
+			Msg("Unable to load settings")
+		return "", nil, errors.New(guid.String() + ": Unable to load settings")
+	}
+	appName := settings.AppName
+
+	// Encrypt the user's Mastodon access token for storage
+	encryptedToken, err := cfg.encryptToken(ctx, accessToken)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "issueSession::cfg.encryptToken(accessToken)").
+			Str("errRef", guid.String()).
+			Msg("Unable to encrypt access token")
+		return "", nil, errors.New(guid.String() + ": Unable to encrypt access token")
+	}
+
+	// Link the account to its identity (or start a new one)
+	identityID, err := cfg.linkLogin(ctx, me, instanceHost, encryptedToken, scopes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Accounts in admin_accounts get the admin claim
+	admin, err := cfg.isAdminAccount(ctx, me.URL)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "issueSession::cfg.isAdminAccount(me.URL)").
+			Str("errRef", guid.String()).
+			Msg("Unable get admin_accounts from database")
+		return "", nil, errors.New(guid.String() + ": Unable get admin_accounts from database")
+	}
+
+	// Mint an opaque session ID for the JWT
+	sessionID, err := randomString(32)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "issueSession::randomString(32)").
+			Str("errRef", guid.String()).
+			Msg("failed getting random bytes for session ID")
+		return "", nil, errors.New(guid.String() + ": failed getting random bytes for session ID")
+	}
+
+	// Store the session (and the encrypted access token) server side
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	session := &database.UserCredentials{
+		SessionID:   sessionID,
+		IdentityID:  identityID,
+		AccountURL:  me.URL,
+		InstanceURL: instanceHost,
+		UserID:      string(me.ID),
+		AccessToken: encryptedToken,
+		Scopes:      scopes,
+		CreatedAt:   now.Unix(),
+		ExpiresAt:   expiresAt.Unix(),
+	}
+	if err := cfg.db.PutUserCredentialsWithContext(ctx, session); err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "issueSession::cfg.db.PutUserCredentials()").
+			Str("errRef", guid.String()).
+			Msg("Unable to save session to database")
+		return "", nil, errors.New(guid.String() + ": Unable to save session to database")
+	}
+
+	// Create the JWT claims
+	claims := JWTClaims{
+		sessionID, // Reference the server-side session; the access token never leaves the server
+		admin,     // Admin routes also check admin_accounts on every request
+		jwt.RegisteredClaims{
+			// A usual scenario is to set the expiration time relative to the current time
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    appName,
+			Subject:   identityID,         // The mastostart identity; linked accounts share it
+			ID:        xid.New().String(), // Unique token ID; used to revoke this JWT
+		},
+	}
+
+	// Sign the JWT with the active signing key
+	signedJWT, err := cfg.signJWT(ctx, claims)
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("function", "issueSession::cfg.signJWT(claims)").
+			Str("errRef", guid.String()).
+			Msg("Unable to sign JWT with RSA private key")
+		return "", nil, errors.New(guid.String() + ": Unable to sign JWT with RSA private key")
+	}
+
+	return signedJWT, session, nil
+}
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mattn/go-mastodon"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestIssueSessionTTL(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	tokenKey := make([]byte, 32)
+	rand.Read(tokenKey)
+	db := database.NewMemory()
+	db.PutConfig(&database.ConfigItem{ConfigKey: "jwt_signing_key", ConfigValue: string(pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+	}))})
+	db.PutConfig(&database.ConfigItem{ConfigKey: "token_encryption_key", ConfigValue: base64.StdEncoding.EncodeToString(tokenKey)})
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(db), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{"session", sessionTTL},
+		{"oidc login", oidcSessionTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			me := &mastodon.Account{ID: "1", URL: "https://example.social/@user"}
+			signedJWT, session, err := cfg.issueSession(context.Background(), me, "example.social", "token", []string{"read"}, tt.ttl)
+			if err != nil {
+				t.Fatalf("issueSession: %v", err)
+			}
+
+			want := time.Now().Add(tt.ttl).Unix()
+			if session.ExpiresAt < want-5 || session.ExpiresAt > want {
+				t.Errorf("session expires at %d, want about %d", session.ExpiresAt, want)
+			}
+			stored, err := db.GetUserCredentials(session.SessionID)
+			if err != nil || stored == nil || stored.ExpiresAt != session.ExpiresAt {
+				t.Errorf("stored session = %+v, %v", stored, err)
+			}
+
+			claims := &JWTClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(signedJWT, claims); err != nil {
+				t.Fatalf("ParseUnverified: %v", err)
+			}
+			if claims.ExpiresAt.Unix() != session.ExpiresAt {
+				t.Errorf("JWT expires at %d, session at %d", claims.ExpiresAt.Unix(), session.ExpiresAt)
+			}
+		})
+	}
+}
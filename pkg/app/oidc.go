@@ -0,0 +1,610 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/mattn/go-mastodon"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// authCodeTTL is how long an authorization code can be exchanged for
+	authCodeTTL = 2 * time.Minute
+
+	// idTokenTTL is how long an ID token (and the access token issued with it) is valid for
+	idTokenTTL = time.Hour
+
+	// oidcSessionTTL is how long the session behind an OpenID Connect login lives: long enough to exchange
+	// the code and use the access token issued for it, and no longer. It is then deleted like any expired session.
+	oidcSessionTTL = authCodeTTL + idTokenTTL
+
+	// userinfoPath is the userinfo endpoint; appended to the issuer it is the audience of OIDC access tokens
+	userinfoPath = "/oidc/userinfo"
+)
+
+// oidcInstanceForm asks the user which Mastodon instance to sign in with.
+// The authorize request is carried through as hidden fields.
+var oidcInstanceForm = template.Must(template.New("instance").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in with Mastodon</title></head>
+<body>
+<form method="get" action="/oidc/authorize">
+{{range $k, $v := .}}<input type="hidden" name="{{$k}}" value="{{$v}}">
+{{end}}<label>Your Mastodon instance (eg: mastodon.social) <input type="text" name="instance_url" required></label>
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+// getIssuer gets the OpenID Connect issuer URL.
+// Uses the oidc_issuer config item, falling back to the origin of the redirect_uri config item.
+func (cfg *Config) getIssuer(ctx context.Context) (string, error) {
+	settings, err := cfg.getSettings(ctx)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("function", "getIssuer::cfg.getSettings()").
+			Str("errRef", guid.String()).
+			Msg("Unable to load settings")
+		return "", errors.New(guid.String() + ": Unable to load settings")
+	}
+	if settings.Issuer == "" {
+		return "", errors.New("neither oidc_issuer nor redirect_uri are set. Maybe run setup?")
+	}
+	return settings.Issuer, nil
+}
+
+// oidcDiscovery is the handler for the /.well-known/openid-configuration endpoint
+func (cfg *Config) oidcDiscovery(c *fiber.Ctx) error {
+	issuer, err := cfg.getIssuer(c.UserContext())
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcDiscovery::cfg.getIssuer()").
+			Msg("unable to get issuer")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(&OIDCDiscovery{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oidc/authorize",
+		TokenEndpoint:                     issuer + "/oidc/token",
+		UserinfoEndpoint:                  issuer + userinfoPath,
+		JWKSURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{jwt.SigningMethodRS256.Alg()},
+		ScopesSupported:                   []string{"openid", "profile"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name", "preferred_username", "profile", "picture"},
+	})
+}
+
+// oidcAuthorize is the handler for the /oidc/authorize endpoint
+func (cfg *Config) oidcAuthorize(c *fiber.Ctx) error {
+	clientID := c.Query("client_id")
+	redirectURI := c.Query("redirect_uri")
+	state := c.Query("state")
+
+	// Validate the client and redirect URI. Until both are known good, errors can't be redirected.
+	client, err := cfg.db.GetOIDCClientWithContext(c.UserContext(), clientID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcAuthorize::cfg.db.GetOIDCClient(clientID)").
+			Msg("unable to get oidc client from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if client == nil || !containsString(client.RedirectURIs, redirectURI) {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcAuthorize::client.RedirectURIs").
+			Str("clientID", clientID).
+			Str("redirectURI", redirectURI).
+			Msg("unknown client_id or redirect_uri")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "unknown 'client_id' or unregistered 'redirect_uri'",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	if c.Query("response_type") != "code" {
+		return oidcRedirectError(c, redirectURI, state, "unsupported_response_type", "only the 'code' response type is supported")
+	}
+
+	scopes := strings.Fields(c.Query("scope"))
+	if !containsString(scopes, "openid") {
+		return oidcRedirectError(c, redirectURI, state, "invalid_scope", "the 'openid' scope is required")
+	}
+
+	codeChallenge := c.Query("code_challenge")
+	codeChallengeMethod := c.Query("code_challenge_method")
+	if codeChallenge != "" && codeChallengeMethod != "S256" {
+		return oidcRedirectError(c, redirectURI, state, "invalid_request", "only the 'S256' code_challenge_method is supported")
+	}
+	if codeChallenge == "" && client.ClientSecretHash == "" {
+		return oidcRedirectError(c, redirectURI, state, "invalid_request", "public clients must use PKCE")
+	}
+
+	// Which instance to sign in with: instance_url, or the instance serving an acct login_hint (user@domain)
+	rawInstanceURL := c.Query("instance_url")
+	if rawInstanceURL == "" {
+		if hint := c.Query("login_hint"); strings.Contains(strings.TrimPrefix(hint, "@"), "@") {
+			resolved, err := cfg.resolveHandle(c.UserContext(), hint)
+			if err != nil {
+				cfg.log.Debug().
+					Err(err).
+					Str("function", "oidcAuthorize::cfg.resolveHandle(login_hint)").
+					Str("loginHint", hint).
+					Msg("unable to resolve login_hint; asking for the instance")
+			} else {
+				rawInstanceURL = resolved.String()
+			}
+		}
+	}
+	if rawInstanceURL == "" {
+		// Ask the user, carrying the authorize request along
+		params := make(map[string]string)
+		for k, v := range c.Queries() {
+			params[k] = v
+		}
+		c.Type("html", "utf-8")
+		return oidcInstanceForm.Execute(c.Response().BodyWriter(), params)
+	}
+	if !strings.Contains(rawInstanceURL, "://") {
+		rawInstanceURL = "https://" + rawInstanceURL
+	}
+	instanceURL, err := url.Parse(rawInstanceURL)
+	if err != nil || instanceURL.Host == "" {
+		return oidcRedirectError(c, redirectURI, state, "invalid_request", "unable to parse instance_url")
+	}
+
+	// Hand the authentication off to the Mastodon login
+	attempt := &database.LoginAttempt{
+		OIDC: &database.OIDCAuthorizeRequest{
+			ClientID:            clientID,
+			RedirectURI:         redirectURI,
+			State:               state,
+			Nonce:               c.Query("nonce"),
+			Scope:               strings.Join(scopes, " "),
+			CodeChallenge:       codeChallenge,
+			CodeChallengeMethod: codeChallengeMethod,
+		},
+	}
+	authURI, err := cfg.beginLogin(c.UserContext(), instanceURL, attempt)
+	if err != nil {
+		var notPermitted *InstanceNotPermitted
+		if errors.As(err, &notPermitted) {
+			return oidcRedirectError(c, redirectURI, state, "access_denied", "instance not permitted")
+		}
+		var unsupported *UnsupportedSoftware
+		if errors.As(err, &unsupported) {
+			return oidcRedirectError(c, redirectURI, state, "access_denied", unsupported.Msg)
+		}
+		var limited *RateLimited
+		if errors.As(err, &limited) {
+			return oidcRedirectError(c, redirectURI, state, "temporarily_unavailable", limited.Error())
+		}
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "oidcAuthorize::cfg.beginLogin()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to start login")
+		return oidcRedirectError(c, redirectURI, state, "server_error", "unable to start the login")
+	}
+
+	// Bind the state to this browser; the callback rejects a mismatched cookie
+	setStateCookie(c, attempt.State)
+
+	return c.Redirect(authURI.String(), fiber.StatusFound)
+}
+
+// oidcFinishAuthorize completes an OpenID Connect authorize request once the Mastodon login is done.
+// It sends the user back to the client with a one-time authorization code.
+// The session JWT isn't stored with the code: the client gets an access token that only works for userinfo.
+func (cfg *Config) oidcFinishAuthorize(c *fiber.Ctx, request *database.OIDCAuthorizeRequest, session *database.UserCredentials, me *mastodon.Account) error {
+	code, err := randomString(32)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "oidcFinishAuthorize::randomString(32)").
+			Msg("failed getting random bytes for authorization code")
+		return oidcRedirectError(c, request.RedirectURI, request.State, "server_error", "unable to issue an authorization code")
+	}
+
+	now := time.Now()
+	if err := cfg.db.PutAuthCodeWithContext(c.UserContext(), &database.AuthCode{
+		Code:                hashSecret(code),
+		ClientID:            request.ClientID,
+		RedirectURI:         request.RedirectURI,
+		Nonce:               request.Nonce,
+		Scope:               request.Scope,
+		CodeChallenge:       request.CodeChallenge,
+		CodeChallengeMethod: request.CodeChallengeMethod,
+		SessionID:           session.SessionID,
+		Subject:             me.URL,
+		Name:                me.DisplayName,
+		PreferredUsername:   me.Acct + "@" + session.InstanceURL,
+		Picture:             me.Avatar,
+		AuthTime:            now.Unix(),
+		ExpiresAt:           now.Add(authCodeTTL).Unix(),
+	}); err != nil {
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "oidcFinishAuthorize::cfg.db.PutAuthCode()").
+			Msg("unable to save authorization code")
+		return oidcRedirectError(c, request.RedirectURI, request.State, "server_error", "unable to issue an authorization code")
+	}
+
+	redirectURI, _ := url.Parse(request.RedirectURI)
+	query := redirectURI.Query()
+	query.Set("code", code)
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	redirectURI.RawQuery = query.Encode()
+	return c.Redirect(redirectURI.String(), fiber.StatusFound)
+}
+
+// oidcToken is the handler for the /oidc/token endpoint
+func (cfg *Config) oidcToken(c *fiber.Ctx) error {
+	// Tokens must never be cached
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if c.FormValue("grant_type") != "authorization_code" {
+		return oidcTokenError(c, fiber.StatusBadRequest, "unsupported_grant_type", "only the 'authorization_code' grant type is supported")
+	}
+
+	// Client authentication: HTTP Basic or form fields
+	clientID, clientSecret, basic := basicAuth(c)
+	if !basic {
+		clientID = c.FormValue("client_id")
+		clientSecret = c.FormValue("client_secret")
+	}
+
+	client, err := cfg.db.GetOIDCClientWithContext(c.UserContext(), clientID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcToken::cfg.db.GetOIDCClient(clientID)").
+			Msg("unable to get oidc client from database")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+	if client == nil {
+		return oidcTokenError(c, fiber.StatusUnauthorized, "invalid_client", "unknown client")
+	}
+	if client.ClientSecretHash != "" && subtle.ConstantTimeCompare([]byte(hashSecret(clientSecret)), []byte(client.ClientSecretHash)) != 1 {
+		return oidcTokenError(c, fiber.StatusUnauthorized, "invalid_client", "client authentication failed")
+	}
+
+	// Codes are single use. Only the client a code was issued to can use it up.
+	authCode, err := cfg.db.ConsumeAuthCodeWithContext(c.UserContext(), hashSecret(c.FormValue("code")), client.ClientID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcToken::cfg.db.ConsumeAuthCode()").
+			Msg("unable to get authorization code from database")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+	if authCode == nil || time.Now().Unix() > authCode.ExpiresAt {
+		return oidcTokenError(c, fiber.StatusBadRequest, "invalid_grant", "unknown, used or expired code")
+	}
+	if authCode.RedirectURI != c.FormValue("redirect_uri") {
+		return oidcTokenError(c, fiber.StatusBadRequest, "invalid_grant", "code was issued to another redirect_uri")
+	}
+	if authCode.CodeChallenge != "" {
+		verifier := c.FormValue("code_verifier")
+		if verifier == "" || subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(authCode.CodeChallenge)) != 1 {
+			return oidcTokenError(c, fiber.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+		}
+	}
+
+	issuer, err := cfg.getIssuer(c.UserContext())
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcToken::cfg.getIssuer()").
+			Msg("unable to get issuer")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+
+	// Build the ID token from the profile snapshot taken at login
+	now := time.Now()
+	claims := &IDTokenClaims{
+		Nonce:    authCode.Nonce,
+		AuthTime: authCode.AuthTime,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   authCode.Subject,
+			Audience:  jwt.ClaimStrings{client.ClientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(idTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        xid.New().String(),
+		},
+	}
+	if containsString(strings.Fields(authCode.Scope), "profile") {
+		claims.Name = authCode.Name
+		claims.PreferredUsername = authCode.PreferredUsername
+		claims.Profile = authCode.Subject
+		claims.Picture = authCode.Picture
+	}
+
+	idToken, err := cfg.signJWT(c.UserContext(), claims)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcToken::cfg.signJWT(claims)").
+			Msg("unable to sign ID token")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+
+	// The access token is limited to userinfo (its audience) and the granted scope; it is never a session JWT
+	accessToken, err := cfg.signJWT(c.UserContext(), &OIDCAccessTokenClaims{
+		SessionID: authCode.SessionID,
+		Scope:     authCode.Scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Subject:   authCode.Subject,
+			Audience:  jwt.ClaimStrings{issuer + userinfoPath},
+			ExpiresAt: jwt.NewNumericDate(now.Add(idTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        xid.New().String(),
+		},
+	})
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcToken::cfg.signJWT(accessTokenClaims)").
+			Msg("unable to sign access token")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+
+	return c.JSON(&OIDCTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(idTokenTTL.Seconds()),
+		IDToken:     idToken,
+		Scope:       authCode.Scope,
+	})
+}
+
+// loadOIDCAccessToken is the middleware for the /oidc/userinfo endpoint. It only accepts the access tokens
+// issued by oidcToken (not session JWTs or API keys), and loads their claims into c.Locals("oidcAccessToken")
+// and their session into c.Locals("session").
+func (cfg *Config) loadOIDCAccessToken(c *fiber.Ctx) error {
+	// Errors are sent as RFC 6750 bearer token errors
+	invalidToken := func(description string) error {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return oidcTokenError(c, fiber.StatusUnauthorized, "invalid_token", description)
+	}
+
+	auth := c.Get(fiber.HeaderAuthorization)
+	if !strings.HasPrefix(auth, "Bearer ") {
+		c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+		return oidcTokenError(c, fiber.StatusUnauthorized, "invalid_request", "missing bearer access token")
+	}
+
+	issuer, err := cfg.getIssuer(c.UserContext())
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadOIDCAccessToken::cfg.getIssuer()").
+			Msg("unable to get issuer")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+
+	claims := &OIDCAccessTokenClaims{}
+	if _, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), claims, cfg.jwtKeyFunc(c.UserContext())); err != nil {
+		return invalidToken("invalid or expired access token")
+	}
+	if !claims.VerifyAudience(issuer+userinfoPath, true) || claims.SessionID == "" {
+		return invalidToken("not a userinfo access token")
+	}
+
+	// The access token lives no longer than the session it reads the profile with
+	session, err := cfg.db.GetUserCredentialsWithContext(c.UserContext(), claims.SessionID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadOIDCAccessToken::cfg.db.GetUserCredentials(sessionID)").
+			Msg("unable to get session from database")
+		return oidcTokenError(c, fiber.StatusInternalServerError, "server_error", "please report "+guid.String()+" to the admin")
+	}
+	if session == nil || time.Now().Unix() > session.ExpiresAt {
+		return invalidToken("session revoked or expired")
+	}
+
+	c.Locals("oidcAccessToken", claims)
+	c.Locals("session", session)
+	return c.Next()
+}
+
+// oidcUserinfo is the handler for the /oidc/userinfo endpoint.
+// The profile claims are only returned if the client was granted the profile scope.
+func (cfg *Config) oidcUserinfo(c *fiber.Ctx) error {
+	claims := c.Locals("oidcAccessToken").(*OIDCAccessTokenClaims)
+	if !containsString(strings.Fields(claims.Scope), "profile") {
+		return c.JSON(&OIDCUserinfo{Subject: claims.Subject})
+	}
+
+	// The profile is read from Mastodon, which takes read:accounts
+	session := c.Locals("session").(*database.UserCredentials)
+	if missing := missingScopes(grantedScopes(session.Scopes), []string{"read:accounts"}); len(missing) > 0 {
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("function", "oidcUserinfo::missingScopes()").
+			Strs("missingScopes", missing).
+			Msg("session can't read the profile")
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="insufficient_scope"`)
+		return oidcTokenError(c, fiber.StatusForbidden, "insufficient_scope", "the login behind this token didn't grant read:accounts, so the profile can't be read")
+	}
+
+	flight, err := cfg.preflight(
+		&PreflightInput{
+			ctx:     c.UserContext(),
+			session: session,
+		},
+	)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcUserinfo::cfg.preflight()").
+			Msg("prefilight failed")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	me, err := flight.Client.MeWithContext(c.UserContext())
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "oidcUserinfo::flight.Client.Me()").
+			Msg("Unable to get user details from mastodon")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "unable to fetch user profile. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrPreconditionRequired.Code).SendString(string(e))
+	}
+
+	host := strings.TrimPrefix(*flight.InstanceURL, "https://")
+	return c.JSON(&OIDCUserinfo{
+		Subject:           me.URL,
+		Name:              me.DisplayName,
+		PreferredUsername: me.Acct + "@" + host,
+		Profile:           me.URL,
+		Picture:           me.Avatar,
+	})
+}
+
+// oidcRedirectError sends an OAuth error back to a (validated) client redirect URI
+func oidcRedirectError(c *fiber.Ctx, redirectURI string, state string, code string, description string) error {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return oidcTokenError(c, fiber.StatusBadRequest, code, description)
+	}
+	query := u.Query()
+	query.Set("error", code)
+	query.Set("error_description", description)
+	if state != "" {
+		query.Set("state", state)
+	}
+	u.RawQuery = query.Encode()
+	return c.Redirect(u.String(), fiber.StatusFound)
+}
+
+// oidcTokenError sends an OAuth error response (RFC 6749 section 5.2)
+func oidcTokenError(c *fiber.Ctx, status int, code string, description string) error {
+	return c.Status(status).JSON(&OAuthError{
+		Error:            code,
+		ErrorDescription: description,
+	})
+}
+
+// basicAuth returns the (form-urlencoded) credentials from an HTTP Basic Authorization header
+func basicAuth(c *fiber.Ctx) (string, string, bool) {
+	auth := c.Get(fiber.HeaderAuthorization)
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	username, err = url.QueryUnescape(username)
+	if err != nil {
+		return "", "", false
+	}
+	password, err = url.QueryUnescape(password)
+	if err != nil {
+		return "", "", false
+	}
+	return username, password, true
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/ratelimit"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultRegistrationCap is how many apps may be registered on new instances an hour, across all clients,
+// unless WithRegistrationCap says otherwise
+const DefaultRegistrationCap = 100
+
+var (
+	// ipLimit limits the unauthenticated auth endpoints per client IP
+	ipLimit = ratelimit.Limit{Requests: 60, Window: time.Minute}
+
+	// instanceLimit limits the logins started against an instance
+	instanceLimit = ratelimit.Limit{Requests: 30, Window: time.Minute}
+
+	// registrationLimit caps the app registrations on instances we haven't seen before, per client IP.
+	// Every one of them is a request to a (possibly made up) host and a new app-credentials item.
+	registrationLimit = ratelimit.Limit{Requests: 10, Window: time.Hour}
+
+	// reregistrationLimit limits how often the app is registered again with one instance
+	reregistrationLimit = ratelimit.Limit{Requests: 3, Window: time.Hour}
+)
+
+// allow counts a request against a limit.
+// If the limiter fails the request is allowed; an outage of the counters shouldn't stop logins.
+func (cfg *Config) allow(ctx context.Context, key string, limit ratelimit.Limit) *ratelimit.Result {
+	res, err := cfg.limiter.Allow(ctx, key, limit)
+	if err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "allow::cfg.limiter.Allow()").
+			Str("key", key).
+			Msg("unable to check rate limit; allowing request")
+		return nil
+	}
+	return res
+}
+
+// limitByIP is middleware that rate limits requests per client IP
+func (cfg *Config) limitByIP(c *fiber.Ctx) error {
+	res := cfg.allow(c.UserContext(), "ip:"+c.IP(), ipLimit)
+	if res == nil {
+		return c.Next()
+	}
+
+	c.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Set("X-RateLimit-Reset", strconv.FormatInt(res.ResetAt.Unix(), 10))
+	if !res.Allowed {
+		return tooManyRequests(c, &RateLimited{RetryAfter: res.RetryAfter})
+	}
+	return c.Next()
+}
+
+// checkInstanceRate returns *RateLimited if too many logins were started against the instance
+func (cfg *Config) checkInstanceRate(ctx context.Context, instanceURL *url.URL) error {
+	res := cfg.allow(ctx, "instance:"+instanceURL.Host, instanceLimit)
+	if res != nil && !res.Allowed {
+		return &RateLimited{
+			Msg:        "too many logins to " + instanceURL.Host + "; try again later",
+			RetryAfter: res.RetryAfter,
+		}
+	}
+	return nil
+}
+
+// peek looks up a limit without counting a request. Like allow, a failing limiter allows the request.
+func (cfg *Config) peek(ctx context.Context, key string, limit ratelimit.Limit) *ratelimit.Result {
+	res, err := cfg.limiter.Peek(ctx, key, limit)
+	if err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("function", "peek::cfg.limiter.Peek()").
+			Str("key", key).
+			Msg("unable to check rate limit; allowing request")
+		return nil
+	}
+	return res
+}
+
+// checkRegistrationRate returns *RateLimited if the client registered with too many instances lately,
+// or all clients together did (the registration cap, unless it is off).
+// It doesn't count the registration; chargeRegistration does once the instance accepted it, so
+// failed registrations (eg a made up host) don't use up the limits.
+func (cfg *Config) checkRegistrationRate(ctx context.Context, instanceURL *url.URL) error {
+	res := cfg.peek(ctx, "registrations:ip:"+clientIP(ctx), registrationLimit)
+	if res == nil || res.Allowed {
+		if cfg.registrationCap.Requests < 1 {
+			return nil
+		}
+		res = cfg.peek(ctx, "registrations", *cfg.registrationCap)
+		if res == nil || res.Allowed {
+			return nil
+		}
+	}
+	cfg.log.Warn().
+		Str("function", "checkRegistrationRate").
+		Str("instanceURL", instanceURL.Host).
+		Str("ip", clientIP(ctx)).
+		Msg("new instance registration cap reached")
+	return &RateLimited{
+		Msg:        "too many new instances; try again later",
+		RetryAfter: res.RetryAfter,
+	}
+}
+
+// chargeRegistration counts a successful app registration against the limits of checkRegistrationRate
+func (cfg *Config) chargeRegistration(ctx context.Context) {
+	cfg.allow(ctx, "registrations:ip:"+clientIP(ctx), registrationLimit)
+	if cfg.registrationCap.Requests > 0 {
+		cfg.allow(ctx, "registrations", *cfg.registrationCap)
+	}
+}
+
+// checkReregistrationRate returns *RateLimited if the app was registered again with the instance too often lately
+func (cfg *Config) checkReregistrationRate(ctx context.Context, instanceURL *url.URL) error {
+	res := cfg.allow(ctx, "reregistrations:"+instanceURL.Host, reregistrationLimit)
+	if res != nil && !res.Allowed {
+		cfg.log.Warn().
+			Str("function", "checkReregistrationRate").
+			Str("instanceURL", instanceURL.Host).
+			Msg("instance re-registration cap reached")
+		return &RateLimited{
+			Msg:        "the app was registered with " + instanceURL.Host + " again too often; try again later",
+			RetryAfter: res.RetryAfter,
+		}
+	}
+	return nil
+}
+
+// tooManyRequests sends a 429 with a Retry-After header
+func tooManyRequests(c *fiber.Ctx, limited *RateLimited) error {
+	guid := xid.New()
+	log.Warn().
+		Str("method", c.Method()).
+		Str("originalURL", c.OriginalURL()).
+		Str("errRef", guid.String()).
+		Str("ip", c.IP()).
+		Dur("retryAfter", limited.RetryAfter).
+		Msg(limited.Error())
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+	e, _ := json.Marshal(&GeneralRestError{
+		ErrorInstanceID: guid.String(),
+		ErrorMessage:    limited.Error(),
+	})
+	return c.Status(fiber.StatusTooManyRequests).SendString(string(e))
+}
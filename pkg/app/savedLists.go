@@ -0,0 +1,188 @@
+package app
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// savedListOwner returns the Mastodon user ID and instance host of the account the request acts as.
+// Saved lists are keyed by the owner's user ID, which is only unique on its instance, so both are checked.
+func savedListOwner(c *fiber.Ctx) (string, string) {
+	if linked := linkedAccount(c); linked != nil {
+		return linked.UserID, linked.InstanceURL
+	}
+	session := c.Locals("session").(*database.UserCredentials)
+	return session.UserID, session.InstanceURL
+}
+
+// loadSavedList is the middleware for the /api/saved-lists/:listID routes. It loads the saved list
+// into c.Locals("savedList"), answering 404 unless it belongs to the account the request acts as.
+func (cfg *Config) loadSavedList(c *fiber.Ctx) error {
+	userID, instance := savedListOwner(c)
+	listID := strings.TrimSpace(c.Params("listID"))
+
+	list, err := cfg.db.GetListWithContext(c.UserContext(), instance, userID, listID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadSavedList::cfg.db.GetList()").
+			Str("listID", listID).
+			Msg("unable to get saved list from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	if list == nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadSavedList::list == nil").
+			Str("listID", listID).
+			Str("UserID", userID).
+			Msg("saved list not found")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "no saved list found with that id",
+		})
+		return c.Status(fiber.ErrNotFound.Code).SendString(string(e))
+	}
+
+	c.Locals("savedList", list)
+	return c.Next()
+}
+
+// savedList returns the saved list loaded by loadSavedList
+func savedList(c *fiber.Ctx) *database.List {
+	return c.Locals("savedList").(*database.List)
+}
+
+// apiSavedLists is the handler for GET /api/saved-lists. It lists the saved lists of the account the request acts as.
+func (cfg *Config) apiSavedLists(c *fiber.Ctx) error {
+	userID, instance := savedListOwner(c)
+
+	lists, err := cfg.db.ListListsWithContext(c.UserContext(), instance, userID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiSavedLists::cfg.db.ListLists()").
+			Msg("unable to get saved lists from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	return c.JSON(fiber.Map{"lists": lists})
+}
+
+// apiGetSavedList is the handler for GET /api/saved-lists/:listID. It returns a saved list and its members.
+func (cfg *Config) apiGetSavedList(c *fiber.Ctx) error {
+	list := savedList(c)
+
+	members, err := cfg.db.GetAccountsInListWithContext(c.UserContext(), list.Instance, list.OwnerUserID, list.ListID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiGetSavedList::cfg.db.GetAccountsInList()").
+			Str("listID", list.ListID).
+			Msg("unable to get saved list members from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	return c.JSON(fiber.Map{
+		"list":    list,
+		"members": members.UserIDs,
+	})
+}
+
+// apiUpdateSavedList is the handler for PUT /api/saved-lists/:listID. It sets whether a saved list is public.
+func (cfg *Config) apiUpdateSavedList(c *fiber.Ctx) error {
+	public, err := strconv.ParseBool(strings.TrimSpace(c.FormValue("public")))
+	if err != nil {
+		guid := xid.New()
+		cfg.log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiUpdateSavedList::strconv.ParseBool(public)").
+			Msg("invalid public value")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "public must be true or false",
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	list := savedList(c)
+	list.Public = public
+	if err := cfg.db.PutListWithContext(c.UserContext(), list); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiUpdateSavedList::cfg.db.PutList()").
+			Str("listID", list.ListID).
+			Msg("unable to save list to database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	return c.JSON(fiber.Map{"list": list})
+}
+
+// apiDeleteSavedList is the handler for DELETE /api/saved-lists/:listID. It deletes a saved list and its members.
+func (cfg *Config) apiDeleteSavedList(c *fiber.Ctx) error {
+	list := savedList(c)
+
+	if err := cfg.db.DeleteListWithContext(c.UserContext(), list.Instance, list.OwnerUserID, list.ListID); err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "apiDeleteSavedList::cfg.db.DeleteList()").
+			Str("listID", list.ListID).
+			Msg("unable to delete saved list from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	return c.JSON(fiber.Map{"deleted": list.ListID})
+}
@@ -0,0 +1,57 @@
+package app
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestLoadSavedList(t *testing.T) {
+	db := database.NewMemory()
+	db.PutList(&database.List{Instance: "a.example", OwnerUserID: "1", ListID: "10", ListTitle: "a"})
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(db), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		session *database.UserCredentials
+		linked  *database.LinkedAccount
+		want    int
+	}{
+		{"owner", &database.UserCredentials{UserID: "1", InstanceURL: "a.example"}, nil, fiber.StatusOK},
+		{"same user ID on another instance", &database.UserCredentials{UserID: "1", InstanceURL: "b.example"}, nil, fiber.StatusNotFound},
+		{"other user on the instance", &database.UserCredentials{UserID: "2", InstanceURL: "a.example"}, nil, fiber.StatusNotFound},
+		{"acting as the owner's linked account", &database.UserCredentials{UserID: "2", InstanceURL: "b.example"},
+			&database.LinkedAccount{UserID: "1", InstanceURL: "a.example"}, fiber.StatusOK},
+		{"owner session acting as another account", &database.UserCredentials{UserID: "1", InstanceURL: "a.example"},
+			&database.LinkedAccount{UserID: "2", InstanceURL: "b.example"}, fiber.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/api/saved-lists/:listID", func(c *fiber.Ctx) error {
+				c.Locals("session", tt.session)
+				if tt.linked != nil {
+					c.Locals("linkedAccount", tt.linked)
+				}
+				return c.Next()
+			}, cfg.loadSavedList, func(c *fiber.Ctx) error {
+				return c.SendString(savedList(c).ListTitle)
+			})
+
+			resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/api/saved-lists/10", nil))
+			if err != nil {
+				t.Fatalf("app.Test: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/xid"
+)
+
+// followScopes are the granular scopes covered by the legacy "follow" scope
+var followScopes = []string{
+	"read:blocks",
+	"read:follows",
+	"read:mutes",
+	"write:blocks",
+	"write:follows",
+	"write:mutes",
+}
+
+// parseScopes splits a space, comma or plus separated list of scopes
+func parseScopes(raw string) []string {
+	scopes := []string{}
+	for _, scope := range strings.FieldsFunc(strings.ToLower(raw), func(r rune) bool {
+		return r == ' ' || r == ',' || r == '+'
+	}) {
+		if !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// scopeCovers reports whether a granted scope includes the required scope.
+// Top level scopes (eg read) include their granular scopes (eg read:lists).
+func scopeCovers(granted string, required string) bool {
+	if granted == required || strings.HasPrefix(required, granted+":") {
+		return true
+	}
+	return granted == "follow" && containsString(followScopes, required)
+}
+
+// missingScopes returns the required scopes not covered by the granted scopes
+func missingScopes(granted []string, required []string) []string {
+	missing := []string{}
+	for _, req := range required {
+		covered := false
+		for _, scope := range granted {
+			if scopeCovers(scope, req) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			missing = append(missing, req)
+		}
+	}
+	return missing
+}
+
+// legacyScopes are the scopes of sessions and linked accounts created before scopes were recorded.
+// Back then the app only ever asked instances for the default scopes.
+var legacyScopes = splitSetting(defaultScopes)
+
+// grantedScopes returns the scopes granted to a session or linked account, or legacyScopes if none were recorded
+func grantedScopes(scopes []string) []string {
+	if len(scopes) == 0 {
+		return legacyScopes
+	}
+	return scopes
+}
+
+// requireScopes returns a middleware rejecting sessions that didn't grant all of the scopes.
+// Sessions created before scopes were recorded are checked against legacyScopes.
+func (cfg *Config) requireScopes(scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Check the scopes of the account the request acts as
+		granted := grantedScopes(c.Locals("session").(*database.UserCredentials).Scopes)
+		if linked := linkedAccount(c); linked != nil {
+			granted = grantedScopes(linked.Scopes)
+		}
+		missing := missingScopes(granted, scopes)
+
+		// API keys are limited to the scopes they were minted with, and can't be upgraded
+		upgradeURI := "/auth/upgrade?scope=" + url.QueryEscape(strings.Join(missing, " "))
+		if key := apiKey(c); key != nil && len(missing) == 0 && len(key.Scopes) > 0 {
+			if missing = missingScopes(key.Scopes, scopes); len(missing) > 0 {
+				granted = key.Scopes
+				upgradeURI = ""
+			}
+		}
+		if len(missing) == 0 {
+			return c.Next()
+		}
+
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "requireScopes").
+			Strs("missingScopes", missing).
+			Msg("insufficient scope")
+		e, _ := json.Marshal(&InsufficientScopeError{
+			ErrorInstanceID: guid.String(),
+			ErrorCode:       "insufficient_scope",
+			ErrorMessage:    "missing scopes: " + strings.Join(missing, " "),
+			RequiredScopes:  scopes,
+			GrantedScopes:   granted,
+			UpgradeURI:      upgradeURI,
+		})
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+		return c.Status(fiber.StatusForbidden).SendString(string(e))
+	}
+}
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestScopeCovers(t *testing.T) {
+	tests := []struct {
+		granted  string
+		required string
+		want     bool
+	}{
+		{"read", "read", true},
+		{"read", "read:lists", true},
+		{"read:lists", "read:lists", true},
+		{"read:lists", "read", false},
+		{"read:lists", "read:accounts", false},
+		{"read", "write:lists", false},
+		{"write", "write:lists", true},
+		{"read", "readx", false},
+		{"follow", "read:follows", true},
+		{"follow", "write:blocks", true},
+		{"follow", "read:lists", false},
+		{"admin:read", "admin:read:accounts", true},
+		{"admin:read", "read:accounts", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granted+" "+tt.required, func(t *testing.T) {
+			if got := scopeCovers(tt.granted, tt.required); got != tt.want {
+				t.Errorf("scopeCovers(%q, %q) = %v, want %v", tt.granted, tt.required, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		granted  []string
+		required []string
+		want     []string
+	}{
+		{"none required", []string{"read"}, []string{}, []string{}},
+		{"covered", []string{"read", "write:lists"}, []string{"read:lists", "write:lists"}, []string{}},
+		{"missing", []string{"read:lists"}, []string{"read:lists", "write:lists"}, []string{"write:lists"}},
+		{"none granted", []string{}, []string{"read"}, []string{"read"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := missingScopes(tt.granted, tt.required); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingScopes(%v, %v) = %v, want %v", tt.granted, tt.required, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []string
+	}{
+		{"", []string{}},
+		{"read", []string{"read"}},
+		{"read write", []string{"read", "write"}},
+		{"READ,write+follow", []string{"read", "write", "follow"}},
+		{"read  read", []string{"read"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if got := parseScopes(tt.raw); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseScopes(%q) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		session  []string
+		linked   []string
+		key      []string
+		required []string
+		want     int
+	}{
+		{"granted", []string{"read"}, nil, nil, []string{"read:lists"}, fiber.StatusOK},
+		{"not granted", []string{"read:lists"}, nil, nil, []string{"read:accounts"}, fiber.StatusForbidden},
+		{"legacy session gets the default scopes", nil, nil, nil, []string{"read:accounts"}, fiber.StatusOK},
+		{"legacy session can't write", nil, nil, nil, []string{"write:lists"}, fiber.StatusForbidden},
+		{"linked account scopes win", []string{"write"}, []string{"read"}, nil, []string{"write:lists"}, fiber.StatusForbidden},
+		{"legacy linked account", []string{"write"}, []string{}, nil, []string{"read"}, fiber.StatusOK},
+		{"api key is narrower", []string{"read"}, nil, []string{"read:lists"}, []string{"read:accounts"}, fiber.StatusForbidden},
+		{"api key covers", []string{"read"}, nil, []string{"read:lists"}, []string{"read:lists"}, fiber.StatusOK},
+	}
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(database.NewMemory()), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Use(func(c *fiber.Ctx) error {
+				c.Locals("session", &database.UserCredentials{Scopes: tt.session})
+				if tt.linked != nil {
+					c.Locals("linkedAccount", &database.LinkedAccount{Scopes: tt.linked})
+				}
+				if tt.key != nil {
+					c.Locals("apiKey", &database.APIKey{Scopes: tt.key})
+				}
+				return c.Next()
+			})
+			app.Get("/", cfg.requireScopes(tt.required...), func(c *fiber.Ctx) error {
+				return c.SendStatus(fiber.StatusOK)
+			})
+
+			resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/", nil))
+			if err != nil {
+				t.Fatalf("app.Test: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCUserinfoScopes(t *testing.T) {
+	tests := []struct {
+		name       string
+		oidcScope  string
+		session    []string
+		wantStatus int
+	}{
+		{"subject only needs no Mastodon scope", "openid", []string{"write:statuses"}, fiber.StatusOK},
+		{"profile without read:accounts", "openid profile", []string{"write:statuses"}, fiber.StatusForbidden},
+	}
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(database.NewMemory()), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/oidc/userinfo", func(c *fiber.Ctx) error {
+				claims := &OIDCAccessTokenClaims{Scope: tt.oidcScope}
+				claims.Subject = "https://example.social/@user"
+				c.Locals("oidcAccessToken", claims)
+				c.Locals("session", &database.UserCredentials{Scopes: tt.session})
+				return c.Next()
+			}, cfg.oidcUserinfo)
+
+			resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/oidc/userinfo", nil))
+			if err != nil {
+				t.Fatalf("app.Test: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == fiber.StatusForbidden && resp.Header.Get(fiber.HeaderWWWAuthenticate) != `Bearer error="insufficient_scope"` {
+				t.Errorf("WWW-Authenticate = %q", resp.Header.Get(fiber.HeaderWWWAuthenticate))
+			}
+		})
+	}
+}
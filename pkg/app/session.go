@@ -0,0 +1,124 @@
+package app
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+// sessionTTL is how long a session (and the JWT referencing it) is valid for
+const sessionTTL = 7 * 24 * time.Hour
+
+// loadSession resolves the session referenced by a valid JWT and stores it in c.Locals("session").
+// It is installed as the JWT middleware's success handler.
+func (cfg *Config) loadSession(c *fiber.Ctx) error {
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+
+	// Session JWTs have no audience. ID tokens and OIDC access tokens (signed with the same keys) do.
+	if _, ok := claims["aud"]; ok {
+		guid := xid.New()
+		log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadSession::claims['aud']").
+			Msg("JWT is not a session JWT")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "invalid session. please login again",
+		})
+		return c.Status(fiber.ErrUnauthorized.Code).SendString(string(e))
+	}
+
+	// Reject JWTs that have been revoked
+	tokenID, _ := claims["jti"].(string)
+	revoked, err := cfg.db.GetRevokedTokenWithContext(c.UserContext(), tokenID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadSession::cfg.db.GetRevokedToken(tokenID)").
+			Msg("unable to check JWT denylist")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if revoked != nil {
+		guid := xid.New()
+		log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadSession::revoked != nil").
+			Str("tokenID", tokenID).
+			Msg("JWT has been revoked")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "invalid session. please login again",
+		})
+		return c.Status(fiber.ErrUnauthorized.Code).SendString(string(e))
+	}
+
+	// Get the session ID from the JWT claims
+	sessionID, _ := claims["sid"].(string)
+	if sessionID == "" {
+		guid := xid.New()
+		log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadSession::claims['sid']").
+			Msg("JWT has no session ID")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "invalid session. please login again",
+		})
+		return c.Status(fiber.ErrUnauthorized.Code).SendString(string(e))
+	}
+
+	// Get the session from the database
+	session, err := cfg.db.GetUserCredentialsWithContext(c.UserContext(), sessionID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadSession::cfg.db.GetUserCredentials(sessionID)").
+			Msg("unable to get session from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// The session was revoked or has expired (DynamoDB TTL deletion is lazy)
+	if session == nil || time.Now().Unix() > session.ExpiresAt {
+		guid := xid.New()
+		log.Error().
+			Str("method", c.Method()).
+			Str("originalURL", c.OriginalURL()).
+			Str("errRef", guid.String()).
+			Str("function", "loadSession::session == nil").
+			Msg("session revoked or expired")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "invalid session. please login again",
+		})
+		return c.Status(fiber.ErrUnauthorized.Code).SendString(string(e))
+	}
+
+	c.Locals("session", session)
+	return c.Next()
+}
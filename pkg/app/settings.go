@@ -0,0 +1,396 @@
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// settingsTTL is how long loaded settings are used before being reloaded from the database.
+	// Changes made on another Lambda instance (or with the CLI) take up to this long to apply.
+	settingsTTL = time.Minute
+
+	// defaultAppName is the name the app registers with instances unless app_name is set
+	defaultAppName = "mastostart"
+
+	// defaultScopes are the scopes requested from instances unless scopes is set
+	defaultScopes = "read"
+)
+
+// knownScopes are the Mastodon OAuth scopes the scopes setting may list
+var knownScopes = []string{
+	"read", "write", "follow", "push", "profile",
+	"read:accounts", "read:blocks", "read:bookmarks", "read:favourites", "read:filters", "read:follows",
+	"read:lists", "read:mutes", "read:notifications", "read:search", "read:statuses",
+	"write:accounts", "write:blocks", "write:bookmarks", "write:conversations", "write:favourites",
+	"write:filters", "write:follows", "write:lists", "write:media", "write:mutes", "write:notifications",
+	"write:reports", "write:statuses",
+	"admin:read", "admin:read:accounts", "admin:read:reports", "admin:read:domain_allows",
+	"admin:read:domain_blocks", "admin:read:ip_blocks", "admin:read:email_domain_blocks",
+	"admin:read:canonical_email_blocks",
+	"admin:write", "admin:write:accounts", "admin:write:reports", "admin:write:domain_allows",
+	"admin:write:domain_blocks", "admin:write:ip_blocks", "admin:write:email_domain_blocks",
+	"admin:write:canonical_email_blocks",
+}
+
+// Settings is the config table, parsed and validated. Handlers get it with cfg.getSettings.
+type Settings struct {
+	// AdminAccounts are the account URLs that may use the admin API (admin_accounts)
+	AdminAccounts []string
+
+	// AppName is the name the app registers with instances (app_name)
+	AppName string
+
+	// CookieDomain is the Domain of the session cookies; empty for host-only cookies (cookie_domain)
+	CookieDomain string
+
+	// CORSHeaders are the request headers cross-origin requests may send (cors_headers)
+	CORSHeaders []string
+
+	// CORSMethods are the methods cross-origin requests may use (cors_methods)
+	CORSMethods []string
+
+	// CORSOrigins are the origins that may call the API from a browser; "*" for any (cors_origins)
+	CORSOrigins []string
+
+	// DenyInstances are the instance patterns users may not login to (deny_instances)
+	DenyInstances []string
+
+	// Issuer is the OpenID Connect issuer (oidc_issuer, or the origin of redirect_uri)
+	Issuer string
+
+	// PermitInstances are the instance patterns users may login to; empty permits all (permit_instances)
+	PermitInstances []string
+
+	// RedirectURI is the /auth/callback URL registered with instances (redirect_uri)
+	RedirectURI string
+
+	// ReturnToAllowlist are the URLs the browser may be sent back to after login (return_to_allowlist)
+	ReturnToAllowlist []*url.URL
+
+	// Scopes are the scopes requested from instances (scopes)
+	Scopes []string
+
+	// Website is the home page of the app registered with instances (website, or the issuer)
+	Website string
+
+	// tokenCipher encrypts the stored Mastodon access tokens (token_encryption_key)
+	tokenCipher cipher.AEAD
+
+	// legacySigningKey is the pre-rotation JWT signing key (jwt_signing_key)
+	legacySigningKey *rsa.PrivateKey
+
+	// values are the valid config values the settings were parsed from, by key
+	values map[string]string
+
+	// loadedAt is when the settings were loaded from the database
+	loadedAt time.Time
+}
+
+// settingParsers parse and validate the value of each setting into Settings
+var settingParsers = map[string]func(s *Settings, value string) error{
+	"admin_accounts": func(s *Settings, value string) error {
+		s.AdminAccounts = splitSetting(value)
+		for _, account := range s.AdminAccounts {
+			if err := checkHTTPSURL(account); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"app_name": func(s *Settings, value string) error {
+		s.AppName = strings.TrimSpace(value)
+		return nil
+	},
+	"cookie_domain": func(s *Settings, value string) error {
+		s.CookieDomain = strings.ToLower(strings.TrimSpace(value))
+		if s.CookieDomain != "" && !validHost(strings.TrimPrefix(s.CookieDomain, ".")) {
+			return errors.New("not a valid domain: " + s.CookieDomain)
+		}
+		return nil
+	},
+	"cors_headers": func(s *Settings, value string) error {
+		s.CORSHeaders = splitSetting(value)
+		return nil
+	},
+	"cors_methods": func(s *Settings, value string) error {
+		s.CORSMethods = splitSetting(strings.ToUpper(value))
+		return nil
+	},
+	"cors_origins": func(s *Settings, value string) error {
+		s.CORSOrigins = splitSetting(value)
+		for _, origin := range s.CORSOrigins {
+			if origin == "*" {
+				continue
+			}
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+				return errors.New("not an origin (scheme://host[:port]): " + origin)
+			}
+		}
+		return nil
+	},
+	"deny_instances": func(s *Settings, value string) error {
+		s.DenyInstances = normalizeInstancePatterns(splitSetting(value))
+		return checkInstancePatterns(s.DenyInstances)
+	},
+	"jwt_signing_key": func(s *Settings, value string) error {
+		var err error
+		s.legacySigningKey, err = parseRSAPrivateKeyPEM(value)
+		return err
+	},
+	"oidc_issuer": func(s *Settings, value string) error {
+		s.Issuer = strings.TrimSuffix(strings.TrimSpace(value), "/")
+		return checkHTTPSURL(s.Issuer)
+	},
+	"permit_instances": func(s *Settings, value string) error {
+		s.PermitInstances = normalizeInstancePatterns(splitSetting(value))
+		return checkInstancePatterns(s.PermitInstances)
+	},
+	"redirect_uri": func(s *Settings, value string) error {
+		s.RedirectURI = strings.TrimSpace(value)
+		return checkHTTPSURL(s.RedirectURI)
+	},
+	"return_to_allowlist": func(s *Settings, value string) error {
+		s.ReturnToAllowlist = nil
+		for _, entry := range splitSetting(value) {
+			allowed, err := url.Parse(entry)
+			if err != nil || !allowed.IsAbs() || allowed.Host == "" {
+				return errors.New("not an absolute URL: " + entry)
+			}
+			s.ReturnToAllowlist = append(s.ReturnToAllowlist, allowed)
+		}
+		return nil
+	},
+	"scopes": func(s *Settings, value string) error {
+		s.Scopes = splitSetting(strings.ToLower(value))
+		for _, scope := range s.Scopes {
+			if !containsString(knownScopes, scope) {
+				return errors.New("not a Mastodon scope: " + scope)
+			}
+		}
+		if len(s.Scopes) == 0 {
+			return errors.New("no scopes")
+		}
+		return nil
+	},
+	"token_encryption_key": func(s *Settings, value string) error {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != 32 {
+			return errors.New("not a base64 encoded 32 byte key")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		s.tokenCipher, err = cipher.NewGCM(block)
+		return err
+	},
+	"website": func(s *Settings, value string) error {
+		s.Website = strings.TrimSpace(value)
+		u, err := url.Parse(s.Website)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New("not an absolute http(s) URL: " + s.Website)
+		}
+		return nil
+	},
+}
+
+// newSettings returns the settings used for the config items that aren't set
+func newSettings() *Settings {
+	return &Settings{
+		AppName:     defaultAppName,
+		CORSHeaders: splitSetting(defaultCORSHeaders),
+		CORSMethods: splitSetting(defaultCORSMethods),
+		Scopes:      splitSetting(defaultScopes),
+		values:      make(map[string]string),
+	}
+}
+
+// ValidateSetting checks a config item's value. Keys without validation are accepted as is.
+func ValidateSetting(key string, value string) error {
+	parse, ok := settingParsers[key]
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil
+	}
+	if err := parse(newSettings(), value); err != nil {
+		return &InvalidSetting{Msg: key, Err: err}
+	}
+	return nil
+}
+
+// loadSettings loads the settings from the config table.
+// An invalid item (eg written to the table by hand) doesn't stop the others from loading: it is logged,
+// and the item's value from the previous settings is used, or its default if there is none.
+func (cfg *Config) loadSettings(ctx context.Context, previous *Settings) (*Settings, error) {
+	items, err := cfg.db.ListConfigWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Empty items are treated as unset
+	settings := newSettings()
+	for _, item := range items {
+		parse, ok := settingParsers[item.ConfigKey]
+		if !ok || strings.TrimSpace(item.ConfigValue) == "" {
+			continue
+		}
+
+		// Parse into a copy, so a half parsed invalid value doesn't leak into the settings
+		next := *settings
+		if err := parse(&next, item.ConfigValue); err != nil {
+			fallback, hasFallback := "", false
+			if previous != nil {
+				fallback, hasFallback = previous.values[item.ConfigKey]
+			}
+			cfg.log.Error().
+				Err(&InvalidSetting{Msg: item.ConfigKey, Err: err}).
+				Str("function", "loadSettings::parse()").
+				Str("key", item.ConfigKey).
+				Bool("usingPrevious", hasFallback).
+				Msg("invalid config item; ignoring it")
+			if hasFallback && parse(settings, fallback) == nil {
+				settings.values[item.ConfigKey] = fallback
+			}
+			continue
+		}
+		*settings = next
+		settings.values[item.ConfigKey] = item.ConfigValue
+	}
+
+	// The issuer defaults to the origin of the redirect URI, and the website to the issuer
+	if settings.Issuer == "" && settings.RedirectURI != "" {
+		redirectURI, _ := url.Parse(settings.RedirectURI)
+		settings.Issuer = redirectURI.Scheme + "://" + redirectURI.Host
+	}
+	if settings.Website == "" {
+		settings.Website = settings.Issuer
+	}
+
+	settings.loadedAt = time.Now()
+	return settings, nil
+}
+
+// getSettings returns the cached settings, reloading them from the database when they are stale.
+// If reloading fails the stale settings are used for another settingsTTL; better than failing every request.
+func (cfg *Config) getSettings(ctx context.Context) (*Settings, error) {
+	cfg.settingsMu.Lock()
+	defer cfg.settingsMu.Unlock()
+
+	if cfg.settings != nil && time.Since(cfg.settings.loadedAt) < settingsTTL {
+		return cfg.settings, nil
+	}
+
+	settings, err := cfg.loadSettings(ctx, cfg.settings)
+	if err != nil {
+		if cfg.settings == nil {
+			return nil, err
+		}
+		cfg.log.Error().
+			Err(err).
+			Str("function", "getSettings::cfg.loadSettings()").
+			Msg("unable to reload settings; using the stale ones")
+		stale := *cfg.settings
+		stale.loadedAt = time.Now()
+		cfg.settings = &stale
+		return cfg.settings, nil
+	}
+	cfg.settings = settings
+	return settings, nil
+}
+
+// invalidateSettings makes the next getSettings reload the settings (eg after the admin API changed one).
+// The current settings are kept, stale, to fall back on if the reload fails.
+func (cfg *Config) invalidateSettings() {
+	cfg.settingsMu.Lock()
+	defer cfg.settingsMu.Unlock()
+	if cfg.settings != nil {
+		stale := *cfg.settings
+		stale.loadedAt = time.Time{}
+		cfg.settings = &stale
+	}
+}
+
+// splitSetting splits a comma separated setting into its trimmed, non-empty entries
+func splitSetting(value string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// checkHTTPSURL checks a URL is absolute and https. http is accepted for loopback hosts, for local development.
+func checkHTTPSURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return errors.New("not an absolute URL: " + raw)
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); u.Scheme == "http" && (host == "localhost" || (ip != nil && ip.IsLoopback())) {
+		return nil
+	}
+	return errors.New("not an https URL: " + raw)
+}
+
+// normalizeInstancePatterns puts the host of each instance pattern in its normal form (see normalizeHost).
+// Patterns whose host isn't valid are left as they are, for checkInstancePatterns to reject.
+func normalizeInstancePatterns(patterns []string) []string {
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		prefix := ""
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			prefix = "*."
+		case strings.HasPrefix(pattern, "."):
+			prefix = "."
+		}
+		if host, ok := normalizeHost(pattern[len(prefix):]); ok {
+			pattern = prefix + host
+		}
+		normalized = append(normalized, strings.ToLower(pattern))
+	}
+	return normalized
+}
+
+// checkInstancePatterns checks the patterns of an instance list (see matchInstancePattern)
+func checkInstancePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		host := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+		if !validHost(host) {
+			return errors.New("not a valid instance pattern: " + pattern)
+		}
+	}
+	return nil
+}
+
+// validHost reports whether s is a valid (lowercase) hostname
+func validHost(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
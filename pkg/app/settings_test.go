@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+func TestValidateSetting(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"permit_instances", "example.social,*.example.com,.example.org", false},
+		{"permit_instances", "exämple.social", false},
+		{"permit_instances", "example.social:443", true},
+		{"deny_instances", "bad example", true},
+		{"scopes", "read,write:lists", false},
+		{"scopes", "read,nope", true},
+		{"redirect_uri", "https://example.com/auth/callback", false},
+		{"redirect_uri", "http://example.com/auth/callback", true},
+		{"redirect_uri", "http://localhost:8080/auth/callback", false},
+		{"token_encryption_key", "c2hvcnQ=", true},
+		{"cors_origins", "https://app.example.com,*", false},
+		{"cors_origins", "https://app.example.com/path", true},
+		{"unknown_key", "anything", false},
+		{"scopes", "  ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			if err := ValidateSetting(tt.key, tt.value); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateSetting(%q, %q) = %v, wantErr %v", tt.key, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeInstancePatterns(t *testing.T) {
+	got := normalizeInstancePatterns([]string{"Example.Social.", "*.Exämple.com", ".example.org", "bad host"})
+	want := []string{"example.social", "*.xn--exmple-cua.com", ".example.org", "bad host"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("normalizeInstancePatterns = %v, want %v", got, want)
+	}
+}
+
+func TestLoadSettingsInvalidItem(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewMemory()
+	db.PutConfig(&database.ConfigItem{ConfigKey: "app_name", ConfigValue: "test"})
+	db.PutConfig(&database.ConfigItem{ConfigKey: "permit_instances", ConfigValue: "good.example"})
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(db), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// An invalid item doesn't stop the rest from loading, and keeps its previous value
+	previous, err := cfg.loadSettings(ctx, nil)
+	if err != nil {
+		t.Fatalf("loadSettings: %v", err)
+	}
+	if err := cfg.db.PutConfig(&database.ConfigItem{ConfigKey: "permit_instances", ConfigValue: "not valid"}); err != nil {
+		t.Fatalf("PutConfig: %v", err)
+	}
+	if err := cfg.db.PutConfig(&database.ConfigItem{ConfigKey: "scopes", ConfigValue: "nope"}); err != nil {
+		t.Fatalf("PutConfig: %v", err)
+	}
+
+	settings, err := cfg.loadSettings(ctx, previous)
+	if err != nil {
+		t.Fatalf("loadSettings: %v", err)
+	}
+	if settings.AppName != "test" {
+		t.Errorf("AppName = %q, want test", settings.AppName)
+	}
+	if want := []string{"good.example"}; !reflect.DeepEqual(settings.PermitInstances, want) {
+		t.Errorf("PermitInstances = %v, want the previous %v", settings.PermitInstances, want)
+	}
+	if want := []string{defaultScopes}; !reflect.DeepEqual(settings.Scopes, want) {
+		t.Errorf("Scopes = %v, want the default %v", settings.Scopes, want)
+	}
+}
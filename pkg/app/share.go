@@ -0,0 +1,275 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/mattn/go-mastodon"
+	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// shareDefaultLimit and shareMaxLimit are the default and largest number of members a shared list page has
+	shareDefaultLimit = 40
+	shareMaxLimit     = 80
+
+	// shareAccountTTL is how long a fetched member account is served from the cache
+	shareAccountTTL = 10 * time.Minute
+
+	// shareAccountCacheSize is about the most member accounts cached at once
+	shareAccountCacheSize = 10000
+)
+
+// shareList is the handler for GET /share/lists/:instance/:owner/:listID. It doesn't need a JWT: anyone may see
+// a saved list that is public, or that they have the PSK of (?psk=). The member accounts are fetched
+// from the list's instance without a token, so accounts the instance doesn't show publicly are left out.
+// Members are returned a page at a time (?offset=, ?limit=) and the fetched accounts are cached, so
+// one request can't fan out to the instance without bound.
+// The path is logged instead of the original URL, which carries the PSK.
+func (cfg *Config) shareList(c *fiber.Ctx) error {
+	instance := normalizeInstanceURL(&url.URL{Host: strings.TrimSpace(c.Params("instance"))}).Host
+	owner := strings.TrimSpace(c.Params("owner"))
+	listID := strings.TrimSpace(c.Params("listID"))
+	psk := c.Query("psk")
+
+	offset := c.QueryInt("offset", 0)
+	limit := c.QueryInt("limit", shareDefaultLimit)
+	if offset < 0 || limit < 1 || limit > shareMaxLimit {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Str("errRef", guid.String()).
+			Str("function", "shareList::c.QueryInt()").
+			Int("offset", offset).
+			Int("limit", limit).
+			Msg("invalid offset or limit")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "offset must be 0 or more and limit between 1 and " + strconv.Itoa(shareMaxLimit),
+		})
+		return c.Status(fiber.ErrBadRequest.Code).SendString(string(e))
+	}
+
+	list, err := cfg.db.GetListWithContext(c.UserContext(), instance, owner, listID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Str("errRef", guid.String()).
+			Str("function", "shareList::cfg.db.GetListWithContext()").
+			Str("listID", listID).
+			Str("owner", owner).
+			Msg("unable to get saved list from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// A wrong PSK looks like a missing list, so lists can't be discovered by guessing IDs
+	shared := list != nil && (list.Public ||
+		(psk != "" && list.PSK != "" && subtle.ConstantTimeCompare([]byte(psk), []byte(list.PSK)) == 1))
+	if !shared {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Str("errRef", guid.String()).
+			Str("function", "shareList::!shared").
+			Str("listID", listID).
+			Str("owner", owner).
+			Msg("shared list not found or wrong psk")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "no shared list found with that id",
+		})
+		return c.Status(fiber.ErrNotFound.Code).SendString(string(e))
+	}
+
+	// The instance may have been denied since the list was saved
+	permitted, err := cfg.checkPermitInstanceList(c.UserContext(), &url.URL{Scheme: "https", Host: list.Instance})
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Str("errRef", guid.String()).
+			Str("function", "shareList::cfg.checkPermitInstanceList()").
+			Str("instanceURL", list.Instance).
+			Msg("unable to check the instance lists")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+	if !*permitted {
+		guid := xid.New()
+		cfg.log.Error().
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Str("errRef", guid.String()).
+			Str("function", "shareList::!permitted").
+			Str("instanceURL", list.Instance).
+			Msg("instance not permitted")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "instance not permitted",
+		})
+		return c.Status(fiber.ErrForbidden.Code).SendString(string(e))
+	}
+
+	members, err := cfg.db.GetAccountsInListWithContext(c.UserContext(), list.Instance, list.OwnerUserID, list.ListID)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Str("errRef", guid.String()).
+			Str("function", "shareList::cfg.db.GetAccountsInList()").
+			Str("listID", list.ListID).
+			Msg("unable to get saved list members from database")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	instanceURL := "https://" + list.Instance
+	mc, err := mastoclient.New(
+		mastoclient.WithInstance(&instanceURL),
+		mastoclient.WithLogger(cfg.log),
+		mastoclient.WithTimeouts(cfg.timeouts.Mastodon),
+	)
+	if err != nil {
+		guid := xid.New()
+		log.Error().
+			Err(err).
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Str("errRef", guid.String()).
+			Str("function", "shareList::mastoclient.New()").
+			Str("instanceURL", list.Instance).
+			Msg("unable to create mastoclient")
+		e, _ := json.Marshal(&GeneralRestError{
+			ErrorInstanceID: guid.String(),
+			ErrorMessage:    "server side failure. please report the error_instance_id to the admin",
+		})
+		return c.Status(fiber.ErrInternalServerError.Code).SendString(string(e))
+	}
+
+	// Only the requested page of members is fetched
+	total := len(members.UserIDs)
+	page := members.UserIDs[min(offset, total):min(offset+limit, total)]
+
+	// Members that moved, were deleted or aren't public are left out rather than failing the list
+	fetched, err := cfg.getShareAccounts(c.UserContext(), mc, list.Instance, page)
+	accounts := []*mastodon.Account{}
+	for _, account := range fetched {
+		if account != nil {
+			accounts = append(accounts, account)
+		}
+	}
+	if err != nil {
+		cfg.log.Warn().
+			Err(err).
+			Str("method", c.Method()).
+			Str("path", c.Path()).
+			Str("function", "shareList::mc.GetUsersByID()").
+			Str("instanceURL", list.Instance).
+			Str("listID", list.ListID).
+			Int("members", len(members.UserIDs)).
+			Int("fetched", len(accounts)).
+			Msg("unable to fetch some list members")
+	}
+
+	return c.JSON(fiber.Map{
+		"listID":   list.ListID,
+		"listName": list.ListTitle,
+		"instance": list.Instance,
+		"ownerID":  list.OwnerUserID,
+		"total":    total,
+		"offset":   offset,
+		"limit":    limit,
+		"accounts": accounts,
+	})
+}
+
+// shareAccount is a member account fetched for a shared list; nil if it couldn't be fetched
+type shareAccount struct {
+	account   *mastodon.Account
+	fetchedAt time.Time
+}
+
+// getShareAccounts gets member accounts of a shared list, from the cache or the instance.
+// Accounts that couldn't be fetched are cached (as nil) too, so they aren't asked for on every request.
+func (cfg *Config) getShareAccounts(ctx context.Context, mc *mastoclient.Config, instance string, ids []string) ([]*mastodon.Account, error) {
+	accounts := make([]*mastodon.Account, len(ids))
+	missing := []string{}
+	missingAt := []int{}
+
+	cfg.shareAccountsMu.Lock()
+	for i, id := range ids {
+		cached, ok := cfg.shareAccounts[instance+"#"+id]
+		if ok && time.Since(cached.fetchedAt) < shareAccountTTL {
+			accounts[i] = cached.account
+			continue
+		}
+		missing = append(missing, id)
+		missingAt = append(missingAt, i)
+	}
+	cfg.shareAccountsMu.Unlock()
+
+	if len(missing) == 0 {
+		return accounts, nil
+	}
+	fetched, err := mc.GetUsersByIDWithContext(ctx, missing)
+
+	// Don't cache the accounts a cancelled request didn't get to
+	if ctx.Err() != nil {
+		for i, account := range fetched {
+			accounts[missingAt[i]] = account
+		}
+		return accounts, err
+	}
+
+	cfg.shareAccountsMu.Lock()
+	defer cfg.shareAccountsMu.Unlock()
+	if cfg.shareAccounts == nil || len(cfg.shareAccounts)+len(missing) > shareAccountCacheSize {
+		cfg.pruneShareAccounts()
+	}
+	now := time.Now()
+	for i, account := range fetched {
+		accounts[missingAt[i]] = account
+		cfg.shareAccounts[instance+"#"+missing[i]] = &shareAccount{account: account, fetchedAt: now}
+	}
+	return accounts, err
+}
+
+// pruneShareAccounts drops the expired cached accounts, or all of them if the cache is still too big.
+// The caller holds cfg.shareAccountsMu.
+func (cfg *Config) pruneShareAccounts() {
+	for key, cached := range cfg.shareAccounts {
+		if time.Since(cached.fetchedAt) >= shareAccountTTL {
+			delete(cfg.shareAccounts, key)
+		}
+	}
+	if cfg.shareAccounts == nil || len(cfg.shareAccounts) >= shareAccountCacheSize/2 {
+		cfg.shareAccounts = make(map[string]*shareAccount)
+	}
+}
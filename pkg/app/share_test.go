@@ -0,0 +1,68 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+	"github.com/rs/zerolog"
+)
+
+// failingLists is a store whose saved lists can't be read
+type failingLists struct {
+	database.Store
+}
+
+func (failingLists) GetListWithContext(context.Context, string, string, string) (*database.List, error) {
+	return nil, errors.New("table unavailable")
+}
+
+func TestShareList(t *testing.T) {
+	db := database.NewMemory()
+	// The same owner and list ID on two instances: each keeps its own PSK and visibility
+	db.PutList(&database.List{Instance: "a.example", OwnerUserID: "1", ListID: "10", ListTitle: "a", PSK: "psk-a"})
+	db.PutList(&database.List{Instance: "b.example", OwnerUserID: "1", ListID: "10", ListTitle: "b", PSK: "psk-b", Public: true})
+	log := zerolog.Nop()
+	cfg, err := New(WithDB(db), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	failing, err := New(WithDB(failingLists{db}), WithLogger(&log))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  *Config
+		path string
+		want int
+	}{
+		{"private with its psk", cfg, "/share/lists/a.example/1/10?psk=psk-a", fiber.StatusOK},
+		{"private without psk", cfg, "/share/lists/a.example/1/10", fiber.StatusNotFound},
+		{"private with a wrong psk", cfg, "/share/lists/a.example/1/10?psk=wrong", fiber.StatusNotFound},
+		{"private with the other instance's psk", cfg, "/share/lists/a.example/1/10?psk=psk-b", fiber.StatusNotFound},
+		{"public without psk", cfg, "/share/lists/b.example/1/10", fiber.StatusOK},
+		{"public with any psk", cfg, "/share/lists/b.example/1/10?psk=wrong", fiber.StatusOK},
+		{"unknown list", cfg, "/share/lists/b.example/1/11", fiber.StatusNotFound},
+		{"bad limit", cfg, "/share/lists/b.example/1/10?limit=0", fiber.StatusBadRequest},
+		{"database failure", failing, "/share/lists/b.example/1/10", fiber.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Get("/share/lists/:instance/:owner/:listID", tt.cfg.shareList)
+
+			resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, tt.path, nil))
+			if err != nil {
+				t.Fatalf("app.Test: %v", err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
+)
+
+// softwareQuirks describes how a Mastodon API compatible server differs from Mastodon
+type softwareQuirks struct {
+	// unsupportedScopes are dropped from the configured scopes when registering the app
+	unsupportedScopes []string
+}
+
+// supportedSoftware is the server software (NodeInfo software name) mastostart can login with
+var supportedSoftware = map[string]softwareQuirks{
+	"mastodon": {},
+	"hometown": {},
+	"pleroma": {
+		// Pleroma/Akkoma reject the Mastodon 4.3 profile scope
+		unsupportedScopes: []string{"profile"},
+	},
+	"akkoma": {
+		unsupportedScopes: []string{"profile"},
+	},
+	"gotosocial": {
+		// GoToSocial has no follow scope or web push
+		unsupportedScopes: []string{"follow", "push", "profile"},
+	},
+}
+
+// detectSoftware identifies the instance's server software with NodeInfo.
+// Returns *UnsupportedSoftware if it can't be identified or isn't supported.
+func (cfg *Config) detectSoftware(ctx context.Context, instanceURL *url.URL) (*mastoclient.NodeInfo, *softwareQuirks, error) {
+	instanceUrlStr := instanceURL.String()
+	mc, err := mastoclient.New(
+		mastoclient.WithInstance(&instanceUrlStr),
+		mastoclient.WithLogger(cfg.log),
+		mastoclient.WithTimeouts(cfg.timeouts.Mastodon),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodeInfo, err := mc.GetNodeInfoWithContext(ctx)
+	if err != nil {
+		cfg.log.Debug().
+			Err(err).
+			Str("function", "detectSoftware::mc.GetNodeInfo()").
+			Str("instanceURL", instanceURL.Host).
+			Msg("unable to fetch nodeinfo")
+		return nil, nil, &UnsupportedSoftware{Msg: "unable to identify the server software of " + instanceURL.Host + " (is it a fediverse server?)"}
+	}
+
+	quirks, ok := supportedSoftware[nodeInfo.Software.Name]
+	if !ok {
+		return nil, nil, &UnsupportedSoftware{Msg: instanceURL.Host + " runs unsupported server software: " + nodeInfo.Software.Name}
+	}
+	return nodeInfo, &quirks, nil
+}
+
+// adaptScopes removes the scopes the server software doesn't support
+func (q *softwareQuirks) adaptScopes(scopes []string) []string {
+	adapted := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !containsString(q.unsupportedScopes, scope) {
+			adapted = append(adapted, scope)
+		}
+	}
+	return adapted
+}
@@ -1,24 +1,91 @@
 package app
 
 import (
+	"context"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/mattn/go-mastodon"
+	"github.com/rmrfslashbin/mastostart/pkg/database"
 	"github.com/rmrfslashbin/mastostart/pkg/mastoclient"
 )
 
 // JWTClaims is the JWT claims struct
 type JWTClaims struct {
-	AccessToken string `json:"access_token"`
+	// SessionID references the server-side session holding the user's Mastodon access token
+	SessionID string `json:"sid"`
+
+	// Admin is set for accounts listed in admin_accounts at login
+	Admin bool `json:"adm,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// AppCredentialsView is an app registration as returned by the admin API (without the client secret)
+type AppCredentialsView struct {
+	InstanceURL     string   `json:"instance_url"`
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Website         string   `json:"website"`
+	RedirectURI     string   `json:"redirect_uri"`
+	ClientID        string   `json:"client_id"`
+	Software        string   `json:"software"`
+	SoftwareVersion string   `json:"software_version"`
+	Scopes          []string `json:"scopes"`
+	CreatedAt       int64    `json:"created_at"`
+	VerifiedAt      int64    `json:"verified_at"`
+}
+
 type AuthVerifyReturn struct {
 	Account    *mastodon.Account `json:"account"`
 	LastStatus *mastodon.Status  `json:"last_status"`
 }
 
 type PreflightInput struct {
-	jwtToken *jwt.Token
+	// ctx is the request's context
+	ctx context.Context
+
+	session *database.UserCredentials
+
+	// linked is the linked account to act as; nil to act as the session's account
+	linked *database.LinkedAccount
+}
+
+// LinkedAccountView is a linked account as returned by /api/accounts
+type LinkedAccountView struct {
+	AccountURL  string   `json:"account_url"`
+	InstanceURL string   `json:"instance_url"`
+	UserID      string   `json:"user_id"`
+	Scopes      []string `json:"scopes"`
+	LinkedAt    int64    `json:"linked_at"`
+
+	// Current is true for the account the session logged in with
+	Current bool `json:"current"`
+
+	// NeedsRelink is true if the account's access token was revoked
+	NeedsRelink bool `json:"needs_relink"`
+}
+
+// APIKeyView is an API key as returned by /api/keys (without the secret or the ID of the session behind it)
+type APIKeyView struct {
+	KeyID      string   `json:"key_id"`
+	Name       string   `json:"name"`
+	AccountURL string   `json:"account_url"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at"`
+	ExpiresAt  int64    `json:"expires_at"`
+
+	// Key is the API key itself. Only returned when the key is minted.
+	Key string `json:"key,omitempty"`
+}
+
+// SessionView is a session as returned by the admin API (without the access token)
+type SessionView struct {
+	SessionID   string   `json:"session_id"`
+	IdentityID  string   `json:"identity_id"`
+	AccountURL  string   `json:"account_url"`
+	InstanceURL string   `json:"instance_url"`
+	Scopes      []string `json:"scopes"`
+	CreatedAt   int64    `json:"created_at"`
+	ExpiresAt   int64    `json:"expires_at"`
 }
 
 type PreflightOutput struct {
@@ -28,3 +95,99 @@ type PreflightOutput struct {
 	InstanceURL *string
 	Username    *string
 }
+
+// JWK is a JSON Web Key (RFC 7517) for an RSA public key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set (RFC 7517)
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// OIDCDiscovery is the OpenID Connect discovery document
+type OIDCDiscovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+// IDTokenClaims are the OpenID Connect ID token claims
+type IDTokenClaims struct {
+	Nonce             string `json:"nonce,omitempty"`
+	AuthTime          int64  `json:"auth_time,omitempty"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Profile           string `json:"profile,omitempty"`
+	Picture           string `json:"picture,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// OIDCAccessTokenClaims are the claims of the access tokens the OpenID Connect token endpoint issues.
+// They are only accepted by /oidc/userinfo (their audience), never by the API.
+type OIDCAccessTokenClaims struct {
+	// SessionID references the server-side session the user's profile is read with
+	SessionID string `json:"sid"`
+
+	// Scope is the space separated scopes the client was granted
+	Scope string `json:"scope"`
+	jwt.RegisteredClaims
+}
+
+// OIDCTokenResponse is the response from the OpenID Connect token endpoint
+type OIDCTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// DeviceAuthorizationResponse is the response from the device authorization endpoint (RFC 8628 section 3.2)
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceTokenResponse is the response from the device token endpoint once the device is authorized
+type DeviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// OIDCUserinfo is the response from the OpenID Connect userinfo endpoint
+type OIDCUserinfo struct {
+	Subject           string `json:"sub"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Profile           string `json:"profile,omitempty"`
+	Picture           string `json:"picture,omitempty"`
+}
+
+// OAuthError is an OAuth 2.0 error response (RFC 6749 section 5.2)
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
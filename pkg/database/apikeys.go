@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// apiKeysByIdentityIndex is the API keys GSI keyed by IdentityID
+const apiKeysByIdentityIndex = "IdentityID-index"
+
+// DeleteAPIKey deletes an API key item from the database.
+func (config *DDB) DeleteAPIKey(keyID string) error {
+	return config.DeleteAPIKeyWithContext(context.Background(), keyID)
+}
+
+// DeleteAPIKeyWithContext is DeleteAPIKey with a context.
+func (config *DDB) DeleteAPIKeyWithContext(ctx context.Context, keyID string) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableAPIKeys),
+		Key: map[string]types.AttributeValue{
+			"KeyID": &types.AttributeValueMemberS{Value: keyID},
+		},
+	}
+	_, err := config.db.DeleteItem(ctx, input)
+	return err
+}
+
+// GetAPIKey retrieves an API key item from the database.
+// A nil item (and nil error) is returned if it doesn't exist.
+func (config *DDB) GetAPIKey(keyID string) (*APIKey, error) {
+	return config.GetAPIKeyWithContext(context.Background(), keyID)
+}
+
+// GetAPIKeyWithContext is GetAPIKey with a context.
+func (config *DDB) GetAPIKeyWithContext(ctx context.Context, keyID string) (*APIKey, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableAPIKeys),
+		Key: map[string]types.AttributeValue{
+			"KeyID": &types.AttributeValueMemberS{Value: keyID},
+		},
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	key := &APIKey{}
+	err = attributevalue.UnmarshalMap(result.Item, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListAPIKeys retrieves all the API key items of an identity from the database.
+func (config *DDB) ListAPIKeys(identityID string) ([]*APIKey, error) {
+	return config.ListAPIKeysWithContext(context.Background(), identityID)
+}
+
+// ListAPIKeysWithContext is ListAPIKeys with a context.
+func (config *DDB) ListAPIKeysWithContext(ctx context.Context, identityID string) ([]*APIKey, error) {
+	keys := []*APIKey{}
+	paginator := dynamodb.NewQueryPaginator(config.db, &dynamodb.QueryInput{
+		TableName:              aws.String(config.tableAPIKeys),
+		IndexName:              aws.String(apiKeysByIdentityIndex),
+		KeyConditionExpression: aws.String("IdentityID = :identityID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":identityID": &types.AttributeValueMemberS{Value: identityID},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := nextPage(ctx, config, paginator.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		pageKeys := []*APIKey{}
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageKeys); err != nil {
+			return nil, err
+		}
+		keys = append(keys, pageKeys...)
+	}
+	return keys, nil
+}
+
+// PutAPIKey stores an API key item in the database.
+func (config *DDB) PutAPIKey(key *APIKey) error {
+	return config.PutAPIKeyWithContext(context.Background(), key)
+}
+
+// PutAPIKeyWithContext is PutAPIKey with a context.
+func (config *DDB) PutAPIKeyWithContext(ctx context.Context, key *APIKey) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableAPIKeys),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
+
+// TouchAPIKey sets the unix time an API key was last used.
+func (config *DDB) TouchAPIKey(keyID string, lastUsedAt int64) error {
+	return config.TouchAPIKeyWithContext(context.Background(), keyID, lastUsedAt)
+}
+
+// TouchAPIKeyWithContext is TouchAPIKey with a context.
+func (config *DDB) TouchAPIKeyWithContext(ctx context.Context, keyID string, lastUsedAt int64) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(config.tableAPIKeys),
+		Key: map[string]types.AttributeValue{
+			"KeyID": &types.AttributeValueMemberS{Value: keyID},
+		},
+		UpdateExpression:    aws.String("SET LastUsedAt = :lastUsedAt"),
+		ConditionExpression: aws.String("attribute_exists(KeyID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lastUsedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(lastUsedAt, 10)},
+		},
+	}
+	_, err := config.db.UpdateItem(ctx, input)
+	return err
+}
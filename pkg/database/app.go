@@ -11,25 +11,41 @@ import (
 
 // DeleteAppCredentials deletes an app credentials item from the database.
 func (config *DDB) DeleteAppCredentials(instance string) error {
+	return config.DeleteAppCredentialsWithContext(context.Background(), instance)
+}
+
+// DeleteAppCredentialsWithContext is DeleteAppCredentials with a context.
+func (config *DDB) DeleteAppCredentialsWithContext(ctx context.Context, instance string) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
 	input := &dynamodb.DeleteItemInput{
 		TableName: aws.String(config.tableAppCredentials),
 		Key: map[string]types.AttributeValue{
 			"InstanceURL": &types.AttributeValueMemberS{Value: instance},
 		},
 	}
-	_, err := config.db.DeleteItem(context.TODO(), input)
+	_, err := config.db.DeleteItem(ctx, input)
 	return err
 }
 
 // GetAppCredentials retrieves an app credentials item from the database.
 func (config *DDB) GetAppCredentials(instance string) (*AppCredentials, error) {
+	return config.GetAppCredentialsWithContext(context.Background(), instance)
+}
+
+// GetAppCredentialsWithContext is GetAppCredentials with a context.
+func (config *DDB) GetAppCredentialsWithContext(ctx context.Context, instance string) (*AppCredentials, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
 	input := &dynamodb.GetItemInput{
 		TableName: aws.String(config.tableAppCredentials),
 		Key: map[string]types.AttributeValue{
 			"InstanceURL": &types.AttributeValueMemberS{Value: instance},
 		},
 	}
-	result, err := config.db.GetItem(context.TODO(), input)
+	result, err := config.db.GetItem(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +62,14 @@ func (config *DDB) GetAppCredentials(instance string) (*AppCredentials, error) {
 
 // PutAppCredentials stores an app credentials item in the database.
 func (config *DDB) PutAppCredentials(app *AppCredentials) error {
+	return config.PutAppCredentialsWithContext(context.Background(), app)
+}
+
+// PutAppCredentialsWithContext is PutAppCredentials with a context.
+func (config *DDB) PutAppCredentialsWithContext(ctx context.Context, app *AppCredentials) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
 	item, err := attributevalue.MarshalMap(app)
 	if err != nil {
 		return err
@@ -54,6 +78,53 @@ func (config *DDB) PutAppCredentials(app *AppCredentials) error {
 		TableName: aws.String(config.tableAppCredentials),
 		Item:      item,
 	}
-	_, err = config.db.PutItem(context.TODO(), input)
+	_, err = config.db.PutItem(ctx, input)
 	return err
 }
+
+// PutArchivedAppCredentials stores a replaced app credentials item in the archive table.
+func (config *DDB) PutArchivedAppCredentials(archived *ArchivedAppCredentials) error {
+	return config.PutArchivedAppCredentialsWithContext(context.Background(), archived)
+}
+
+// PutArchivedAppCredentialsWithContext is PutArchivedAppCredentials with a context.
+func (config *DDB) PutArchivedAppCredentialsWithContext(ctx context.Context, archived *ArchivedAppCredentials) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(archived)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableAppCredsArchive),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
+
+// ListAppCredentials retrieves all app credentials items from the database.
+func (config *DDB) ListAppCredentials() ([]*AppCredentials, error) {
+	return config.ListAppCredentialsWithContext(context.Background())
+}
+
+// ListAppCredentialsWithContext is ListAppCredentials with a context.
+func (config *DDB) ListAppCredentialsWithContext(ctx context.Context) ([]*AppCredentials, error) {
+	apps := []*AppCredentials{}
+	paginator := dynamodb.NewScanPaginator(config.db, &dynamodb.ScanInput{
+		TableName: aws.String(config.tableAppCredentials),
+	})
+	for paginator.HasMorePages() {
+		page, err := nextPage(ctx, config, paginator.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		var pageApps []*AppCredentials
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageApps); err != nil {
+			return nil, err
+		}
+		apps = append(apps, pageApps...)
+	}
+	return apps, nil
+}
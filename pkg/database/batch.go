@@ -0,0 +1,125 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// batchWriteLimit is the most write requests DynamoDB accepts in one BatchWriteItem
+	batchWriteLimit = 25
+
+	// batchMaxAttempts is how many times a chunk is sent before its unprocessed items are given up on
+	batchMaxAttempts = 8
+
+	// batchBaseBackoff and batchMaxBackoff bound the (jittered, exponential) wait before resending unprocessed items
+	batchBaseBackoff = 50 * time.Millisecond
+	batchMaxBackoff  = 5 * time.Second
+
+	// DefaultBatchConcurrency is how many chunks of a bulk write are sent at once unless WithDDBBatchConcurrency says otherwise
+	DefaultBatchConcurrency = 4
+)
+
+// WithDDBBatchConcurrency sets how many chunks of a bulk write are sent at once
+func WithDDBBatchConcurrency(concurrency int) func(*DDB) {
+	return func(config *DDB) {
+		config.batchConcurrency = concurrency
+	}
+}
+
+// batchWrite sends write requests for a table in chunks of batchWriteLimit, batchConcurrency chunks at a time.
+// Unprocessed items are resent with backoff. The DDB timeout bounds each BatchWriteItem call rather than
+// the whole write, so big writes aren't cut short. The first error cancels the chunks not yet sent.
+func (config *DDB) batchWrite(ctx context.Context, table string, requests []types.WriteRequest) error {
+	if len(requests) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := config.batchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, concurrency)
+	for start := 0; start < len(requests); start += batchWriteLimit {
+		end := start + batchWriteLimit
+		if end > len(requests) {
+			end = len(requests)
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(chunk []types.WriteRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := config.batchWriteChunk(ctx, table, chunk); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(requests[start:end])
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// batchWriteChunk sends one chunk, resending its unprocessed items until they're all written
+func (config *DDB) batchWriteChunk(ctx context.Context, table string, chunk []types.WriteRequest) error {
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := config.withTimeout(ctx)
+		output, err := config.db.BatchWriteItem(callCtx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{table: chunk},
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		chunk = output.UnprocessedItems[table]
+		if len(chunk) == 0 {
+			return nil
+		}
+		if attempt+1 >= batchMaxAttempts {
+			return fmt.Errorf("%d items left unprocessed in %s after %d attempts", len(chunk), table, batchMaxAttempts)
+		}
+
+		// Full jitter: wait a random time up to the exponential backoff
+		backoff := batchBaseBackoff << attempt
+		if backoff > batchMaxBackoff {
+			backoff = batchMaxBackoff
+		}
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
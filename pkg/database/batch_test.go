@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeBatchWriter is a DynamoDB endpoint that answers BatchWriteItem. unprocessed picks the
+// write requests of a call (by its number, from 0) that are handed back as unprocessed.
+type fakeBatchWriter struct {
+	mu          sync.Mutex
+	calls       []int
+	unprocessed func(call int, requests []json.RawMessage) []json.RawMessage
+	fail        bool
+}
+
+func (f *fakeBatchWriter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RequestItems map[string][]json.RawMessage
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if f.fail {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazon.coral.validate#ValidationException","message":"bad request"}`))
+		return
+	}
+
+	f.mu.Lock()
+	call := len(f.calls)
+	f.calls = append(f.calls, len(input.RequestItems["test"]))
+	f.mu.Unlock()
+
+	left := []json.RawMessage{}
+	if f.unprocessed != nil {
+		left = f.unprocessed(call, input.RequestItems["test"])
+	}
+	output := map[string]map[string][]json.RawMessage{"UnprocessedItems": {}}
+	if len(left) > 0 {
+		output["UnprocessedItems"]["test"] = left
+	}
+	json.NewEncoder(w).Encode(output)
+}
+
+// newFakeDDB returns a DDB whose client talks to the fake endpoint
+func newFakeDDB(t *testing.T, fake *fakeBatchWriter) *DDB {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return &DDB{
+		db: dynamodb.New(dynamodb.Options{
+			BaseEndpoint:     aws.String(server.URL),
+			Region:           "us-east-1",
+			Credentials:      aws.AnonymousCredentials{},
+			RetryMaxAttempts: 1,
+		}),
+		timeout:          DefaultDDBTimeout,
+		batchConcurrency: DefaultBatchConcurrency,
+	}
+}
+
+// putRequests returns n put requests
+func putRequests(n int) []types.WriteRequest {
+	requests := make([]types.WriteRequest, n)
+	for i := range requests {
+		requests[i] = types.WriteRequest{
+			PutRequest: &types.PutRequest{
+				Item: map[string]types.AttributeValue{
+					"UserID": &types.AttributeValueMemberS{Value: strconv.Itoa(i)},
+				},
+			},
+		}
+	}
+	return requests
+}
+
+func TestBatchWrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		requests    int
+		unprocessed func(call int, requests []json.RawMessage) []json.RawMessage
+		wantCalls   []int
+	}{
+		{"empty", 0, nil, []int{}},
+		{"one chunk", 10, nil, []int{10}},
+		{"full chunks", 50, nil, []int{25, 25}},
+		{"partial chunk", 60, nil, []int{10, 25, 25}},
+		{"unprocessed are resent", 10, func(call int, requests []json.RawMessage) []json.RawMessage {
+			if call == 0 {
+				return requests[8:]
+			}
+			return nil
+		}, []int{2, 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeBatchWriter{unprocessed: tt.unprocessed}
+			db := newFakeDDB(t, fake)
+
+			if err := db.batchWrite(context.Background(), "test", putRequests(tt.requests)); err != nil {
+				t.Fatalf("batchWrite: %v", err)
+			}
+
+			// Chunks are sent concurrently, so compare the sizes sorted
+			calls := append([]int{}, fake.calls...)
+			sort.Ints(calls)
+			if len(calls) != len(tt.wantCalls) {
+				t.Fatalf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+			for i := range calls {
+				if calls[i] != tt.wantCalls[i] {
+					t.Fatalf("calls = %v, want %v", calls, tt.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchWriteErrors(t *testing.T) {
+	t.Run("request fails", func(t *testing.T) {
+		db := newFakeDDB(t, &fakeBatchWriter{fail: true})
+		if err := db.batchWrite(context.Background(), "test", putRequests(30)); err == nil {
+			t.Fatal("batchWrite succeeded, want an error")
+		}
+	})
+
+	t.Run("cancelled while resending", func(t *testing.T) {
+		db := newFakeDDB(t, &fakeBatchWriter{
+			unprocessed: func(_ int, requests []json.RawMessage) []json.RawMessage { return requests },
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if err := db.batchWrite(ctx, "test", putRequests(5)); err == nil {
+			t.Fatal("batchWrite succeeded, want an error")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("batchWrite took %v after its context ended", elapsed)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltKV is a key/value backend in a bbolt file
+type boltKV struct {
+	db *bolt.DB
+}
+
+// boltTx is a bbolt transaction
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// NewBolt opens (or creates) a store in a bbolt file. Only one process can open the file at a time:
+// it is locked until the store is closed, so a running `mastostart serve` keeps the CLI out.
+func NewBolt(path string) (*KVStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is locked by another process (is mastostart serve running? stop it, or use the admin API): %w", path, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range kvBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &KVStore{kv: &boltKV{db: db}}, nil
+}
+
+func (b *boltKV) view(fn func(tx kvTx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (b *boltKV) update(fn func(tx kvTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (b *boltKV) close() error {
+	return b.db.Close()
+}
+
+func (t *boltTx) get(bucket string, key string) []byte {
+	value := t.tx.Bucket([]byte(bucket)).Get([]byte(key))
+	if value == nil {
+		return nil
+	}
+	// Values are only valid during the transaction
+	return append([]byte{}, value...)
+}
+
+func (t *boltTx) put(bucket string, key string, value []byte) error {
+	return t.tx.Bucket([]byte(bucket)).Put([]byte(key), value)
+}
+
+func (t *boltTx) delete(bucket string, key string) error {
+	return t.tx.Bucket([]byte(bucket)).Delete([]byte(key))
+}
+
+func (t *boltTx) forEach(bucket string, fn func(key string, value []byte) error) error {
+	return t.tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
@@ -11,25 +11,41 @@ import (
 
 // DeleteConfig deletes a config item from the database.
 func (config *DDB) DeleteConfig(key string) error {
+	return config.DeleteConfigWithContext(context.Background(), key)
+}
+
+// DeleteConfigWithContext is DeleteConfig with a context.
+func (config *DDB) DeleteConfigWithContext(ctx context.Context, key string) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
 	input := &dynamodb.DeleteItemInput{
 		TableName: aws.String(config.tableConfig),
 		Key: map[string]types.AttributeValue{
 			"ConfigKey": &types.AttributeValueMemberS{Value: key},
 		},
 	}
-	_, err := config.db.DeleteItem(context.TODO(), input)
+	_, err := config.db.DeleteItem(ctx, input)
 	return err
 }
 
 // GetConfig retrieves a config item from the database.
 func (config *DDB) GetConfig(key string) (*ConfigItem, error) {
+	return config.GetConfigWithContext(context.Background(), key)
+}
+
+// GetConfigWithContext is GetConfig with a context.
+func (config *DDB) GetConfigWithContext(ctx context.Context, key string) (*ConfigItem, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
 	input := &dynamodb.GetItemInput{
 		TableName: aws.String(config.tableConfig),
 		Key: map[string]types.AttributeValue{
 			"ConfigKey": &types.AttributeValueMemberS{Value: key},
 		},
 	}
-	result, err := config.db.GetItem(context.TODO(), input)
+	result, err := config.db.GetItem(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +62,14 @@ func (config *DDB) GetConfig(key string) (*ConfigItem, error) {
 
 // PutConfig stores a config item in the database.
 func (config *DDB) PutConfig(item *ConfigItem) error {
+	return config.PutConfigWithContext(context.Background(), item)
+}
+
+// PutConfigWithContext is PutConfig with a context.
+func (config *DDB) PutConfigWithContext(ctx context.Context, item *ConfigItem) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
 	m, err := attributevalue.MarshalMap(item)
 	if err != nil {
 		return err
@@ -55,6 +79,31 @@ func (config *DDB) PutConfig(item *ConfigItem) error {
 		TableName: aws.String(config.tableConfig),
 		Item:      m,
 	}
-	_, err = config.db.PutItem(context.TODO(), input)
+	_, err = config.db.PutItem(ctx, input)
 	return err
 }
+
+// ListConfig retrieves all config items from the database.
+func (config *DDB) ListConfig() ([]*ConfigItem, error) {
+	return config.ListConfigWithContext(context.Background())
+}
+
+// ListConfigWithContext is ListConfig with a context.
+func (config *DDB) ListConfigWithContext(ctx context.Context) ([]*ConfigItem, error) {
+	items := []*ConfigItem{}
+	paginator := dynamodb.NewScanPaginator(config.db, &dynamodb.ScanInput{
+		TableName: aws.String(config.tableConfig),
+	})
+	for paginator.HasMorePages() {
+		page, err := nextPage(ctx, config, paginator.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		var pageItems []*ConfigItem
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageItems); err != nil {
+			return nil, err
+		}
+		items = append(items, pageItems...)
+	}
+	return items, nil
+}
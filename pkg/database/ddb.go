@@ -3,11 +3,15 @@ package database
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
 
+// DefaultDDBTimeout is how long a database call may take unless WithDDBTimeout says otherwise
+const DefaultDDBTimeout = 5 * time.Second
+
 // DDBOption is a function that configures the DDB struct
 type DDBOption func(config *DDB)
 
@@ -17,10 +21,22 @@ type DDB struct {
 	profile              string
 	region               string
 	tablePrefix          string
+	timeout              time.Duration
+	batchConcurrency     int
 	tableAccountsInList  string
+	tableAPIKeys         string
 	tableAppCredentials  string
+	tableAppCredsArchive string
+	tableAuthCodes       string
 	tableConfig          string
+	tableDeviceCodes     string
+	tableLinkedAccounts  string
 	tableLists           string
+	tableLoginAttempts   string
+	tableOIDCClients     string
+	tableRateLimits      string
+	tableRevokedTokens   string
+	tableSigningKeys     string
 	tableUserCredentials string
 }
 
@@ -43,12 +59,30 @@ func New(opts ...func(*DDB)) (*DDB, error) {
 		cfg.tablePrefix = "mastostart-"
 	}
 
+	// Bound every call unless told otherwise
+	if cfg.timeout == 0 {
+		cfg.timeout = DefaultDDBTimeout
+	}
+	if cfg.batchConcurrency == 0 {
+		cfg.batchConcurrency = DefaultBatchConcurrency
+	}
+
 	// Set the table names
 	cfg.tableAccountsInList = cfg.tablePrefix + "accounts-in-list"
+	cfg.tableAPIKeys = cfg.tablePrefix + "api-keys"
 	cfg.tableAppCredentials = cfg.tablePrefix + "app-credentials"
+	cfg.tableAppCredsArchive = cfg.tablePrefix + "app-credentials-archive"
 	cfg.tableConfig = cfg.tablePrefix + "config"
 	cfg.tableUserCredentials = cfg.tablePrefix + "user-credentials"
-	cfg.tableLists = cfg.tablePrefix + "lists"
+	cfg.tableLists = cfg.tablePrefix + "saved-lists"
+	cfg.tableLinkedAccounts = cfg.tablePrefix + "linked-accounts"
+	cfg.tableLoginAttempts = cfg.tablePrefix + "login-attempts"
+	cfg.tableRevokedTokens = cfg.tablePrefix + "revoked-tokens"
+	cfg.tableRateLimits = cfg.tablePrefix + "rate-limits"
+	cfg.tableSigningKeys = cfg.tablePrefix + "jwt-keys"
+	cfg.tableOIDCClients = cfg.tablePrefix + "oidc-clients"
+	cfg.tableAuthCodes = cfg.tablePrefix + "auth-codes"
+	cfg.tableDeviceCodes = cfg.tablePrefix + "device-codes"
 
 	// Config DynamoDB
 	c, err := config.LoadDefaultConfig(context.TODO(), func(o *config.LoadOptions) error {
@@ -91,3 +125,28 @@ func WithDDBTablePrefix(prefix string) func(*DDB) {
 		config.tablePrefix = prefix
 	}
 }
+
+// WithDDBTimeout sets how long a call (including its retries and pages) may take.
+// Bulk writes apply it to each batch of 25 items. A negative timeout leaves calls bounded by their context only.
+func WithDDBTimeout(timeout time.Duration) func(*DDB) {
+	return func(config *DDB) {
+		config.timeout = timeout
+	}
+}
+
+// withTimeout bounds a call's context by the timeout
+func (config *DDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if config.timeout < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, config.timeout)
+}
+
+// nextPage gets the next page of a Scan or Query paginator, bounded by the timeout.
+// Paginated reads bound each page rather than the whole read, as batchWriteChunk does for bulk
+// writes, so reading a big table isn't cut short; the caller's context still bounds the whole read.
+func nextPage[T any](ctx context.Context, config *DDB, next func(context.Context, ...func(*dynamodb.Options)) (T, error)) (T, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+	return next(ctx)
+}
@@ -0,0 +1,246 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// deviceCodesByUserCodeIndex is the device codes GSI keyed by UserCode
+const deviceCodesByUserCodeIndex = "UserCode-index"
+
+// ConsumeDeviceAuthorization deletes an approved device authorization from the database and returns it.
+// A nil item (and nil error) is returned if it is unknown, not approved or was already used.
+func (config *DDB) ConsumeDeviceAuthorization(deviceCode string) (*DeviceAuthorization, error) {
+	return config.ConsumeDeviceAuthorizationWithContext(context.Background(), deviceCode)
+}
+
+// ConsumeDeviceAuthorizationWithContext is ConsumeDeviceAuthorization with a context.
+func (config *DDB) ConsumeDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableDeviceCodes),
+		Key: map[string]types.AttributeValue{
+			"DeviceCode": &types.AttributeValueMemberS{Value: deviceCode},
+		},
+		ConditionExpression: aws.String("#status = :approved"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":approved": &types.AttributeValueMemberS{Value: DeviceApproved},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	}
+	result, err := config.db.DeleteItem(ctx, input)
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if result.Attributes == nil {
+		return nil, nil
+	}
+	device := &DeviceAuthorization{}
+	err = attributevalue.UnmarshalMap(result.Attributes, device)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// DeleteDeviceAuthorization deletes a device authorization from the database.
+func (config *DDB) DeleteDeviceAuthorization(deviceCode string) error {
+	return config.DeleteDeviceAuthorizationWithContext(context.Background(), deviceCode)
+}
+
+// DeleteDeviceAuthorizationWithContext is DeleteDeviceAuthorization with a context.
+func (config *DDB) DeleteDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableDeviceCodes),
+		Key: map[string]types.AttributeValue{
+			"DeviceCode": &types.AttributeValueMemberS{Value: deviceCode},
+		},
+	}
+	_, err := config.db.DeleteItem(ctx, input)
+	return err
+}
+
+// GetDeviceAuthorization retrieves a device authorization from the database.
+// A nil item (and nil error) is returned if it doesn't exist.
+func (config *DDB) GetDeviceAuthorization(deviceCode string) (*DeviceAuthorization, error) {
+	return config.GetDeviceAuthorizationWithContext(context.Background(), deviceCode)
+}
+
+// GetDeviceAuthorizationWithContext is GetDeviceAuthorization with a context.
+func (config *DDB) GetDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableDeviceCodes),
+		Key: map[string]types.AttributeValue{
+			"DeviceCode": &types.AttributeValueMemberS{Value: deviceCode},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	device := &DeviceAuthorization{}
+	err = attributevalue.UnmarshalMap(result.Item, device)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// GetDeviceAuthorizationByUserCode retrieves the device authorization for a user code from the database.
+// A nil item (and nil error) is returned if there isn't one.
+func (config *DDB) GetDeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error) {
+	return config.GetDeviceAuthorizationByUserCodeWithContext(context.Background(), userCode)
+}
+
+// GetDeviceAuthorizationByUserCodeWithContext is GetDeviceAuthorizationByUserCode with a context.
+func (config *DDB) GetDeviceAuthorizationByUserCodeWithContext(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(config.tableDeviceCodes),
+		IndexName:              aws.String(deviceCodesByUserCodeIndex),
+		KeyConditionExpression: aws.String("UserCode = :userCode"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userCode": &types.AttributeValueMemberS{Value: userCode},
+		},
+		Limit: aws.Int32(1),
+	}
+	result, err := config.db.Query(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Items) == 0 {
+		return nil, nil
+	}
+
+	// The index only projects the keys; get the whole item
+	keys := &DeviceAuthorization{}
+	if err := attributevalue.UnmarshalMap(result.Items[0], keys); err != nil {
+		return nil, err
+	}
+	return config.GetDeviceAuthorizationWithContext(ctx, keys.DeviceCode)
+}
+
+// PollDeviceAuthorization records a poll of a pending device authorization: only its LastPolledAt and
+// Interval are updated, so the poll can't overwrite an approval or denial made in the meantime.
+// Returns false (and nil error) if the device authorization is unknown or no longer pending.
+func (config *DDB) PollDeviceAuthorization(deviceCode string, lastPolledAt int64, interval int64) (bool, error) {
+	return config.PollDeviceAuthorizationWithContext(context.Background(), deviceCode, lastPolledAt, interval)
+}
+
+// PollDeviceAuthorizationWithContext is PollDeviceAuthorization with a context.
+func (config *DDB) PollDeviceAuthorizationWithContext(ctx context.Context, deviceCode string, lastPolledAt int64, interval int64) (bool, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(config.tableDeviceCodes),
+		Key: map[string]types.AttributeValue{
+			"DeviceCode": &types.AttributeValueMemberS{Value: deviceCode},
+		},
+		UpdateExpression:    aws.String("SET LastPolledAt = :lastPolledAt, #interval = :interval"),
+		ConditionExpression: aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{
+			"#interval": "Interval",
+			"#status":   "Status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lastPolledAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(lastPolledAt, 10)},
+			":interval":     &types.AttributeValueMemberN{Value: strconv.FormatInt(interval, 10)},
+			":pending":      &types.AttributeValueMemberS{Value: DevicePending},
+		},
+	}
+	return config.updateDeviceAuthorization(ctx, input)
+}
+
+// ResolveDeviceAuthorization sets the Status (DeviceApproved or DeviceDenied), SessionID and Token of a
+// pending device authorization. Returns false (and nil error) if it is unknown or no longer pending.
+func (config *DDB) ResolveDeviceAuthorization(deviceCode string, status string, sessionID string, token string) (bool, error) {
+	return config.ResolveDeviceAuthorizationWithContext(context.Background(), deviceCode, status, sessionID, token)
+}
+
+// ResolveDeviceAuthorizationWithContext is ResolveDeviceAuthorization with a context.
+func (config *DDB) ResolveDeviceAuthorizationWithContext(ctx context.Context, deviceCode string, status string, sessionID string, token string) (bool, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(config.tableDeviceCodes),
+		Key: map[string]types.AttributeValue{
+			"DeviceCode": &types.AttributeValueMemberS{Value: deviceCode},
+		},
+		UpdateExpression:    aws.String("SET #status = :status, SessionID = :sessionID, #token = :token"),
+		ConditionExpression: aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "Status",
+			"#token":  "Token",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":    &types.AttributeValueMemberS{Value: status},
+			":sessionID": &types.AttributeValueMemberS{Value: sessionID},
+			":token":     &types.AttributeValueMemberS{Value: token},
+			":pending":   &types.AttributeValueMemberS{Value: DevicePending},
+		},
+	}
+	return config.updateDeviceAuthorization(ctx, input)
+}
+
+// updateDeviceAuthorization runs a conditional update; false if the condition failed
+func (config *DDB) updateDeviceAuthorization(ctx context.Context, input *dynamodb.UpdateItemInput) (bool, error) {
+	if _, err := config.db.UpdateItem(ctx, input); err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PutDeviceAuthorization stores a device authorization in the database.
+func (config *DDB) PutDeviceAuthorization(device *DeviceAuthorization) error {
+	return config.PutDeviceAuthorizationWithContext(context.Background(), device)
+}
+
+// PutDeviceAuthorizationWithContext is PutDeviceAuthorization with a context.
+func (config *DDB) PutDeviceAuthorizationWithContext(ctx context.Context, device *DeviceAuthorization) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(device)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableDeviceCodes),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
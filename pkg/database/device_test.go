@@ -0,0 +1,73 @@
+package database
+
+import "testing"
+
+func TestDeviceAuthorization(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		poll       bool
+		resolveTo  string
+		wantOK     bool
+		wantStatus string
+	}{
+		{"poll pending", DevicePending, true, "", true, DevicePending},
+		{"poll approved", DeviceApproved, true, "", false, DeviceApproved},
+		{"poll denied", DeviceDenied, true, "", false, DeviceDenied},
+		{"approve pending", DevicePending, false, DeviceApproved, true, DeviceApproved},
+		{"deny pending", DevicePending, false, DeviceDenied, true, DeviceDenied},
+		{"deny approved", DeviceApproved, false, DeviceDenied, false, DeviceApproved},
+		{"approve denied", DeviceDenied, false, DeviceApproved, false, DeviceDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewMemory()
+			if err := db.PutDeviceAuthorization(&DeviceAuthorization{
+				DeviceCode: "device",
+				UserCode:   "BCDF-GHJK",
+				Status:     tt.status,
+				Interval:   5,
+			}); err != nil {
+				t.Fatalf("PutDeviceAuthorization: %v", err)
+			}
+
+			var ok bool
+			var err error
+			if tt.poll {
+				ok, err = db.PollDeviceAuthorization("device", 1700000000, 10)
+			} else {
+				ok, err = db.ResolveDeviceAuthorization("device", tt.resolveTo, "session", "token")
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("ok = %v, want %v", ok, tt.wantOK)
+			}
+
+			device, err := db.GetDeviceAuthorizationByUserCode("BCDF-GHJK")
+			if err != nil || device == nil {
+				t.Fatalf("GetDeviceAuthorizationByUserCode = %+v, %v", device, err)
+			}
+			if device.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", device.Status, tt.wantStatus)
+			}
+			if tt.poll && tt.wantOK && (device.LastPolledAt != 1700000000 || device.Interval != 10) {
+				t.Errorf("poll not recorded: %+v", device)
+			}
+			if !tt.wantOK && (device.SessionID != "" || device.Token != "" || device.LastPolledAt != 0) {
+				t.Errorf("a resolved device authorization was changed: %+v", device)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		db := NewMemory()
+		if ok, err := db.PollDeviceAuthorization("missing", 1, 5); ok || err != nil {
+			t.Errorf("PollDeviceAuthorization = %v, %v; want false, nil", ok, err)
+		}
+		if ok, err := db.ResolveDeviceAuthorization("missing", DeviceApproved, "", ""); ok || err != nil {
+			t.Errorf("ResolveDeviceAuthorization = %v, %v; want false, nil", ok, err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// GetSigningKey retrieves a JWT signing key item from the database.
+func (config *DDB) GetSigningKey(keyID string) (*SigningKey, error) {
+	return config.GetSigningKeyWithContext(context.Background(), keyID)
+}
+
+// GetSigningKeyWithContext is GetSigningKey with a context.
+func (config *DDB) GetSigningKeyWithContext(ctx context.Context, keyID string) (*SigningKey, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableSigningKeys),
+		Key: map[string]types.AttributeValue{
+			"KeyID": &types.AttributeValueMemberS{Value: keyID},
+		},
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	key := &SigningKey{}
+	err = attributevalue.UnmarshalMap(result.Item, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ListSigningKeys retrieves all JWT signing key items from the database.
+func (config *DDB) ListSigningKeys() ([]*SigningKey, error) {
+	return config.ListSigningKeysWithContext(context.Background())
+}
+
+// ListSigningKeysWithContext is ListSigningKeys with a context.
+func (config *DDB) ListSigningKeysWithContext(ctx context.Context) ([]*SigningKey, error) {
+	keys := []*SigningKey{}
+	paginator := dynamodb.NewScanPaginator(config.db, &dynamodb.ScanInput{
+		TableName: aws.String(config.tableSigningKeys),
+	})
+	for paginator.HasMorePages() {
+		page, err := nextPage(ctx, config, paginator.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		var pageKeys []*SigningKey
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageKeys); err != nil {
+			return nil, err
+		}
+		keys = append(keys, pageKeys...)
+	}
+	return keys, nil
+}
+
+// PutSigningKey stores a JWT signing key item in the database.
+func (config *DDB) PutSigningKey(key *SigningKey) error {
+	return config.PutSigningKeyWithContext(context.Background(), key)
+}
+
+// PutSigningKeyWithContext is PutSigningKey with a context.
+func (config *DDB) PutSigningKeyWithContext(ctx context.Context, key *SigningKey) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableSigningKeys),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
@@ -0,0 +1,884 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Buckets of the key/value stores. They're named after the DynamoDB tables.
+const (
+	bucketAccountsInList  = "accounts-in-list"
+	bucketAPIKeys         = "api-keys"
+	bucketAppCredentials  = "app-credentials"
+	bucketAppCredsArchive = "app-credentials-archive"
+	bucketAuthCodes       = "auth-codes"
+	bucketConfig          = "config"
+	bucketDeviceCodes     = "device-codes"
+	bucketLinkedAccounts  = "linked-accounts"
+	bucketLists           = "lists"
+	bucketLoginAttempts   = "login-attempts"
+	bucketOIDCClients     = "oidc-clients"
+	bucketRateLimits      = "rate-limits"
+	bucketRevokedTokens   = "revoked-tokens"
+	bucketSigningKeys     = "jwt-keys"
+	bucketUserCredentials = "user-credentials"
+)
+
+// kvBuckets are all the buckets
+var kvBuckets = []string{
+	bucketAccountsInList, bucketAPIKeys, bucketAppCredentials, bucketAppCredsArchive, bucketAuthCodes,
+	bucketConfig, bucketDeviceCodes, bucketLinkedAccounts, bucketLists, bucketLoginAttempts,
+	bucketOIDCClients, bucketRateLimits, bucketRevokedTokens, bucketSigningKeys, bucketUserCredentials,
+}
+
+// kvExpiringBuckets are the buckets whose items have an ExpiresAt (the DynamoDB TTL attribute).
+// Sweep deletes their expired items.
+var kvExpiringBuckets = []string{
+	bucketAPIKeys, bucketAuthCodes, bucketDeviceCodes, bucketLoginAttempts,
+	bucketRateLimits, bucketRevokedTokens, bucketUserCredentials,
+}
+
+// kvTx is a transaction on a key/value backend. Keys are iterated in order.
+type kvTx interface {
+	get(bucket string, key string) []byte
+	put(bucket string, key string, value []byte) error
+	delete(bucket string, key string) error
+	forEach(bucket string, fn func(key string, value []byte) error) error
+}
+
+// kvBackend is a key/value backend with transactions
+type kvBackend interface {
+	view(fn func(tx kvTx) error) error
+	update(fn func(tx kvTx) error) error
+	close() error
+}
+
+// KVStore is a Store on top of a key/value backend: in memory (NewMemory) or a bbolt file (NewBolt).
+// Items are stored as JSON. Lookups DynamoDB does with an index scan the bucket.
+type KVStore struct {
+	kv kvBackend
+}
+
+// view runs a read only transaction, unless the context is done
+func (config *KVStore) view(ctx context.Context, fn func(tx kvTx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return config.kv.view(fn)
+}
+
+// update runs a read/write transaction, unless the context is done
+func (config *KVStore) update(ctx context.Context, fn func(tx kvTx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return config.kv.update(fn)
+}
+
+// Close closes the backend
+func (config *KVStore) Close() error {
+	return config.kv.close()
+}
+
+// Sweep deletes the expired items, like DynamoDB's TTL does. Run it now and then.
+func (config *KVStore) Sweep() (int, error) {
+	now := time.Now().Unix()
+	deleted := 0
+	err := config.kv.update(func(tx kvTx) error {
+		for _, bucket := range kvExpiringBuckets {
+			expired := []string{}
+			err := tx.forEach(bucket, func(key string, value []byte) error {
+				item := struct {
+					ExpiresAt int64 `json:"expires_at"`
+				}{}
+				if err := json.Unmarshal(value, &item); err != nil {
+					return err
+				}
+				if item.ExpiresAt != 0 && item.ExpiresAt < now {
+					expired = append(expired, key)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range expired {
+				if err := tx.delete(bucket, key); err != nil {
+					return err
+				}
+			}
+			deleted += len(expired)
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// kvKey joins the parts of a composite key (eg a DynamoDB hash and range key)
+func kvKey(parts ...string) string {
+	key := ""
+	for i, part := range parts {
+		if i > 0 {
+			key += "\x00"
+		}
+		key += part
+	}
+	return key
+}
+
+// kvGet reads an item into v. Returns false if it doesn't exist.
+func kvGet(tx kvTx, bucket string, key string, v interface{}) (bool, error) {
+	value := tx.get(bucket, key)
+	if value == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(value, v)
+}
+
+// kvPut writes an item
+func kvPut(tx kvTx, bucket string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.put(bucket, key, value)
+}
+
+// kvList reads the items of a bucket that match (nil matches all)
+func kvList[T any](tx kvTx, bucket string, match func(item *T) bool) ([]*T, error) {
+	items := []*T{}
+	err := tx.forEach(bucket, func(key string, value []byte) error {
+		item := new(T)
+		if err := json.Unmarshal(value, item); err != nil {
+			return err
+		}
+		if match == nil || match(item) {
+			items = append(items, item)
+		}
+		return nil
+	})
+	return items, err
+}
+
+// kvGetItem reads one item. A nil item (and nil error) is returned if it doesn't exist.
+func kvGetItem[T any](ctx context.Context, config *KVStore, bucket string, key string) (*T, error) {
+	var item *T
+	err := config.view(ctx, func(tx kvTx) error {
+		v := new(T)
+		found, err := kvGet(tx, bucket, key, v)
+		if found {
+			item = v
+		}
+		return err
+	})
+	return item, err
+}
+
+// kvPutItem writes one item
+func kvPutItem(ctx context.Context, config *KVStore, bucket string, key string, v interface{}) error {
+	return config.update(ctx, func(tx kvTx) error {
+		return kvPut(tx, bucket, key, v)
+	})
+}
+
+// kvDeleteItem deletes one item
+func kvDeleteItem(ctx context.Context, config *KVStore, bucket string, key string) error {
+	return config.update(ctx, func(tx kvTx) error {
+		return tx.delete(bucket, key)
+	})
+}
+
+// kvConsumeItem deletes one item that matches (nil matches all) and returns it.
+// A nil item (and nil error) is returned if it doesn't exist or doesn't match; an item that doesn't match is kept.
+func kvConsumeItem[T any](ctx context.Context, config *KVStore, bucket string, key string, match func(item *T) bool) (*T, error) {
+	var item *T
+	err := config.update(ctx, func(tx kvTx) error {
+		v := new(T)
+		found, err := kvGet(tx, bucket, key, v)
+		if err != nil || !found || (match != nil && !match(v)) {
+			return err
+		}
+		item = v
+		return tx.delete(bucket, key)
+	})
+	return item, err
+}
+
+// kvListItems reads the items of a bucket that match (nil matches all)
+func kvListItems[T any](ctx context.Context, config *KVStore, bucket string, match func(item *T) bool) ([]*T, error) {
+	var items []*T
+	err := config.view(ctx, func(tx kvTx) error {
+		var err error
+		items, err = kvList(tx, bucket, match)
+		return err
+	})
+	return items, err
+}
+
+// DeleteAPIKey deletes an API key item from the store.
+func (config *KVStore) DeleteAPIKey(keyID string) error {
+	return config.DeleteAPIKeyWithContext(context.Background(), keyID)
+}
+
+// DeleteAPIKeyWithContext is DeleteAPIKey with a context.
+func (config *KVStore) DeleteAPIKeyWithContext(ctx context.Context, keyID string) error {
+	return kvDeleteItem(ctx, config, bucketAPIKeys, keyID)
+}
+
+// GetAPIKey retrieves an API key item from the store.
+// A nil item (and nil error) is returned if it doesn't exist.
+func (config *KVStore) GetAPIKey(keyID string) (*APIKey, error) {
+	return config.GetAPIKeyWithContext(context.Background(), keyID)
+}
+
+// GetAPIKeyWithContext is GetAPIKey with a context.
+func (config *KVStore) GetAPIKeyWithContext(ctx context.Context, keyID string) (*APIKey, error) {
+	return kvGetItem[APIKey](ctx, config, bucketAPIKeys, keyID)
+}
+
+// ListAPIKeys retrieves all the API key items of an identity from the store.
+func (config *KVStore) ListAPIKeys(identityID string) ([]*APIKey, error) {
+	return config.ListAPIKeysWithContext(context.Background(), identityID)
+}
+
+// ListAPIKeysWithContext is ListAPIKeys with a context.
+func (config *KVStore) ListAPIKeysWithContext(ctx context.Context, identityID string) ([]*APIKey, error) {
+	return kvListItems(ctx, config, bucketAPIKeys, func(key *APIKey) bool { return key.IdentityID == identityID })
+}
+
+// PutAPIKey stores an API key item in the store.
+func (config *KVStore) PutAPIKey(key *APIKey) error {
+	return config.PutAPIKeyWithContext(context.Background(), key)
+}
+
+// PutAPIKeyWithContext is PutAPIKey with a context.
+func (config *KVStore) PutAPIKeyWithContext(ctx context.Context, key *APIKey) error {
+	return kvPutItem(ctx, config, bucketAPIKeys, key.KeyID, key)
+}
+
+// TouchAPIKey sets the unix time an API key was last used.
+func (config *KVStore) TouchAPIKey(keyID string, lastUsedAt int64) error {
+	return config.TouchAPIKeyWithContext(context.Background(), keyID, lastUsedAt)
+}
+
+// TouchAPIKeyWithContext is TouchAPIKey with a context.
+func (config *KVStore) TouchAPIKeyWithContext(ctx context.Context, keyID string, lastUsedAt int64) error {
+	return config.update(ctx, func(tx kvTx) error {
+		key := &APIKey{}
+		found, err := kvGet(tx, bucketAPIKeys, keyID, key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("api key %s not found", keyID)
+		}
+		key.LastUsedAt = lastUsedAt
+		return kvPut(tx, bucketAPIKeys, keyID, key)
+	})
+}
+
+// DeleteAppCredentials deletes an app credentials item from the store.
+func (config *KVStore) DeleteAppCredentials(instance string) error {
+	return config.DeleteAppCredentialsWithContext(context.Background(), instance)
+}
+
+// DeleteAppCredentialsWithContext is DeleteAppCredentials with a context.
+func (config *KVStore) DeleteAppCredentialsWithContext(ctx context.Context, instance string) error {
+	return kvDeleteItem(ctx, config, bucketAppCredentials, instance)
+}
+
+// GetAppCredentials retrieves an app credentials item from the store.
+// A nil item (and nil error) is returned if it doesn't exist.
+func (config *KVStore) GetAppCredentials(instance string) (*AppCredentials, error) {
+	return config.GetAppCredentialsWithContext(context.Background(), instance)
+}
+
+// GetAppCredentialsWithContext is GetAppCredentials with a context.
+func (config *KVStore) GetAppCredentialsWithContext(ctx context.Context, instance string) (*AppCredentials, error) {
+	return kvGetItem[AppCredentials](ctx, config, bucketAppCredentials, instance)
+}
+
+// ListAppCredentials retrieves all the app credentials items from the store.
+func (config *KVStore) ListAppCredentials() ([]*AppCredentials, error) {
+	return config.ListAppCredentialsWithContext(context.Background())
+}
+
+// ListAppCredentialsWithContext is ListAppCredentials with a context.
+func (config *KVStore) ListAppCredentialsWithContext(ctx context.Context) ([]*AppCredentials, error) {
+	return kvListItems[AppCredentials](ctx, config, bucketAppCredentials, nil)
+}
+
+// PutAppCredentials stores an app credentials item in the store.
+func (config *KVStore) PutAppCredentials(app *AppCredentials) error {
+	return config.PutAppCredentialsWithContext(context.Background(), app)
+}
+
+// PutAppCredentialsWithContext is PutAppCredentials with a context.
+func (config *KVStore) PutAppCredentialsWithContext(ctx context.Context, app *AppCredentials) error {
+	return kvPutItem(ctx, config, bucketAppCredentials, app.InstanceURL, app)
+}
+
+// PutArchivedAppCredentials stores a replaced app registration in the archive.
+func (config *KVStore) PutArchivedAppCredentials(archived *ArchivedAppCredentials) error {
+	return config.PutArchivedAppCredentialsWithContext(context.Background(), archived)
+}
+
+// PutArchivedAppCredentialsWithContext is PutArchivedAppCredentials with a context.
+func (config *KVStore) PutArchivedAppCredentialsWithContext(ctx context.Context, archived *ArchivedAppCredentials) error {
+	return kvPutItem(ctx, config, bucketAppCredsArchive, kvKey(archived.InstanceURL, fmt.Sprintf("%020d", archived.ArchivedAt)), archived)
+}
+
+// DeleteConfig deletes a config item from the store.
+func (config *KVStore) DeleteConfig(key string) error {
+	return config.DeleteConfigWithContext(context.Background(), key)
+}
+
+// DeleteConfigWithContext is DeleteConfig with a context.
+func (config *KVStore) DeleteConfigWithContext(ctx context.Context, key string) error {
+	return kvDeleteItem(ctx, config, bucketConfig, key)
+}
+
+// GetConfig retrieves a config item from the store.
+// A nil item (and nil error) is returned if it doesn't exist.
+func (config *KVStore) GetConfig(key string) (*ConfigItem, error) {
+	return config.GetConfigWithContext(context.Background(), key)
+}
+
+// GetConfigWithContext is GetConfig with a context.
+func (config *KVStore) GetConfigWithContext(ctx context.Context, key string) (*ConfigItem, error) {
+	return kvGetItem[ConfigItem](ctx, config, bucketConfig, key)
+}
+
+// ListConfig retrieves all the config items from the store.
+func (config *KVStore) ListConfig() ([]*ConfigItem, error) {
+	return config.ListConfigWithContext(context.Background())
+}
+
+// ListConfigWithContext is ListConfig with a context.
+func (config *KVStore) ListConfigWithContext(ctx context.Context) ([]*ConfigItem, error) {
+	return kvListItems[ConfigItem](ctx, config, bucketConfig, nil)
+}
+
+// PutConfig stores a config item in the store.
+func (config *KVStore) PutConfig(item *ConfigItem) error {
+	return config.PutConfigWithContext(context.Background(), item)
+}
+
+// PutConfigWithContext is PutConfig with a context.
+func (config *KVStore) PutConfigWithContext(ctx context.Context, item *ConfigItem) error {
+	return kvPutItem(ctx, config, bucketConfig, item.ConfigKey, item)
+}
+
+// ConsumeDeviceAuthorization deletes an approved device authorization from the store and returns it.
+// A nil item (and nil error) is returned if it is unknown, not approved or was already used.
+func (config *KVStore) ConsumeDeviceAuthorization(deviceCode string) (*DeviceAuthorization, error) {
+	return config.ConsumeDeviceAuthorizationWithContext(context.Background(), deviceCode)
+}
+
+// ConsumeDeviceAuthorizationWithContext is ConsumeDeviceAuthorization with a context.
+func (config *KVStore) ConsumeDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	var device *DeviceAuthorization
+	err := config.update(ctx, func(tx kvTx) error {
+		v := &DeviceAuthorization{}
+		found, err := kvGet(tx, bucketDeviceCodes, deviceCode, v)
+		if err != nil || !found || v.Status != DeviceApproved {
+			return err
+		}
+		device = v
+		return tx.delete(bucketDeviceCodes, deviceCode)
+	})
+	return device, err
+}
+
+// DeleteDeviceAuthorization deletes a device authorization from the store.
+func (config *KVStore) DeleteDeviceAuthorization(deviceCode string) error {
+	return config.DeleteDeviceAuthorizationWithContext(context.Background(), deviceCode)
+}
+
+// DeleteDeviceAuthorizationWithContext is DeleteDeviceAuthorization with a context.
+func (config *KVStore) DeleteDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) error {
+	return kvDeleteItem(ctx, config, bucketDeviceCodes, deviceCode)
+}
+
+// GetDeviceAuthorization retrieves a device authorization from the store.
+// A nil item (and nil error) is returned if it doesn't exist.
+func (config *KVStore) GetDeviceAuthorization(deviceCode string) (*DeviceAuthorization, error) {
+	return config.GetDeviceAuthorizationWithContext(context.Background(), deviceCode)
+}
+
+// GetDeviceAuthorizationWithContext is GetDeviceAuthorization with a context.
+func (config *KVStore) GetDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) (*DeviceAuthorization, error) {
+	return kvGetItem[DeviceAuthorization](ctx, config, bucketDeviceCodes, deviceCode)
+}
+
+// GetDeviceAuthorizationByUserCode retrieves the device authorization for a user code from the store.
+// A nil item (and nil error) is returned if there isn't one.
+func (config *KVStore) GetDeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error) {
+	return config.GetDeviceAuthorizationByUserCodeWithContext(context.Background(), userCode)
+}
+
+// GetDeviceAuthorizationByUserCodeWithContext is GetDeviceAuthorizationByUserCode with a context.
+func (config *KVStore) GetDeviceAuthorizationByUserCodeWithContext(ctx context.Context, userCode string) (*DeviceAuthorization, error) {
+	devices, err := kvListItems(ctx, config, bucketDeviceCodes, func(device *DeviceAuthorization) bool { return device.UserCode == userCode })
+	if err != nil || len(devices) == 0 {
+		return nil, err
+	}
+	return devices[0], nil
+}
+
+// PollDeviceAuthorization records a poll of a pending device authorization: only its LastPolledAt and
+// Interval are updated, so the poll can't overwrite an approval or denial made in the meantime.
+// Returns false (and nil error) if the device authorization is unknown or no longer pending.
+func (config *KVStore) PollDeviceAuthorization(deviceCode string, lastPolledAt int64, interval int64) (bool, error) {
+	return config.PollDeviceAuthorizationWithContext(context.Background(), deviceCode, lastPolledAt, interval)
+}
+
+// PollDeviceAuthorizationWithContext is PollDeviceAuthorization with a context.
+func (config *KVStore) PollDeviceAuthorizationWithContext(ctx context.Context, deviceCode string, lastPolledAt int64, interval int64) (bool, error) {
+	return config.updatePendingDevice(ctx, deviceCode, func(device *DeviceAuthorization) {
+		device.LastPolledAt = lastPolledAt
+		device.Interval = interval
+	})
+}
+
+// ResolveDeviceAuthorization sets the Status (DeviceApproved or DeviceDenied), SessionID and Token of a
+// pending device authorization. Returns false (and nil error) if it is unknown or no longer pending.
+func (config *KVStore) ResolveDeviceAuthorization(deviceCode string, status string, sessionID string, token string) (bool, error) {
+	return config.ResolveDeviceAuthorizationWithContext(context.Background(), deviceCode, status, sessionID, token)
+}
+
+// ResolveDeviceAuthorizationWithContext is ResolveDeviceAuthorization with a context.
+func (config *KVStore) ResolveDeviceAuthorizationWithContext(ctx context.Context, deviceCode string, status string, sessionID string, token string) (bool, error) {
+	return config.updatePendingDevice(ctx, deviceCode, func(device *DeviceAuthorization) {
+		device.Status = status
+		device.SessionID = sessionID
+		device.Token = token
+	})
+}
+
+// updatePendingDevice changes a pending device authorization in one transaction; false if it isn't pending
+func (config *KVStore) updatePendingDevice(ctx context.Context, deviceCode string, change func(device *DeviceAuthorization)) (bool, error) {
+	updated := false
+	err := config.update(ctx, func(tx kvTx) error {
+		device := &DeviceAuthorization{}
+		found, err := kvGet(tx, bucketDeviceCodes, deviceCode, device)
+		if err != nil || !found || device.Status != DevicePending {
+			return err
+		}
+		change(device)
+		updated = true
+		return kvPut(tx, bucketDeviceCodes, deviceCode, device)
+	})
+	return updated, err
+}
+
+// PutDeviceAuthorization stores a device authorization in the store.
+func (config *KVStore) PutDeviceAuthorization(device *DeviceAuthorization) error {
+	return config.PutDeviceAuthorizationWithContext(context.Background(), device)
+}
+
+// PutDeviceAuthorizationWithContext is PutDeviceAuthorization with a context.
+func (config *KVStore) PutDeviceAuthorizationWithContext(ctx context.Context, device *DeviceAuthorization) error {
+	return kvPutItem(ctx, config, bucketDeviceCodes, device.DeviceCode, device)
+}
+
+// GetSigningKey retrieves a JWT signing key from the store.
+// A nil key (and nil error) is returned if it doesn't exist.
+func (config *KVStore) GetSigningKey(keyID string) (*SigningKey, error) {
+	return config.GetSigningKeyWithContext(context.Background(), keyID)
+}
+
+// GetSigningKeyWithContext is GetSigningKey with a context.
+func (config *KVStore) GetSigningKeyWithContext(ctx context.Context, keyID string) (*SigningKey, error) {
+	return kvGetItem[SigningKey](ctx, config, bucketSigningKeys, keyID)
+}
+
+// ListSigningKeys retrieves all the JWT signing keys from the store.
+func (config *KVStore) ListSigningKeys() ([]*SigningKey, error) {
+	return config.ListSigningKeysWithContext(context.Background())
+}
+
+// ListSigningKeysWithContext is ListSigningKeys with a context.
+func (config *KVStore) ListSigningKeysWithContext(ctx context.Context) ([]*SigningKey, error) {
+	return kvListItems[SigningKey](ctx, config, bucketSigningKeys, nil)
+}
+
+// PutSigningKey stores a JWT signing key in the store.
+func (config *KVStore) PutSigningKey(key *SigningKey) error {
+	return config.PutSigningKeyWithContext(context.Background(), key)
+}
+
+// PutSigningKeyWithContext is PutSigningKey with a context.
+func (config *KVStore) PutSigningKeyWithContext(ctx context.Context, key *SigningKey) error {
+	return kvPutItem(ctx, config, bucketSigningKeys, key.KeyID, key)
+}
+
+// DeleteLinkedAccount deletes a linked account item from the store.
+func (config *KVStore) DeleteLinkedAccount(identityID string, accountURL string) error {
+	return config.DeleteLinkedAccountWithContext(context.Background(), identityID, accountURL)
+}
+
+// DeleteLinkedAccountWithContext is DeleteLinkedAccount with a context.
+func (config *KVStore) DeleteLinkedAccountWithContext(ctx context.Context, identityID string, accountURL string) error {
+	return kvDeleteItem(ctx, config, bucketLinkedAccounts, kvKey(identityID, accountURL))
+}
+
+// GetLinkedAccount retrieves a linked account item from the store.
+// A nil item (and nil error) is returned if it doesn't exist.
+func (config *KVStore) GetLinkedAccount(identityID string, accountURL string) (*LinkedAccount, error) {
+	return config.GetLinkedAccountWithContext(context.Background(), identityID, accountURL)
+}
+
+// GetLinkedAccountWithContext is GetLinkedAccount with a context.
+func (config *KVStore) GetLinkedAccountWithContext(ctx context.Context, identityID string, accountURL string) (*LinkedAccount, error) {
+	return kvGetItem[LinkedAccount](ctx, config, bucketLinkedAccounts, kvKey(identityID, accountURL))
+}
+
+// GetLinkedAccountByURL retrieves the linked account item of an account, whatever identity it is linked to.
+// A nil item (and nil error) is returned if the account isn't linked.
+func (config *KVStore) GetLinkedAccountByURL(accountURL string) (*LinkedAccount, error) {
+	return config.GetLinkedAccountByURLWithContext(context.Background(), accountURL)
+}
+
+// GetLinkedAccountByURLWithContext is GetLinkedAccountByURL with a context.
+func (config *KVStore) GetLinkedAccountByURLWithContext(ctx context.Context, accountURL string) (*LinkedAccount, error) {
+	accounts, err := kvListItems(ctx, config, bucketLinkedAccounts, func(account *LinkedAccount) bool { return account.AccountURL == accountURL })
+	if err != nil || len(accounts) == 0 {
+		return nil, err
+	}
+	return accounts[0], nil
+}
+
+// ListLinkedAccounts retrieves all the linked account items of an identity from the store.
+func (config *KVStore) ListLinkedAccounts(identityID string) ([]*LinkedAccount, error) {
+	return config.ListLinkedAccountsWithContext(context.Background(), identityID)
+}
+
+// ListLinkedAccountsWithContext is ListLinkedAccounts with a context.
+func (config *KVStore) ListLinkedAccountsWithContext(ctx context.Context, identityID string) ([]*LinkedAccount, error) {
+	return kvListItems(ctx, config, bucketLinkedAccounts, func(account *LinkedAccount) bool { return account.IdentityID == identityID })
+}
+
+// PutLinkedAccount stores a linked account item in the store.
+func (config *KVStore) PutLinkedAccount(account *LinkedAccount) error {
+	return config.PutLinkedAccountWithContext(context.Background(), account)
+}
+
+// PutLinkedAccountWithContext is PutLinkedAccount with a context.
+func (config *KVStore) PutLinkedAccountWithContext(ctx context.Context, account *LinkedAccount) error {
+	return kvPutItem(ctx, config, bucketLinkedAccounts, kvKey(account.IdentityID, account.AccountURL), account)
+}
+
+// kvListMember is an accounts-in-list item. ListID is the listMemberKey of the list.
+type kvListMember struct {
+	ListID string `json:"list_id"`
+	UserID string `json:"user_id"`
+}
+
+// DeleteList deletes a saved list item and its members from the store.
+func (config *KVStore) DeleteList(instance string, ownerUserID string, listID string) error {
+	return config.DeleteListWithContext(context.Background(), instance, ownerUserID, listID)
+}
+
+// DeleteListWithContext is DeleteList with a context.
+func (config *KVStore) DeleteListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) error {
+	if err := config.PutAccountsInListWithContext(ctx, &ListMember{
+		Instance:    instance,
+		OwnerUserID: ownerUserID,
+		ListID:      listID,
+	}); err != nil {
+		return err
+	}
+	return kvDeleteItem(ctx, config, bucketLists, kvKey(listOwnerKey(instance, ownerUserID), listID))
+}
+
+// GetList retrieves a saved list item from the store.
+// A nil item (and nil error) is returned if the owner has no saved list with that ID on the instance.
+func (config *KVStore) GetList(instance string, ownerUserID string, listID string) (*List, error) {
+	return config.GetListWithContext(context.Background(), instance, ownerUserID, listID)
+}
+
+// GetListWithContext is GetList with a context.
+func (config *KVStore) GetListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) (*List, error) {
+	list, err := kvGetItem[List](ctx, config, bucketLists, kvKey(listOwnerKey(instance, ownerUserID), listID))
+	if err != nil || list == nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetAccountsInList retrieves the members of a saved list from the store, sorted by user ID.
+func (config *KVStore) GetAccountsInList(instance string, ownerUserID string, listID string) (*ListMember, error) {
+	return config.GetAccountsInListWithContext(context.Background(), instance, ownerUserID, listID)
+}
+
+// GetAccountsInListWithContext is GetAccountsInList with a context.
+func (config *KVStore) GetAccountsInListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) (*ListMember, error) {
+	memberKey := listMemberKey(instance, ownerUserID, listID)
+	members, err := kvListItems(ctx, config, bucketAccountsInList, func(member *kvListMember) bool { return member.ListID == memberKey })
+	if err != nil {
+		return nil, err
+	}
+	listMember := &ListMember{
+		Instance:    instance,
+		OwnerUserID: ownerUserID,
+		ListID:      listID,
+		UserIDs:     make([]string, 0, len(members)),
+	}
+	for _, member := range members {
+		listMember.UserIDs = append(listMember.UserIDs, member.UserID)
+	}
+	sort.Strings(listMember.UserIDs)
+	return listMember, nil
+}
+
+// ListLists retrieves all saved list items from the store.
+// Set instance and ownerUserID to only return the lists of one owner; set either alone to filter on it.
+func (config *KVStore) ListLists(instance string, ownerUserID string) ([]*List, error) {
+	return config.ListListsWithContext(context.Background(), instance, ownerUserID)
+}
+
+// ListListsWithContext is ListLists with a context.
+func (config *KVStore) ListListsWithContext(ctx context.Context, instance string, ownerUserID string) ([]*List, error) {
+	return kvListItems(ctx, config, bucketLists, func(list *List) bool {
+		return (instance == "" || list.Instance == instance) && (ownerUserID == "" || list.OwnerUserID == ownerUserID)
+	})
+}
+
+// PutAccountsInList replaces the members of a list in the store: members not in
+// listMember.UserIDs are removed, so the list's items are an exact snapshot.
+// Only the items of the list's instance and owner (see listMemberKey) are removed.
+func (config *KVStore) PutAccountsInList(listMember *ListMember) error {
+	return config.PutAccountsInListWithContext(context.Background(), listMember)
+}
+
+// PutAccountsInListWithContext is PutAccountsInList with a context.
+func (config *KVStore) PutAccountsInListWithContext(ctx context.Context, listMember *ListMember) error {
+	memberKey := listMemberKey(listMember.Instance, listMember.OwnerUserID, listMember.ListID)
+	return config.update(ctx, func(tx kvTx) error {
+		members := make(map[string]struct{}, len(listMember.UserIDs))
+		for _, userID := range listMember.UserIDs {
+			members[userID] = struct{}{}
+		}
+
+		// Remove the members that left the list
+		stale := []string{}
+		err := tx.forEach(bucketAccountsInList, func(key string, value []byte) error {
+			member := &kvListMember{}
+			if err := json.Unmarshal(value, member); err != nil {
+				return err
+			}
+			if _, ok := members[member.UserID]; member.ListID == memberKey && !ok {
+				stale = append(stale, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range stale {
+			if err := tx.delete(bucketAccountsInList, key); err != nil {
+				return err
+			}
+		}
+
+		for _, userID := range listMember.UserIDs {
+			if err := kvPut(tx, bucketAccountsInList, kvKey(memberKey, userID), &kvListMember{
+				ListID: memberKey,
+				UserID: userID,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutList stores a list item in the store.
+func (config *KVStore) PutList(list *List) error {
+	return config.PutListWithContext(context.Background(), list)
+}
+
+// PutListWithContext is PutList with a context.
+func (config *KVStore) PutListWithContext(ctx context.Context, list *List) error {
+	return kvPutItem(ctx, config, bucketLists, kvKey(listOwnerKey(list.Instance, list.OwnerUserID), list.ListID), list)
+}
+
+// ConsumeLoginAttempt deletes a login attempt from the store and returns it.
+// A nil attempt (and nil error) is returned if the state is unknown or was already used.
+func (config *KVStore) ConsumeLoginAttempt(state string) (*LoginAttempt, error) {
+	return config.ConsumeLoginAttemptWithContext(context.Background(), state)
+}
+
+// ConsumeLoginAttemptWithContext is ConsumeLoginAttempt with a context.
+func (config *KVStore) ConsumeLoginAttemptWithContext(ctx context.Context, state string) (*LoginAttempt, error) {
+	return kvConsumeItem[LoginAttempt](ctx, config, bucketLoginAttempts, state, nil)
+}
+
+// PutLoginAttempt stores a login attempt in the store.
+func (config *KVStore) PutLoginAttempt(attempt *LoginAttempt) error {
+	return config.PutLoginAttemptWithContext(context.Background(), attempt)
+}
+
+// PutLoginAttemptWithContext is PutLoginAttempt with a context.
+func (config *KVStore) PutLoginAttemptWithContext(ctx context.Context, attempt *LoginAttempt) error {
+	return kvPutItem(ctx, config, bucketLoginAttempts, attempt.State, attempt)
+}
+
+// ConsumeAuthCode deletes an authorization code issued to the client (empty for /auth/exchange codes)
+// from the store and returns it. A nil code (and nil error) is returned if the code is unknown, was already
+// used or was issued to another client; a code issued to another client is kept.
+func (config *KVStore) ConsumeAuthCode(code string, clientID string) (*AuthCode, error) {
+	return config.ConsumeAuthCodeWithContext(context.Background(), code, clientID)
+}
+
+// ConsumeAuthCodeWithContext is ConsumeAuthCode with a context.
+func (config *KVStore) ConsumeAuthCodeWithContext(ctx context.Context, code string, clientID string) (*AuthCode, error) {
+	return kvConsumeItem(ctx, config, bucketAuthCodes, code, func(authCode *AuthCode) bool {
+		return authCode.ClientID == clientID
+	})
+}
+
+// PutAuthCode stores an authorization code in the store.
+func (config *KVStore) PutAuthCode(authCode *AuthCode) error {
+	return config.PutAuthCodeWithContext(context.Background(), authCode)
+}
+
+// PutAuthCodeWithContext is PutAuthCode with a context.
+func (config *KVStore) PutAuthCodeWithContext(ctx context.Context, authCode *AuthCode) error {
+	return kvPutItem(ctx, config, bucketAuthCodes, authCode.Code, authCode)
+}
+
+// DeleteOIDCClient deletes an OpenID Connect client from the store.
+func (config *KVStore) DeleteOIDCClient(clientID string) error {
+	return config.DeleteOIDCClientWithContext(context.Background(), clientID)
+}
+
+// DeleteOIDCClientWithContext is DeleteOIDCClient with a context.
+func (config *KVStore) DeleteOIDCClientWithContext(ctx context.Context, clientID string) error {
+	return kvDeleteItem(ctx, config, bucketOIDCClients, clientID)
+}
+
+// GetOIDCClient retrieves an OpenID Connect client from the store.
+// A nil client (and nil error) is returned if it doesn't exist.
+func (config *KVStore) GetOIDCClient(clientID string) (*OIDCClient, error) {
+	return config.GetOIDCClientWithContext(context.Background(), clientID)
+}
+
+// GetOIDCClientWithContext is GetOIDCClient with a context.
+func (config *KVStore) GetOIDCClientWithContext(ctx context.Context, clientID string) (*OIDCClient, error) {
+	return kvGetItem[OIDCClient](ctx, config, bucketOIDCClients, clientID)
+}
+
+// PutOIDCClient stores an OpenID Connect client in the store.
+func (config *KVStore) PutOIDCClient(client *OIDCClient) error {
+	return config.PutOIDCClientWithContext(context.Background(), client)
+}
+
+// PutOIDCClientWithContext is PutOIDCClient with a context.
+func (config *KVStore) PutOIDCClientWithContext(ctx context.Context, client *OIDCClient) error {
+	return kvPutItem(ctx, config, bucketOIDCClients, client.ClientID, client)
+}
+
+// IncrementRateLimitCounter atomically adds one to a rate limit counter and returns the new count.
+// The counter is created if it doesn't exist; expiresAt (unix time) is only set on creation.
+func (config *KVStore) IncrementRateLimitCounter(counterKey string, expiresAt int64) (int64, error) {
+	return config.IncrementRateLimitCounterWithContext(context.Background(), counterKey, expiresAt)
+}
+
+// IncrementRateLimitCounterWithContext is IncrementRateLimitCounter with a context.
+func (config *KVStore) IncrementRateLimitCounterWithContext(ctx context.Context, counterKey string, expiresAt int64) (int64, error) {
+	counter := &RateLimitCounter{}
+	err := config.update(ctx, func(tx kvTx) error {
+		found, err := kvGet(tx, bucketRateLimits, counterKey, counter)
+		if err != nil {
+			return err
+		}
+		if !found {
+			counter.CounterKey = counterKey
+			counter.ExpiresAt = expiresAt
+		}
+		counter.Count++
+		return kvPut(tx, bucketRateLimits, counterKey, counter)
+	})
+	return counter.Count, err
+}
+
+// GetRateLimitCounter returns the count of a rate limit counter; zero if it doesn't exist.
+func (config *KVStore) GetRateLimitCounter(counterKey string) (int64, error) {
+	return config.GetRateLimitCounterWithContext(context.Background(), counterKey)
+}
+
+// GetRateLimitCounterWithContext is GetRateLimitCounter with a context.
+func (config *KVStore) GetRateLimitCounterWithContext(ctx context.Context, counterKey string) (int64, error) {
+	counter, err := kvGetItem[RateLimitCounter](ctx, config, bucketRateLimits, counterKey)
+	if err != nil || counter == nil {
+		return 0, err
+	}
+	return counter.Count, nil
+}
+
+// GetRevokedToken retrieves a revoked token item from the store.
+// A nil item (and nil error) is returned if the token has not been revoked.
+func (config *KVStore) GetRevokedToken(tokenID string) (*RevokedToken, error) {
+	return config.GetRevokedTokenWithContext(context.Background(), tokenID)
+}
+
+// GetRevokedTokenWithContext is GetRevokedToken with a context.
+func (config *KVStore) GetRevokedTokenWithContext(ctx context.Context, tokenID string) (*RevokedToken, error) {
+	return kvGetItem[RevokedToken](ctx, config, bucketRevokedTokens, tokenID)
+}
+
+// PutRevokedToken stores a revoked token item in the store.
+func (config *KVStore) PutRevokedToken(revoked *RevokedToken) error {
+	return config.PutRevokedTokenWithContext(context.Background(), revoked)
+}
+
+// PutRevokedTokenWithContext is PutRevokedToken with a context.
+func (config *KVStore) PutRevokedTokenWithContext(ctx context.Context, revoked *RevokedToken) error {
+	return kvPutItem(ctx, config, bucketRevokedTokens, revoked.TokenID, revoked)
+}
+
+// DeleteUserCredentials deletes a session from the store.
+func (config *KVStore) DeleteUserCredentials(sessionID string) error {
+	return config.DeleteUserCredentialsWithContext(context.Background(), sessionID)
+}
+
+// DeleteUserCredentialsWithContext is DeleteUserCredentials with a context.
+func (config *KVStore) DeleteUserCredentialsWithContext(ctx context.Context, sessionID string) error {
+	return kvDeleteItem(ctx, config, bucketUserCredentials, sessionID)
+}
+
+// GetUserCredentials retrieves a session from the store.
+// A nil item (and nil error) is returned if it doesn't exist.
+func (config *KVStore) GetUserCredentials(sessionID string) (*UserCredentials, error) {
+	return config.GetUserCredentialsWithContext(context.Background(), sessionID)
+}
+
+// GetUserCredentialsWithContext is GetUserCredentials with a context.
+func (config *KVStore) GetUserCredentialsWithContext(ctx context.Context, sessionID string) (*UserCredentials, error) {
+	return kvGetItem[UserCredentials](ctx, config, bucketUserCredentials, sessionID)
+}
+
+// ListUserCredentials retrieves all the sessions of an account from the store.
+func (config *KVStore) ListUserCredentials(accountURL string) ([]*UserCredentials, error) {
+	return config.ListUserCredentialsWithContext(context.Background(), accountURL)
+}
+
+// ListUserCredentialsWithContext is ListUserCredentials with a context.
+func (config *KVStore) ListUserCredentialsWithContext(ctx context.Context, accountURL string) ([]*UserCredentials, error) {
+	return kvListItems(ctx, config, bucketUserCredentials, func(session *UserCredentials) bool { return session.AccountURL == accountURL })
+}
+
+// PutUserCredentials stores a session in the store.
+func (config *KVStore) PutUserCredentials(creds *UserCredentials) error {
+	return config.PutUserCredentialsWithContext(context.Background(), creds)
+}
+
+// PutUserCredentialsWithContext is PutUserCredentials with a context.
+func (config *KVStore) PutUserCredentialsWithContext(ctx context.Context, creds *UserCredentials) error {
+	return kvPutItem(ctx, config, bucketUserCredentials, creds.SessionID, creds)
+}
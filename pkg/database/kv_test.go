@@ -0,0 +1,93 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKVGetMissing(t *testing.T) {
+	db := NewMemory()
+
+	tests := []struct {
+		name string
+		get  func() (bool, error)
+	}{
+		{"APIKey", func() (bool, error) { v, err := db.GetAPIKey("missing"); return v == nil, err }},
+		{"AppCredentials", func() (bool, error) { v, err := db.GetAppCredentials("missing"); return v == nil, err }},
+		{"Config", func() (bool, error) { v, err := db.GetConfig("missing"); return v == nil, err }},
+		{"DeviceAuthorization", func() (bool, error) { v, err := db.GetDeviceAuthorization("missing"); return v == nil, err }},
+		{"DeviceAuthorizationByUserCode", func() (bool, error) {
+			v, err := db.GetDeviceAuthorizationByUserCode("missing")
+			return v == nil, err
+		}},
+		{"LinkedAccount", func() (bool, error) { v, err := db.GetLinkedAccount("missing", "missing"); return v == nil, err }},
+		{"List", func() (bool, error) { v, err := db.GetList("missing", "missing", "missing"); return v == nil, err }},
+		{"OIDCClient", func() (bool, error) { v, err := db.GetOIDCClient("missing"); return v == nil, err }},
+		{"RevokedToken", func() (bool, error) { v, err := db.GetRevokedToken("missing"); return v == nil, err }},
+		{"SigningKey", func() (bool, error) { v, err := db.GetSigningKey("missing"); return v == nil, err }},
+		{"UserCredentials", func() (bool, error) { v, err := db.GetUserCredentials("missing"); return v == nil, err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isNil, err := tt.get()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !isNil {
+				t.Errorf("got an item for a missing key")
+			}
+		})
+	}
+}
+
+func TestKVConsumeLoginAttempt(t *testing.T) {
+	db := NewMemory()
+	if err := db.PutLoginAttempt(&LoginAttempt{State: "state", InstanceURL: "example.social"}); err != nil {
+		t.Fatalf("PutLoginAttempt: %v", err)
+	}
+
+	attempt, err := db.ConsumeLoginAttempt("state")
+	if err != nil || attempt == nil || attempt.InstanceURL != "example.social" {
+		t.Fatalf("first ConsumeLoginAttempt = %+v, %v; want the attempt", attempt, err)
+	}
+	attempt, err = db.ConsumeLoginAttempt("state")
+	if err != nil || attempt != nil {
+		t.Fatalf("second ConsumeLoginAttempt = %+v, %v; want nil", attempt, err)
+	}
+}
+
+func TestKVSweep(t *testing.T) {
+	db := NewMemory()
+	now := time.Now()
+	items := []struct {
+		id        string
+		expiresAt int64
+		wantKept  bool
+	}{
+		{"expired", now.Add(-time.Minute).Unix(), false},
+		{"current", now.Add(time.Minute).Unix(), true},
+		{"forever", 0, true},
+	}
+	for _, item := range items {
+		if err := db.PutRevokedToken(&RevokedToken{TokenID: item.id, ExpiresAt: item.expiresAt}); err != nil {
+			t.Fatalf("PutRevokedToken: %v", err)
+		}
+	}
+
+	deleted, err := db.Sweep()
+	if err != nil {
+		t.Fatalf("Sweep: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("deleted = %d, want 1", deleted)
+	}
+	for _, item := range items {
+		revoked, err := db.GetRevokedToken(item.id)
+		if err != nil {
+			t.Fatalf("GetRevokedToken: %v", err)
+		}
+		if kept := revoked != nil; kept != item.wantKept {
+			t.Errorf("%s: kept = %v, want %v", item.id, kept, item.wantKept)
+		}
+	}
+}
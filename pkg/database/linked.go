@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// linkedAccountsByURLIndex is the linked accounts GSI keyed by AccountURL
+const linkedAccountsByURLIndex = "AccountURL-index"
+
+// DeleteLinkedAccount deletes a linked account item from the database.
+func (config *DDB) DeleteLinkedAccount(identityID string, accountURL string) error {
+	return config.DeleteLinkedAccountWithContext(context.Background(), identityID, accountURL)
+}
+
+// DeleteLinkedAccountWithContext is DeleteLinkedAccount with a context.
+func (config *DDB) DeleteLinkedAccountWithContext(ctx context.Context, identityID string, accountURL string) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableLinkedAccounts),
+		Key: map[string]types.AttributeValue{
+			"IdentityID": &types.AttributeValueMemberS{Value: identityID},
+			"AccountURL": &types.AttributeValueMemberS{Value: accountURL},
+		},
+	}
+	_, err := config.db.DeleteItem(ctx, input)
+	return err
+}
+
+// GetLinkedAccount retrieves a linked account item from the database.
+func (config *DDB) GetLinkedAccount(identityID string, accountURL string) (*LinkedAccount, error) {
+	return config.GetLinkedAccountWithContext(context.Background(), identityID, accountURL)
+}
+
+// GetLinkedAccountWithContext is GetLinkedAccount with a context.
+func (config *DDB) GetLinkedAccountWithContext(ctx context.Context, identityID string, accountURL string) (*LinkedAccount, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableLinkedAccounts),
+		Key: map[string]types.AttributeValue{
+			"IdentityID": &types.AttributeValueMemberS{Value: identityID},
+			"AccountURL": &types.AttributeValueMemberS{Value: accountURL},
+		},
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	account := &LinkedAccount{}
+	err = attributevalue.UnmarshalMap(result.Item, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// GetLinkedAccountByURL finds the linked account item for a Mastodon account, whichever identity it is linked to.
+// A nil item (and nil error) is returned if the account isn't linked.
+func (config *DDB) GetLinkedAccountByURL(accountURL string) (*LinkedAccount, error) {
+	return config.GetLinkedAccountByURLWithContext(context.Background(), accountURL)
+}
+
+// GetLinkedAccountByURLWithContext is GetLinkedAccountByURL with a context.
+func (config *DDB) GetLinkedAccountByURLWithContext(ctx context.Context, accountURL string) (*LinkedAccount, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(config.tableLinkedAccounts),
+		IndexName:              aws.String(linkedAccountsByURLIndex),
+		KeyConditionExpression: aws.String("AccountURL = :accountURL"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":accountURL": &types.AttributeValueMemberS{Value: accountURL},
+		},
+		Limit: aws.Int32(1),
+	}
+	result, err := config.db.Query(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Items) == 0 {
+		return nil, nil
+	}
+
+	// The index only projects the keys; get the whole item
+	keys := &LinkedAccount{}
+	if err := attributevalue.UnmarshalMap(result.Items[0], keys); err != nil {
+		return nil, err
+	}
+	return config.GetLinkedAccountWithContext(ctx, keys.IdentityID, keys.AccountURL)
+}
+
+// ListLinkedAccounts retrieves all the linked account items of an identity from the database.
+func (config *DDB) ListLinkedAccounts(identityID string) ([]*LinkedAccount, error) {
+	return config.ListLinkedAccountsWithContext(context.Background(), identityID)
+}
+
+// ListLinkedAccountsWithContext is ListLinkedAccounts with a context.
+func (config *DDB) ListLinkedAccountsWithContext(ctx context.Context, identityID string) ([]*LinkedAccount, error) {
+	accounts := []*LinkedAccount{}
+	paginator := dynamodb.NewQueryPaginator(config.db, &dynamodb.QueryInput{
+		TableName:              aws.String(config.tableLinkedAccounts),
+		KeyConditionExpression: aws.String("IdentityID = :identityID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":identityID": &types.AttributeValueMemberS{Value: identityID},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := nextPage(ctx, config, paginator.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		var pageAccounts []*LinkedAccount
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageAccounts); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, pageAccounts...)
+	}
+	return accounts, nil
+}
+
+// PutLinkedAccount stores a linked account item in the database.
+func (config *DDB) PutLinkedAccount(account *LinkedAccount) error {
+	return config.PutLinkedAccountWithContext(context.Background(), account)
+}
+
+// PutLinkedAccountWithContext is PutLinkedAccount with a context.
+func (config *DDB) PutLinkedAccountWithContext(ctx context.Context, account *LinkedAccount) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(account)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableLinkedAccounts),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
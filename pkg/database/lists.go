@@ -2,6 +2,8 @@ package database
 
 import (
 	"context"
+	"sort"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -9,44 +11,276 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-// PutAppCredentials stores an app credentials item in the database.
+// listMemberKey is the key the member items of a list are stored under (their ListID attribute).
+// Mastodon list IDs are only unique on their instance, so the bare list ID would mix up the
+// members of lists on different instances.
+func listMemberKey(instance string, ownerUserID string, listID string) string {
+	return instance + "#" + ownerUserID + "#" + listID
+}
+
+// listOwnerKey is the key saved list items are stored under (their OwnerKey attribute, with the ListID).
+// Mastodon user IDs are only unique on their instance, so the bare owner ID would let the lists of
+// owners on different instances overwrite each other.
+func listOwnerKey(instance string, ownerUserID string) string {
+	return instance + "#" + ownerUserID
+}
+
+// DeleteList deletes a saved list item and its members from the database.
+func (config *DDB) DeleteList(instance string, ownerUserID string, listID string) error {
+	return config.DeleteListWithContext(context.Background(), instance, ownerUserID, listID)
+}
+
+// DeleteListWithContext is DeleteList with a context.
+func (config *DDB) DeleteListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) error {
+	// Members go first, so a failure leaves the list to delete again
+	if err := config.PutAccountsInListWithContext(ctx, &ListMember{
+		Instance:    instance,
+		OwnerUserID: ownerUserID,
+		ListID:      listID,
+	}); err != nil {
+		return err
+	}
+
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableLists),
+		Key: map[string]types.AttributeValue{
+			"OwnerKey": &types.AttributeValueMemberS{Value: listOwnerKey(instance, ownerUserID)},
+			"ListID":   &types.AttributeValueMemberS{Value: listID},
+		},
+	}
+	_, err := config.db.DeleteItem(ctx, input)
+	return err
+}
+
+// GetList retrieves a saved list item from the database.
+// A nil item (and nil error) is returned if the owner has no saved list with that ID on the instance.
+func (config *DDB) GetList(instance string, ownerUserID string, listID string) (*List, error) {
+	return config.GetListWithContext(context.Background(), instance, ownerUserID, listID)
+}
+
+// GetListWithContext is GetList with a context.
+func (config *DDB) GetListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) (*List, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableLists),
+		Key: map[string]types.AttributeValue{
+			"OwnerKey": &types.AttributeValueMemberS{Value: listOwnerKey(instance, ownerUserID)},
+			"ListID":   &types.AttributeValueMemberS{Value: listID},
+		},
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	list := &List{}
+	err = attributevalue.UnmarshalMap(result.Item, list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetAccountsInList retrieves the members of a saved list from the database, sorted by user ID.
+func (config *DDB) GetAccountsInList(instance string, ownerUserID string, listID string) (*ListMember, error) {
+	return config.GetAccountsInListWithContext(context.Background(), instance, ownerUserID, listID)
+}
+
+// GetAccountsInListWithContext is GetAccountsInList with a context.
+func (config *DDB) GetAccountsInListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) (*ListMember, error) {
+	stored, err := config.listAccountsInList(ctx, listMemberKey(instance, ownerUserID, listID))
+	if err != nil {
+		return nil, err
+	}
+	listMember := &ListMember{
+		Instance:    instance,
+		OwnerUserID: ownerUserID,
+		ListID:      listID,
+		UserIDs:     make([]string, 0, len(stored)),
+	}
+	for userID := range stored {
+		listMember.UserIDs = append(listMember.UserIDs, userID)
+	}
+	sort.Strings(listMember.UserIDs)
+	return listMember, nil
+}
+
+// PutList stores a saved list item in the database.
 func (config *DDB) PutList(list *List) error {
+	return config.PutListWithContext(context.Background(), list)
+}
+
+// PutListWithContext is PutList with a context.
+func (config *DDB) PutListWithContext(ctx context.Context, list *List) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
 	item, err := attributevalue.MarshalMap(list)
 	if err != nil {
 		return err
 	}
+	item["OwnerKey"] = &types.AttributeValueMemberS{Value: listOwnerKey(list.Instance, list.OwnerUserID)}
 	input := &dynamodb.PutItemInput{
 		TableName: aws.String(config.tableLists),
 		Item:      item,
 	}
-	_, err = config.db.PutItem(context.TODO(), input)
+	_, err = config.db.PutItem(ctx, input)
 	return err
 }
 
+// PutAccountsInList replaces the members of a list in the database: members not in
+// listMember.UserIDs are removed, so the list's items are an exact snapshot.
+// Only the items of the list's instance and owner (see listMemberKey) are read and removed.
 func (config *DDB) PutAccountsInList(listMember *ListMember) error {
-	input := &dynamodb.BatchWriteItemInput{}
-	input.RequestItems = make(map[string][]types.WriteRequest)
+	return config.PutAccountsInListWithContext(context.Background(), listMember)
+}
+
+// PutAccountsInListWithContext is PutAccountsInList with a context.
+func (config *DDB) PutAccountsInListWithContext(ctx context.Context, listMember *ListMember) error {
+	memberKey := listMemberKey(listMember.Instance, listMember.OwnerUserID, listMember.ListID)
+	stored, err := config.listAccountsInList(ctx, memberKey)
+	if err != nil {
+		return err
+	}
 
 	type entry struct {
 		ListID string
 		UserID string
 	}
+	requests := []types.WriteRequest{}
+	members := make(map[string]struct{}, len(listMember.UserIDs))
 	for _, userID := range listMember.UserIDs {
+		// A batch may not write the same item twice
+		if _, ok := members[userID]; ok {
+			continue
+		}
+		members[userID] = struct{}{}
+		if _, ok := stored[userID]; ok {
+			continue
+		}
 		item, err := attributevalue.MarshalMap(entry{
-			ListID: listMember.ListID,
+			ListID: memberKey,
 			UserID: userID,
 		})
 		if err != nil {
 			return err
 		}
-		input.RequestItems[config.tableAccountsInList] = append(
-			input.RequestItems[config.tableAccountsInList],
-			types.WriteRequest{
-				PutRequest: &types.PutRequest{
-					Item: item,
+		requests = append(requests, types.WriteRequest{
+			PutRequest: &types.PutRequest{
+				Item: item,
+			},
+		})
+	}
+
+	// Remove the members that left the list
+	for userID := range stored {
+		if _, ok := members[userID]; ok {
+			continue
+		}
+		requests = append(requests, types.WriteRequest{
+			DeleteRequest: &types.DeleteRequest{
+				Key: map[string]types.AttributeValue{
+					"ListID": &types.AttributeValueMemberS{Value: memberKey},
+					"UserID": &types.AttributeValueMemberS{Value: userID},
 				},
-			})
+			},
+		})
 	}
-	_, err := config.db.BatchWriteItem(context.TODO(), input)
-	return err
+
+	return config.batchWrite(ctx, config.tableAccountsInList, requests)
+}
+
+// listAccountsInList gets the user IDs of the stored members of a list, by its listMemberKey
+func (config *DDB) listAccountsInList(ctx context.Context, memberKey string) (map[string]struct{}, error) {
+	userIDs := make(map[string]struct{})
+	paginator := dynamodb.NewQueryPaginator(config.db, &dynamodb.QueryInput{
+		TableName:              aws.String(config.tableAccountsInList),
+		KeyConditionExpression: aws.String("ListID = :list"),
+		ProjectionExpression:   aws.String("UserID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":list": &types.AttributeValueMemberS{Value: memberKey},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := nextPage(ctx, config, paginator.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if userID, ok := item["UserID"].(*types.AttributeValueMemberS); ok {
+				userIDs[userID.Value] = struct{}{}
+			}
+		}
+	}
+	return userIDs, nil
+}
+
+// ListLists retrieves all saved list items from the database.
+// Set instance and ownerUserID to only return the lists of one owner; set either alone to filter on it.
+func (config *DDB) ListLists(instance string, ownerUserID string) ([]*List, error) {
+	return config.ListListsWithContext(context.Background(), instance, ownerUserID)
+}
+
+// ListListsWithContext is ListLists with a context.
+func (config *DDB) ListListsWithContext(ctx context.Context, instance string, ownerUserID string) ([]*List, error) {
+	lists := []*List{}
+	if instance != "" && ownerUserID != "" {
+		paginator := dynamodb.NewQueryPaginator(config.db, &dynamodb.QueryInput{
+			TableName:              aws.String(config.tableLists),
+			KeyConditionExpression: aws.String("OwnerKey = :owner"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":owner": &types.AttributeValueMemberS{Value: listOwnerKey(instance, ownerUserID)},
+			},
+		})
+		for paginator.HasMorePages() {
+			page, err := nextPage(ctx, config, paginator.NextPage)
+			if err != nil {
+				return nil, err
+			}
+			var pageLists []*List
+			if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageLists); err != nil {
+				return nil, err
+			}
+			lists = append(lists, pageLists...)
+		}
+		return lists, nil
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(config.tableLists),
+	}
+	filters := []string{}
+	values := map[string]types.AttributeValue{}
+	if instance != "" {
+		filters = append(filters, "Instance = :instance")
+		values[":instance"] = &types.AttributeValueMemberS{Value: instance}
+	}
+	if ownerUserID != "" {
+		filters = append(filters, "OwnerUserID = :owner")
+		values[":owner"] = &types.AttributeValueMemberS{Value: ownerUserID}
+	}
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+		input.ExpressionAttributeValues = values
+	}
+	paginator := dynamodb.NewScanPaginator(config.db, input)
+	for paginator.HasMorePages() {
+		page, err := nextPage(ctx, config, paginator.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		var pageLists []*List
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageLists); err != nil {
+			return nil, err
+		}
+		lists = append(lists, pageLists...)
+	}
+	return lists, nil
 }
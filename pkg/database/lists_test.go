@@ -0,0 +1,144 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLists(t *testing.T) {
+	db := NewMemory()
+	lists := []*List{
+		{Instance: "a.example", OwnerUserID: "1", ListID: "10", ListTitle: "a", PSK: "psk-a"},
+		{Instance: "b.example", OwnerUserID: "1", ListID: "10", ListTitle: "b", PSK: "psk-b", Public: true},
+		{Instance: "b.example", OwnerUserID: "1", ListID: "11", ListTitle: "b2"},
+		{Instance: "a.example", OwnerUserID: "2", ListID: "10", ListTitle: "a2"},
+	}
+	for _, list := range lists {
+		if err := db.PutList(list); err != nil {
+			t.Fatalf("PutList: %v", err)
+		}
+	}
+	members := []*ListMember{
+		{Instance: "a.example", OwnerUserID: "1", ListID: "10", UserIDs: []string{"3", "1", "2"}},
+		{Instance: "a.example", OwnerUserID: "2", ListID: "10", UserIDs: []string{"9"}},
+	}
+	for _, member := range members {
+		if err := db.PutAccountsInList(member); err != nil {
+			t.Fatalf("PutAccountsInList: %v", err)
+		}
+	}
+
+	getTests := []struct {
+		name       string
+		instance   string
+		owner      string
+		wantTitle  string
+		wantPSK    string
+		wantPublic bool
+	}{
+		// The same user and list ID on another instance is someone else's list, stored apart
+		{"first instance", "a.example", "1", "a", "psk-a", false},
+		{"second instance", "b.example", "1", "b", "psk-b", true},
+		{"other owner", "a.example", "2", "a2", "", false},
+		{"unknown owner", "b.example", "2", "", "", false},
+		{"unknown instance", "c.example", "1", "", "", false},
+	}
+	for _, tt := range getTests {
+		t.Run("GetList "+tt.name, func(t *testing.T) {
+			list, err := db.GetList(tt.instance, tt.owner, "10")
+			if err != nil {
+				t.Fatalf("GetList: %v", err)
+			}
+			if list == nil {
+				list = &List{}
+			}
+			if list.ListTitle != tt.wantTitle || list.PSK != tt.wantPSK || list.Public != tt.wantPublic {
+				t.Errorf("list = %+v, want title %q, psk %q, public %v", list, tt.wantTitle, tt.wantPSK, tt.wantPublic)
+			}
+		})
+	}
+
+	listTests := []struct {
+		name     string
+		instance string
+		owner    string
+		want     []string
+	}{
+		{"all", "", "", []string{"a", "a2", "b", "b2"}},
+		{"one owner", "b.example", "1", []string{"b", "b2"}},
+		{"one instance", "a.example", "", []string{"a", "a2"}},
+		{"one owner ID on any instance", "", "1", []string{"a", "b", "b2"}},
+	}
+	for _, tt := range listTests {
+		t.Run("ListLists "+tt.name, func(t *testing.T) {
+			got, err := db.ListLists(tt.instance, tt.owner)
+			if err != nil {
+				t.Fatalf("ListLists: %v", err)
+			}
+			titles := []string{}
+			for _, list := range got {
+				titles = append(titles, list.ListTitle)
+			}
+			sort.Strings(titles)
+			if !reflect.DeepEqual(titles, tt.want) {
+				t.Errorf("lists = %v, want %v", titles, tt.want)
+			}
+		})
+	}
+
+	memberTests := []struct {
+		name     string
+		instance string
+		owner    string
+		want     []string
+	}{
+		{"sorted", "a.example", "1", []string{"1", "2", "3"}},
+		{"other owner", "a.example", "2", []string{"9"}},
+		{"other instance", "b.example", "1", []string{}},
+	}
+	for _, tt := range memberTests {
+		t.Run("GetAccountsInList "+tt.name, func(t *testing.T) {
+			got, err := db.GetAccountsInList(tt.instance, tt.owner, "10")
+			if err != nil {
+				t.Fatalf("GetAccountsInList: %v", err)
+			}
+			if !reflect.DeepEqual(got.UserIDs, tt.want) {
+				t.Errorf("members = %v, want %v", got.UserIDs, tt.want)
+			}
+		})
+	}
+
+	t.Run("PutAccountsInList replaces", func(t *testing.T) {
+		if err := db.PutAccountsInList(&ListMember{Instance: "a.example", OwnerUserID: "1", ListID: "10", UserIDs: []string{"2", "4"}}); err != nil {
+			t.Fatalf("PutAccountsInList: %v", err)
+		}
+		got, err := db.GetAccountsInList("a.example", "1", "10")
+		if err != nil {
+			t.Fatalf("GetAccountsInList: %v", err)
+		}
+		if want := []string{"2", "4"}; !reflect.DeepEqual(got.UserIDs, want) {
+			t.Errorf("members = %v, want %v", got.UserIDs, want)
+		}
+	})
+
+	t.Run("DeleteList", func(t *testing.T) {
+		if err := db.DeleteList("a.example", "1", "10"); err != nil {
+			t.Fatalf("DeleteList: %v", err)
+		}
+		got, err := db.GetAccountsInList("a.example", "1", "10")
+		if err != nil || len(got.UserIDs) != 0 {
+			t.Errorf("members after delete = %v, %v; want none", got.UserIDs, err)
+		}
+		other, err := db.GetAccountsInList("a.example", "2", "10")
+		if err != nil || len(other.UserIDs) != 1 {
+			t.Errorf("other owner's members after delete = %v, %v; want them kept", other.UserIDs, err)
+		}
+		if list, err := db.GetList("a.example", "1", "10"); err != nil || list != nil {
+			t.Errorf("GetList after delete = %+v, %v; want nil", list, err)
+		}
+		if list, err := db.GetList("b.example", "1", "10"); err != nil || list == nil {
+			t.Errorf("other instance's list after delete = %+v, %v; want it kept", list, err)
+		}
+	})
+}
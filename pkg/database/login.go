@@ -0,0 +1,65 @@
+package database
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ConsumeLoginAttempt deletes a login attempt from the database and returns it.
+// A nil attempt (and nil error) is returned if the state is unknown or was already consumed.
+func (config *DDB) ConsumeLoginAttempt(state string) (*LoginAttempt, error) {
+	return config.ConsumeLoginAttemptWithContext(context.Background(), state)
+}
+
+// ConsumeLoginAttemptWithContext is ConsumeLoginAttempt with a context.
+func (config *DDB) ConsumeLoginAttemptWithContext(ctx context.Context, state string) (*LoginAttempt, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableLoginAttempts),
+		Key: map[string]types.AttributeValue{
+			"State": &types.AttributeValueMemberS{Value: state},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	}
+	result, err := config.db.DeleteItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Attributes == nil {
+		return nil, nil
+	}
+	attempt := &LoginAttempt{}
+	err = attributevalue.UnmarshalMap(result.Attributes, attempt)
+	if err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// PutLoginAttempt stores a login attempt in the database.
+func (config *DDB) PutLoginAttempt(attempt *LoginAttempt) error {
+	return config.PutLoginAttemptWithContext(context.Background(), attempt)
+}
+
+// PutLoginAttemptWithContext is PutLoginAttempt with a context.
+func (config *DDB) PutLoginAttemptWithContext(ctx context.Context, attempt *LoginAttempt) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(attempt)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableLoginAttempts),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryKV is an in-memory key/value backend. Transactions are serialized.
+type memoryKV struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemory returns a new, empty, in-memory store. Meant for tests and local runs; nothing is persisted.
+func NewMemory() *KVStore {
+	kv := &memoryKV{buckets: make(map[string]map[string][]byte)}
+	for _, bucket := range kvBuckets {
+		kv.buckets[bucket] = make(map[string][]byte)
+	}
+	return &KVStore{kv: kv}
+}
+
+func (m *memoryKV) view(fn func(tx kvTx) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return fn(m)
+}
+
+func (m *memoryKV) update(fn func(tx kvTx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fn(m)
+}
+
+func (m *memoryKV) close() error {
+	return nil
+}
+
+func (m *memoryKV) get(bucket string, key string) []byte {
+	return m.buckets[bucket][key]
+}
+
+func (m *memoryKV) put(bucket string, key string, value []byte) error {
+	m.buckets[bucket][key] = value
+	return nil
+}
+
+func (m *memoryKV) delete(bucket string, key string) error {
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *memoryKV) forEach(bucket string, fn func(key string, value []byte) error) error {
+	keys := make([]string, 0, len(m.buckets[bucket]))
+	for key := range m.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, m.buckets[bucket][key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
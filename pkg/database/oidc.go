@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ConsumeAuthCode deletes an authorization code issued to the client (empty for /auth/exchange codes)
+// from the database and returns it. A nil code (and nil error) is returned if the code is unknown, was
+// already used or was issued to another client; a code issued to another client is kept.
+func (config *DDB) ConsumeAuthCode(code string, clientID string) (*AuthCode, error) {
+	return config.ConsumeAuthCodeWithContext(context.Background(), code, clientID)
+}
+
+// ConsumeAuthCodeWithContext is ConsumeAuthCode with a context.
+func (config *DDB) ConsumeAuthCodeWithContext(ctx context.Context, code string, clientID string) (*AuthCode, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	// Codes stored without a ClientID are /auth/exchange codes
+	condition := "ClientID = :clientID"
+	if clientID == "" {
+		condition = "attribute_not_exists(ClientID) OR ClientID = :clientID"
+	}
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableAuthCodes),
+		Key: map[string]types.AttributeValue{
+			"Code": &types.AttributeValueMemberS{Value: code},
+		},
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":clientID": &types.AttributeValueMemberS{Value: clientID},
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	}
+	result, err := config.db.DeleteItem(ctx, input)
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if result.Attributes == nil {
+		return nil, nil
+	}
+	authCode := &AuthCode{}
+	err = attributevalue.UnmarshalMap(result.Attributes, authCode)
+	if err != nil {
+		return nil, err
+	}
+	return authCode, nil
+}
+
+// PutAuthCode stores an authorization code in the database.
+func (config *DDB) PutAuthCode(authCode *AuthCode) error {
+	return config.PutAuthCodeWithContext(context.Background(), authCode)
+}
+
+// PutAuthCodeWithContext is PutAuthCode with a context.
+func (config *DDB) PutAuthCodeWithContext(ctx context.Context, authCode *AuthCode) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(authCode)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableAuthCodes),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
+
+// DeleteOIDCClient deletes an OpenID Connect client from the database.
+func (config *DDB) DeleteOIDCClient(clientID string) error {
+	return config.DeleteOIDCClientWithContext(context.Background(), clientID)
+}
+
+// DeleteOIDCClientWithContext is DeleteOIDCClient with a context.
+func (config *DDB) DeleteOIDCClientWithContext(ctx context.Context, clientID string) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableOIDCClients),
+		Key: map[string]types.AttributeValue{
+			"ClientID": &types.AttributeValueMemberS{Value: clientID},
+		},
+	}
+	_, err := config.db.DeleteItem(ctx, input)
+	return err
+}
+
+// GetOIDCClient retrieves an OpenID Connect client from the database.
+func (config *DDB) GetOIDCClient(clientID string) (*OIDCClient, error) {
+	return config.GetOIDCClientWithContext(context.Background(), clientID)
+}
+
+// GetOIDCClientWithContext is GetOIDCClient with a context.
+func (config *DDB) GetOIDCClientWithContext(ctx context.Context, clientID string) (*OIDCClient, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableOIDCClients),
+		Key: map[string]types.AttributeValue{
+			"ClientID": &types.AttributeValueMemberS{Value: clientID},
+		},
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	client := &OIDCClient{}
+	err = attributevalue.UnmarshalMap(result.Item, client)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// PutOIDCClient stores an OpenID Connect client in the database.
+func (config *DDB) PutOIDCClient(client *OIDCClient) error {
+	return config.PutOIDCClientWithContext(context.Background(), client)
+}
+
+// PutOIDCClientWithContext is PutOIDCClient with a context.
+func (config *DDB) PutOIDCClientWithContext(ctx context.Context, client *OIDCClient) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(client)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableOIDCClients),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
@@ -0,0 +1,44 @@
+package database
+
+import "testing"
+
+func TestConsumeAuthCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		storedFor  string
+		consumeFor string
+		wantFound  bool
+		wantKept   bool
+	}{
+		{"exchange code at /auth/exchange", "", "", true, false},
+		{"oidc code at its client", "client-a", "client-a", true, false},
+		{"oidc code at /auth/exchange", "client-a", "", false, true},
+		{"oidc code at another client", "client-a", "client-b", false, true},
+		{"exchange code at an oidc client", "", "client-a", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewMemory()
+			if err := db.PutAuthCode(&AuthCode{Code: "code", ClientID: tt.storedFor}); err != nil {
+				t.Fatalf("PutAuthCode: %v", err)
+			}
+
+			authCode, err := db.ConsumeAuthCode("code", tt.consumeFor)
+			if err != nil {
+				t.Fatalf("ConsumeAuthCode: %v", err)
+			}
+			if found := authCode != nil; found != tt.wantFound {
+				t.Errorf("found = %v, want %v", found, tt.wantFound)
+			}
+
+			// A kept code can still be used by the right consumer; a used one can't
+			again, err := db.ConsumeAuthCode("code", tt.storedFor)
+			if err != nil {
+				t.Fatalf("ConsumeAuthCode again: %v", err)
+			}
+			if kept := again != nil; kept != tt.wantKept {
+				t.Errorf("kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// IncrementRateLimitCounter atomically adds one to a rate limit counter and returns the new count.
+// The counter is created if it doesn't exist; expiresAt (unix time) is only set on creation.
+func (config *DDB) IncrementRateLimitCounter(counterKey string, expiresAt int64) (int64, error) {
+	return config.IncrementRateLimitCounterWithContext(context.Background(), counterKey, expiresAt)
+}
+
+// IncrementRateLimitCounterWithContext is IncrementRateLimitCounter with a context.
+func (config *DDB) IncrementRateLimitCounterWithContext(ctx context.Context, counterKey string, expiresAt int64) (int64, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(config.tableRateLimits),
+		Key: map[string]types.AttributeValue{
+			"CounterKey": &types.AttributeValueMemberS{Value: counterKey},
+		},
+		UpdateExpression: aws.String("ADD #count :one SET #expiresAt = if_not_exists(#expiresAt, :expiresAt)"),
+		ExpressionAttributeNames: map[string]string{
+			"#count":     "Count",
+			"#expiresAt": "ExpiresAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":       &types.AttributeValueMemberN{Value: "1"},
+			":expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	}
+	result, err := config.db.UpdateItem(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+	counter := &RateLimitCounter{}
+	if err := attributevalue.UnmarshalMap(result.Attributes, counter); err != nil {
+		return 0, err
+	}
+	return counter.Count, nil
+}
+
+// GetRateLimitCounter returns the count of a rate limit counter; zero if it doesn't exist.
+func (config *DDB) GetRateLimitCounter(counterKey string) (int64, error) {
+	return config.GetRateLimitCounterWithContext(context.Background(), counterKey)
+}
+
+// GetRateLimitCounterWithContext is GetRateLimitCounter with a context.
+func (config *DDB) GetRateLimitCounterWithContext(ctx context.Context, counterKey string) (int64, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableRateLimits),
+		Key: map[string]types.AttributeValue{
+			"CounterKey": &types.AttributeValueMemberS{Value: counterKey},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+	if result.Item == nil {
+		return 0, nil
+	}
+	counter := &RateLimitCounter{}
+	if err := attributevalue.UnmarshalMap(result.Item, counter); err != nil {
+		return 0, err
+	}
+	return counter.Count, nil
+}
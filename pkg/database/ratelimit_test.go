@@ -0,0 +1,37 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitCounter(t *testing.T) {
+	db := NewMemory()
+	expiresAt := time.Now().Add(time.Minute).Unix()
+
+	steps := []struct {
+		increment bool
+		want      int64
+	}{
+		{false, 0},
+		{true, 1},
+		{true, 2},
+		{false, 2},
+		{true, 3},
+	}
+	for i, step := range steps {
+		var count int64
+		var err error
+		if step.increment {
+			count, err = db.IncrementRateLimitCounter("ip:192.0.2.1:0", expiresAt)
+		} else {
+			count, err = db.GetRateLimitCounter("ip:192.0.2.1:0")
+		}
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if count != step.want {
+			t.Errorf("step %d: count = %d, want %d", i, count, step.want)
+		}
+	}
+}
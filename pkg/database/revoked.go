@@ -0,0 +1,64 @@
+package database
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// GetRevokedToken retrieves a revoked token item from the database.
+// A nil item (and nil error) is returned if the token has not been revoked.
+func (config *DDB) GetRevokedToken(tokenID string) (*RevokedToken, error) {
+	return config.GetRevokedTokenWithContext(context.Background(), tokenID)
+}
+
+// GetRevokedTokenWithContext is GetRevokedToken with a context.
+func (config *DDB) GetRevokedTokenWithContext(ctx context.Context, tokenID string) (*RevokedToken, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableRevokedTokens),
+		Key: map[string]types.AttributeValue{
+			"TokenID": &types.AttributeValueMemberS{Value: tokenID},
+		},
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	revoked := &RevokedToken{}
+	err = attributevalue.UnmarshalMap(result.Item, revoked)
+	if err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// PutRevokedToken stores a revoked token item in the database.
+func (config *DDB) PutRevokedToken(revoked *RevokedToken) error {
+	return config.PutRevokedTokenWithContext(context.Background(), revoked)
+}
+
+// PutRevokedTokenWithContext is PutRevokedToken with a context.
+func (config *DDB) PutRevokedTokenWithContext(ctx context.Context, revoked *RevokedToken) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(revoked)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableRevokedTokens),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
@@ -0,0 +1,164 @@
+package database
+
+import "context"
+
+// Store is the storage used by mastostart. It is implemented by DDB (DynamoDB, for Lambda)
+// and KVStore (in memory for tests, or a bbolt file for a single VM).
+// Every method has a WithContext variant; the plain methods use a background context.
+type Store interface {
+	ConfigStore
+	AppCredentialsStore
+	ListStore
+	SessionStore
+	LoginStore
+	OIDCClientStore
+	SigningKeyStore
+	LinkedAccountStore
+	APIKeyStore
+	RateLimitStore
+}
+
+// ConfigStore stores the config items
+type ConfigStore interface {
+	DeleteConfig(key string) error
+	DeleteConfigWithContext(ctx context.Context, key string) error
+	GetConfig(key string) (*ConfigItem, error)
+	GetConfigWithContext(ctx context.Context, key string) (*ConfigItem, error)
+	ListConfig() ([]*ConfigItem, error)
+	ListConfigWithContext(ctx context.Context) ([]*ConfigItem, error)
+	PutConfig(item *ConfigItem) error
+	PutConfigWithContext(ctx context.Context, item *ConfigItem) error
+}
+
+// AppCredentialsStore stores the app registrations with the instances
+type AppCredentialsStore interface {
+	DeleteAppCredentials(instance string) error
+	DeleteAppCredentialsWithContext(ctx context.Context, instance string) error
+	GetAppCredentials(instance string) (*AppCredentials, error)
+	GetAppCredentialsWithContext(ctx context.Context, instance string) (*AppCredentials, error)
+	ListAppCredentials() ([]*AppCredentials, error)
+	ListAppCredentialsWithContext(ctx context.Context) ([]*AppCredentials, error)
+	PutAppCredentials(app *AppCredentials) error
+	PutAppCredentialsWithContext(ctx context.Context, app *AppCredentials) error
+	PutArchivedAppCredentials(archived *ArchivedAppCredentials) error
+	PutArchivedAppCredentialsWithContext(ctx context.Context, archived *ArchivedAppCredentials) error
+}
+
+// ListStore stores the saved lists and their members
+type ListStore interface {
+	DeleteList(instance string, ownerUserID string, listID string) error
+	DeleteListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) error
+	GetAccountsInList(instance string, ownerUserID string, listID string) (*ListMember, error)
+	GetAccountsInListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) (*ListMember, error)
+	GetList(instance string, ownerUserID string, listID string) (*List, error)
+	GetListWithContext(ctx context.Context, instance string, ownerUserID string, listID string) (*List, error)
+	ListLists(instance string, ownerUserID string) ([]*List, error)
+	ListListsWithContext(ctx context.Context, instance string, ownerUserID string) ([]*List, error)
+	PutAccountsInList(listMember *ListMember) error
+	PutAccountsInListWithContext(ctx context.Context, listMember *ListMember) error
+	PutList(list *List) error
+	PutListWithContext(ctx context.Context, list *List) error
+}
+
+// SessionStore stores the sessions and the revoked JWTs
+type SessionStore interface {
+	DeleteUserCredentials(sessionID string) error
+	DeleteUserCredentialsWithContext(ctx context.Context, sessionID string) error
+	GetUserCredentials(sessionID string) (*UserCredentials, error)
+	GetUserCredentialsWithContext(ctx context.Context, sessionID string) (*UserCredentials, error)
+	ListUserCredentials(accountURL string) ([]*UserCredentials, error)
+	ListUserCredentialsWithContext(ctx context.Context, accountURL string) ([]*UserCredentials, error)
+	PutUserCredentials(creds *UserCredentials) error
+	PutUserCredentialsWithContext(ctx context.Context, creds *UserCredentials) error
+	GetRevokedToken(tokenID string) (*RevokedToken, error)
+	GetRevokedTokenWithContext(ctx context.Context, tokenID string) (*RevokedToken, error)
+	PutRevokedToken(revoked *RevokedToken) error
+	PutRevokedTokenWithContext(ctx context.Context, revoked *RevokedToken) error
+}
+
+// LoginStore stores logins in progress: login attempts, one-time codes and device authorizations
+type LoginStore interface {
+	ConsumeLoginAttempt(state string) (*LoginAttempt, error)
+	ConsumeLoginAttemptWithContext(ctx context.Context, state string) (*LoginAttempt, error)
+	PutLoginAttempt(attempt *LoginAttempt) error
+	PutLoginAttemptWithContext(ctx context.Context, attempt *LoginAttempt) error
+	ConsumeAuthCode(code string, clientID string) (*AuthCode, error)
+	ConsumeAuthCodeWithContext(ctx context.Context, code string, clientID string) (*AuthCode, error)
+	PutAuthCode(authCode *AuthCode) error
+	PutAuthCodeWithContext(ctx context.Context, authCode *AuthCode) error
+	ConsumeDeviceAuthorization(deviceCode string) (*DeviceAuthorization, error)
+	ConsumeDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) (*DeviceAuthorization, error)
+	DeleteDeviceAuthorization(deviceCode string) error
+	DeleteDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) error
+	GetDeviceAuthorization(deviceCode string) (*DeviceAuthorization, error)
+	GetDeviceAuthorizationWithContext(ctx context.Context, deviceCode string) (*DeviceAuthorization, error)
+	GetDeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error)
+	GetDeviceAuthorizationByUserCodeWithContext(ctx context.Context, userCode string) (*DeviceAuthorization, error)
+	PollDeviceAuthorization(deviceCode string, lastPolledAt int64, interval int64) (bool, error)
+	PollDeviceAuthorizationWithContext(ctx context.Context, deviceCode string, lastPolledAt int64, interval int64) (bool, error)
+	PutDeviceAuthorization(device *DeviceAuthorization) error
+	PutDeviceAuthorizationWithContext(ctx context.Context, device *DeviceAuthorization) error
+	ResolveDeviceAuthorization(deviceCode string, status string, sessionID string, token string) (bool, error)
+	ResolveDeviceAuthorizationWithContext(ctx context.Context, deviceCode string, status string, sessionID string, token string) (bool, error)
+}
+
+// OIDCClientStore stores the OpenID Connect clients
+type OIDCClientStore interface {
+	DeleteOIDCClient(clientID string) error
+	DeleteOIDCClientWithContext(ctx context.Context, clientID string) error
+	GetOIDCClient(clientID string) (*OIDCClient, error)
+	GetOIDCClientWithContext(ctx context.Context, clientID string) (*OIDCClient, error)
+	PutOIDCClient(client *OIDCClient) error
+	PutOIDCClientWithContext(ctx context.Context, client *OIDCClient) error
+}
+
+// SigningKeyStore stores the JWT signing keys
+type SigningKeyStore interface {
+	GetSigningKey(keyID string) (*SigningKey, error)
+	GetSigningKeyWithContext(ctx context.Context, keyID string) (*SigningKey, error)
+	ListSigningKeys() ([]*SigningKey, error)
+	ListSigningKeysWithContext(ctx context.Context) ([]*SigningKey, error)
+	PutSigningKey(key *SigningKey) error
+	PutSigningKeyWithContext(ctx context.Context, key *SigningKey) error
+}
+
+// LinkedAccountStore stores the accounts linked to identities
+type LinkedAccountStore interface {
+	DeleteLinkedAccount(identityID string, accountURL string) error
+	DeleteLinkedAccountWithContext(ctx context.Context, identityID string, accountURL string) error
+	GetLinkedAccount(identityID string, accountURL string) (*LinkedAccount, error)
+	GetLinkedAccountWithContext(ctx context.Context, identityID string, accountURL string) (*LinkedAccount, error)
+	GetLinkedAccountByURL(accountURL string) (*LinkedAccount, error)
+	GetLinkedAccountByURLWithContext(ctx context.Context, accountURL string) (*LinkedAccount, error)
+	ListLinkedAccounts(identityID string) ([]*LinkedAccount, error)
+	ListLinkedAccountsWithContext(ctx context.Context, identityID string) ([]*LinkedAccount, error)
+	PutLinkedAccount(account *LinkedAccount) error
+	PutLinkedAccountWithContext(ctx context.Context, account *LinkedAccount) error
+}
+
+// APIKeyStore stores the API keys
+type APIKeyStore interface {
+	DeleteAPIKey(keyID string) error
+	DeleteAPIKeyWithContext(ctx context.Context, keyID string) error
+	GetAPIKey(keyID string) (*APIKey, error)
+	GetAPIKeyWithContext(ctx context.Context, keyID string) (*APIKey, error)
+	ListAPIKeys(identityID string) ([]*APIKey, error)
+	ListAPIKeysWithContext(ctx context.Context, identityID string) ([]*APIKey, error)
+	PutAPIKey(key *APIKey) error
+	PutAPIKeyWithContext(ctx context.Context, key *APIKey) error
+	TouchAPIKey(keyID string, lastUsedAt int64) error
+	TouchAPIKeyWithContext(ctx context.Context, keyID string, lastUsedAt int64) error
+}
+
+// RateLimitStore stores the rate limit counters
+type RateLimitStore interface {
+	IncrementRateLimitCounter(counterKey string, expiresAt int64) (int64, error)
+	IncrementRateLimitCounterWithContext(ctx context.Context, counterKey string, expiresAt int64) (int64, error)
+	GetRateLimitCounter(counterKey string) (int64, error)
+	GetRateLimitCounterWithContext(ctx context.Context, counterKey string) (int64, error)
+}
+
+var (
+	_ Store = (*DDB)(nil)
+	_ Store = (*KVStore)(nil)
+)
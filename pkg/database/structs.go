@@ -22,6 +22,111 @@ type AppCredentials struct {
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
 	AuthURI      string `json:"vapid_key"`
+
+	// Software and SoftwareVersion identify the instance's server software (from NodeInfo)
+	Software        string `json:"software"`
+	SoftwareVersion string `json:"software_version"`
+
+	// Scopes are the scopes the app was registered with. Empty for apps registered before scopes were stored.
+	Scopes []string `json:"scopes"`
+
+	// CreatedAt is when the app was registered (unix seconds)
+	CreatedAt int64 `json:"created_at"`
+
+	// VerifiedAt is when the registration was last verified with the instance (unix seconds)
+	VerifiedAt int64 `json:"verified_at"`
+}
+
+// ArchivedAppCredentials is an app registration that was replaced, kept for audit.
+// Keyed by InstanceURL and ArchivedAt.
+type ArchivedAppCredentials struct {
+	AppCredentials
+
+	// ArchivedAt is when the registration was replaced (unix nanoseconds)
+	ArchivedAt int64 `json:"archived_at"`
+
+	// Reason is why the registration was replaced
+	Reason string `json:"reason"`
+}
+
+// APIKey is a long-lived API key acting as the session it was minted from.
+type APIKey struct {
+	// KeyID is the public part of the key (msk_<KeyID>_<secret>).
+	KeyID string `json:"key_id"`
+
+	// SecretHash is the SHA-256 hash (hex) of the whole key.
+	SecretHash string `json:"secret_hash"`
+
+	// Name is the user's name for the key.
+	Name string `json:"name"`
+
+	// IdentityID is the mastostart identity the key belongs to.
+	IdentityID string `json:"identity_id"`
+
+	// SessionID is the credentials the key acts as (see UserCredentials.KeyID). The key stops working when they end.
+	// Keys minted before keys had their own credentials act as the login session they were minted from.
+	SessionID string `json:"session_id"`
+
+	// AccountURL is the fully qualified URL of the session's account.
+	AccountURL string `json:"account_url"`
+
+	// Scopes are the scopes the key may use; a subset of the session's scopes.
+	// Empty if the session's scopes weren't recorded.
+	Scopes []string `json:"scopes"`
+
+	// CreatedAt is the unix time the key was minted.
+	CreatedAt int64 `json:"created_at"`
+
+	// LastUsedAt is the unix time the key was last used (to the minute). 0 if never.
+	LastUsedAt int64 `json:"last_used_at"`
+
+	// ExpiresAt is the unix time the key expires.
+	// This is also the DynamoDB TTL attribute for the table.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// AuthCode represents a one-time authorization (or JWT exchange) code in the database.
+type AuthCode struct {
+	// Code is the SHA-256 hash (hex) of the code handed to the client.
+	Code string `json:"code"`
+
+	// ClientID is the OpenID Connect client the code was issued to.
+	// Empty for /auth/exchange codes.
+	ClientID string `json:"client_id"`
+
+	// RedirectURI is the redirect URI the code was sent to.
+	RedirectURI string `json:"redirect_uri"`
+
+	// Nonce is the OpenID Connect nonce from the authorize request.
+	Nonce string `json:"nonce"`
+
+	// Scope is the space separated scope granted to the client.
+	Scope string `json:"scope"`
+
+	// CodeChallenge and CodeChallengeMethod are the client's PKCE challenge, if any.
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+
+	// SessionID is the mastostart session created by the login.
+	SessionID string `json:"session_id"`
+
+	// Token is the signed mastostart JWT handed out when the code is exchanged, encrypted with token_encryption_key.
+	Token string `json:"token"`
+
+	// Subject is the fully qualified URL of the user's account.
+	Subject string `json:"subject"`
+
+	// Name, PreferredUsername and Picture are snapshots of the user's Mastodon profile for the ID token.
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	Picture           string `json:"picture"`
+
+	// AuthTime is the unix time the user authenticated.
+	AuthTime int64 `json:"auth_time"`
+
+	// ExpiresAt is the unix time the code expires.
+	// This is also the DynamoDB TTL attribute for the table.
+	ExpiresAt int64 `json:"expires_at"`
 }
 
 // ConfigItem represents a config item in the database.
@@ -30,7 +135,85 @@ type ConfigItem struct {
 	ConfigValue string `json:"config_value"`
 }
 
+// Device authorization statuses.
+const (
+	DevicePending  = "pending"
+	DeviceApproved = "approved"
+	DeviceDenied   = "denied"
+)
+
+// DeviceAuthorization is a device flow (RFC 8628) login in progress.
+type DeviceAuthorization struct {
+	// DeviceCode is the SHA-256 hash (hex) of the device code the device polls with.
+	DeviceCode string `json:"device_code"`
+
+	// UserCode is the code the user enters on the verification page (eg BCDF-GHJK).
+	UserCode string `json:"user_code"`
+
+	// InstanceURL is the host of the Mastodon instance to login to.
+	InstanceURL string `json:"instance_url"`
+
+	// Scope is the space separated list of scopes to request from the instance.
+	// Empty to request all the scopes the app is registered with.
+	Scope string `json:"scope"`
+
+	// Status is one of DevicePending, DeviceApproved or DeviceDenied.
+	Status string `json:"status"`
+
+	// SessionID is the mastostart session created once the user logged in.
+	SessionID string `json:"session_id"`
+
+	// Token is the signed mastostart JWT handed to the device once approved, encrypted with the token_encryption_key.
+	Token string `json:"token"`
+
+	// Interval is the minimum number of seconds between polls.
+	Interval int64 `json:"interval"`
+
+	// LastPolledAt is the unix time the device last polled.
+	LastPolledAt int64 `json:"last_polled_at"`
+
+	// CreatedAt is the unix time the device flow was started.
+	CreatedAt int64 `json:"created_at"`
+
+	// ExpiresAt is the unix time after which the codes are no longer accepted.
+	// This is also the DynamoDB TTL attribute for the table.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// LinkedAccount is a Mastodon account linked to a mastostart identity.
+// Keyed by IdentityID and AccountURL; the AccountURL-index GSI finds the identity of an account.
+type LinkedAccount struct {
+	// IdentityID is the mastostart identity the account is linked to.
+	IdentityID string `json:"identity_id"`
+
+	// AccountURL is the fully qualified URL of the account.
+	// ex: https://mastodon.social/@user
+	AccountURL string `json:"account_url"`
+
+	// InstanceURL is the host of the Mastodon instance.
+	// ex: mastodon.social
+	InstanceURL string `json:"instance_url"`
+
+	// UserID is the Mastodon (numeric) user ID.
+	UserID string `json:"user_id"`
+
+	// AccessToken is the account's Mastodon access token, encrypted with the token_encryption_key.
+	// Empty if the token was revoked (the account must be linked again to use it).
+	AccessToken string `json:"access_token"`
+
+	// Scopes are the OAuth scopes granted to the access token.
+	Scopes []string `json:"scopes"`
+
+	// LinkedAt is the unix time the account was linked.
+	LinkedAt int64 `json:"linked_at"`
+
+	// UpdatedAt is the unix time the access token was last replaced.
+	UpdatedAt int64 `json:"updated_at"`
+}
+
 // List represents a list item in the database.
+// Mastodon user IDs are only unique on their instance, so lists are keyed by the instance
+// and owner together (see listOwnerKey) and the list ID.
 type List struct {
 	// Instance is the host of the Mastodon instance.
 	// ex: mastodon.social
@@ -54,11 +237,192 @@ type List struct {
 	Public bool `json:"public"`
 }
 
-// ListMember represents a list member item in the database.
+// ListMember represents the member items of a list in the database.
+// Mastodon list and user IDs are only unique on their instance, so the items are keyed by the
+// instance, owner and list ID together (see listMemberKey).
 type ListMember struct {
+	// Instance is the host of the Mastodon instance.
+	// ex: mastodon.social
+	Instance string `json:"instance"`
+
+	// OwnerUserID is the Mastodon (numeric) user ID of the list owner.
+	OwnerUserID string `json:"owner_user_id"`
+
 	// ListID is the Mastodon (numeric) list ID.
 	ListID string `json:"list_id"`
 
 	// UserIDs are the Mastodon (numeric) user IDs of the list members.
 	UserIDs []string `json:"user_id"`
 }
+
+// LoginAttempt represents an in-flight OAuth login in the database.
+type LoginAttempt struct {
+	// State is the random OAuth state parameter sent to the instance.
+	State string `json:"state"`
+
+	// InstanceURL is the host of the Mastodon instance the login was started against.
+	// ex: mastodon.social
+	InstanceURL string `json:"instance_url"`
+
+	// CodeVerifier is the PKCE code verifier for the attempt.
+	// Empty if the instance does not support PKCE.
+	CodeVerifier string `json:"code_verifier"`
+
+	// ReturnTo is the allowlisted URL to send the browser back to after the callback.
+	// Empty to return JSON from the callback.
+	ReturnTo string `json:"return_to"`
+
+	// ResponseMode is how the JWT is handed over: "fragment" or "code" (to ReturnTo) or "cookie"
+	// (an HttpOnly session cookie, with or without ReturnTo).
+	ResponseMode string `json:"response_mode"`
+
+	// OIDC is the OpenID Connect authorize request this login is for.
+	// nil for logins started with /auth/login.
+	OIDC *OIDCAuthorizeRequest `json:"oidc"`
+
+	// Scope is the space separated list of scopes requested from the instance.
+	// Empty to request all the scopes the app is registered with.
+	Scope string `json:"scope"`
+
+	// UpgradeSessionID is the session whose scopes this login upgrades (/auth/upgrade).
+	// Empty for new logins.
+	UpgradeSessionID string `json:"upgrade_session_id"`
+
+	// LinkIdentityID is the identity this login links another account to (POST /api/accounts).
+	// Empty for new logins.
+	LinkIdentityID string `json:"link_identity_id"`
+
+	// DeviceCode is the device authorization (hashed device code) this login approves.
+	// Empty for logins not started from /auth/device/verify.
+	DeviceCode string `json:"device_code"`
+
+	// CreatedAt is the unix time the login attempt was started.
+	CreatedAt int64 `json:"created_at"`
+
+	// ExpiresAt is the unix time after which the state is no longer accepted.
+	// This is also the DynamoDB TTL attribute for the table.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// OIDCAuthorizeRequest is an OpenID Connect authorize request carried through a Mastodon login.
+type OIDCAuthorizeRequest struct {
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	State               string `json:"state"`
+	Nonce               string `json:"nonce"`
+	Scope               string `json:"scope"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// OIDCClient represents an OpenID Connect client (relying party) in the database.
+type OIDCClient struct {
+	// ClientID is the client's identifier.
+	ClientID string `json:"client_id"`
+
+	// ClientSecretHash is the SHA-256 hash (hex) of the client secret.
+	// Empty for public clients, which must use PKCE.
+	ClientSecretHash string `json:"client_secret_hash"`
+
+	// Name is a human friendly name for the client.
+	Name string `json:"name"`
+
+	// RedirectURIs are the exact redirect URIs the client may use.
+	RedirectURIs []string `json:"redirect_uris"`
+
+	// CreatedAt is the unix time the client was registered.
+	CreatedAt int64 `json:"created_at"`
+}
+
+// RevokedToken represents a revoked (denylisted) JWT in the database.
+type RevokedToken struct {
+	// TokenID is the JWT "jti" claim.
+	TokenID string `json:"token_id"`
+
+	// RevokedAt is the unix time the token was revoked.
+	RevokedAt int64 `json:"revoked_at"`
+
+	// ExpiresAt is the unix time the JWT expires; the entry is useless after that.
+	// This is also the DynamoDB TTL attribute for the table.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// RateLimitCounter represents the count of requests for a key in a rate limit window.
+type RateLimitCounter struct {
+	// CounterKey is the rate limit key and the start of the window (eg "ip:192.0.2.1:1700000000").
+	CounterKey string `json:"counter_key"`
+
+	// Count is the number of requests in the window.
+	Count int64 `json:"count"`
+
+	// ExpiresAt is the unix time the window ends.
+	// This is also the DynamoDB TTL attribute for the table.
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// Signing key statuses.
+// pending keys are published (JWKS) but don't sign, active keys sign new JWTs,
+// retiring keys only verify existing JWTs and retired keys are no longer used at all.
+const (
+	SigningKeyPending  = "pending"
+	SigningKeyActive   = "active"
+	SigningKeyRetiring = "retiring"
+	SigningKeyRetired  = "retired"
+)
+
+// SigningKey represents a JWT signing key in the database.
+type SigningKey struct {
+	// KeyID is the JWT "kid" header for tokens signed with this key.
+	KeyID string `json:"key_id"`
+
+	// PrivateKey is the PEM encoded RSA private key.
+	PrivateKey string `json:"private_key"`
+
+	// Status is one of the SigningKey* statuses.
+	Status string `json:"status"`
+
+	// CreatedAt is the unix time the key was created.
+	CreatedAt int64 `json:"created_at"`
+
+	// UpdatedAt is the unix time the status last changed.
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// UserCredentials represents a user session and its Mastodon access token in the database.
+type UserCredentials struct {
+	// SessionID is the opaque session ID carried in the JWT "sid" claim.
+	SessionID string `json:"session_id"`
+
+	// IdentityID is the mastostart identity the session belongs to (the JWT "sub" claim).
+	// Empty for sessions created before identities.
+	IdentityID string `json:"identity_id"`
+
+	// AccountURL is the fully qualified URL of the user's account.
+	// ex: https://mastodon.social/@user
+	AccountURL string `json:"account_url"`
+
+	// InstanceURL is the host of the Mastodon instance.
+	// ex: mastodon.social
+	InstanceURL string `json:"instance_url"`
+
+	// UserID is the Mastodon (numeric) user ID.
+	UserID string `json:"user_id"`
+
+	// AccessToken is the user's Mastodon access token, encrypted with the token_encryption_key.
+	AccessToken string `json:"access_token"`
+
+	// Scopes are the OAuth scopes the user granted the access token.
+	// Empty for sessions created before scopes were recorded.
+	Scopes []string `json:"scopes"`
+
+	// KeyID is set on the credentials an API key acts as. They are a copy of the session the key was
+	// minted from, so the key outlives that session (eg a logout). Empty for login sessions.
+	KeyID string `json:"key_id"`
+
+	// CreatedAt is the unix time the session was created.
+	CreatedAt int64 `json:"created_at"`
+
+	// ExpiresAt is the unix time the session expires.
+	// This is also the DynamoDB TTL attribute for the table.
+	ExpiresAt int64 `json:"expires_at"`
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DeleteUserCredentials deletes a user credentials (session) item from the database.
+func (config *DDB) DeleteUserCredentials(sessionID string) error {
+	return config.DeleteUserCredentialsWithContext(context.Background(), sessionID)
+}
+
+// DeleteUserCredentialsWithContext is DeleteUserCredentials with a context.
+func (config *DDB) DeleteUserCredentialsWithContext(ctx context.Context, sessionID string) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(config.tableUserCredentials),
+		Key: map[string]types.AttributeValue{
+			"SessionID": &types.AttributeValueMemberS{Value: sessionID},
+		},
+	}
+	_, err := config.db.DeleteItem(ctx, input)
+	return err
+}
+
+// GetUserCredentials retrieves a user credentials (session) item from the database.
+func (config *DDB) GetUserCredentials(sessionID string) (*UserCredentials, error) {
+	return config.GetUserCredentialsWithContext(context.Background(), sessionID)
+}
+
+// GetUserCredentialsWithContext is GetUserCredentials with a context.
+func (config *DDB) GetUserCredentialsWithContext(ctx context.Context, sessionID string) (*UserCredentials, error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	input := &dynamodb.GetItemInput{
+		TableName: aws.String(config.tableUserCredentials),
+		Key: map[string]types.AttributeValue{
+			"SessionID": &types.AttributeValueMemberS{Value: sessionID},
+		},
+	}
+	result, err := config.db.GetItem(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	creds := &UserCredentials{}
+	err = attributevalue.UnmarshalMap(result.Item, creds)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// PutUserCredentials stores a user credentials (session) item in the database.
+func (config *DDB) PutUserCredentials(creds *UserCredentials) error {
+	return config.PutUserCredentialsWithContext(context.Background(), creds)
+}
+
+// PutUserCredentialsWithContext is PutUserCredentials with a context.
+func (config *DDB) PutUserCredentialsWithContext(ctx context.Context, creds *UserCredentials) error {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+
+	item, err := attributevalue.MarshalMap(creds)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(config.tableUserCredentials),
+		Item:      item,
+	}
+	_, err = config.db.PutItem(ctx, input)
+	return err
+}
+
+// ListUserCredentials retrieves the user credentials (session) items of a Mastodon account from the database.
+func (config *DDB) ListUserCredentials(accountURL string) ([]*UserCredentials, error) {
+	return config.ListUserCredentialsWithContext(context.Background(), accountURL)
+}
+
+// ListUserCredentialsWithContext is ListUserCredentials with a context.
+func (config *DDB) ListUserCredentialsWithContext(ctx context.Context, accountURL string) ([]*UserCredentials, error) {
+	sessions := []*UserCredentials{}
+	paginator := dynamodb.NewScanPaginator(config.db, &dynamodb.ScanInput{
+		TableName:        aws.String(config.tableUserCredentials),
+		FilterExpression: aws.String("AccountURL = :accountURL"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":accountURL": &types.AttributeValueMemberS{Value: accountURL},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := nextPage(ctx, config, paginator.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		var pageSessions []*UserCredentials
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &pageSessions); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, pageSessions...)
+	}
+	return sessions, nil
+}
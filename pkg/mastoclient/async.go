@@ -8,13 +8,21 @@ import (
 
 // AsyncGetAccountStatuses gets account statuses asynchronously
 func (c *Config) AsyncGetAccountStatuses(input *AsyncGetAccountStatusesInput) {
+	c.AsyncGetAccountStatusesWithContext(context.Background(), input)
+}
+
+// AsyncGetAccountStatusesWithContext is AsyncGetAccountStatuses with a context.
+// Fetching stops and the channel is closed once the context is done (eg the client went away).
+func (c *Config) AsyncGetAccountStatusesWithContext(ctx context.Context, input *AsyncGetAccountStatusesInput) {
 	// TODO: Something in the pagination is broken
+	defer close(input.Ch)
 	client, err := c.preflight()
 	if err != nil {
-		input.Ch <- AsyncStatuses{
+		send(ctx, input.Ch, AsyncStatuses{
 			Statuses: nil,
 			Err:      err,
-		}
+		})
+		return
 	}
 
 	var pg mastodon.Pagination
@@ -27,22 +35,31 @@ func (c *Config) AsyncGetAccountStatuses(input *AsyncGetAccountStatusesInput) {
 	}
 	total := 0
 	for {
-		statuses, err := client.GetAccountStatuses(context.Background(), mastodon.ID(input.ID), &pg)
+		pageCtx, cancel := WithTimeout(ctx, c.timeouts.API)
+		statuses, err := client.GetAccountStatuses(pageCtx, mastodon.ID(input.ID), &pg)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			c.log.Error().
 				Err(err).
 				Str("id", input.ID).
 				Str("function", "mastoclient::AsyncGetAccountStatuses::client.GetAccountStatuses()").
 				Msg("error getting statuses")
-			input.Ch <- AsyncStatuses{
+			if !send(ctx, input.Ch, AsyncStatuses{
 				Statuses: nil,
 				Err:      err,
+			}) {
+				return
 			}
 			continue
 		}
-		input.Ch <- AsyncStatuses{
+		if !send(ctx, input.Ch, AsyncStatuses{
 			Statuses: statuses,
 			Err:      nil,
+		}) {
+			return
 		}
 		total += len(statuses)
 		if pg.MaxID == "" {
@@ -58,17 +75,24 @@ func (c *Config) AsyncGetAccountStatuses(input *AsyncGetAccountStatusesInput) {
 		pg.MinID = ""
 		//time.Sleep(5 * time.Second)
 	}
-	close(input.Ch)
 }
 
 // AsyncGetFollowers gets followers asynchronously
 func (c *Config) AsyncGetFollowers(input *AsyncGetFollowersInput) {
+	c.AsyncGetFollowersWithContext(context.Background(), input)
+}
+
+// AsyncGetFollowersWithContext is AsyncGetFollowers with a context.
+// Fetching stops and the channel is closed once the context is done (eg the client went away).
+func (c *Config) AsyncGetFollowersWithContext(ctx context.Context, input *AsyncGetFollowersInput) {
+	defer close(input.Ch)
 	client, err := c.preflight()
 	if err != nil {
-		input.Ch <- AsyncFollowers{
+		send(ctx, input.Ch, AsyncFollowers{
 			Followers: nil,
 			Err:       err,
-		}
+		})
+		return
 	}
 
 	var pg mastodon.Pagination
@@ -81,17 +105,26 @@ func (c *Config) AsyncGetFollowers(input *AsyncGetFollowersInput) {
 	}
 	total := 0
 	for {
-		fs, err := client.GetAccountFollowers(context.Background(), mastodon.ID(input.ID), &pg)
+		pageCtx, cancel := WithTimeout(ctx, c.timeouts.API)
+		fs, err := client.GetAccountFollowers(pageCtx, mastodon.ID(input.ID), &pg)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			input.Ch <- AsyncFollowers{
+			if !send(ctx, input.Ch, AsyncFollowers{
 				Followers: nil,
 				Err:       err,
+			}) {
+				return
 			}
 		}
-		input.Ch <- AsyncFollowers{
+		if !send(ctx, input.Ch, AsyncFollowers{
 			Followers:  fs,
 			Pagination: &pg,
 			Err:        nil,
+		}) {
+			return
 		}
 		c.log.Info().
 			Str("max_id", string(pg.MaxID)).
@@ -113,22 +146,29 @@ func (c *Config) AsyncGetFollowers(input *AsyncGetFollowersInput) {
 		pg.SinceID = ""
 	}
 	// Send pagination info
-	input.Ch <- AsyncFollowers{
+	send(ctx, input.Ch, AsyncFollowers{
 		Followers:  nil,
 		Pagination: &pg,
 		Err:        nil,
-	}
-	close(input.Ch)
+	})
 }
 
 // AsyncGetFollowing gets following asynchronously
 func (c *Config) AsyncGetFollowing(input *AsyncGetFollowingInput) {
+	c.AsyncGetFollowingWithContext(context.Background(), input)
+}
+
+// AsyncGetFollowingWithContext is AsyncGetFollowing with a context.
+// Fetching stops and the channel is closed once the context is done (eg the client went away).
+func (c *Config) AsyncGetFollowingWithContext(ctx context.Context, input *AsyncGetFollowingInput) {
+	defer close(input.Ch)
 	client, err := c.preflight()
 	if err != nil {
-		input.Ch <- AsyncFollowing{
+		send(ctx, input.Ch, AsyncFollowing{
 			Following: nil,
 			Err:       err,
-		}
+		})
+		return
 	}
 
 	var pg mastodon.Pagination
@@ -141,24 +181,33 @@ func (c *Config) AsyncGetFollowing(input *AsyncGetFollowingInput) {
 	}
 	total := 0
 	for {
-		fs, err := client.GetAccountFollowing(context.Background(), mastodon.ID(input.ID), &pg)
+		pageCtx, cancel := WithTimeout(ctx, c.timeouts.API)
+		fs, err := client.GetAccountFollowing(pageCtx, mastodon.ID(input.ID), &pg)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			c.log.Error().
 				Err(err).
 				Str("id", input.ID).
 				Str("function", "mastoclient::AsyncGetFollowing::client.GetAccountFollowing()").
 				Msg("error getting statuses")
-			input.Ch <- AsyncFollowing{
+			if !send(ctx, input.Ch, AsyncFollowing{
 				Following:  nil,
 				Pagination: nil,
 				Err:        err,
+			}) {
+				return
 			}
 			continue
 		}
-		input.Ch <- AsyncFollowing{
+		if !send(ctx, input.Ch, AsyncFollowing{
 			Following:  fs,
 			Pagination: &pg,
 			Err:        nil,
+		}) {
+			return
 		}
 		total += len(fs)
 		if pg.MaxID == "" {
@@ -174,23 +223,28 @@ func (c *Config) AsyncGetFollowing(input *AsyncGetFollowingInput) {
 		//time.Sleep(5 * time.Second)
 	}
 	// Send pagination info
-	input.Ch <- AsyncFollowing{
+	send(ctx, input.Ch, AsyncFollowing{
 		Following:  nil,
 		Pagination: &pg,
 		Err:        nil,
-	}
-	close(input.Ch)
+	})
 }
 
 // AsyncGetNotifications gets notifications asynchronously
 func (c *Config) AsyncGetNotifications(input *AsyncGetNotificationsInput) {
+	c.AsyncGetNotificationsWithContext(context.Background(), input)
+}
+
+// AsyncGetNotificationsWithContext is AsyncGetNotifications with a context.
+// Fetching stops and the channel is closed once the context is done (eg the client went away).
+func (c *Config) AsyncGetNotificationsWithContext(ctx context.Context, input *AsyncGetNotificationsInput) {
+	defer close(input.Ch)
 	client, err := c.preflight()
 	if err != nil {
-		input.Ch <- AsyncNotices{
+		send(ctx, input.Ch, AsyncNotices{
 			Notices: nil,
 			Err:     err,
-		}
-		close(input.Ch)
+		})
 		return
 	}
 
@@ -219,18 +273,24 @@ func (c *Config) AsyncGetNotifications(input *AsyncGetNotificationsInput) {
 	total := 0
 	for {
 		// Get notifications
-		notices, err := client.GetNotifications(context.Background(), &pg)
+		pageCtx, cancel := WithTimeout(ctx, c.timeouts.API)
+		notices, err := client.GetNotifications(pageCtx, &pg)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			input.Ch <- AsyncNotices{
+			send(ctx, input.Ch, AsyncNotices{
 				Notices: nil,
 				Err:     err,
-			}
-			close(input.Ch)
+			})
 			return
 		}
-		input.Ch <- AsyncNotices{
+		if !send(ctx, input.Ch, AsyncNotices{
 			Notices: notices,
 			Err:     nil,
+		}) {
+			return
 		}
 		total += len(notices)
 
@@ -248,5 +308,14 @@ func (c *Config) AsyncGetNotifications(input *AsyncGetNotificationsInput) {
 		pg.MinID = ""
 		//time.Sleep(5 * time.Second)
 	}
-	close(input.Ch)
+}
+
+// send sends v on ch unless the context is done first. Returns false if it wasn't sent.
+func send[T any](ctx context.Context, ch chan T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
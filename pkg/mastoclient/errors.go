@@ -1,5 +1,39 @@
 package mastoclient
 
+// InvalidHandleError error
+type InvalidHandleError struct {
+	Err error
+	Msg string
+}
+
+// Error returns the error message
+func (e *InvalidHandleError) Error() string {
+	if e.Msg == "" {
+		e.Msg = "invalid handle"
+	}
+	if e.Err != nil {
+		e.Msg += ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+// InvalidClientError is returned when the instance no longer recognizes the app's client credentials
+type InvalidClientError struct {
+	Err error
+	Msg string
+}
+
+// Error returns the error message
+func (e *InvalidClientError) Error() string {
+	if e.Msg == "" {
+		e.Msg = "invalid client credentials"
+	}
+	if e.Err != nil {
+		e.Msg += ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
 // NoAccessTokenError error
 type NoAccessTokenError struct {
 	Err error
@@ -84,3 +118,23 @@ func (e *PostFailedError) Error() string {
 	}
 	return e.Msg
 }
+
+// RequestFailedError error
+type RequestFailedError struct {
+	Err error
+	Msg string
+
+	// StatusCode is the HTTP status the server responded with, if any
+	StatusCode int
+}
+
+// Error returns the error message
+func (e *RequestFailedError) Error() string {
+	if e.Msg == "" {
+		e.Msg = "request failed"
+	}
+	if e.Err != nil {
+		e.Msg += ": " + e.Err.Error()
+	}
+	return e.Msg
+}
@@ -2,8 +2,11 @@ package mastoclient
 
 import (
 	"context"
+	"errors"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mattn/go-mastodon"
 	"github.com/rs/zerolog"
@@ -12,6 +15,30 @@ import (
 // Options for the mastoclient query
 type Option func(c *Config)
 
+// Timeouts bound the calls to the instance, by class of call. A call's context may end it sooner.
+// Zero leaves that class bounded by the context only.
+type Timeouts struct {
+	// API is for the Mastodon REST API calls (per page for the Async functions)
+	API time.Duration
+
+	// OAuth is for the token exchange, token revocation and app verification
+	OAuth time.Duration
+
+	// Discovery is for NodeInfo, WebFinger, host-meta and the OAuth server metadata
+	Discovery time.Duration
+
+	// Register is for registering the app with an instance
+	Register time.Duration
+}
+
+// DefaultTimeouts are the timeouts used unless WithTimeouts says otherwise
+var DefaultTimeouts = Timeouts{
+	API:       10 * time.Second,
+	OAuth:     10 * time.Second,
+	Discovery: 5 * time.Second,
+	Register:  15 * time.Second,
+}
+
 // Config for the mastoclient query
 type Config struct {
 	log          *zerolog.Logger
@@ -19,11 +46,12 @@ type Config struct {
 	clientKey    *string
 	clientSecret *string
 	accessToken  *string
+	timeouts     Timeouts
 }
 
 // NewConfig creates a new Config
 func New(opts ...Option) (*Config, error) {
-	cfg := &Config{}
+	cfg := &Config{timeouts: DefaultTimeouts}
 
 	// apply the list of options to Config
 	for _, opt := range opts {
@@ -68,6 +96,13 @@ func WithInstance(instance *string) Option {
 	}
 }
 
+// WithTimeouts sets the timeouts of the calls to the instance
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(cfg *Config) {
+		cfg.timeouts = timeouts
+	}
+}
+
 // WithLogger sets the logger to use
 func WithLogger(log *zerolog.Logger) Option {
 	return func(cfg *Config) {
@@ -100,6 +135,14 @@ func (cfg *Config) SetLogger(log *zerolog.Logger) {
 	cfg.log = log
 }
 
+// WithTimeout bounds ctx by timeout. A zero timeout only adds a cancel.
+func WithTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 // prefight checks if the config is set up correctly and returns a mastodon client
 func (cfg *Config) preflight() (*mastodon.Client, error) {
 	// set up a new mastodon client config struct
@@ -127,13 +170,21 @@ func (cfg *Config) preflight() (*mastodon.Client, error) {
 	return client, nil
 }
 
+// GetAccountsInList gets the accounts in a list of the current user
 func (cfg *Config) GetAccountsInList(listId *mastodon.ID) ([]*mastodon.Account, error) {
+	return cfg.GetAccountsInListWithContext(context.Background(), listId)
+}
+
+// GetAccountsInListWithContext is GetAccountsInList with a context
+func (cfg *Config) GetAccountsInListWithContext(ctx context.Context, listId *mastodon.ID) ([]*mastodon.Account, error) {
 	client, err := cfg.preflight()
 	if err != nil {
 		return nil, err
 	}
 
-	accounts, err := client.GetListAccounts(context.Background(), *listId)
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.API)
+	defer cancel()
+	accounts, err := client.GetListAccounts(ctx, *listId)
 	if err != nil {
 		return nil, err
 	}
@@ -141,46 +192,55 @@ func (cfg *Config) GetAccountsInList(listId *mastodon.ID) ([]*mastodon.Account,
 	return accounts, nil
 }
 
-// GetAuthTokenFromCode gets an auth token from an auth code
-func (cfg *Config) GetAuthTokenFromCode(authCode *string, redirectURI *string) (*string, error) {
-	client, err := cfg.preflight()
-	if err != nil {
-		return nil, err
-	}
-
-	if err = client.AuthenticateToken(context.Background(), *authCode, *redirectURI); err != nil {
-		return nil, err
-	}
-
-	return &client.Config.AccessToken, nil
+// GetInstanceInfo gets the instance's info
+func (cfg *Config) GetInstanceInfo() (*mastodon.Instance, error) {
+	return cfg.GetInstanceInfoWithContext(context.Background())
 }
 
-func (cfg *Config) GetInstanceInfo() (*mastodon.Instance, error) {
+// GetInstanceInfoWithContext is GetInstanceInfo with a context
+func (cfg *Config) GetInstanceInfoWithContext(ctx context.Context) (*mastodon.Instance, error) {
 	client, err := cfg.preflight()
 	if err != nil {
 		return nil, err
 	}
 
-	return client.GetInstance(context.Background())
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.API)
+	defer cancel()
+	return client.GetInstance(ctx)
 }
 
+// GetInstanceStats gets the instance's weekly activity
 func (cfg *Config) GetInstanceStats() ([]*mastodon.WeeklyActivity, error) {
+	return cfg.GetInstanceStatsWithContext(context.Background())
+}
+
+// GetInstanceStatsWithContext is GetInstanceStats with a context
+func (cfg *Config) GetInstanceStatsWithContext(ctx context.Context) ([]*mastodon.WeeklyActivity, error) {
 	client, err := cfg.preflight()
 	if err != nil {
 		return nil, err
 	}
 
-	return client.GetInstanceActivity(context.Background())
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.API)
+	defer cancel()
+	return client.GetInstanceActivity(ctx)
 }
 
 // GetLastStatus gets the last status of a user
 func (cfg *Config) GetLastStatus(id *mastodon.ID) (*mastodon.Status, error) {
+	return cfg.GetLastStatusWithContext(context.Background(), id)
+}
+
+// GetLastStatusWithContext is GetLastStatus with a context
+func (cfg *Config) GetLastStatusWithContext(ctx context.Context, id *mastodon.ID) (*mastodon.Status, error) {
 	client, err := cfg.preflight()
 	if err != nil {
 		return nil, err
 	}
 
-	statuses, err := client.GetAccountStatuses(context.Background(), *id, &mastodon.Pagination{Limit: 1})
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.API)
+	defer cancel()
+	statuses, err := client.GetAccountStatuses(ctx, *id, &mastodon.Pagination{Limit: 1})
 	if err != nil {
 		return nil, err
 	}
@@ -194,61 +254,132 @@ func (cfg *Config) GetLastStatus(id *mastodon.ID) (*mastodon.Status, error) {
 
 // GetUserByID gets a user by ID
 func (cfg *Config) GetUserByID(id string) (*mastodon.Account, error) {
+	return cfg.GetUserByIDWithContext(context.Background(), id)
+}
+
+// GetUserByIDWithContext is GetUserByID with a context
+func (cfg *Config) GetUserByIDWithContext(ctx context.Context, id string) (*mastodon.Account, error) {
 	client, err := cfg.preflight()
 	if err != nil {
 		return nil, err
 	}
+
 	// Get user
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.API)
+	defer cancel()
+	return client.GetAccount(ctx, mastodon.ID(id))
+}
+
+// getUsersByIDConcurrency is how many accounts GetUsersByID fetches at once
+const getUsersByIDConcurrency = 8
+
+// GetUsersByID gets users by ID, a few at a time. The accounts are in the order of the IDs,
+// with nil for the ones that couldn't be fetched; the error joins their errors.
+func (cfg *Config) GetUsersByID(ids []string) ([]*mastodon.Account, error) {
+	return cfg.GetUsersByIDWithContext(context.Background(), ids)
+}
 
-	return client.GetAccount(context.Background(), mastodon.ID(id))
+// GetUsersByIDWithContext is GetUsersByID with a context
+func (cfg *Config) GetUsersByIDWithContext(ctx context.Context, ids []string) ([]*mastodon.Account, error) {
+	accounts := make([]*mastodon.Account, len(ids))
+	errs := make([]error, len(ids))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, getUsersByIDConcurrency)
+	for i, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			accounts[i], errs[i] = cfg.GetUserByIDWithContext(ctx, id)
+		}(i, id)
+	}
+	wg.Wait()
+
+	return accounts, errors.Join(errs...)
 }
 
 // Me gets the current user
 func (cfg *Config) Me() (*mastodon.Account, error) {
+	return cfg.MeWithContext(context.Background())
+}
+
+// MeWithContext is Me with a context
+func (cfg *Config) MeWithContext(ctx context.Context) (*mastodon.Account, error) {
 	client, err := cfg.preflight()
 	if err != nil {
 		return nil, err
 	}
+
 	// Get user
-	return client.GetAccountCurrentUser(context.Background())
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.API)
+	defer cancel()
+	return client.GetAccountCurrentUser(ctx)
 }
 
 // MyLists gets the lists of the current user. Set listId to get a specific list or nil to get all lists.
 func (cfg *Config) MyLists(listId *mastodon.ID) ([]*mastodon.List, error) {
+	return cfg.MyListsWithContext(context.Background(), listId)
+}
+
+// MyListsWithContext is MyLists with a context
+func (cfg *Config) MyListsWithContext(ctx context.Context, listId *mastodon.ID) ([]*mastodon.List, error) {
 	client, err := cfg.preflight()
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.API)
+	defer cancel()
 	if listId != nil {
-		if list, err := client.GetList(context.Background(), *listId); err != nil {
+		if list, err := client.GetList(ctx, *listId); err != nil {
 			return nil, err
 		} else {
 			return []*mastodon.List{list}, nil
 		}
 	} else {
-		return client.GetLists(context.Background())
+		return client.GetLists(ctx)
 	}
 }
 
 // Post a toot
 func (cfg *Config) Post(toot *mastodon.Toot) (*mastodon.ID, error) {
+	return cfg.PostWithContext(context.Background(), toot)
+}
+
+// PostWithContext is Post with a context
+func (cfg *Config) PostWithContext(ctx context.Context, toot *mastodon.Toot) (*mastodon.ID, error) {
 	client, err := cfg.preflight()
 	if err != nil {
 		return nil, err
 	}
 
 	// Post the toot
-	if status, err := client.PostStatus(context.Background(), toot); err != nil {
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.API)
+	defer cancel()
+	if status, err := client.PostStatus(ctx, toot); err != nil {
 		return nil, err
 	} else {
 		return &status.ID, nil
 	}
 }
 
-// RegisterAppInput is the input for RegisterApp
+// RegisterApp registers the app with an instance
 func RegisterApp(input *RegisterAppInput) (*mastodon.Application, error) {
-	app, err := mastodon.RegisterApp(context.Background(), &mastodon.AppConfig{
+	ctx, cancel := WithTimeout(context.Background(), DefaultTimeouts.Register)
+	defer cancel()
+	return RegisterAppWithContext(ctx, input)
+}
+
+// RegisterAppWithContext is RegisterApp with a context. The caller sets the deadline.
+func RegisterAppWithContext(ctx context.Context, input *RegisterAppInput) (*mastodon.Application, error) {
+	app, err := mastodon.RegisterApp(ctx, &mastodon.AppConfig{
 		Server:       input.InstanceURL,
 		ClientName:   input.ClientName,
 		RedirectURIs: input.RedirectURI,
@@ -0,0 +1,121 @@
+package mastoclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	// nodeInfoSchemaPrefix is the rel prefix of the NodeInfo schema links in /.well-known/nodeinfo
+	nodeInfoSchemaPrefix = "http://nodeinfo.diaspora.software/ns/schema/"
+
+	// maxDiscoveryBody is the most of a discovery document (NodeInfo, host-meta, WebFinger) that is read
+	maxDiscoveryBody = 1 << 20
+)
+
+// GetNodeInfo identifies the instance's server software with NodeInfo.
+// The newest 2.x schema advertised in /.well-known/nodeinfo is used.
+func (cfg *Config) GetNodeInfo() (*NodeInfo, error) {
+	return cfg.GetNodeInfoWithContext(context.Background())
+}
+
+// GetNodeInfoWithContext is GetNodeInfo with a context. The discovery timeout covers both requests.
+func (cfg *Config) GetNodeInfoWithContext(ctx context.Context) (*NodeInfo, error) {
+	if cfg.instance == nil {
+		return nil, &NoInstanceError{}
+	}
+
+	u, err := url.Parse(*cfg.instance)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "/.well-known/nodeinfo")
+
+	// Documents are only fetched from the instance itself, so a hostile instance can't point us elsewhere
+	client := discoveryClient(func(target *url.URL) bool { return isSameHost(target, u.Host) })
+
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.Discovery)
+	defer cancel()
+	wellKnown := &NodeInfoWellKnown{}
+	if err := getJSON(ctx, client, u.String(), wellKnown); err != nil {
+		return nil, err
+	}
+
+	// Pick the newest schema we understand
+	href := ""
+	schema := ""
+	for _, link := range wellKnown.Links {
+		version := strings.TrimPrefix(link.Rel, nodeInfoSchemaPrefix)
+		if version == link.Rel || !strings.HasPrefix(version, "2.") || link.Href == "" {
+			continue
+		}
+		if version > schema {
+			schema = version
+			href = link.Href
+		}
+	}
+	if href == "" {
+		return nil, &RequestFailedError{Msg: "no supported nodeinfo schema advertised"}
+	}
+
+	if schemaURL, err := url.Parse(href); err != nil || !isSameHost(schemaURL, u.Host) {
+		return nil, &RequestFailedError{Msg: "nodeinfo schema not served over https by the instance: " + href}
+	}
+
+	nodeInfo := &NodeInfo{}
+	if err := getJSON(ctx, client, href, nodeInfo); err != nil {
+		return nil, err
+	}
+	if nodeInfo.Software.Name == "" {
+		return nil, &RequestFailedError{Msg: "nodeinfo document does not name the server software"}
+	}
+	nodeInfo.Software.Name = strings.ToLower(nodeInfo.Software.Name)
+	return nodeInfo, nil
+}
+
+// discoveryClient returns an HTTP client that only follows redirects to the URLs allowed accepts
+func discoveryClient(allowed func(u *url.URL) bool) *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !allowed(req.URL) {
+				return &RequestFailedError{Msg: "redirect not allowed: " + req.URL.String()}
+			}
+			return nil
+		},
+	}
+}
+
+// isSameHost reports whether u is an https URL on host
+func isSameHost(u *url.URL, host string) bool {
+	return u.Scheme == "https" && strings.EqualFold(u.Host, host)
+}
+
+// getJSON fetches a URL with client and decodes the JSON response (up to maxDiscoveryBody) into res
+func getJSON(ctx context.Context, client *http.Client, rawURL string, res interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &RequestFailedError{Msg: "unable to fetch " + rawURL + ": " + resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, maxDiscoveryBody)).Decode(res)
+}
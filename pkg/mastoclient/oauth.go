@@ -0,0 +1,242 @@
+package mastoclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// GetAuthServerMetadata fetches the instance's OAuth authorization server metadata (RFC 8414).
+// Mastodon 4.3+ publishes this document; older instances return a 404.
+func (cfg *Config) GetAuthServerMetadata() (*AuthServerMetadata, error) {
+	return cfg.GetAuthServerMetadataWithContext(context.Background())
+}
+
+// GetAuthServerMetadataWithContext is GetAuthServerMetadata with a context
+func (cfg *Config) GetAuthServerMetadataWithContext(ctx context.Context) (*AuthServerMetadata, error) {
+	if cfg.instance == nil {
+		return nil, &NoInstanceError{}
+	}
+
+	u, err := url.Parse(*cfg.instance)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "/.well-known/oauth-authorization-server")
+
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.Discovery)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RequestFailedError{Msg: "unable to fetch oauth authorization server metadata: " + resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	metadata := &AuthServerMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// SupportsPKCE reports whether the instance advertises the S256 PKCE code challenge method
+func (cfg *Config) SupportsPKCE() (bool, error) {
+	return cfg.SupportsPKCEWithContext(context.Background())
+}
+
+// SupportsPKCEWithContext is SupportsPKCE with a context
+func (cfg *Config) SupportsPKCEWithContext(ctx context.Context) (bool, error) {
+	metadata, err := cfg.GetAuthServerMetadataWithContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, method := range metadata.CodeChallengeMethodsSupported {
+		if method == "S256" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetAuthTokenFromCode exchanges an auth code for an access token.
+// Set codeVerifier to the PKCE code verifier of the login attempt or nil if PKCE was not used.
+func (cfg *Config) GetAuthTokenFromCode(authCode *string, redirectURI *string, codeVerifier *string) (*OAuthToken, error) {
+	return cfg.GetAuthTokenFromCodeWithContext(context.Background(), authCode, redirectURI, codeVerifier)
+}
+
+// GetAuthTokenFromCodeWithContext is GetAuthTokenFromCode with a context
+func (cfg *Config) GetAuthTokenFromCodeWithContext(ctx context.Context, authCode *string, redirectURI *string, codeVerifier *string) (*OAuthToken, error) {
+	if cfg.instance == nil {
+		return nil, &NoInstanceError{}
+	}
+	if cfg.clientKey == nil {
+		return nil, &NoClientKeyError{}
+	}
+	if cfg.clientSecret == nil {
+		return nil, &NoClientSecretError{}
+	}
+
+	params := url.Values{
+		"client_id":     {*cfg.clientKey},
+		"client_secret": {*cfg.clientSecret},
+		"grant_type":    {"authorization_code"},
+		"code":          {*authCode},
+		"redirect_uri":  {*redirectURI},
+	}
+	if codeVerifier != nil {
+		params.Set("code_verifier", *codeVerifier)
+	}
+
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.OAuth)
+	defer cancel()
+	token := &OAuthToken{}
+	if err := cfg.postOAuthForm(ctx, "/oauth/token", params, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// postOAuthForm posts a form to an OAuth endpoint on the instance and decodes the JSON response into res.
+// Set res to nil to discard the response body.
+func (cfg *Config) postOAuthForm(ctx context.Context, endpoint string, params url.Values, res interface{}) error {
+	u, err := url.Parse(*cfg.instance)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &RequestFailedError{Msg: endpoint + " returned " + strconv.Itoa(resp.StatusCode), StatusCode: resp.StatusCode}
+	}
+
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// RevokeToken revokes the access token with the instance's /oauth/revoke endpoint
+func (cfg *Config) RevokeToken() error {
+	return cfg.RevokeTokenWithContext(context.Background())
+}
+
+// RevokeTokenWithContext is RevokeToken with a context
+func (cfg *Config) RevokeTokenWithContext(ctx context.Context) error {
+	if cfg.instance == nil {
+		return &NoInstanceError{}
+	}
+	if cfg.clientKey == nil {
+		return &NoClientKeyError{}
+	}
+	if cfg.clientSecret == nil {
+		return &NoClientSecretError{}
+	}
+	if cfg.accessToken == nil {
+		return &NoAccessTokenError{}
+	}
+
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.OAuth)
+	defer cancel()
+	return cfg.postOAuthForm(ctx, "/oauth/revoke", url.Values{
+		"client_id":     {*cfg.clientKey},
+		"client_secret": {*cfg.clientSecret},
+		"token":         {*cfg.accessToken},
+	}, nil)
+}
+
+// VerifyAppCredentials checks the app's client credentials are still registered with the instance.
+// A client credentials token is minted and used with /api/v1/apps/verify_credentials.
+// Returns *InvalidClientError if the instance no longer recognizes the app (eg it was deleted by an admin).
+func (cfg *Config) VerifyAppCredentials() (*AppVerification, error) {
+	return cfg.VerifyAppCredentialsWithContext(context.Background())
+}
+
+// VerifyAppCredentialsWithContext is VerifyAppCredentials with a context.
+// The OAuth timeout covers both requests.
+func (cfg *Config) VerifyAppCredentialsWithContext(ctx context.Context) (*AppVerification, error) {
+	if cfg.instance == nil {
+		return nil, &NoInstanceError{}
+	}
+	if cfg.clientKey == nil {
+		return nil, &NoClientKeyError{}
+	}
+	if cfg.clientSecret == nil {
+		return nil, &NoClientSecretError{}
+	}
+
+	ctx, cancel := WithTimeout(ctx, cfg.timeouts.OAuth)
+	defer cancel()
+	token := &OAuthToken{}
+	if err := cfg.postOAuthForm(ctx, "/oauth/token", url.Values{
+		"client_id":     {*cfg.clientKey},
+		"client_secret": {*cfg.clientSecret},
+		"grant_type":    {"client_credentials"},
+		"redirect_uri":  {"urn:ietf:wg:oauth:2.0:oob"},
+	}, token); err != nil {
+		var failed *RequestFailedError
+		if errors.As(err, &failed) && (failed.StatusCode == http.StatusBadRequest || failed.StatusCode == http.StatusUnauthorized) {
+			return nil, &InvalidClientError{Msg: "instance rejected the client credentials", Err: err}
+		}
+		return nil, err
+	}
+
+	u, err := url.Parse(*cfg.instance)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, "/api/v1/apps/verify_credentials")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, &InvalidClientError{Msg: "instance rejected the client token"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RequestFailedError{Msg: "/api/v1/apps/verify_credentials returned " + strconv.Itoa(resp.StatusCode), StatusCode: resp.StatusCode}
+	}
+
+	verification := &AppVerification{}
+	if err := json.NewDecoder(resp.Body).Decode(verification); err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
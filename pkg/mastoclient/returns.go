@@ -27,3 +27,67 @@ type AsyncStatuses struct {
 	Statuses []*mastodon.Status
 	Err      error
 }
+
+// AppVerification is the app returned by /api/v1/apps/verify_credentials.
+// Scopes and RedirectURIs are only returned by Mastodon 4.3+.
+type AppVerification struct {
+	Name         string   `json:"name"`
+	Website      string   `json:"website"`
+	Scopes       []string `json:"scopes"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// AuthServerMetadata is the subset of the OAuth authorization server metadata (RFC 8414) used by mastostart
+type AuthServerMetadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	RevocationEndpoint            string   `json:"revocation_endpoint"`
+	ScopesSupported               []string `json:"scopes_supported"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+}
+
+// NodeInfo is the subset of a NodeInfo 2.x document used by mastostart
+type NodeInfo struct {
+	Version  string `json:"version"`
+	Software struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"software"`
+	Protocols []string `json:"protocols"`
+}
+
+// NodeInfoWellKnown is the /.well-known/nodeinfo discovery document
+type NodeInfoWellKnown struct {
+	Links []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+// OAuthToken is the token returned by the instance's /oauth/token endpoint
+type OAuthToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+// HostMeta is the subset of a host-meta XRD document (RFC 6415) used by mastostart
+type HostMeta struct {
+	Links []struct {
+		Rel      string `xml:"rel,attr"`
+		Template string `xml:"template,attr"`
+	} `xml:"Link"`
+}
+
+// WebFinger is a WebFinger JRD document (RFC 7033)
+type WebFinger struct {
+	Subject string   `json:"subject"`
+	Aliases []string `json:"aliases"`
+	Links   []struct {
+		Rel  string `json:"rel"`
+		Type string `json:"type"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
@@ -0,0 +1,125 @@
+package mastoclient
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ParseHandle splits a fediverse handle (@user@domain, user@domain or acct:user@domain) into its user and domain parts
+func ParseHandle(handle string) (string, string, error) {
+	handle = strings.TrimPrefix(strings.TrimSpace(handle), "acct:")
+	handle = strings.TrimPrefix(handle, "@")
+	user, domain, ok := strings.Cut(handle, "@")
+	if !ok || user == "" || domain == "" || strings.ContainsAny(domain, "@/?#") {
+		return "", "", &InvalidHandleError{Msg: "invalid handle: " + handle}
+	}
+	return user, strings.ToLower(domain), nil
+}
+
+// ResolveHandle resolves a fediverse handle to the URL of the instance serving the account.
+// The handle's domain may differ from the instance's (split-domain setups), so the account
+// is looked up with WebFinger, using the host-meta LRDD template when the domain publishes one.
+// Discovery requests (and their redirects) stay on https URLs on the domain or its subdomains.
+func ResolveHandle(handle string) (*url.URL, error) {
+	ctx, cancel := WithTimeout(context.Background(), DefaultTimeouts.Discovery)
+	defer cancel()
+	return ResolveHandleWithContext(ctx, handle)
+}
+
+// ResolveHandleWithContext is ResolveHandle with a context. The caller sets the deadline.
+func ResolveHandleWithContext(ctx context.Context, handle string) (*url.URL, error) {
+	user, domain, err := ParseHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+	resource := "acct:" + user + "@" + domain
+
+	// Split-domain setups may only publish host-meta on the handle domain
+	webfingerURL := "https://" + domain + "/.well-known/webfinger?resource=" + url.QueryEscape(resource)
+	if template, err := getHostMetaLRDD(ctx, domain); err == nil && template != "" {
+		webfingerURL = strings.ReplaceAll(template, "{uri}", url.QueryEscape(resource))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, webfingerURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jrd+json, application/json")
+
+	resp, err := discoveryClient(func(u *url.URL) bool { return isOnDomain(u, domain) }).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &RequestFailedError{Msg: "unable to resolve " + resource + " with webfinger: " + resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	jrd := &WebFinger{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDiscoveryBody)).Decode(jrd); err != nil {
+		return nil, err
+	}
+
+	// The actor lives on the instance serving the account
+	for _, link := range jrd.Links {
+		if link.Rel != "self" || (link.Type != "application/activity+json" && !strings.HasPrefix(link.Type, "application/ld+json")) {
+			continue
+		}
+		actor, err := url.Parse(link.Href)
+		if err != nil || actor.Host == "" {
+			continue
+		}
+		return &url.URL{Scheme: "https", Host: actor.Host}, nil
+	}
+
+	// No actor link; fall back to wherever the webfinger request ended up
+	return &url.URL{Scheme: "https", Host: resp.Request.URL.Host}, nil
+}
+
+// getHostMetaLRDD fetches the domain's /.well-known/host-meta and returns its LRDD (webfinger) template.
+// Only https templates on the domain or one of its subdomains (eg social.example.com for example.com)
+// are used, so a domain can't send the WebFinger request to an arbitrary host.
+func getHostMetaLRDD(ctx context.Context, domain string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+domain+"/.well-known/host-meta", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/xrd+xml")
+
+	resp, err := discoveryClient(func(u *url.URL) bool { return isOnDomain(u, domain) }).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", &RequestFailedError{Msg: "unable to fetch host-meta: " + resp.Status, StatusCode: resp.StatusCode}
+	}
+
+	xrd := &HostMeta{}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxDiscoveryBody)).Decode(xrd); err != nil {
+		return "", err
+	}
+	for _, link := range xrd.Links {
+		if link.Rel != "lrdd" {
+			continue
+		}
+		template, err := url.Parse(strings.ReplaceAll(link.Template, "{uri}", ""))
+		if err == nil && isOnDomain(template, domain) {
+			return link.Template, nil
+		}
+	}
+	return "", nil
+}
+
+// isOnDomain reports whether u is an https URL on the domain or one of its subdomains
+func isOnDomain(u *url.URL, domain string) bool {
+	host := strings.ToLower(u.Host)
+	return u.Scheme == "https" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often expired counters are dropped
+const memorySweepInterval = time.Minute
+
+// Memory is a fixed window limiter that keeps its counters in memory.
+// Counters aren't shared between processes, so it's meant for tests and local runs.
+type Memory struct {
+	mu        sync.Mutex
+	counters  map[string]*memoryCounter
+	lastSweep time.Time
+}
+
+// memoryCounter is the count of requests in a window
+type memoryCounter struct {
+	count     int64
+	expiresAt time.Time
+}
+
+// NewMemory returns a new in-memory limiter
+func NewMemory() *Memory {
+	return &Memory{
+		counters:  make(map[string]*memoryCounter),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow counts a request against the limit for the key
+func (m *Memory) Allow(_ context.Context, key string, limit Limit) (*Result, error) {
+	now := time.Now()
+	counterKey, resetAt := windowKey(key, limit, now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Drop the counters of past windows now and then
+	if now.Sub(m.lastSweep) >= memorySweepInterval {
+		for k, counter := range m.counters {
+			if !now.Before(counter.expiresAt) {
+				delete(m.counters, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	counter, ok := m.counters[counterKey]
+	if !ok {
+		counter = &memoryCounter{expiresAt: resetAt}
+		m.counters[counterKey] = counter
+	}
+	counter.count++
+
+	return newResult(counter.count, limit, resetAt, now), nil
+}
+
+// Peek returns the result Allow would return for the key, without counting the request
+func (m *Memory) Peek(_ context.Context, key string, limit Limit) (*Result, error) {
+	now := time.Now()
+	counterKey, resetAt := windowKey(key, limit, now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int64
+	if counter, ok := m.counters[counterKey]; ok {
+		count = counter.count
+	}
+	return newResult(count+1, limit, resetAt, now), nil
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Limit is the number of requests allowed per time window
+type Limit struct {
+	// Requests is the number of requests allowed in a window
+	Requests int
+
+	// Window is the length of the window
+	Window time.Duration
+}
+
+// Result is the outcome of counting a request against a limit
+type Result struct {
+	// Allowed is true if the request is within the limit
+	Allowed bool
+
+	// Limit is the number of requests allowed in the window
+	Limit int
+
+	// Remaining is the number of requests left in the window
+	Remaining int
+
+	// ResetAt is when the window ends
+	ResetAt time.Time
+
+	// RetryAfter is how long to wait before trying again; zero if the request is allowed
+	RetryAfter time.Duration
+}
+
+// Limiter counts requests against limits.
+// Keys are opaque to the limiter; callers namespace them (eg "ip:192.0.2.1").
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (*Result, error)
+
+	// Peek returns the result Allow would return, without counting the request
+	Peek(ctx context.Context, key string, limit Limit) (*Result, error)
+}
+
+// windowKey returns the counter key for the window a time falls in, and the window's end
+func windowKey(key string, limit Limit, now time.Time) (string, time.Time) {
+	start := now.Truncate(limit.Window)
+	return key + ":" + strconv.FormatInt(start.Unix(), 10), start.Add(limit.Window)
+}
+
+// newResult builds the result for the count of requests in a window
+func newResult(count int64, limit Limit, resetAt time.Time, now time.Time) *Result {
+	res := &Result{
+		Allowed: count <= int64(limit.Requests),
+		Limit:   limit.Requests,
+		ResetAt: resetAt,
+	}
+	if remaining := int64(limit.Requests) - count; remaining > 0 {
+		res.Remaining = int(remaining)
+	}
+	if !res.Allowed {
+		res.RetryAfter = resetAt.Sub(now)
+	}
+	return res
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rmrfslashbin/mastostart/pkg/database"
+)
+
+func TestLimiters(t *testing.T) {
+	limiters := []struct {
+		name    string
+		limiter Limiter
+	}{
+		{"Memory", NewMemory()},
+		{"Store", NewStore(database.NewMemory())},
+	}
+	limit := Limit{Requests: 2, Window: time.Hour}
+
+	// Peek reports what Allow would, without counting
+	steps := []struct {
+		peek          bool
+		wantAllowed   bool
+		wantRemaining int
+	}{
+		{true, true, 1},
+		{false, true, 1},
+		{true, true, 0},
+		{false, true, 0},
+		{true, false, 0},
+		{false, false, 0},
+	}
+	for _, l := range limiters {
+		t.Run(l.name, func(t *testing.T) {
+			ctx := context.Background()
+			for i, step := range steps {
+				var res *Result
+				var err error
+				if step.peek {
+					res, err = l.limiter.Peek(ctx, "key", limit)
+				} else {
+					res, err = l.limiter.Allow(ctx, "key", limit)
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if res.Allowed != step.wantAllowed || res.Remaining != step.wantRemaining {
+					t.Errorf("step %d: allowed %v remaining %d, want %v %d", i, res.Allowed, res.Remaining, step.wantAllowed, step.wantRemaining)
+				}
+				if !res.Allowed && res.RetryAfter <= 0 {
+					t.Errorf("step %d: no RetryAfter when over the limit", i)
+				}
+			}
+
+			// Keys are counted apart
+			res, err := l.limiter.Allow(ctx, "other", limit)
+			if err != nil || !res.Allowed {
+				t.Errorf("other key: %+v, %v; want allowed", res, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Counter atomically increments a counter, creating it if needed, and returns the new count.
+// The counter may be dropped after expiresAt (unix time). GetRateLimitCounterWithContext returns
+// the count without incrementing it; zero if the counter doesn't exist.
+type Counter interface {
+	IncrementRateLimitCounterWithContext(ctx context.Context, counterKey string, expiresAt int64) (int64, error)
+	GetRateLimitCounterWithContext(ctx context.Context, counterKey string) (int64, error)
+}
+
+// Store is a fixed window limiter that keeps its counters in the database (see database.Store),
+// so every Lambda instance counts against the same limits.
+type Store struct {
+	counter Counter
+}
+
+// NewStore returns a new limiter backed by the counter store
+func NewStore(counter Counter) *Store {
+	return &Store{counter: counter}
+}
+
+// Allow counts a request against the limit for the key
+func (s *Store) Allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	now := time.Now()
+	counterKey, resetAt := windowKey(key, limit, now)
+
+	count, err := s.counter.IncrementRateLimitCounterWithContext(ctx, counterKey, resetAt.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	return newResult(count, limit, resetAt, now), nil
+}
+
+// Peek returns the result Allow would return for the key, without counting the request
+func (s *Store) Peek(ctx context.Context, key string, limit Limit) (*Result, error) {
+	now := time.Now()
+	counterKey, resetAt := windowKey(key, limit, now)
+
+	count, err := s.counter.GetRateLimitCounterWithContext(ctx, counterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return newResult(count+1, limit, resetAt, now), nil
+}